@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hlf2016/snippetbox/internal/models"
+	"github.com/hlf2016/snippetbox/internal/validator"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	adminUsersPerPage    = 20
+	adminSnippetsPerPage = 50
+	// 管理首页统计图表覆盖的天数
+	adminStatsDays = 14
+)
+
+var assignableRoles = []models.Role{models.RoleUser, models.RoleModerator, models.RoleAdmin}
+
+// adminStats 是管理首页顶部展示的统计数据
+type adminStats struct {
+	TotalUsers     int
+	ActiveUsers24h int
+	ActiveUsers7d  int
+	SnippetsPerDay []models.DailyCount
+}
+
+type adminUserRoleForm struct {
+	Email               string      `form:"email"`
+	Role                models.Role `form:"role"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) adminView(w http.ResponseWriter, r *http.Request) {
+	app.renderAdmin(w, r, http.StatusOK, adminUserRoleForm{Role: models.RoleUser})
+}
+
+// renderAdmin 渲染管理首页：统计数据、可搜索的用户列表以及修改角色的表单。
+func (app *application) renderAdmin(w http.ResponseWriter, r *http.Request, status int, form adminUserRoleForm) {
+	var stats adminStats
+	var err error
+	stats.TotalUsers, err = app.users.Count(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	now := time.Now()
+	stats.ActiveUsers24h, err = app.userSessions.ActiveUsers(r.Context(), now.Add(-24*time.Hour))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	stats.ActiveUsers7d, err = app.userSessions.ActiveUsers(r.Context(), now.AddDate(0, 0, -7))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	stats.SnippetsPerDay, err = app.snippets.CreatedPerDay(r.Context(), adminStatsDays)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	pagination := newPagination(r, adminUsersPerPage)
+	users, total, err := app.users.List(r.Context(), query, pagination.PerPage, pagination.Offset())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	pagination.Total = total
+
+	data := app.newTemplateData(r)
+	data.Form = form
+	data.Roles = assignableRoles
+	data.AdminStats = stats
+	data.Users = users
+	data.Query = query
+	data.Pagination = pagination
+	app.render(w, r, status, "admin.tmpl", data)
+}
+
+func (app *application) adminUserRolePost(w http.ResponseWriter, r *http.Request) {
+	var form adminUserRoleForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.CheckField(validator.NotBlank(form.Email), "email", "validation.blank")
+	form.CheckField(form.Role.Valid(), "role", "validation.role")
+
+	var user *models.User
+	if form.Valid() {
+		user, err = app.users.GetByEmail(r.Context(), form.Email)
+		if err != nil {
+			if errors.Is(err, models.ErrNoRecord) {
+				form.AddFieldError("email", "admin.error.no_user")
+			} else {
+				app.serverError(w, r, err)
+				return
+			}
+		}
+	}
+	// 防止管理员误操作把自己降级，导致系统里没有管理员
+	if form.Valid() && user.ID == app.currentUser(r).ID && form.Role != models.RoleAdmin {
+		form.AddFieldError("role", "admin.error.self_demote")
+	}
+
+	if !form.Valid() {
+		app.renderAdmin(w, r, http.StatusUnprocessableEntity, form)
+		return
+	}
+
+	err = app.users.SetRole(r.Context(), user.ID, form.Role)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.flash(r, "flash.admin_role_set", user.Email, app.T(r, "role."+string(form.Role)))
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// adminTargetUser 读取路由参数中的用户 ID 并确认用户存在。操作对象是管理员自己时返回 403，避免把自己锁在外面。
+// 出错时已经写好了响应，调用方直接返回即可。
+func (app *application) adminTargetUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return nil, false
+	}
+	user, err := app.users.Get(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return nil, false
+	}
+	if user.ID == app.currentUser(r).ID {
+		app.clientError(w, http.StatusForbidden)
+		return nil, false
+	}
+	return user, true
+}
+
+// adminUserDisablePost 禁用账号，并立即撤销该用户所有已登录的会话。
+func (app *application) adminUserDisablePost(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	err := app.users.SetDisabled(r.Context(), user.ID, true)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	err = app.revokeAllUserSessions(r.Context(), user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.flash(r, "flash.admin_user_disabled", user.Email)
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+func (app *application) adminUserEnablePost(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	err := app.users.SetDisabled(r.Context(), user.ID, false)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.flash(r, "flash.admin_user_enabled", user.Email)
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// adminUserForceResetPost 要求用户在下次访问时修改密码，见 requireAuthentication 中间件。
+func (app *application) adminUserForceResetPost(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	// 通过单点登录创建的账号没有密码可改，密码由提供方管理
+	if user.Passwordless {
+		app.flash(r, "flash.admin_force_reset_passwordless", user.Email)
+		http.Redirect(w, r, "/admin", http.StatusSeeOther)
+		return
+	}
+	err := app.users.RequirePasswordReset(r.Context(), user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.flash(r, "flash.admin_force_reset", user.Email)
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// adminSnippets 列出所有片段（包括已过期的），用于批量清理垃圾内容。
+func (app *application) adminSnippets(w http.ResponseWriter, r *http.Request) {
+	pagination := newPagination(r, adminSnippetsPerPage)
+	snippets, total, err := app.snippets.List(r.Context(), pagination.PerPage, pagination.Offset())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	pagination.Total = total
+
+	data := app.newTemplateData(r)
+	data.Snippets = snippets
+	data.Pagination = pagination
+	app.render(w, r, http.StatusOK, "admin_snippets.tmpl", data)
+}
+
+type adminSnippetDeleteForm struct {
+	IDs []int `form:"id"`
+}
+
+func (app *application) adminSnippetDeletePost(w http.ResponseWriter, r *http.Request) {
+	var form adminSnippetDeleteForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	if len(form.IDs) == 0 {
+		app.flash(r, "flash.admin_no_snippets_selected")
+		http.Redirect(w, r, "/admin/snippets", http.StatusSeeOther)
+		return
+	}
+
+	n, err := app.snippets.DeleteMany(r.Context(), form.IDs)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.logger.InfoContext(r.Context(), "admin deleted snippets", "admin", app.currentUser(r).Email, "count", n)
+	app.flashPlural(r, "flash.admin_snippets_deleted", n)
+	http.Redirect(w, r, "/admin/snippets", http.StatusSeeOther)
+}
+
+// promoteAdmin 供命令行 -promote-admin 参数使用，把已注册的用户提升为管理员，用来创建第一个管理员账号。
+func promoteAdmin(ctx context.Context, users models.UserModelInterface, email string) error {
+	user, err := users.GetByEmail(ctx, email)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			return fmt.Errorf("no user with email %q, sign up first", email)
+		}
+		return err
+	}
+	return users.SetRole(ctx, user.ID, models.RoleAdmin)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hlf2016/snippetbox/internal/auth"
+	"github.com/hlf2016/snippetbox/internal/models"
+	"strings"
+)
+
+// newAuthenticator 按 -auth-backends 中列出的顺序组合登录验证方式。
+// 例如 "ldap,db" 先尝试目录，目录中没有这个用户或密码不对时再检查数据库中的密码，本站单独创建的管理员仍然可以登录。
+func newAuthenticator(cfg config, users models.UserModelInterface, identities models.IdentityModelInterface) (auth.Authenticator, error) {
+	var chain auth.Chain
+	for _, name := range strings.Split(cfg.authBackends, ",") {
+		switch strings.TrimSpace(name) {
+		case "db":
+			chain = append(chain, &auth.Database{Users: users})
+		case "ldap":
+			if cfg.ldap.url == "" || cfg.ldap.baseDN == "" {
+				return nil, fmt.Errorf("the ldap backend requires -ldap-url and -ldap-base-dn")
+			}
+			groupRoles, err := auth.ParseGroupRoles(cfg.ldap.groupRoles)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, &auth.LDAP{
+				Config: auth.LDAPConfig{
+					URL:           cfg.ldap.url,
+					StartTLS:      cfg.ldap.startTLS,
+					BindDN:        cfg.ldap.bindDN,
+					BindPassword:  cfg.ldap.bindPassword,
+					BaseDN:        cfg.ldap.baseDN,
+					UserFilter:    cfg.ldap.userFilter,
+					GroupRoles:    groupRoles,
+					RequiredGroup: cfg.ldap.requiredGroup,
+				},
+				Provisioner: &auth.Provisioner{Users: users, Identities: identities},
+			})
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown auth backend %q", name)
+		}
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no auth backends configured")
+	}
+	// 只有一种方式时不需要 Chain 包装
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+	return chain, nil
+}
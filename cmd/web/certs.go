@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certReloader 持有 HTTPS 当前使用的证书，通过 tls.Config.GetCertificate 提供给每一次握手。
+// 证书文件被替换后（定期检查文件的修改时间和大小，或者收到 SIGHUP）重新载入，新的连接随即使用新证书，不需要重启。
+// 新文件载入失败时（例如证书和私钥只更新了一个，或者文件还没写完）继续使用原来的证书。
+type certReloader struct {
+	certFile string
+	keyFile  string
+	// 证书剩余有效期少于这个时间时记录警告
+	warnBefore time.Duration
+	logger     *slog.Logger
+	// 当前时间，测试中可以替换
+	now func() time.Time
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	// 证书的有效期截止时间
+	notAfter time.Time
+	// 上次成功载入时两个文件的修改时间和大小，用于判断文件是否变化
+	stamp string
+	// 上次载入失败时文件的状态，文件没有再变化就不重复记录同样的错误
+	failedStamp string
+	// 上次记录即将过期警告的时间，运行期间每天最多提醒一次
+	lastWarned time.Time
+}
+
+// newCertReloader 载入证书和私钥。启动时载入失败直接返回错误，没有可用的证书时服务器无法提供 HTTPS。
+func newCertReloader(certFile, keyFile string, warnBefore time.Duration, logger *slog.Logger) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile, warnBefore: warnBefore, logger: logger, now: time.Now}
+	err := cr.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// GetCertificate 返回当前的证书，用作 tls.Config.GetCertificate。
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// Reload 重新载入证书和私钥，成功后替换当前的证书，并检查新证书的有效期。
+func (cr *certReloader) Reload() error {
+	stamp, err := cr.fileStamp()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.notAfter = leaf.NotAfter
+	cr.stamp = stamp
+	cr.failedStamp = ""
+	cr.lastWarned = time.Time{}
+	cr.mu.Unlock()
+
+	cr.logger.Info("loaded TLS certificate",
+		"file", cr.certFile,
+		"subject", leaf.Subject.String(),
+		"dns_names", strings.Join(leaf.DNSNames, ","),
+		"not_after", leaf.NotAfter.UTC().Format(time.RFC3339),
+	)
+	cr.checkExpiry()
+	return nil
+}
+
+// reloadIfChanged 在证书或私钥文件变化时重新载入。
+func (cr *certReloader) reloadIfChanged() {
+	stamp, err := cr.fileStamp()
+	if err != nil {
+		// 文件暂时不存在等错误也当作一种状态，同样的错误只记录一次
+		stamp = "error: " + err.Error()
+	}
+	cr.mu.RLock()
+	unchanged := stamp == cr.stamp || stamp == cr.failedStamp
+	cr.mu.RUnlock()
+	if unchanged {
+		return
+	}
+	if err == nil {
+		err = cr.Reload()
+	}
+	if err != nil {
+		cr.mu.Lock()
+		cr.failedStamp = stamp
+		cr.mu.Unlock()
+		cr.logger.Error("reloading TLS certificate, keeping the current one", "error", err)
+	}
+}
+
+// checkExpiry 在证书即将过期或已经过期时记录警告，每天最多一次。
+func (cr *certReloader) checkExpiry() {
+	cr.mu.Lock()
+	now := cr.now()
+	notAfter := cr.notAfter
+	remaining := notAfter.Sub(now)
+	if remaining > cr.warnBefore || now.Sub(cr.lastWarned) < 24*time.Hour {
+		cr.mu.Unlock()
+		return
+	}
+	cr.lastWarned = now
+	cr.mu.Unlock()
+
+	if remaining <= 0 {
+		cr.logger.Error("TLS certificate has expired", "file", cr.certFile, "not_after", notAfter.UTC().Format(time.RFC3339))
+		return
+	}
+	cr.logger.Warn("TLS certificate expires soon",
+		"file", cr.certFile,
+		"not_after", notAfter.UTC().Format(time.RFC3339),
+		"remaining", remaining.Round(time.Minute).String(),
+	)
+}
+
+// fileStamp 用两个文件的修改时间和大小概括它们的状态
+func (cr *certReloader) fileStamp() (string, error) {
+	var stamp strings.Builder
+	for _, path := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&stamp, "%d:%d;", info.ModTime().UnixNano(), info.Size())
+	}
+	return stamp.String(), nil
+}
+
+// watch 每隔 interval 检查一次证书文件是否变化，收到 SIGHUP 时立即重新载入。interval 为 0 时只响应 SIGHUP。
+// SIGHUP 同时也会让日志文件重新打开，见 reopenLogOnHangup。
+func (cr *certReloader) watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-hup:
+			err := cr.Reload()
+			if err != nil {
+				cr.logger.Error("reloading TLS certificate, keeping the current one", "error", err)
+			}
+		case <-tick:
+			cr.reloadIfChanged()
+			cr.checkExpiry()
+		}
+	}
+}
+
+// parseTLSVersion 解析 -tls-min-version。TLS 1.0 和 1.1 已经不安全，不允许使用。
+func parseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("must be 1.2 or 1.3, got %q", s)
+	}
+}
+
+// parseCipherSuites 解析 -tls-ciphers 中以逗号分隔的密码套件名称，例如 TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256。
+// 为空时返回 nil，使用 Go 的默认列表。只接受 tls.CipherSuites() 中的安全套件。
+// 密码套件只影响 TLS 1.2 连接，TLS 1.3 的套件不可配置。
+func parseCipherSuites(s string) ([]uint16, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, c := range tls.CipherSuites() {
+		known[c.Name] = c.ID
+	}
+	insecure := make(map[string]bool)
+	for _, c := range tls.InsecureCipherSuites() {
+		insecure[c.Name] = true
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := known[name]
+		switch {
+		case ok:
+			ids = append(ids, id)
+		case insecure[name]:
+			return nil, fmt.Errorf("cipher suite %s is insecure", name)
+		default:
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+	}
+	return ids, nil
+}
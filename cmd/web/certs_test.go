@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/hlf2016/snippetbox/internal/assert"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCert 生成一张有效期到 notAfter 的自签名证书和对应的私钥，写入 certFile 和 keyFile。
+// 文件的修改时间设为 mtime，保证每次写入后文件的状态都不同。
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64, notAfter, mtime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    notAfter.Add(-30 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if path == "" {
+			continue
+		}
+		err = os.WriteFile(path, pem.EncodeToMemory(block), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(path, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func serialOf(t *testing.T, cr *certReloader) int64 {
+	cert, err := cr.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.SerialNumber.Int64()
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	mtime := time.Now().Add(-time.Hour)
+	notAfter := time.Now().Add(30 * 24 * time.Hour)
+	writeTestCert(t, certFile, keyFile, 1, notAfter, mtime)
+
+	var logs bytes.Buffer
+	cr, err := newCertReloader(certFile, keyFile, 7*24*time.Hour, slog.New(slog.NewTextHandler(&logs, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, serialOf(t, cr), int64(1))
+
+	// 文件没有变化时不重新载入
+	logs.Reset()
+	cr.reloadIfChanged()
+	assert.Equal(t, logs.Len(), 0)
+
+	// CA 签发了新证书
+	writeTestCert(t, certFile, keyFile, 2, notAfter, mtime.Add(time.Minute))
+	cr.reloadIfChanged()
+	assert.Equal(t, serialOf(t, cr), int64(2))
+
+	// 只替换了证书、还没替换私钥时载入失败，继续使用原来的证书，同样的错误只记录一次
+	writeTestCert(t, certFile, "", 3, notAfter, mtime.Add(2*time.Minute))
+	logs.Reset()
+	cr.reloadIfChanged()
+	cr.reloadIfChanged()
+	assert.Equal(t, serialOf(t, cr), int64(2))
+	assert.Equal(t, strings.Count(logs.String(), "keeping the current one"), 1)
+
+	// 私钥随后也被替换
+	writeTestCert(t, certFile, keyFile, 4, notAfter, mtime.Add(3*time.Minute))
+	cr.reloadIfChanged()
+	assert.Equal(t, serialOf(t, cr), int64(4))
+}
+
+func TestCertReloaderMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	_, err := newCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), 0, slog.Default())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestCertExpiryWarning(t *testing.T) {
+	tests := []struct {
+		name     string
+		validFor time.Duration
+		want     string
+	}{
+		{
+			name:     "Plenty of time left",
+			validFor: 30 * 24 * time.Hour,
+		},
+		{
+			name:     "Expires soon",
+			validFor: 2 * 24 * time.Hour,
+			want:     "TLS certificate expires soon",
+		},
+		{
+			name:     "Expired",
+			validFor: -time.Hour,
+			want:     "TLS certificate has expired",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			certFile := filepath.Join(dir, "cert.pem")
+			keyFile := filepath.Join(dir, "key.pem")
+			writeTestCert(t, certFile, keyFile, 1, time.Now().Add(tt.validFor), time.Now())
+
+			var logs bytes.Buffer
+			cr, err := newCertReloader(certFile, keyFile, 7*24*time.Hour, slog.New(slog.NewTextHandler(&logs, nil)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				assert.Equal(t, strings.Contains(logs.String(), "level=WARN"), false)
+				return
+			}
+			assert.StringContains(t, logs.String(), tt.want)
+
+			// 运行期间每天最多提醒一次
+			logs.Reset()
+			cr.checkExpiry()
+			assert.Equal(t, logs.Len(), 0)
+			now := time.Now().Add(25 * time.Hour)
+			cr.now = func() time.Time { return now }
+			cr.checkExpiry()
+			assert.StringContains(t, logs.String(), "TLS certificate")
+		})
+	}
+}
+
+func TestParseTLSPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		ciphers string
+		wantErr string
+	}{
+		{
+			name:    "Defaults",
+			version: "1.2",
+		},
+		{
+			name:    "TLS 1.3 only",
+			version: "1.3",
+		},
+		{
+			name:    "Explicit ciphers",
+			version: "1.2",
+			ciphers: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+		},
+		{
+			name:    "TLS 1.1",
+			version: "1.1",
+			wantErr: `must be 1.2 or 1.3, got "1.1"`,
+		},
+		{
+			name:    "Insecure cipher",
+			version: "1.2",
+			ciphers: "TLS_RSA_WITH_RC4_128_SHA",
+			wantErr: "cipher suite TLS_RSA_WITH_RC4_128_SHA is insecure",
+		},
+		{
+			name:    "Unknown cipher",
+			version: "1.2",
+			ciphers: "TLS_MADE_UP",
+			wantErr: `unknown cipher suite "TLS_MADE_UP"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTLSVersion(tt.version)
+			if err == nil {
+				_, err = parseCipherSuites(tt.ciphers)
+			}
+			if tt.wantErr == "" {
+				assert.NilError(t, err)
+				return
+			}
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			assert.Equal(t, err.Error(), tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/hlf2016/snippetbox/internal/password"
+	"github.com/hlf2016/snippetbox/internal/validator"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// envPrefix 是环境变量的前缀：标志 -log-format 对应环境变量 SNIPPETBOX_LOG_FORMAT
+const envPrefix = "SNIPPETBOX_"
+
+// secretFlags 中的配置项在 -print-config 中打印为 REDACTED。dsn 只隐去其中的密码。
+var secretFlags = map[string]bool{
+	"dsn":                true,
+	"oidc-client-secret": true,
+	"ldap-bind-password": true,
+	"smtp-password":      true,
+	"metrics-token":      true,
+}
+
+// errInvalidFlags 表示命令行标志有误。FlagSet 已经把错误和用法打印到标准错误，调用方不需要再打印。
+var errInvalidFlags = errors.New("invalid command line flags")
+
+// metaFlags 控制配置本身如何载入，不能写在配置文件中，也不会被 -print-config 打印
+var metaFlags = map[string]bool{
+	"config":       true,
+	"print-config": true,
+}
+
+// config 聚合程序的所有配置。各字段的值依次来自标志的默认值、配置文件、环境变量和命令行标志，后者覆盖前者，见 loadConfig。
+type config struct {
+	addr      string
+	staticDir string
+	// 站点对外的地址，例如 https://snippetbox.example.com。邮件中的链接和单点登录的默认回调地址都基于它，
+	// 而不是请求的 Host 标头：后者由客户端控制，在代理后面还会是内部地址
+	baseURL string
+	// 没有默认值，必须通过配置文件、环境变量 SNIPPETBOX_DSN 或 -dsn 提供
+	dsn string
+	// http.Server 的读、写和空闲超时
+	server struct {
+		readTimeout  time.Duration
+		writeTimeout time.Duration
+		idleTimeout  time.Duration
+	}
+	// 会话的有效期
+	session struct {
+		lifetime time.Duration
+	}
+	// 不为空时另外在这个地址上监听纯 HTTP，只提供健康检查，其余请求重定向到 HTTPS
+	httpAddr string
+	// 为 true 时 -addr 上提供纯 HTTP，由前面的代理终结 TLS，并相信代理设置的 X-Forwarded-Proto
+	behindProxy bool
+	// Strict-Transport-Security 的 max-age，为 0 时不发送；includeSubdomains 为 true 时同时作用于所有子域名
+	hsts struct {
+		maxAge            time.Duration
+		includeSubdomains bool
+	}
+	// HTTPS 使用的证书和私钥文件，以及 TLS 的版本和密码套件策略
+	tls struct {
+		certFile string
+		keyFile  string
+		// 最低 TLS 版本，1.2 或 1.3
+		minVersion string
+		// 以逗号分隔的 TLS 1.2 密码套件，为空时使用 Go 的默认列表
+		cipherSuites string
+		// 每隔多久检查一次证书文件是否被替换，0 表示只在收到 SIGHUP 时重新载入
+		reloadInterval time.Duration
+		// 证书剩余有效期少于这个时间时记录警告
+		expiryWarning time.Duration
+	}
+	// 每次模型方法调用中数据库查询的最长耗时，超时的请求返回 503
+	queryTimeout time.Duration
+	// 外部 OpenID Connect 提供方，issuer 为空时不启用单点登录
+	oidc struct {
+		issuer       string
+		clientID     string
+		clientSecret string
+		// 在提供方登记的回调地址，为空时使用 <base-url>/auth/oidc/callback
+		redirectURL string
+	}
+	// 以逗号分隔的登录验证方式，按顺序尝试：db 为数据库中的密码，ldap 为 LDAP/Active Directory 目录
+	authBackends string
+	ldap         struct {
+		url          string
+		startTLS     bool
+		bindDN       string
+		bindPassword string
+		baseDN       string
+		userFilter   string
+		groupRoles   string
+		// 不为空时只有这个组的成员可以通过目录登录
+		requiredGroup string
+	}
+	// 新密码使用的哈希算法和参数。修改后已有的哈希仍然有效，用户下次登录时自动按新配置重新计算
+	password struct {
+		algorithm     string
+		argon2Memory  uint
+		argon2Time    uint
+		argon2Threads uint
+		bcryptCost    int
+		// 新密码的最少字符数
+		minLength int
+		// 泄露密码的 SHA-1 哈希文件，为空时不检查
+		breachFile string
+	}
+	// "记住我"令牌的有效期，以及超过多久没有使用就失效
+	remember struct {
+		lifetime    time.Duration
+		idleTimeout time.Duration
+	}
+	// 优雅关闭：收到信号后先等待 delay 让负载均衡器摘除实例，再最多等待 timeout 让正在处理的请求完成
+	shutdown struct {
+		delay   time.Duration
+		timeout time.Duration
+	}
+	// /metrics 的管理端口和访问令牌。addr 为空时 /metrics 放在主端口上，这时必须配置令牌，否则不导出
+	metrics struct {
+		addr  string
+		token string
+	}
+	// 链路追踪：exporter 为 none、stdout、file 或 otlp，file 为 file 导出器写入的文件，
+	// otlpEndpoint 为 OTLP/HTTP 收集器的地址，sampleRatio 为没有上游决定时的采样比例
+	tracing struct {
+		exporter     string
+		file         string
+		otlpEndpoint string
+		otlpInsecure bool
+		sampleRatio  float64
+	}
+	// /readyz 中每项检查的超时，以及检查结果缓存多久
+	health struct {
+		timeout  time.Duration
+		cacheTTL time.Duration
+	}
+	// 日志格式（json 或 text）和最低级别，以及日志文件的轮转和保留规则
+	log struct {
+		format string
+		level  string
+		// 日志文件的路径，为空时只写标准输出
+		file string
+		// 单个文件的最大 MB 数，0 表示不按大小轮转
+		maxSize int
+		// 每天轮转一次
+		daily bool
+		// 备份最长保留多久、最多保留几个，0 表示不限
+		maxAge     time.Duration
+		maxBackups int
+		compress   bool
+	}
+	debug bool
+	// 非空时只把该邮箱对应的用户提升为管理员然后退出，不启动服务器
+	promoteAdmin string
+	// 发送邮件使用的 SMTP 服务器。host 为空时不发送邮件，只把邮件内容写入日志
+	smtp struct {
+		host     string
+		port     int
+		username string
+		password string
+		sender   string
+	}
+
+	// 以下两项只能通过命令行或环境变量设置：配置文件的路径，以及只打印最终配置然后退出
+	configFile  string
+	printConfig bool
+}
+
+// flagSet 把 cfg 的每个字段注册为一个标志，标志的默认值就是配置的默认值。
+// 标志名同时也是配置文件中的键名和环境变量名（加上 SNIPPETBOX_ 前缀、转为大写、- 换成 _）。
+func (cfg *config) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&cfg.addr, "addr", ":4000", "HTTP network address")
+	fs.StringVar(&cfg.staticDir, "static-dir", "./ui/static", "Path to static assets")
+	fs.StringVar(&cfg.baseURL, "base-url", "https://localhost:4000", "Public URL of the site, used for links in emails, e.g. https://snippetbox.example.com")
+
+	// DSN 中的 parseTime=true 部分是一个特定于驱动程序的参数，它指示我们的驱动程序将 SQL TIME 和 DATE 字段转换为 Go time.Time 对象。
+	fs.StringVar(&cfg.dsn, "dsn", "", "MySQL data source name, e.g. user:pass@/snippetbox?parseTime=true (required)")
+	fs.DurationVar(&cfg.server.readTimeout, "read-timeout", 5*time.Second, "Maximum time to read a request, including the body")
+	fs.DurationVar(&cfg.server.writeTimeout, "write-timeout", 10*time.Second, "Maximum time to write a response")
+	fs.DurationVar(&cfg.server.idleTimeout, "idle-timeout", time.Minute, "How long keep-alive connections may stay idle")
+	fs.DurationVar(&cfg.session.lifetime, "session-lifetime", 12*time.Hour, "Absolute lifetime of a session")
+	fs.StringVar(&cfg.httpAddr, "http-addr", "", "Also listen for plain HTTP on this address, e.g. :80, and redirect to HTTPS")
+	fs.BoolVar(&cfg.behindProxy, "behind-proxy", false, "Serve plain HTTP on -addr behind a TLS-terminating proxy and trust X-Forwarded-Proto")
+	fs.DurationVar(&cfg.hsts.maxAge, "hsts-max-age", 0, "Send Strict-Transport-Security with this max-age on HTTPS responses (0 disables)")
+	fs.BoolVar(&cfg.hsts.includeSubdomains, "hsts-include-subdomains", false, "Add includeSubDomains to the Strict-Transport-Security header")
+	fs.StringVar(&cfg.tls.certFile, "tls-cert", "./tls/cert.pem", "TLS certificate file (PEM)")
+	fs.StringVar(&cfg.tls.keyFile, "tls-key", "./tls/key.pem", "TLS private key file (PEM)")
+	fs.StringVar(&cfg.tls.minVersion, "tls-min-version", "1.2", "Minimum TLS version (1.2 or 1.3)")
+	fs.StringVar(&cfg.tls.cipherSuites, "tls-ciphers", "", "Comma-separated TLS 1.2 cipher suites (Go's secure defaults when empty)")
+	fs.DurationVar(&cfg.tls.reloadInterval, "tls-reload-interval", time.Minute, "How often to check the certificate files for changes (0 reloads only on SIGHUP)")
+	fs.DurationVar(&cfg.tls.expiryWarning, "tls-expiry-warning", 7*24*time.Hour, "Warn when the certificate expires within this long")
+	fs.DurationVar(&cfg.queryTimeout, "query-timeout", 3*time.Second, "Maximum time a model call may spend on database queries (0 disables)")
+	fs.StringVar(&cfg.oidc.issuer, "oidc-issuer", "", "OpenID Connect issuer URL (single sign-on is disabled when empty)")
+	fs.StringVar(&cfg.oidc.clientID, "oidc-client-id", "", "OpenID Connect client ID")
+	fs.StringVar(&cfg.oidc.clientSecret, "oidc-client-secret", "", "OpenID Connect client secret")
+	fs.StringVar(&cfg.oidc.redirectURL, "oidc-redirect-url", "", "OpenID Connect redirect URL (default <base-url>/auth/oidc/callback)")
+	fs.StringVar(&cfg.authBackends, "auth-backends", "db", "Comma-separated login backends tried in order (db, ldap)")
+	fs.StringVar(&cfg.ldap.url, "ldap-url", "", "LDAP server URL, e.g. ldaps://ldap.example.com")
+	fs.BoolVar(&cfg.ldap.startTLS, "ldap-starttls", false, "Upgrade ldap:// connections with StartTLS")
+	fs.StringVar(&cfg.ldap.bindDN, "ldap-bind-dn", "", "DN of the service account used to search for users")
+	fs.StringVar(&cfg.ldap.bindPassword, "ldap-bind-password", "", "Password of the LDAP service account")
+	fs.StringVar(&cfg.ldap.baseDN, "ldap-base-dn", "", "Base DN to search for users")
+	fs.StringVar(&cfg.ldap.userFilter, "ldap-user-filter", "", "LDAP filter to find a user, %[1]s is the escaped login (default matches mail or userPrincipalName)")
+	fs.StringVar(&cfg.ldap.groupRoles, "ldap-group-roles", "", "Map directory groups to roles: role:groupDN;role:groupDN")
+	fs.StringVar(&cfg.ldap.requiredGroup, "ldap-required-group", "", "Only members of this group DN may log in via LDAP")
+	fs.StringVar(&cfg.password.algorithm, "password-hash", password.Argon2id, "Password hashing algorithm for new hashes (argon2id or bcrypt)")
+	fs.UintVar(&cfg.password.argon2Memory, "argon2-memory", uint(password.DefaultArgon2Params.Memory), "argon2id memory in KiB")
+	fs.UintVar(&cfg.password.argon2Time, "argon2-time", uint(password.DefaultArgon2Params.Iterations), "argon2id iterations")
+	fs.UintVar(&cfg.password.argon2Threads, "argon2-threads", uint(password.DefaultArgon2Params.Threads), "argon2id parallelism")
+	fs.IntVar(&cfg.password.bcryptCost, "bcrypt-cost", password.DefaultBcryptCost, "bcrypt cost")
+	fs.IntVar(&cfg.password.minLength, "password-min-length", validator.DefaultPasswordPolicy.MinLength, "Minimum length of new passwords")
+	fs.StringVar(&cfg.password.breachFile, "password-breach-file", "", "File of SHA-1 hashes of breached passwords to reject (disabled when empty)")
+	fs.DurationVar(&cfg.remember.lifetime, "remember-lifetime", 30*24*time.Hour, "Lifetime of remember-me tokens")
+	fs.DurationVar(&cfg.remember.idleTimeout, "remember-idle-timeout", 7*24*time.Hour, "Remember-me tokens expire after this long without use")
+	fs.DurationVar(&cfg.shutdown.delay, "shutdown-delay", 5*time.Second, "How long /ping reports not ready before the server stops accepting connections")
+	fs.DurationVar(&cfg.shutdown.timeout, "shutdown-timeout", 30*time.Second, "Maximum time to wait for in-flight requests and background tasks on shutdown")
+	fs.DurationVar(&cfg.health.timeout, "health-timeout", 2*time.Second, "Timeout for each /readyz dependency check")
+	fs.DurationVar(&cfg.health.cacheTTL, "health-cache-ttl", 5*time.Second, "How long /readyz reuses the previous check results")
+	fs.StringVar(&cfg.metrics.addr, "metrics-addr", "", "Serve /metrics on this separate admin address, e.g. localhost:9090")
+	fs.StringVar(&cfg.metrics.token, "metrics-token", "", "Bearer token required for /metrics (needed to serve it on the main address)")
+	fs.StringVar(&cfg.tracing.exporter, "trace-exporter", "none", "Trace exporter (none, stdout, file or otlp)")
+	fs.StringVar(&cfg.tracing.file, "trace-file", "./log/traces.json", "File written by the file trace exporter")
+	fs.StringVar(&cfg.tracing.otlpEndpoint, "otlp-endpoint", "", "OTLP/HTTP collector host:port (defaults to OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4318)")
+	fs.BoolVar(&cfg.tracing.otlpInsecure, "otlp-insecure", false, "Send traces to the OTLP collector over plain HTTP")
+	fs.Float64Var(&cfg.tracing.sampleRatio, "trace-sample-ratio", 1, "Fraction of new traces to sample (0 to 1)")
+	fs.StringVar(&cfg.log.format, "log-format", "text", "Log output format (text or json)")
+	fs.StringVar(&cfg.log.level, "log-level", "info", "Minimum log level (debug, info, warn or error)")
+	fs.StringVar(&cfg.log.file, "log-file", "./log/info.log", "Also write logs to this file (disabled when empty)")
+	fs.IntVar(&cfg.log.maxSize, "log-max-size", 100, "Rotate the log file when it exceeds this many megabytes (0 disables)")
+	fs.BoolVar(&cfg.log.daily, "log-rotate-daily", false, "Rotate the log file once a day")
+	fs.DurationVar(&cfg.log.maxAge, "log-max-age", 0, "Delete rotated log files older than this (0 keeps them)")
+	fs.IntVar(&cfg.log.maxBackups, "log-max-backups", 10, "Maximum number of rotated log files to keep (0 keeps all)")
+	fs.BoolVar(&cfg.log.compress, "log-compress", true, "Compress rotated log files with gzip")
+	// 是否启用 debug 模式 直接在页面上输出错误信息
+	fs.BoolVar(&cfg.debug, "debug", false, "whether in debug mode ")
+	fs.StringVar(&cfg.promoteAdmin, "promote-admin", "", "Promote the user with this email to admin and exit")
+	fs.StringVar(&cfg.smtp.host, "smtp-host", "", "SMTP host (mail is only logged when empty)")
+	fs.IntVar(&cfg.smtp.port, "smtp-port", 587, "SMTP port")
+	fs.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
+	fs.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
+	fs.StringVar(&cfg.smtp.sender, "smtp-sender", "Snippetbox <no-reply@snippetbox.local>", "SMTP sender")
+	fs.StringVar(&cfg.configFile, "config", "", "YAML config file (also SNIPPETBOX_CONFIG)")
+	fs.BoolVar(&cfg.printConfig, "print-config", false, "Print the effective config with secrets redacted and exit")
+	return fs
+}
+
+// loadConfig 按以下顺序载入配置，后面的覆盖前面的：
+//  1. 标志的默认值
+//  2. -config 或 SNIPPETBOX_CONFIG 指定的 YAML 文件
+//  3. SNIPPETBOX_ 开头的环境变量
+//  4. 命令行标志
+//
+// 返回的 FlagSet 用于 -print-config。loadConfig 只检查每一项能否解析，取值是否合理由 validate 检查。
+func loadConfig(name string, args []string, lookupEnv func(string) (string, bool)) (config, *flag.FlagSet, error) {
+	var cfg config
+	fs := cfg.flagSet(name)
+	// 先解析命令行，得到配置文件的路径，并记下哪些项已经在命令行上设置过，文件和环境变量不能覆盖它们
+	err := fs.Parse(args)
+	if err != nil {
+		return cfg, nil, fmt.Errorf("%w: %w", errInvalidFlags, err)
+	}
+	if fs.NArg() > 0 {
+		return cfg, nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	onCommandLine := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		onCommandLine[f.Name] = true
+	})
+
+	path := cfg.configFile
+	if path == "" {
+		path, _ = lookupEnv(envName("config"))
+		cfg.configFile = path
+	}
+	if path != "" {
+		values, err := readConfigFile(path)
+		if err != nil {
+			return cfg, nil, err
+		}
+		// 按键名排序，出错时报告的总是同一个键
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if fs.Lookup(key) == nil || metaFlags[key] {
+				return cfg, nil, fmt.Errorf("%s: unknown setting %q", path, key)
+			}
+			if onCommandLine[key] {
+				continue
+			}
+			err := fs.Set(key, values[key])
+			if err != nil {
+				return cfg, nil, fmt.Errorf("%s: %s: %w", path, key, err)
+			}
+		}
+	}
+
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if envErr != nil || onCommandLine[f.Name] || f.Name == "config" {
+			return
+		}
+		value, ok := lookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		err := fs.Set(f.Name, value)
+		if err != nil {
+			envErr = fmt.Errorf("%s: %w", envName(f.Name), err)
+		}
+	})
+	if envErr != nil {
+		return cfg, nil, envErr
+	}
+	return cfg, fs, nil
+}
+
+// envName 返回标志对应的环境变量名，例如 log-format 对应 SNIPPETBOX_LOG_FORMAT。
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// readConfigFile 读取 YAML 配置文件，返回标志名到值的映射。键名就是标志名，也可以按前缀分组嵌套，
+// 嵌套的键用 - 连接，下面两种写法等价：
+//
+//	log-format: json
+//
+//	log:
+//	  format: json
+func readConfigFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	err = yaml.Unmarshal(b, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	values := make(map[string]string)
+	err = flattenConfig("", doc, values)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+func flattenConfig(prefix string, doc map[string]any, values map[string]string) error {
+	for key, value := range doc {
+		if prefix != "" {
+			key = prefix + "-" + key
+		}
+		switch v := value.(type) {
+		case map[string]any:
+			err := flattenConfig(key, v, values)
+			if err != nil {
+				return err
+			}
+		case []any:
+			return fmt.Errorf("%s: lists are not supported", key)
+		case nil:
+			values[key] = ""
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+// writeConfig 以 YAML 格式打印 fs 中所有配置项的最终取值，输出可以直接作为配置文件使用。密码、令牌等敏感信息打印为 REDACTED。
+func writeConfig(w io.Writer, fs *flag.FlagSet) error {
+	values := make(map[string]any)
+	fs.VisitAll(func(f *flag.Flag) {
+		if metaFlags[f.Name] {
+			return
+		}
+		value := f.Value.(flag.Getter).Get()
+		switch v := value.(type) {
+		case time.Duration:
+			value = v.String()
+		case string:
+			if secretFlags[f.Name] && v != "" {
+				value = redact(f.Name, v)
+			}
+		}
+		values[f.Name] = value
+	})
+	enc := yaml.NewEncoder(w)
+	err := enc.Encode(values)
+	if err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// redact 隐去敏感配置的值。DSN 只隐去密码，用户名、地址和参数在排查问题时仍然有用。
+func redact(name, value string) string {
+	const redacted = "REDACTED"
+	if name != "dsn" {
+		return redacted
+	}
+	dsn, err := mysql.ParseDSN(value)
+	if err != nil {
+		return redacted
+	}
+	if dsn.Passwd != "" {
+		dsn.Passwd = redacted
+	}
+	return dsn.FormatDSN()
+}
+
+// validate 检查配置的取值是否合理，一次报告所有问题，每个问题都指出对应的配置项。
+func (cfg config) validate() error {
+	var errs []error
+	check := func(ok bool, name, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", name, fmt.Sprintf(format, args...)))
+		}
+	}
+	positive := func(d time.Duration, name string) {
+		check(d > 0, name, "must be greater than zero, got %s", d)
+	}
+	notNegative := func(n int64, name string) {
+		check(n >= 0, name, "must not be negative, got %d", n)
+	}
+	oneOf := func(value, name string, allowed ...string) {
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		check(false, name, "must be one of %s, got %q", strings.Join(allowed, ", "), value)
+	}
+
+	check(cfg.addr != "", "addr", "must not be empty")
+	u, err := url.Parse(cfg.baseURL)
+	check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "" && strings.Trim(u.Path, "/") == "" && u.RawQuery == "" && u.Fragment == "",
+		"base-url", "must be an absolute http or https URL without a path, got %q", cfg.baseURL)
+	check(cfg.dsn != "", "dsn", "is required (set dsn in the config file, %s or -dsn)", envName("dsn"))
+	if cfg.dsn != "" {
+		_, err := mysql.ParseDSN(cfg.dsn)
+		check(err == nil, "dsn", "%v", err)
+	}
+	positive(cfg.server.readTimeout, "read-timeout")
+	positive(cfg.server.writeTimeout, "write-timeout")
+	positive(cfg.server.idleTimeout, "idle-timeout")
+	positive(cfg.session.lifetime, "session-lifetime")
+	// 在代理后面运行时不使用证书，重定向也由 X-Forwarded-Proto 决定
+	if cfg.behindProxy {
+		check(cfg.httpAddr == "", "http-addr", "cannot be used with behind-proxy, requests arriving over plain HTTP are redirected using X-Forwarded-Proto")
+	} else {
+		check(cfg.tls.certFile != "", "tls-cert", "must not be empty")
+		check(cfg.tls.keyFile != "", "tls-key", "must not be empty")
+	}
+	notNegative(int64(cfg.hsts.maxAge), "hsts-max-age")
+	_, err = parseTLSVersion(cfg.tls.minVersion)
+	check(err == nil, "tls-min-version", "%v", err)
+	_, err = parseCipherSuites(cfg.tls.cipherSuites)
+	check(err == nil, "tls-ciphers", "%v", err)
+	notNegative(int64(cfg.tls.reloadInterval), "tls-reload-interval")
+	notNegative(int64(cfg.tls.expiryWarning), "tls-expiry-warning")
+	notNegative(int64(cfg.queryTimeout), "query-timeout")
+	positive(cfg.remember.lifetime, "remember-lifetime")
+	positive(cfg.remember.idleTimeout, "remember-idle-timeout")
+	notNegative(int64(cfg.shutdown.delay), "shutdown-delay")
+	positive(cfg.shutdown.timeout, "shutdown-timeout")
+	positive(cfg.health.timeout, "health-timeout")
+	notNegative(int64(cfg.health.cacheTTL), "health-cache-ttl")
+	oneOf(cfg.password.algorithm, "password-hash", password.Argon2id, password.Bcrypt)
+	check(cfg.password.minLength > 0, "password-min-length", "must be greater than zero, got %d", cfg.password.minLength)
+	oneOf(cfg.tracing.exporter, "trace-exporter", "none", "stdout", "file", "otlp")
+	check(cfg.tracing.sampleRatio >= 0 && cfg.tracing.sampleRatio <= 1, "trace-sample-ratio", "must be between 0 and 1, got %g", cfg.tracing.sampleRatio)
+	if cfg.tracing.exporter == "file" {
+		check(cfg.tracing.file != "", "trace-file", "must not be empty when trace-exporter is file")
+	}
+	oneOf(strings.ToLower(cfg.log.format), "log-format", "text", "json")
+	var level slog.Level
+	check(level.UnmarshalText([]byte(cfg.log.level)) == nil, "log-level", "must be debug, info, warn or error, got %q", cfg.log.level)
+	notNegative(int64(cfg.log.maxSize), "log-max-size")
+	notNegative(int64(cfg.log.maxAge), "log-max-age")
+	notNegative(int64(cfg.log.maxBackups), "log-max-backups")
+	check(cfg.smtp.port > 0 && cfg.smtp.port < 65536, "smtp-port", "must be between 1 and 65535, got %d", cfg.smtp.port)
+	if cfg.oidc.issuer != "" {
+		check(cfg.oidc.clientID != "", "oidc-client-id", "is required when oidc-issuer is set")
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"github.com/hlf2016/snippetbox/internal/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeConfigFile 把 content 写入临时目录中的配置文件，返回文件路径
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "snippetbox.yaml")
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// fakeEnv 返回只包含 env 中变量的 lookupEnv
+func fakeEnv(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+addr: ":5000"
+dsn: "web:pass@/snippetbox?parseTime=true"
+read-timeout: 7s
+log:
+  format: json
+  level: debug
+  max-backups: 3
+`)
+	env := fakeEnv(map[string]string{
+		"SNIPPETBOX_CONFIG":    path,
+		"SNIPPETBOX_LOG_LEVEL": "warn",
+		"SNIPPETBOX_ADDR":      ":6000",
+	})
+
+	cfg, _, err := loadConfig("web", []string{"-addr", ":7000"}, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 命令行 > 环境变量 > 配置文件 > 默认值
+	assert.Equal(t, cfg.addr, ":7000")
+	assert.Equal(t, cfg.log.level, "warn")
+	assert.Equal(t, cfg.log.format, "json")
+	assert.Equal(t, cfg.log.maxBackups, 3)
+	assert.Equal(t, cfg.server.readTimeout, 7*time.Second)
+	assert.Equal(t, cfg.server.writeTimeout, 10*time.Second)
+	assert.Equal(t, cfg.dsn, "web:pass@/snippetbox?parseTime=true")
+	assert.Equal(t, cfg.configFile, path)
+	assert.NilError(t, cfg.validate())
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		args    []string
+		wantErr string
+	}{
+		{
+			name:    "Unknown setting",
+			file:    "adress: \":4000\"\n",
+			wantErr: `unknown setting "adress"`,
+		},
+		{
+			name:    "Config file cannot name another config file",
+			file:    "config: other.yaml\n",
+			wantErr: `unknown setting "config"`,
+		},
+		{
+			name:    "Invalid duration in file",
+			file:    "read-timeout: soon\n",
+			wantErr: "read-timeout: parse error",
+		},
+		{
+			name:    "Lists are not supported",
+			file:    "auth-backends: [db, ldap]\n",
+			wantErr: "auth-backends: lists are not supported",
+		},
+		{
+			name:    "Invalid environment variable",
+			env:     map[string]string{"SNIPPETBOX_LOG_COMPRESS": "maybe"},
+			wantErr: "SNIPPETBOX_LOG_COMPRESS: parse error",
+		},
+		{
+			name:    "Missing config file",
+			args:    []string{"-config", "/no/such/file.yaml"},
+			wantErr: "no such file",
+		},
+		{
+			name:    "Unexpected arguments",
+			args:    []string{"serve"},
+			wantErr: "unexpected arguments: serve",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfigFile(t, tt.file)}, args...)
+			}
+			_, _, err := loadConfig("web", args, fakeEnv(tt.env))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			assert.StringContains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{
+			name: "Valid",
+			args: []string{"-dsn", "web:pass@/snippetbox"},
+		},
+		{
+			name:    "Missing DSN",
+			wantErr: "dsn: is required",
+		},
+		{
+			name:    "Zero timeout",
+			args:    []string{"-dsn", "web:pass@/snippetbox", "-write-timeout", "0s"},
+			wantErr: "write-timeout: must be greater than zero",
+		},
+		{
+			name:    "Unknown log format",
+			args:    []string{"-dsn", "web:pass@/snippetbox", "-log-format", "xml"},
+			wantErr: `log-format: must be one of text, json, got "xml"`,
+		},
+		{
+			name: "Behind proxy without certificates",
+			args: []string{"-dsn", "web:pass@/snippetbox", "-behind-proxy", "-tls-cert", "", "-tls-key", ""},
+		},
+		{
+			name:    "Missing certificate",
+			args:    []string{"-dsn", "web:pass@/snippetbox", "-tls-cert", ""},
+			wantErr: "tls-cert: must not be empty",
+		},
+		{
+			name:    "Redirect listener behind proxy",
+			args:    []string{"-dsn", "web:pass@/snippetbox", "-behind-proxy", "-http-addr", ":80"},
+			wantErr: "http-addr: cannot be used with behind-proxy",
+		},
+		{
+			name:    "Negative HSTS max-age",
+			args:    []string{"-dsn", "web:pass@/snippetbox", "-hsts-max-age", "-1h"},
+			wantErr: "hsts-max-age: must not be negative",
+		},
+		{
+			name:    "Base URL with a path",
+			args:    []string{"-dsn", "web:pass@/snippetbox", "-base-url", "https://snippetbox.example.com/app"},
+			wantErr: "base-url: must be an absolute http or https URL without a path",
+		},
+		{
+			name:    "Relative base URL",
+			args:    []string{"-dsn", "web:pass@/snippetbox", "-base-url", "snippetbox.example.com"},
+			wantErr: "base-url: must be an absolute http or https URL without a path",
+		},
+		{
+			name:    "Sample ratio out of range",
+			args:    []string{"-dsn", "web:pass@/snippetbox", "-trace-sample-ratio", "2"},
+			wantErr: "trace-sample-ratio: must be between 0 and 1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _, err := loadConfig("web", tt.args, fakeEnv(nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = cfg.validate()
+			if tt.wantErr == "" {
+				assert.NilError(t, err)
+				return
+			}
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			assert.StringContains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestWriteConfig(t *testing.T) {
+	_, fs, err := loadConfig("web", []string{
+		"-dsn", "web:hunter2@tcp(db:3306)/snippetbox?parseTime=true",
+		"-smtp-password", "hunter2",
+		"-log-format", "json",
+	}, fakeEnv(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = writeConfig(&buf, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	assert.StringContains(t, out, "dsn: web:REDACTED@tcp(db:3306)/snippetbox?parseTime=true\n")
+	assert.StringContains(t, out, "smtp-password: REDACTED\n")
+	assert.StringContains(t, out, "log-format: json\n")
+	assert.StringContains(t, out, "read-timeout: 5s\n")
+	assert.Equal(t, bytes.Contains(buf.Bytes(), []byte("hunter2")), false)
+
+	// 输出可以直接作为配置文件载入
+	cfg, _, err := loadConfig("web", []string{"-config", writeConfigFile(t, out)}, fakeEnv(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, cfg.log.format, "json")
+	assert.Equal(t, cfg.server.readTimeout, 5*time.Second)
+}
@@ -3,3 +3,6 @@ package main
 type contextKey string
 
 const isAuthenticatedContextKey = contextKey("isAuthenticated")
+
+// authenticatedUserContextKey 对应的值是当前登录用户的 *models.User，由 authenticate 中间件写入
+const authenticatedUserContextKey = contextKey("authenticatedUser")
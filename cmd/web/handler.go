@@ -6,8 +6,10 @@ import (
 	"github.com/hlf2016/snippetbox/internal/models"
 	"github.com/hlf2016/snippetbox/internal/validator"
 	"github.com/julienschmidt/httprouter"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 func (app *application) home(w http.ResponseWriter, r *http.Request) {
@@ -20,16 +22,16 @@ func (app *application) home(w http.ResponseWriter, r *http.Request) {
 	// 故意制造错误 查看 recoverPanic 中间件的反应
 	// panic("oops! something went wrong")
 
-	snippets, err := app.snippets.Latest()
+	snippets, err := app.snippets.Latest(r.Context())
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 
 	data := app.newTemplateData(r)
 	data.Snippets = snippets
 
-	app.render(w, http.StatusOK, "home.tmpl", data)
+	app.render(w, r, http.StatusOK, "home.tmpl", data)
 }
 func (app *application) snippetView(w http.ResponseWriter, r *http.Request) {
 	// 当 httprouter 解析请求时，任何已命名参数的值都将存储在请求上下文中。关于请求上下文，我们将在本书后面的章节中详细讨论，
@@ -41,14 +43,14 @@ func (app *application) snippetView(w http.ResponseWriter, r *http.Request) {
 		app.notFound(w)
 		return
 	}
-	snippet, err := app.snippets.Get(id)
+	snippet, err := app.snippets.Get(r.Context(), id)
 	if err != nil {
 		// 这是因为 Go 1.13 引入了通过封装错误为错误添加附加信息的功能。
 		// 如果一个错误碰巧被封装，就会创建一个全新的错误值--这反过来又意味着无法使用常规的 == 平等运算符来检查原始底层错误的值
 		if errors.Is(err, models.ErrNoRecord) {
 			app.notFound(w)
 		} else {
-			app.serverError(w, err)
+			app.serverError(w, r, err)
 		}
 		return
 	}
@@ -59,8 +61,9 @@ func (app *application) snippetView(w http.ResponseWriter, r *http.Request) {
 
 	data := app.newTemplateData(r)
 	data.Snippet = snippet
+	data.CanModifySnippet = app.canModifySnippet(r, snippet)
 
-	app.render(w, http.StatusOK, "view.tmpl", data)
+	app.render(w, r, http.StatusOK, "view.tmpl", data)
 	// 将片段数据写成纯文本 HTTP 响应体。
 	//fmt.Fprintf(w, "%+v", snippet)
 }
@@ -70,7 +73,7 @@ func (app *application) snippetCreate(w http.ResponseWriter, r *http.Request) {
 	data.Form = snippetCreateForm{
 		Expires: 365,
 	}
-	app.render(w, http.StatusOK, "create.tmpl", data)
+	app.render(w, r, http.StatusOK, "create.tmpl", data)
 }
 
 // 定义一个 snippetCreateForm 结构，用于表示表单数据和表单字段的验证错误。
@@ -108,34 +111,72 @@ func (app *application) snippetCreatePost(w http.ResponseWriter, r *http.Request
 	// 由于 Validator 类型已嵌入到 snippetCreateForm 结构中，因此我们可以直接调用 CheckField() 来执行验证检查。
 	// 如果检查结果不为 true，CheckField() 将把提供的键和错误信息添加到 FieldErrors 映射中。例如，在第一行中，我们 "检查 form.Title 字段是否为空"。
 	// 在第二行中，我们 "检查 form.Title 字段的最大字符长度是否为 100"，以此类推。
-	form.CheckField(validator.NotBlank(form.Title), "title", "This field cannot be blank")
-	form.CheckField(validator.MaxChars(form.Title, 100), "title", "This field cannot be more than 100 characters long")
-	form.CheckField(validator.NotBlank(form.Content), "content", "This field cannot be blank")
-	form.CheckField(validator.PermittedValue(form.Expires, 1, 7, 365), "expires", "This field must equal 1, 7 or 365")
+	form.CheckField(validator.NotBlank(form.Title), "title", "validation.blank")
+	form.CheckField(validator.MaxChars(form.Title, 100), "title", "validation.max_chars", 100)
+	form.CheckField(validator.NotBlank(form.Content), "content", "validation.blank")
+	form.CheckField(validator.PermittedValue(form.Expires, 1, 7, 365), "expires", "validation.expires")
 
 	if !form.Valid() {
 		data := app.newTemplateData(r)
 		data.Form = form
-		app.render(w, http.StatusUnprocessableEntity, "create.tmpl", data)
+		app.render(w, r, http.StatusUnprocessableEntity, "create.tmpl", data)
 		return
 	}
 
-	id, err := app.snippets.Insert(form.Title, form.Content, form.Expires)
+	userID := app.sessionManager.GetInt(r.Context(), app.authId)
+	id, err := app.snippets.Insert(r.Context(), userID, form.Title, form.Content, form.Expires)
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
+	app.metrics.snippetsCreated.Inc()
 
 	// 使用 Put() 方法将字符串值（"片段创建成功！"）和相应的键（"flash"）添加到会话数据中。
 	// r.Context 在处理程序处理请求时，将其作为会话管理器临时存储信息的地方
 	// 第二个参数（在我们的例子中是字符串 "flash"）是我们要添加到会话数据中的特定消息的密钥。随后，我们也将使用该键从会话数据中获取信息
-	app.sessionManager.Put(r.Context(), "flash", "Snippet successfully created!")
+	app.flash(r, "flash.snippet_created")
 	//Redirect the user to the relevant page for the snippet.
 	http.Redirect(w, r, fmt.Sprintf("/snippet/view/%d", id), http.StatusSeeOther)
 }
 
+// snippetDeletePost 删除片段。创建者可以删除自己的片段，版主和管理员可以删除任何片段。
+func (app *application) snippetDeletePost(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return
+	}
+	snippet, err := app.snippets.Get(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+	if !app.canModifySnippet(r, snippet) {
+		app.clientError(w, http.StatusForbidden)
+		return
+	}
+
+	err = app.snippets.Delete(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+	app.flash(r, "flash.snippet_deleted")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
 type userSignupForm struct {
 	Name                string `form:"name"`
+	Username            string `form:"username"`
 	Email               string `form:"email"`
 	Password            string `form:"password"`
 	validator.Validator `form:"-"`
@@ -144,7 +185,7 @@ type userSignupForm struct {
 func (app *application) userSignup(w http.ResponseWriter, r *http.Request) {
 	data := app.newTemplateData(r)
 	data.Form = userSignupForm{}
-	app.render(w, http.StatusOK, "signup.tmpl", data)
+	app.render(w, r, http.StatusOK, "signup.tmpl", data)
 }
 func (app *application) userSignupPost(w http.ResponseWriter, r *http.Request) {
 	var form userSignupForm
@@ -153,47 +194,55 @@ func (app *application) userSignupPost(w http.ResponseWriter, r *http.Request) {
 		app.clientError(w, http.StatusBadRequest)
 		return
 	}
-	form.CheckField(validator.NotBlank(form.Name), "name", "This field cannot be blank")
-	form.CheckField(validator.NotBlank(form.Email), "email", "This field cannot be blank")
-	form.CheckField(validator.Matches(form.Email, validator.EmailRX), "email", "This field must be a valid email address")
-	form.CheckField(validator.NotBlank(form.Password), "password", "This field cannot be blank")
-	form.CheckField(validator.MinChars(form.Password, 8), "password", "This field must be at least 8 characters long")
+	form.Username = strings.ToLower(strings.TrimSpace(form.Username))
+	form.CheckField(validator.NotBlank(form.Name), "name", "validation.blank")
+	checkUsername(&form.Validator, form.Username)
+	form.CheckField(validator.NotBlank(form.Email), "email", "validation.blank")
+	form.CheckField(validator.Matches(form.Email, validator.EmailRX), "email", "validation.email")
+	form.CheckField(validator.NotBlank(form.Password), "password", "validation.blank")
+	form.CheckPassword(app.passwordPolicy, "password", form.Password, form.Name, form.Username, form.Email)
 
 	if !form.Valid() {
 		data := app.newTemplateData(r)
 		data.Form = form
-		app.render(w, http.StatusUnprocessableEntity, "signup.tmpl", data)
+		app.render(w, r, http.StatusUnprocessableEntity, "signup.tmpl", data)
 		return
 	}
 
-	err = app.users.Insert(form.Name, form.Email, form.Password)
+	err = app.users.Insert(r.Context(), form.Name, form.Username, form.Email, form.Password)
 	if err != nil {
-		if errors.Is(err, models.ErrDuplicateEmail) {
-			form.AddFieldError("email", "Email address is already in use")
+		if errors.Is(err, models.ErrDuplicateEmail) || errors.Is(err, models.ErrDuplicateUsername) {
+			if errors.Is(err, models.ErrDuplicateEmail) {
+				form.AddFieldError("email", "error.email_taken")
+			} else {
+				form.AddFieldError("username", "error.username_taken")
+			}
 			data := app.newTemplateData(r)
 			data.Form = form
-			app.render(w, http.StatusUnprocessableEntity, "signup.tmpl", data)
+			app.render(w, r, http.StatusUnprocessableEntity, "signup.tmpl", data)
 		} else {
-			app.serverError(w, err)
+			app.serverError(w, r, err)
 		}
 		return
 	}
 
-	app.sessionManager.Put(r.Context(), "flash", "Your signup was successful. Please log in.")
+	app.flash(r, "flash.signup")
 	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 
 }
 
 type userLoginForm struct {
-	Email               string `form:"email"`
-	Password            string `form:"password"`
+	Email    string `form:"email"`
+	Password string `form:"password"`
+	// 勾选"记住我"后，会话过期时用持久令牌自动重新登录
+	Remember            bool `form:"remember"`
 	validator.Validator `form:"-"`
 }
 
 func (app *application) userLogin(w http.ResponseWriter, r *http.Request) {
 	data := app.newTemplateData(r)
 	data.Form = userLoginForm{}
-	app.render(w, http.StatusOK, "login.tmpl", data)
+	app.render(w, r, http.StatusOK, "login.tmpl", data)
 }
 func (app *application) userLoginPost(w http.ResponseWriter, r *http.Request) {
 	var form userLoginForm
@@ -202,78 +251,132 @@ func (app *application) userLoginPost(w http.ResponseWriter, r *http.Request) {
 		app.clientError(w, http.StatusBadRequest)
 		return
 	}
-	form.CheckField(validator.NotBlank(form.Email), "email", "This field cannot be blank")
-	form.CheckField(validator.NotBlank(form.Password), "password", "This field cannot be blank")
-	form.CheckField(validator.Matches(form.Email, validator.EmailRX), "email", "This field must be a valid email address")
+	form.CheckField(validator.NotBlank(form.Email), "email", "validation.blank")
+	form.CheckField(validator.NotBlank(form.Password), "password", "validation.blank")
+	form.CheckField(validator.Matches(form.Email, validator.EmailRX), "email", "validation.email")
 	if !form.Valid() {
 		data := app.newTemplateData(r)
 		data.Form = form
-		app.render(w, http.StatusUnprocessableEntity, "login.tmpl", data)
+		app.render(w, r, http.StatusUnprocessableEntity, "login.tmpl", data)
+		return
+	}
+
+	// 在执行代价高昂的密码哈希比较之前先检查是否处于退避或锁定状态
+	ip := app.clientIP(r)
+	wait, err := app.loginWait(form.Email, ip)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if wait > 0 {
+		app.metrics.loginFailures.WithLabelValues("throttled").Inc()
+		form.AddNonFieldError("login.error.throttled", app.humanDuration(r, wait))
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, r, http.StatusTooManyRequests, "login.tmpl", data)
 		return
 	}
 
-	id, err := app.users.Authenticate(form.Email, form.Password)
+	id, err := app.authenticator.Authenticate(r.Context(), form.Email, form.Password)
 	if err != nil {
 		if errors.Is(err, models.ErrInvalidCredential) {
-			form.AddNonFieldError("Email or password is incorrect")
+			app.metrics.loginFailures.WithLabelValues("invalid_credentials").Inc()
+			err = app.loginFailed(form.Email, ip)
+			if err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+			form.AddNonFieldError("login.error.invalid")
 
 			data := app.newTemplateData(r)
 			data.Form = form
-			app.render(w, http.StatusUnprocessableEntity, "login.tmpl", data)
+			app.render(w, r, http.StatusUnprocessableEntity, "login.tmpl", data)
+		} else if errors.Is(err, models.ErrAccountDisabled) {
+			app.metrics.loginFailures.WithLabelValues("disabled").Inc()
+			form.AddNonFieldError("login.error.disabled")
+
+			data := app.newTemplateData(r)
+			data.Form = form
+			app.render(w, r, http.StatusForbidden, "login.tmpl", data)
 		} else {
-			app.serverError(w, err)
+			app.serverError(w, r, err)
 		}
 		return
 	}
 
-	// 对当前会话使用 RenewToken() 方法更改会话 ID。当用户的身份验证状态或权限级别发生变化（如登录和注销操作）时，生成一个新的会话 ID 不失为一种好的做法。
-	err = app.sessionManager.RenewToken(r.Context())
+	// 开启了两步验证的用户在密码通过后还不算登录：会话中只记录一个"待验证"状态，等输入正确的验证码后再写入 authenticatedUserID。
+	enabled, err := app.twoFactorEnabled(r.Context(), id)
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
-
-	//	将当前用户的 ID 添加到会话中，这样他们就 "登录 "了。
-	app.sessionManager.Put(r.Context(), app.authId, id)
-
-	redirectUrlPath := "/snippet/create"
-	targetUrlPath := app.sessionManager.PopString(r.Context(), "targetUrlPath")
-	if targetUrlPath != "" {
-		redirectUrlPath = targetUrlPath
+	if enabled {
+		err = app.startTwoFactorLogin(r, id, form.Email, form.Remember)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/user/login/totp", http.StatusSeeOther)
+		return
 	}
-	http.Redirect(w, r, redirectUrlPath, http.StatusSeeOther)
+
+	app.completeLogin(w, r, id, form.Email, form.Remember)
 }
 func (app *application) userLogoutPost(w http.ResponseWriter, r *http.Request) {
-	err := app.sessionManager.RenewToken(r.Context())
+	// RenewToken 会从会话存储中删除旧令牌，对应的设备记录也一并删除
+	err := app.userSessions.Delete(r.Context(), app.sessionManager.Token(r.Context()))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	err = app.forgetRememberToken(w, r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	err = app.sessionManager.RenewToken(r.Context())
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 	app.sessionManager.Remove(r.Context(), app.authId)
-	app.sessionManager.Put(r.Context(), "flash", "You've been logged out successfully!")
+	app.flash(r, "flash.logout")
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 func (app *application) about(w http.ResponseWriter, r *http.Request) {
 	data := app.newTemplateData(r)
-	app.render(w, http.StatusOK, "about.tmpl", data)
+	app.render(w, r, http.StatusOK, "about.tmpl", data)
 }
 
 func (app *application) accountView(w http.ResponseWriter, r *http.Request) {
+	app.renderAccount(w, r, http.StatusOK, accountBioForm{Bio: app.currentUser(r).Bio})
+}
+
+// renderAccount 渲染账户页面。页面上有编辑简介的表单，所以提交失败时也通过它重新渲染。
+func (app *application) renderAccount(w http.ResponseWriter, r *http.Request, status int, form accountBioForm) {
 	userID := app.sessionManager.GetInt(r.Context(), app.authId)
-	user, err := app.users.Get(userID)
+	user, err := app.users.Get(r.Context(), userID)
 	if err != nil {
 		if errors.Is(err, models.ErrNoRecord) {
 			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 		} else {
-			app.serverError(w, err)
+			app.serverError(w, r, err)
 		}
 		return
 	}
+	enabled, err := app.twoFactorEnabled(r.Context(), userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
 	// fmt.Fprintf(w, "%+v", user)
 	data := app.newTemplateData(r)
 	data.CurrentUser = user
-	app.render(w, http.StatusOK, "account.tmpl", data)
+	data.TwoFactorEnabled = enabled
+	data.Form = form
+	app.render(w, r, status, "account.tmpl", data)
 }
 
 type resetPasswordForm struct {
@@ -286,7 +389,7 @@ type resetPasswordForm struct {
 func (app *application) accountPasswordUpdate(w http.ResponseWriter, r *http.Request) {
 	data := app.newTemplateData(r)
 	data.Form = resetPasswordForm{}
-	app.render(w, http.StatusOK, "password.tmpl", data)
+	app.render(w, r, http.StatusOK, "password.tmpl", data)
 }
 
 func (app *application) accountPasswordUpdatePost(w http.ResponseWriter, r *http.Request) {
@@ -298,38 +401,35 @@ func (app *application) accountPasswordUpdatePost(w http.ResponseWriter, r *http
 	}
 	// userID := app.sessionManager.GetInt(r.Context(), app.authId)
 
-	form.CheckField(validator.NotBlank(form.CurrentPassword), "currentPassword", "This field cannot be blank")
-	form.CheckField(validator.NotBlank(form.NewPassword), "newPassword", "This field cannot be blank")
-	form.CheckField(validator.MinChars(form.NewPassword, 8), "newPassword", "This field must be at least 8 characters long")
-	form.CheckField(validator.NotBlank(form.ConfirmPassword), "confirmPassword", "This field cannot be blank")
-	form.CheckField(form.NewPassword == form.ConfirmPassword, "confirmPassword", "Passwords do not match")
+	form.CheckField(validator.NotBlank(form.CurrentPassword), "currentPassword", "validation.blank")
+	form.CheckField(validator.NotBlank(form.NewPassword), "newPassword", "validation.blank")
+	user := app.currentUser(r)
+	form.CheckPassword(app.passwordPolicy, "newPassword", form.NewPassword, user.Name, user.Username, user.Email)
+	form.CheckField(validator.NotBlank(form.ConfirmPassword), "confirmPassword", "validation.blank")
+	form.CheckField(form.NewPassword == form.ConfirmPassword, "confirmPassword", "validation.passwords_mismatch")
 
 	if !form.Valid() {
 		data := app.newTemplateData(r)
 		data.Form = form
-		app.render(w, http.StatusUnprocessableEntity, "password.tmpl", data)
+		app.render(w, r, http.StatusUnprocessableEntity, "password.tmpl", data)
 		return
 	}
 
 	userID := app.sessionManager.GetInt(r.Context(), app.authId)
-	err = app.users.PasswordUpdate(userID, form.CurrentPassword, form.NewPassword)
+	err = app.users.PasswordUpdate(r.Context(), userID, form.CurrentPassword, form.NewPassword)
 	if err != nil {
 		if errors.Is(err, models.ErrInvalidCredential) {
-			form.AddFieldError("currentPassword", "Current password is incorrect")
+			form.AddFieldError("currentPassword", "password.error.incorrect")
 			data := app.newTemplateData(r)
 			data.Form = form
-			app.render(w, http.StatusUnprocessableEntity, "password.tmpl", data)
+			app.render(w, r, http.StatusUnprocessableEntity, "password.tmpl", data)
 		} else {
-			app.serverError(w, err)
+			app.serverError(w, r, err)
 		}
 		return
 	}
 
 	// fmt.Fprintf(w, "%+v", form)
-	app.sessionManager.Put(r.Context(), "flash", "Your password has been updated successfully")
+	app.flash(r, "flash.password_updated")
 	http.Redirect(w, r, "/account/view", http.StatusSeeOther)
 }
-
-func ping(w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte("OK"))
-}
@@ -1,10 +1,22 @@
 package main
 
 import (
+	"archive/zip"
+	"context"
+	"encoding/json"
 	"github.com/hlf2016/snippetbox/internal/assert"
+	"github.com/hlf2016/snippetbox/internal/models"
+	"github.com/hlf2016/snippetbox/internal/models/mocks"
+	"github.com/hlf2016/snippetbox/internal/oidc"
+	"github.com/hlf2016/snippetbox/internal/oidc/oidctest"
+	"github.com/pquerna/otp/totp"
+	"io"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestPing(t *testing.T) {
@@ -19,6 +31,24 @@ func TestPing(t *testing.T) {
 	statusCode, _, body := ts.get(t, "/ping")
 	assert.Equal(t, statusCode, http.StatusOK)
 	assert.Equal(t, body, "OK")
+
+	// 收到关闭信号后先报告未就绪，负载均衡器据此摘除实例
+	app.shuttingDown.Store(true)
+	statusCode, _, _ = ts.get(t, "/ping")
+	assert.Equal(t, statusCode, http.StatusServiceUnavailable)
+}
+
+func TestBackground(t *testing.T) {
+	app := newTestApplication(t)
+
+	var ran atomic.Int32
+	app.background(func() { ran.Add(1) })
+	app.background(func() { panic("boom") })
+	app.background(func() { ran.Add(1) })
+
+	// 关闭服务器时会等待所有后台任务，其中的 panic 不会导致程序崩溃
+	app.wg.Wait()
+	assert.Equal(t, ran.Load(), int32(2))
 }
 
 func TestSnippetView(t *testing.T) {
@@ -44,6 +74,12 @@ func TestSnippetView(t *testing.T) {
 			urlPath:  "/snippet/view/2",
 			wantCode: http.StatusNotFound,
 		},
+		{
+			name:     "Query timeout",
+			urlPath:  "/snippet/view/99",
+			wantCode: http.StatusServiceUnavailable,
+			wantBody: "Please try again in a few moments.",
+		},
 		{
 			name:     "Negative ID",
 			urlPath:  "/snippet/view/-1",
@@ -90,6 +126,7 @@ func TestUserSignup(t *testing.T) {
 
 	const (
 		validName     = "Bob"
+		validUsername = "bob_smith"
 		validPassword = "validPassword"
 		validEmail    = "Bob@test.com"
 		formTag       = "<form action='/user/signup' method='POST' novalidate>"
@@ -98,6 +135,7 @@ func TestUserSignup(t *testing.T) {
 	tests := []struct {
 		name         string
 		userName     string
+		username     string
 		userEmail    string
 		userPassword string
 		csrfToken    string
@@ -107,6 +145,7 @@ func TestUserSignup(t *testing.T) {
 		{
 			name:         "Valid submission",
 			userName:     validName,
+			username:     validUsername,
 			userEmail:    validEmail,
 			userPassword: validPassword,
 			csrfToken:    validCSRFToken,
@@ -115,6 +154,7 @@ func TestUserSignup(t *testing.T) {
 		{
 			name:         "Invalid CSRF Token",
 			userName:     validName,
+			username:     validUsername,
 			userEmail:    validEmail,
 			userPassword: validPassword,
 			csrfToken:    "wrongToken",
@@ -123,6 +163,7 @@ func TestUserSignup(t *testing.T) {
 		{
 			name:         "Empty name",
 			userName:     "",
+			username:     validUsername,
 			userEmail:    validEmail,
 			userPassword: validPassword,
 			csrfToken:    validCSRFToken,
@@ -132,6 +173,7 @@ func TestUserSignup(t *testing.T) {
 		{
 			name:         "Empty email",
 			userName:     validName,
+			username:     validUsername,
 			userEmail:    "",
 			userPassword: validPassword,
 			csrfToken:    validCSRFToken,
@@ -141,6 +183,7 @@ func TestUserSignup(t *testing.T) {
 		{
 			name:         "Empty password",
 			userName:     validName,
+			username:     validUsername,
 			userEmail:    validEmail,
 			userPassword: "",
 			csrfToken:    validCSRFToken,
@@ -150,6 +193,7 @@ func TestUserSignup(t *testing.T) {
 		{
 			name:         "Invalid email",
 			userName:     validName,
+			username:     validUsername,
 			userEmail:    "bob@example.",
 			userPassword: validPassword,
 			csrfToken:    validCSRFToken,
@@ -159,15 +203,67 @@ func TestUserSignup(t *testing.T) {
 		{
 			name:         "Short password",
 			userName:     validName,
+			username:     validUsername,
 			userEmail:    validEmail,
 			userPassword: "pa$$",
 			csrfToken:    validCSRFToken,
 			wantCode:     http.StatusUnprocessableEntity,
 			wantFormTag:  formTag,
 		},
+		{
+			name:         "Common password",
+			userName:     validName,
+			username:     validUsername,
+			userEmail:    validEmail,
+			userPassword: "Password123",
+			csrfToken:    validCSRFToken,
+			wantCode:     http.StatusUnprocessableEntity,
+			wantFormTag:  formTag,
+		},
+		{
+			name:         "Password contains username",
+			userName:     validName,
+			username:     validUsername,
+			userEmail:    validEmail,
+			userPassword: "bob_smith_2024",
+			csrfToken:    validCSRFToken,
+			wantCode:     http.StatusUnprocessableEntity,
+			wantFormTag:  formTag,
+		},
+		{
+			name:         "Invalid username",
+			userName:     validName,
+			username:     "Bob Smith!",
+			userEmail:    validEmail,
+			userPassword: validPassword,
+			csrfToken:    validCSRFToken,
+			wantCode:     http.StatusUnprocessableEntity,
+			wantFormTag:  formTag,
+		},
+		{
+			name:         "Numeric username",
+			userName:     validName,
+			username:     "12345",
+			userEmail:    validEmail,
+			userPassword: validPassword,
+			csrfToken:    validCSRFToken,
+			wantCode:     http.StatusUnprocessableEntity,
+			wantFormTag:  formTag,
+		},
+		{
+			name:         "Duplicate username",
+			userName:     validName,
+			username:     "dupe",
+			userEmail:    validEmail,
+			userPassword: validPassword,
+			csrfToken:    validCSRFToken,
+			wantCode:     http.StatusUnprocessableEntity,
+			wantFormTag:  formTag,
+		},
 		{
 			name:         "Duplicate email",
 			userName:     validName,
+			username:     validUsername,
 			userEmail:    "dupe@example.com",
 			userPassword: validPassword,
 			csrfToken:    validCSRFToken,
@@ -179,6 +275,7 @@ func TestUserSignup(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			form := url.Values{}
 			form.Add("name", tt.userName)
+			form.Add("username", tt.username)
 			form.Add("email", tt.userEmail)
 			form.Add("password", tt.userPassword)
 			form.Add("csrf_token", tt.csrfToken)
@@ -223,3 +320,1481 @@ func TestSnippetCreate(t *testing.T) {
 		assert.StringContains(t, body, "<form action='/snippet/create' method='POST'>")
 	})
 }
+
+func TestUserLoginTOTP(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	_, _, body := ts.get(t, "/user/login")
+	validCSRFToken := extractCSRFToken(t, body)
+
+	form := url.Values{}
+	form.Add("email", "bob@example.com")
+	form.Add("password", "password")
+	form.Add("csrf_token", validCSRFToken)
+
+	// 密码正确后应跳转到验证码页面，此时仍未登录
+	code, headers, _ := ts.postForm(t, "/user/login", form)
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, headers.Get("Location"), "/user/login/totp")
+
+	code, headers, _ = ts.get(t, "/snippet/create")
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, headers.Get("Location"), "/user/login")
+
+	validCode, err := totp.GenerateCode(mocks.TOTPSecret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		code         string
+		wantCode     int
+		wantLocation string
+	}{
+		{
+			name:     "Empty code",
+			code:     "",
+			wantCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:     "Invalid code",
+			code:     "000000",
+			wantCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:         "Valid code",
+			code:         validCode,
+			wantCode:     http.StatusSeeOther,
+			wantLocation: "/snippet/create",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			form.Add("code", tt.code)
+			form.Add("csrf_token", validCSRFToken)
+
+			code, headers, _ := ts.postForm(t, "/user/login/totp", form)
+			assert.Equal(t, code, tt.wantCode)
+			if tt.wantLocation != "" {
+				assert.Equal(t, headers.Get("Location"), tt.wantLocation)
+			}
+		})
+	}
+
+	code, _, _ = ts.get(t, "/snippet/create")
+	assert.Equal(t, code, http.StatusOK)
+}
+
+func TestAccountSessions(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		code, headers, _ := ts.get(t, "/account/sessions")
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, headers.Get("Location"), "/user/login")
+	})
+
+	_, _, body := ts.get(t, "/user/login")
+	validCSRFToken := extractCSRFToken(t, body)
+	form := url.Values{}
+	form.Add("email", "alice@example.com")
+	form.Add("password", "password")
+	form.Add("csrf_token", validCSRFToken)
+	ts.postForm(t, "/user/login", form)
+
+	t.Run("List", func(t *testing.T) {
+		code, _, body := ts.get(t, "/account/sessions")
+		assert.Equal(t, code, http.StatusOK)
+		assert.StringContains(t, body, "192.0.2.10")
+		assert.StringContains(t, body, "<form action='/account/sessions/revoke-others' method='POST'>")
+	})
+
+	tests := []struct {
+		name     string
+		id       string
+		wantCode int
+	}{
+		{
+			name:     "Revoke other session",
+			id:       "1",
+			wantCode: http.StatusSeeOther,
+		},
+		{
+			name:     "Non-existent session",
+			id:       "2",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "Invalid ID",
+			id:       "foo",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			form.Add("id", tt.id)
+			form.Add("csrf_token", validCSRFToken)
+
+			code, _, _ := ts.postForm(t, "/account/sessions/revoke", form)
+			assert.Equal(t, code, tt.wantCode)
+		})
+	}
+}
+
+func TestUserLoginThrottle(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	_, _, body := ts.get(t, "/user/login")
+	validCSRFToken := extractCSRFToken(t, body)
+
+	login := func(password string) (int, http.Header, string) {
+		form := url.Values{}
+		form.Add("email", "alice@example.com")
+		form.Add("password", password)
+		form.Add("csrf_token", validCSRFToken)
+		return ts.postForm(t, "/user/login", form)
+	}
+
+	// 前几次失败只会得到普通的 422 响应
+	for i := 0; i < accountLoginPolicy.FreeAttempts+1; i++ {
+		code, _, _ := login("wrongPassword")
+		assert.Equal(t, code, http.StatusUnprocessableEntity)
+	}
+
+	// 超过允许的次数后进入退避，即使密码正确也会被拒绝
+	code, headers, body := login("password")
+	assert.Equal(t, code, http.StatusTooManyRequests)
+	assert.Equal(t, headers.Get("Retry-After"), "1")
+	assert.StringContains(t, body, "Too many failed login attempts")
+}
+
+func TestUserLoginTOTPThrottle(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	_, _, body := ts.get(t, "/user/login")
+	validCSRFToken := extractCSRFToken(t, body)
+
+	login := func() {
+		form := url.Values{}
+		form.Add("email", "bob@example.com")
+		form.Add("password", "password")
+		form.Add("csrf_token", validCSRFToken)
+		code, headers, _ := ts.postForm(t, "/user/login", form)
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, headers.Get("Location"), "/user/login/totp")
+	}
+	submitCode := func(totpCode string) (int, http.Header, string) {
+		form := url.Values{}
+		form.Add("code", totpCode)
+		form.Add("csrf_token", validCSRFToken)
+		return ts.postForm(t, "/user/login/totp", form)
+	}
+
+	// 输错的验证码计入账号的失败次数，重新输入正确的密码不会清除这些记录
+	login()
+	for i := 0; i < twoFactorMaxAttempts-1; i++ {
+		code, _, _ := submitCode("000000")
+		assert.Equal(t, code, http.StatusUnprocessableEntity)
+	}
+	login()
+	for i := twoFactorMaxAttempts - 1; i < accountLoginPolicy.FreeAttempts+1; i++ {
+		code, _, _ := submitCode("000000")
+		assert.Equal(t, code, http.StatusUnprocessableEntity)
+	}
+
+	// 超过允许的次数后进入退避，即使验证码正确也会被拒绝
+	validCode, err := totp.GenerateCode(mocks.TOTPSecret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, headers, body := submitCode(validCode)
+	assert.Equal(t, code, http.StatusTooManyRequests)
+	assert.Equal(t, headers.Get("Retry-After"), "1")
+	assert.StringContains(t, body, "Too many failed login attempts")
+}
+
+func TestAdminView(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		wantCode int
+	}{
+		{
+			name:     "Regular user",
+			email:    "alice@example.com",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "Admin",
+			email:    "admin@example.com",
+			wantCode: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			ts.login(t, tt.email, "password")
+
+			code, _, _ := ts.get(t, "/admin")
+			assert.Equal(t, code, tt.wantCode)
+
+			// 只有管理员的导航栏中才有管理入口
+			_, _, body := ts.get(t, "/")
+			if tt.wantCode == http.StatusOK {
+				assert.StringContains(t, body, `<a href="/admin">Admin</a>`)
+			} else if strings.Contains(body, `<a href="/admin">Admin</a>`) {
+				t.Errorf("unexpected admin link for %s", tt.email)
+			}
+		})
+	}
+}
+
+func TestSnippetDelete(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		urlPath  string
+		wantCode int
+	}{
+		{
+			name:     "Owner",
+			email:    "alice@example.com",
+			urlPath:  "/snippet/delete/1",
+			wantCode: http.StatusSeeOther,
+		},
+		{
+			name:     "Other user",
+			email:    "carol@example.com",
+			urlPath:  "/snippet/delete/1",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "Admin override",
+			email:    "admin@example.com",
+			urlPath:  "/snippet/delete/1",
+			wantCode: http.StatusSeeOther,
+		},
+		{
+			name:     "Non-existent ID",
+			email:    "admin@example.com",
+			urlPath:  "/snippet/delete/2",
+			wantCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			csrfToken := ts.login(t, tt.email, "password")
+
+			form := url.Values{}
+			form.Add("csrf_token", csrfToken)
+			code, _, _ := ts.postForm(t, tt.urlPath, form)
+			assert.Equal(t, code, tt.wantCode)
+		})
+	}
+}
+
+func TestAdminUserActions(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		urlPath  string
+		wantCode int
+	}{
+		{
+			name:     "Disable user",
+			email:    "admin@example.com",
+			urlPath:  "/admin/users/disable/4",
+			wantCode: http.StatusSeeOther,
+		},
+		{
+			name:     "Enable user",
+			email:    "admin@example.com",
+			urlPath:  "/admin/users/enable/5",
+			wantCode: http.StatusSeeOther,
+		},
+		{
+			name:     "Force password reset",
+			email:    "admin@example.com",
+			urlPath:  "/admin/users/force-reset/4",
+			wantCode: http.StatusSeeOther,
+		},
+		{
+			name:     "Disable self",
+			email:    "admin@example.com",
+			urlPath:  "/admin/users/disable/3",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "Non-existent user",
+			email:    "admin@example.com",
+			urlPath:  "/admin/users/disable/99",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "Regular user",
+			email:    "carol@example.com",
+			urlPath:  "/admin/users/disable/1",
+			wantCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			csrfToken := ts.login(t, tt.email, "password")
+
+			form := url.Values{}
+			form.Add("csrf_token", csrfToken)
+			code, _, _ := ts.postForm(t, tt.urlPath, form)
+			assert.Equal(t, code, tt.wantCode)
+		})
+	}
+}
+
+func TestAdminSearchUsers(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ts.login(t, "admin@example.com", "password")
+
+	code, _, body := ts.get(t, "/admin?q=carol")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "carol@example.com")
+	if strings.Contains(body, "bob@example.com") {
+		t.Errorf("search results should not contain bob@example.com")
+	}
+}
+
+func TestAdminSnippetDelete(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	csrfToken := ts.login(t, "admin@example.com", "password")
+
+	code, _, body := ts.get(t, "/admin/snippets")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "An old silent pond")
+
+	form := url.Values{}
+	form.Add("csrf_token", csrfToken)
+	form.Add("id", "1")
+	form.Add("id", "2")
+	code, header, _ := ts.postForm(t, "/admin/snippets/delete", form)
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/admin/snippets")
+
+	_, _, body = ts.get(t, "/admin/snippets")
+	assert.StringContains(t, body, "1 snippet deleted.")
+}
+
+func TestDisabledUserLogin(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	_, _, body := ts.get(t, "/user/login")
+	csrfToken := extractCSRFToken(t, body)
+
+	form := url.Values{}
+	form.Add("email", "dave@example.com")
+	form.Add("password", "password")
+	form.Add("csrf_token", csrfToken)
+	code, _, body := ts.postForm(t, "/user/login", form)
+	assert.Equal(t, code, http.StatusForbidden)
+	assert.StringContains(t, body, "This account has been disabled.")
+}
+
+func TestForcedPasswordResetPasswordless(t *testing.T) {
+	provider := oidctest.NewProvider(t)
+	provider.SetIdentity(oidctest.Identity{Subject: "s-heidi", Email: "new@example.com", EmailVerified: true})
+
+	app := newTestApplication(t)
+	app.oidc = oidc.NewProvider(oidc.Config{
+		Issuer:       provider.Issuer(),
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+	})
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+	app.cfg.oidc.redirectURL = ts.URL + "/auth/oidc/callback"
+
+	t.Run("Admin cannot require a reset", func(t *testing.T) {
+		admin := newTestServer(t, app.routes())
+		defer admin.Close()
+		csrfToken := admin.login(t, "admin@example.com", "password")
+
+		form := url.Values{}
+		form.Add("csrf_token", csrfToken)
+		code, header, _ := admin.postForm(t, "/admin/users/force-reset/7", form)
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "/admin")
+		_, _, body := admin.get(t, "/admin")
+		assert.StringContains(t, body, "heidi@example.com signs in through single sign-on and has no password to change.")
+	})
+
+	t.Run("Existing flag does not lock the user out", func(t *testing.T) {
+		// 单点登录创建的用户 7 没有密码，即使带着要求修改密码的标记也可以正常访问
+		_, header, _ := ts.get(t, "/auth/oidc/login")
+		rs, err := ts.Client().Get(header.Get("Location"))
+		assert.NilError(t, err)
+		rs.Body.Close()
+		callback, err := url.Parse(rs.Header.Get("Location"))
+		assert.NilError(t, err)
+		code, _, _ := ts.get(t, callback.RequestURI())
+		assert.Equal(t, code, http.StatusSeeOther)
+
+		code, _, _ = ts.get(t, "/snippet/create")
+		assert.Equal(t, code, http.StatusOK)
+	})
+}
+
+func TestForcedPasswordReset(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ts.login(t, "erin@example.com", "password")
+
+	code, header, _ := ts.get(t, "/snippet/create")
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/account/password/update")
+
+	code, _, body := ts.get(t, "/account/password/update")
+	assert.Equal(t, code, http.StatusOK)
+	csrfToken := extractCSRFToken(t, body)
+
+	// 强制修改密码时新密码同样要满足密码策略
+	tests := []struct {
+		name        string
+		newPassword string
+		wantBody    string
+	}{
+		{"Common password", "qwertyuiop", "This password is too common"},
+		{"Contains name", "erin-rocks-2024", "Your password cannot contain your name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			form.Add("currentPassword", "password")
+			form.Add("newPassword", tt.newPassword)
+			form.Add("confirmPassword", tt.newPassword)
+			form.Add("csrf_token", csrfToken)
+			code, _, body := ts.postForm(t, "/account/password/update", form)
+			assert.Equal(t, code, http.StatusUnprocessableEntity)
+			assert.StringContains(t, body, tt.wantBody)
+		})
+	}
+}
+
+func TestAccountDelete(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		snippets string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "Delete snippets",
+			password: "password",
+			snippets: "delete",
+			wantCode: http.StatusSeeOther,
+		},
+		{
+			name:     "Anonymise snippets",
+			password: "password",
+			snippets: "anonymise",
+			wantCode: http.StatusSeeOther,
+		},
+		{
+			name:     "Wrong password",
+			password: "wrong",
+			snippets: "delete",
+			wantCode: http.StatusUnprocessableEntity,
+			wantBody: "Password is incorrect",
+		},
+		{
+			name:     "Invalid snippets choice",
+			password: "password",
+			snippets: "keep",
+			wantCode: http.StatusUnprocessableEntity,
+			wantBody: "This field must be delete or anonymise",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			csrfToken := ts.login(t, "carol@example.com", "password")
+
+			form := url.Values{}
+			form.Add("csrf_token", csrfToken)
+			form.Add("password", tt.password)
+			form.Add("snippets", tt.snippets)
+			code, _, body := ts.postForm(t, "/account/delete", form)
+			assert.Equal(t, code, tt.wantCode)
+			if tt.wantBody != "" {
+				assert.StringContains(t, body, tt.wantBody)
+			}
+
+			// 删除成功后当前会话不再处于登录状态
+			if tt.wantCode == http.StatusSeeOther {
+				code, header, _ := ts.get(t, "/account/view")
+				assert.Equal(t, code, http.StatusSeeOther)
+				assert.Equal(t, header.Get("Location"), "/user/login")
+			}
+		})
+	}
+}
+
+func TestAccountDeleteThrottle(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	csrfToken := ts.login(t, "carol@example.com", "password")
+	submit := func(password string) (int, http.Header, string) {
+		form := url.Values{}
+		form.Add("csrf_token", csrfToken)
+		form.Add("password", password)
+		form.Add("snippets", "delete")
+		return ts.postForm(t, "/account/delete", form)
+	}
+
+	// 拿到会话的人在这里猜密码，和登录一样计入账号的失败次数
+	for i := 0; i < accountLoginPolicy.FreeAttempts+1; i++ {
+		code, _, _ := submit("wrong")
+		assert.Equal(t, code, http.StatusUnprocessableEntity)
+	}
+
+	// 进入退避后即使密码正确也会被拒绝，账号不会被删除
+	code, header, body := submit("password")
+	assert.Equal(t, code, http.StatusTooManyRequests)
+	assert.Equal(t, header.Get("Retry-After"), "1")
+	assert.StringContains(t, body, "Too many failed login attempts")
+
+	// 同一个账号的登录同样被限流
+	wait, err := app.loginWait("carol@example.com", "127.0.0.1")
+	assert.NilError(t, err)
+	if wait <= 0 {
+		t.Error("expected the login for the account to be throttled as well")
+	}
+}
+
+func TestAccountExport(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ts.login(t, "alice@example.com", "password")
+
+	code, header, body := ts.get(t, "/account/export")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, header.Get("Content-Type"), "application/zip")
+	assert.StringContains(t, header.Get("Content-Disposition"), "attachment")
+
+	zr, err := zip.NewReader(strings.NewReader(body), int64(len(body)))
+	assert.NilError(t, err)
+
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	for _, name := range []string{"profile.json", "sessions.json", "snippets.json", "snippets/1.txt"} {
+		if files[name] == nil {
+			t.Fatalf("missing %s in export", name)
+		}
+	}
+
+	rc, err := files["profile.json"].Open()
+	assert.NilError(t, err)
+	defer rc.Close()
+	var profile struct {
+		Email    string `json:"email"`
+		Username string `json:"username"`
+		Bio      string `json:"bio"`
+		Timezone string `json:"timezone"`
+		Locale   string `json:"locale"`
+	}
+	err = json.NewDecoder(rc).Decode(&profile)
+	assert.NilError(t, err)
+	assert.Equal(t, profile.Email, "example@email.com")
+	assert.Equal(t, profile.Username, "alice")
+	assert.Equal(t, profile.Bio, "Writes haiku on the train.")
+	assert.Equal(t, profile.Timezone, "")
+	assert.Equal(t, profile.Locale, "")
+}
+
+func TestUserProfile(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		urlPath  string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "Valid ID",
+			urlPath:  "/u/1",
+			wantCode: http.StatusOK,
+			wantBody: "Writes haiku on the train.",
+		},
+		{
+			name:     "Username",
+			urlPath:  "/u/alice",
+			wantCode: http.StatusOK,
+			wantBody: "Writes haiku on the train.",
+		},
+		{
+			name:     "Disabled user",
+			urlPath:  "/u/5",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "Non-existent ID",
+			urlPath:  "/u/99",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "String ID",
+			urlPath:  "/u/foo",
+			wantCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := ts.get(t, tt.urlPath)
+			assert.Equal(t, code, tt.wantCode)
+			if tt.wantBody != "" {
+				assert.StringContains(t, body, tt.wantBody)
+				assert.StringContains(t, body, "An old silent pond")
+				// 公开页面上不能出现邮箱地址
+				if strings.Contains(body, "example@email.com") {
+					t.Errorf("profile page leaks the email address")
+				}
+			}
+		})
+	}
+}
+
+func TestAccountBio(t *testing.T) {
+	tests := []struct {
+		name     string
+		bio      string
+		wantCode int
+	}{
+		{
+			name:     "Valid bio",
+			bio:      "Hello!",
+			wantCode: http.StatusSeeOther,
+		},
+		{
+			name:     "Too long",
+			bio:      strings.Repeat("a", 501),
+			wantCode: http.StatusUnprocessableEntity,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			csrfToken := ts.login(t, "alice@example.com", "password")
+
+			form := url.Values{}
+			form.Add("csrf_token", csrfToken)
+			form.Add("bio", tt.bio)
+			code, _, _ := ts.postForm(t, "/account/bio", form)
+			assert.Equal(t, code, tt.wantCode)
+		})
+	}
+}
+
+func TestAccountEdit(t *testing.T) {
+	tests := []struct {
+		name       string
+		username   string
+		email      string
+		wantCode   int
+		wantMails  int
+		wantFlash  string
+		wantErrMsg string
+	}{
+		{
+			name:      "Change name and username",
+			username:  "alice_j",
+			email:     "example@email.com",
+			wantCode:  http.StatusSeeOther,
+			wantFlash: "Your profile has been updated.",
+		},
+		{
+			name:      "Change email",
+			username:  "alice",
+			email:     "alice.new@example.com",
+			wantCode:  http.StatusSeeOther,
+			wantMails: 2,
+			wantFlash: "sent a link to alice.new@example.com",
+		},
+		{
+			name:       "Username taken",
+			username:   "bob",
+			email:      "example@email.com",
+			wantCode:   http.StatusUnprocessableEntity,
+			wantErrMsg: "Username is already taken",
+		},
+		{
+			name:       "Email taken",
+			username:   "alice",
+			email:      "bob@example.com",
+			wantCode:   http.StatusUnprocessableEntity,
+			wantErrMsg: "Email address is already in use",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			csrfToken := ts.login(t, "alice@example.com", "password")
+
+			form := url.Values{}
+			form.Add("csrf_token", csrfToken)
+			form.Add("name", "Alice")
+			form.Add("username", tt.username)
+			form.Add("email", tt.email)
+			code, _, body := ts.postForm(t, "/account/edit", form)
+			assert.Equal(t, code, tt.wantCode)
+			if tt.wantErrMsg != "" {
+				assert.StringContains(t, body, tt.wantErrMsg)
+			}
+
+			// 发往原邮箱的通知在后台发送
+			app.wg.Wait()
+			sent := app.mailer.(*testMailer).messages()
+			assert.Equal(t, len(sent), tt.wantMails)
+			if tt.wantMails > 0 {
+				// 确认链接发往新邮箱，通知发往原邮箱
+				assert.Equal(t, sent[0].To, tt.email)
+				// 链接基于 -base-url，与请求的 Host 无关
+				assert.StringContains(t, sent[0].Body, "https://snippetbox.example.com/account/email/verify?token=")
+				assert.Equal(t, sent[1].To, "example@email.com")
+			}
+
+			if tt.wantFlash != "" {
+				_, _, body = ts.get(t, "/account/view")
+				assert.StringContains(t, body, tt.wantFlash)
+			}
+		})
+	}
+}
+
+func TestAccountEmailVerify(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	tests := []struct {
+		name         string
+		urlPath      string
+		wantCode     int
+		wantLocation string
+	}{
+		{
+			name:         "Valid token",
+			urlPath:      "/account/email/verify?token=" + mocks.EmailChangeToken,
+			wantCode:     http.StatusSeeOther,
+			wantLocation: "/account/view",
+		},
+		{
+			name:         "Invalid token",
+			urlPath:      "/account/email/verify?token=nope",
+			wantCode:     http.StatusSeeOther,
+			wantLocation: "/",
+		},
+		{
+			name:     "Missing token",
+			urlPath:  "/account/email/verify",
+			wantCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, header, _ := ts.get(t, tt.urlPath)
+			assert.Equal(t, code, tt.wantCode)
+			assert.Equal(t, header.Get("Location"), tt.wantLocation)
+		})
+	}
+}
+
+func TestViewerTimezone(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		tzCookie string
+		wantZone string
+	}{
+		{
+			name:     "Anonymous",
+			wantZone: "UTC",
+		},
+		{
+			name:     "Anonymous with browser zone",
+			tzCookie: "Europe%2FBerlin",
+			wantZone: "UTC",
+		},
+		{
+			name:     "Saved preference",
+			email:    "carol@example.com",
+			tzCookie: "Europe%2FBerlin",
+			wantZone: "CST",
+		},
+		{
+			name:     "Browser zone",
+			email:    "alice@example.com",
+			tzCookie: "Europe%2FBerlin",
+			wantZone: "CE",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			if tt.tzCookie != "" {
+				u, err := url.Parse(ts.URL)
+				assert.NilError(t, err)
+				ts.Client().Jar.SetCookies(u, []*http.Cookie{{Name: "tz", Value: tt.tzCookie}})
+			}
+			if tt.email != "" {
+				ts.login(t, tt.email, "password")
+			}
+
+			_, _, body := ts.get(t, "/snippet/view/1")
+			assert.StringContains(t, body, `<time datetime="`)
+			// 悬停提示中的完整时间以时区缩写结尾，柏林夏令时和冬令时分别为 CEST 和 CET
+			assert.StringContains(t, body, " "+tt.wantZone)
+		})
+	}
+}
+
+func TestAccountPreferences(t *testing.T) {
+	tests := []struct {
+		name     string
+		timezone string
+		wantCode int
+	}{
+		{
+			name:     "Valid zone",
+			timezone: "Europe/Berlin",
+			wantCode: http.StatusSeeOther,
+		},
+		{
+			name:     "Automatic",
+			timezone: "",
+			wantCode: http.StatusSeeOther,
+		},
+		{
+			name:     "Invalid zone",
+			timezone: "Mars/Olympus_Mons",
+			wantCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:     "Server local zone",
+			timezone: "Local",
+			wantCode: http.StatusUnprocessableEntity,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			csrfToken := ts.login(t, "alice@example.com", "password")
+
+			form := url.Values{}
+			form.Add("csrf_token", csrfToken)
+			form.Add("timezone", tt.timezone)
+			code, _, _ := ts.postForm(t, "/account/preferences", form)
+			assert.Equal(t, code, tt.wantCode)
+		})
+	}
+}
+
+func TestLocale(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptLanguage string
+		localeCookie   string
+		wantLang       string
+		wantBody       string
+	}{
+		{
+			name:     "Default",
+			wantLang: "en",
+			wantBody: "Latest Snippets",
+		},
+		{
+			name:           "Accept-Language",
+			acceptLanguage: "zh-CN,zh;q=0.9,en;q=0.8",
+			wantLang:       "zh-CN",
+			wantBody:       "最新片段",
+		},
+		{
+			name:           "Base language match",
+			acceptLanguage: "fr-FR, zh-TW;q=0.5",
+			wantLang:       "zh-CN",
+			wantBody:       "最新片段",
+		},
+		{
+			name:           "Unsupported language",
+			acceptLanguage: "fr-FR, de;q=0.5",
+			wantLang:       "en",
+			wantBody:       "Latest Snippets",
+		},
+		{
+			name:           "Cookie overrides header",
+			acceptLanguage: "zh-CN",
+			localeCookie:   "en",
+			wantLang:       "en",
+			wantBody:       "Latest Snippets",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+			assert.NilError(t, err)
+			if tt.acceptLanguage != "" {
+				req.Header.Set("Accept-Language", tt.acceptLanguage)
+			}
+			if tt.localeCookie != "" {
+				req.AddCookie(&http.Cookie{Name: "locale", Value: tt.localeCookie})
+			}
+			rs, err := ts.Client().Do(req)
+			assert.NilError(t, err)
+			defer rs.Body.Close()
+			body, err := io.ReadAll(rs.Body)
+			assert.NilError(t, err)
+
+			assert.StringContains(t, string(body), "<html lang='"+tt.wantLang+"'>")
+			assert.StringContains(t, string(body), tt.wantBody)
+		})
+	}
+}
+
+func TestSetLocale(t *testing.T) {
+	tests := []struct {
+		name         string
+		locale       string
+		next         string
+		wantCode     int
+		wantLocation string
+	}{
+		{
+			name:         "Chinese",
+			locale:       "zh-CN",
+			next:         "/about",
+			wantCode:     http.StatusSeeOther,
+			wantLocation: "/about",
+		},
+		{
+			name:         "Case insensitive",
+			locale:       "zh-cn",
+			next:         "/snippet/view/1?x=1",
+			wantCode:     http.StatusSeeOther,
+			wantLocation: "/snippet/view/1?x=1",
+		},
+		{
+			name:         "Off-site next",
+			locale:       "en",
+			next:         "//evil.example.com/",
+			wantCode:     http.StatusSeeOther,
+			wantLocation: "/",
+		},
+		{
+			name:     "Unknown locale",
+			locale:   "klingon",
+			next:     "/",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			_, _, body := ts.get(t, "/")
+			form := url.Values{}
+			form.Add("csrf_token", extractCSRFToken(t, body))
+			form.Add("locale", tt.locale)
+			form.Add("next", tt.next)
+			code, header, _ := ts.postForm(t, "/locale", form)
+			assert.Equal(t, code, tt.wantCode)
+			if tt.wantLocation == "" {
+				return
+			}
+			assert.Equal(t, header.Get("Location"), tt.wantLocation)
+
+			// 之后的页面都使用新选择的语言
+			_, _, body = ts.get(t, "/")
+			if tt.locale == "en" {
+				assert.StringContains(t, body, "Latest Snippets")
+			} else {
+				assert.StringContains(t, body, "最新片段")
+			}
+		})
+	}
+}
+
+func TestTranslatedValidationErrors(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	assert.NilError(t, err)
+	ts.Client().Jar.SetCookies(u, []*http.Cookie{{Name: "locale", Value: "zh-CN"}})
+	csrfToken := ts.login(t, "alice@example.com", "password")
+
+	form := url.Values{}
+	form.Add("csrf_token", csrfToken)
+	form.Add("title", "")
+	form.Add("content", strings.Repeat("a", 10))
+	form.Add("expires", "7")
+	code, _, body := ts.postForm(t, "/snippet/create", form)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.StringContains(t, body, "此项不能为空")
+
+	form.Set("title", strings.Repeat("a", 101))
+	_, _, body = ts.postForm(t, "/snippet/create", form)
+	assert.StringContains(t, body, "此项不能超过 100 个字符")
+}
+
+func TestOIDCLogin(t *testing.T) {
+	tests := []struct {
+		name         string
+		identity     oidctest.Identity
+		nonce        string
+		tamperState  bool
+		wantCode     int
+		wantLocation string
+		wantBody     string
+	}{
+		{
+			name:         "Existing user with verified email",
+			identity:     oidctest.Identity{Subject: "s-carol", Email: "carol@example.com", EmailVerified: true},
+			wantCode:     http.StatusSeeOther,
+			wantLocation: "/snippet/create",
+		},
+		{
+			name:         "New user",
+			identity:     oidctest.Identity{Subject: "s-new", Email: "new@example.com", EmailVerified: true, Name: "New User"},
+			wantCode:     http.StatusSeeOther,
+			wantLocation: "/snippet/create",
+		},
+		{
+			name:         "Already linked identity with two-factor",
+			identity:     oidctest.Identity{Subject: mocks.LinkedSubject, Email: "changed@example.com"},
+			wantCode:     http.StatusSeeOther,
+			wantLocation: "/user/login/totp",
+		},
+		{
+			name:     "Unverified email",
+			identity: oidctest.Identity{Subject: "s-bob", Email: "bob@example.com", EmailVerified: false},
+			wantCode: http.StatusForbidden,
+			wantBody: "has not verified your email address",
+		},
+		{
+			name:     "Disabled user",
+			identity: oidctest.Identity{Subject: "s-dave", Email: "dave@example.com", EmailVerified: true},
+			wantCode: http.StatusForbidden,
+			wantBody: "This account has been disabled.",
+		},
+		{
+			name:     "Nonce mismatch",
+			identity: oidctest.Identity{Subject: "s-carol", Email: "carol@example.com", EmailVerified: true},
+			nonce:    "replayed-nonce",
+			wantCode: http.StatusUnauthorized,
+			wantBody: "Single sign-on failed.",
+		},
+		{
+			name:        "State mismatch",
+			identity:    oidctest.Identity{Subject: "s-carol", Email: "carol@example.com", EmailVerified: true},
+			tamperState: true,
+			wantCode:    http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := oidctest.NewProvider(t)
+			provider.SetIdentity(tt.identity)
+			provider.SetNonceOverride(tt.nonce)
+
+			app := newTestApplication(t)
+			app.oidc = oidc.NewProvider(oidc.Config{
+				Issuer:       provider.Issuer(),
+				ClientID:     oidctest.ClientID,
+				ClientSecret: oidctest.ClientSecret,
+			})
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+			app.cfg.oidc.redirectURL = ts.URL + "/auth/oidc/callback"
+
+			code, header, _ := ts.get(t, "/auth/oidc/login")
+			assert.Equal(t, code, http.StatusFound)
+			authURL := header.Get("Location")
+			assert.StringContains(t, authURL, provider.Issuer()+"/authorize?")
+			assert.StringContains(t, authURL, "code_challenge_method=S256")
+
+			// 提供方登录完成后把浏览器重定向回回调地址
+			rs, err := ts.Client().Get(authURL)
+			assert.NilError(t, err)
+			rs.Body.Close()
+			callback, err := url.Parse(rs.Header.Get("Location"))
+			assert.NilError(t, err)
+			if tt.tamperState {
+				q := callback.Query()
+				q.Set("state", "forged")
+				callback.RawQuery = q.Encode()
+			}
+
+			code, header, body := ts.get(t, callback.RequestURI())
+			assert.Equal(t, code, tt.wantCode)
+			if tt.wantLocation != "" {
+				assert.Equal(t, header.Get("Location"), tt.wantLocation)
+			}
+			if tt.wantBody != "" {
+				assert.StringContains(t, body, tt.wantBody)
+			}
+
+			// state 只能使用一次，重放同一个回调会被拒绝
+			code, _, _ = ts.get(t, callback.RequestURI())
+			assert.Equal(t, code, http.StatusBadRequest)
+		})
+	}
+}
+
+func TestRememberMeAbandonedTwoFactor(t *testing.T) {
+	provider := oidctest.NewProvider(t)
+	provider.SetIdentity(oidctest.Identity{Subject: "s-carol", Email: "carol@example.com", EmailVerified: true})
+
+	app := newTestApplication(t)
+	app.oidc = oidc.NewProvider(oidc.Config{
+		Issuer:       provider.Issuer(),
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+	})
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+	app.cfg.oidc.redirectURL = ts.URL + "/auth/oidc/callback"
+
+	// bob 勾选"记住我"输入了密码，但没有完成两步验证
+	_, _, body := ts.get(t, "/user/login")
+	form := url.Values{}
+	form.Add("email", "bob@example.com")
+	form.Add("password", "password")
+	form.Add("remember", "true")
+	form.Add("csrf_token", extractCSRFToken(t, body))
+	code, header, _ := ts.postForm(t, "/user/login", form)
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/user/login/totp")
+
+	// 同一个浏览器接着通过单点登录以 carol 的身份登录，不应该得到她没有要求的"记住我"令牌
+	_, header, _ = ts.get(t, "/auth/oidc/login")
+	rs, err := ts.Client().Get(header.Get("Location"))
+	assert.NilError(t, err)
+	rs.Body.Close()
+	callback, err := url.Parse(rs.Header.Get("Location"))
+	assert.NilError(t, err)
+	code, header, _ = ts.get(t, callback.RequestURI())
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/snippet/create")
+	assert.Equal(t, ts.cookie(t, rememberCookie), "")
+}
+
+func TestAccountDeleteReauth(t *testing.T) {
+	tests := []struct {
+		name         string
+		subject      string
+		wantFlash    string
+		wantDeleteOK bool
+	}{
+		{
+			name:         "Identity linked to the current user",
+			subject:      mocks.LinkedSubject,
+			wantFlash:    "Your identity has been confirmed.",
+			wantDeleteOK: true,
+		},
+		{
+			name:      "Identity of someone else",
+			subject:   "s-other",
+			wantFlash: "Your identity could not be confirmed.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := oidctest.NewProvider(t)
+			provider.SetIdentity(oidctest.Identity{Subject: tt.subject, Email: "bob@example.com", EmailVerified: true})
+
+			app := newTestApplication(t)
+			app.oidc = oidc.NewProvider(oidc.Config{
+				Issuer:       provider.Issuer(),
+				ClientID:     oidctest.ClientID,
+				ClientSecret: oidctest.ClientSecret,
+			})
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+			app.cfg.oidc.redirectURL = ts.URL + "/auth/oidc/callback"
+
+			// bob 开启了两步验证，登录时还要输入验证码
+			csrfToken := ts.login(t, "bob@example.com", "password")
+			validCode, err := totp.GenerateCode(mocks.TOTPSecret, time.Now())
+			assert.NilError(t, err)
+			form := url.Values{}
+			form.Add("code", validCode)
+			form.Add("csrf_token", csrfToken)
+			code, _, _ := ts.postForm(t, "/user/login/totp", form)
+			assert.Equal(t, code, http.StatusSeeOther)
+
+			_, _, body := ts.get(t, "/account/delete")
+			assert.StringContains(t, body, "<form action='/account/delete/reauth' method='POST'>")
+
+			form = url.Values{}
+			form.Add("csrf_token", csrfToken)
+			code, header, _ := ts.postForm(t, "/account/delete/reauth", form)
+			assert.Equal(t, code, http.StatusFound)
+			authURL := header.Get("Location")
+			assert.StringContains(t, authURL, "prompt=login")
+
+			rs, err := ts.Client().Get(authURL)
+			assert.NilError(t, err)
+			rs.Body.Close()
+			callback, err := url.Parse(rs.Header.Get("Location"))
+			assert.NilError(t, err)
+			code, header, _ = ts.get(t, callback.RequestURI())
+			assert.Equal(t, code, http.StatusSeeOther)
+			assert.Equal(t, header.Get("Location"), "/account/delete")
+
+			_, _, body = ts.get(t, "/account/delete")
+			assert.StringContains(t, body, tt.wantFlash)
+
+			// 不输入密码提交删除
+			form = url.Values{}
+			form.Add("csrf_token", csrfToken)
+			form.Add("snippets", "delete")
+			code, _, _ = ts.postForm(t, "/account/delete", form)
+			if tt.wantDeleteOK {
+				assert.Equal(t, code, http.StatusSeeOther)
+			} else {
+				assert.Equal(t, code, http.StatusUnprocessableEntity)
+			}
+		})
+	}
+}
+
+func TestOIDCNotConfigured(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	code, _, body := ts.get(t, "/user/login")
+	assert.Equal(t, code, http.StatusOK)
+	if strings.Contains(body, "/auth/oidc/login") {
+		t.Error("login page links to single sign-on although it is not configured")
+	}
+
+	code, _, _ = ts.get(t, "/auth/oidc/login")
+	assert.Equal(t, code, http.StatusNotFound)
+}
+
+func TestRememberMe(t *testing.T) {
+	app := newTestApplication(t)
+	tokens := app.rememberTokens.(*mocks.RememberTokenModel)
+
+	// loginRemembered 勾选"记住我"登录，返回 cookie 中的 "系列:令牌"
+	loginRemembered := func(t *testing.T, ts *testServer) string {
+		_, _, body := ts.get(t, "/user/login")
+		form := url.Values{}
+		form.Add("email", "alice@example.com")
+		form.Add("password", "password")
+		form.Add("remember", "true")
+		form.Add("csrf_token", extractCSRFToken(t, body))
+		code, _, _ := ts.postForm(t, "/user/login", form)
+		assert.Equal(t, code, http.StatusSeeOther)
+		value := ts.cookie(t, rememberCookie)
+		if value == "" {
+			t.Fatal("expected a remember-me cookie")
+		}
+		return value
+	}
+
+	t.Run("Not remembered", func(t *testing.T) {
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+		ts.login(t, "alice@example.com", "password")
+		assert.Equal(t, ts.cookie(t, rememberCookie), "")
+	})
+
+	t.Run("Expired session logs in again and rotates", func(t *testing.T) {
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+		first := loginRemembered(t, ts)
+
+		ts.expireSession(t)
+		code, _, _ := ts.get(t, "/account/view")
+		assert.Equal(t, code, http.StatusOK)
+		second := ts.cookie(t, rememberCookie)
+		series, _, _ := strings.Cut(first, ":")
+		assert.StringContains(t, second, series+":")
+		if second == first {
+			t.Fatal("expected the token to be rotated")
+		}
+	})
+
+	t.Run("Concurrent request with previous token", func(t *testing.T) {
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+		first := loginRemembered(t, ts)
+		ts.expireSession(t)
+		ts.get(t, "/account/view")
+
+		// 另一个几乎同时发出的请求还带着旧令牌
+		other := newTestServer(t, app.routes())
+		defer other.Close()
+		other.setCookie(t, rememberCookie, first)
+		code, _, _ := other.get(t, "/account/view")
+		assert.Equal(t, code, http.StatusOK)
+	})
+
+	t.Run("Reused token revokes everything", func(t *testing.T) {
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+		first := loginRemembered(t, ts)
+		series, _, _ := strings.Cut(first, ":")
+		ts.expireSession(t)
+		ts.get(t, "/account/view")
+		tokens.Backdate(series, time.Minute)
+
+		// 攻击者复制了旧的 cookie，在宽限期之后使用
+		thief := newTestServer(t, app.routes())
+		defer thief.Close()
+		thief.setCookie(t, rememberCookie, first)
+		code, header, _ := thief.get(t, "/account/view")
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "/user/login")
+		_, _, body := thief.get(t, "/user/login")
+		assert.StringContains(t, body, "logged out everywhere")
+
+		// 合法用户的令牌也被撤销了
+		_, err := tokens.Get(context.Background(), series)
+		assert.Equal(t, err, models.ErrNoRecord)
+		ts.expireSession(t)
+		code, _, _ = ts.get(t, "/account/view")
+		assert.Equal(t, code, http.StatusSeeOther)
+	})
+
+	t.Run("Idle timeout", func(t *testing.T) {
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+		value := loginRemembered(t, ts)
+		series, _, _ := strings.Cut(value, ":")
+		tokens.Backdate(series, 8*24*time.Hour)
+
+		ts.expireSession(t)
+		code, _, _ := ts.get(t, "/account/view")
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, ts.cookie(t, rememberCookie), "")
+	})
+
+	t.Run("Revoking a renewed session forgets its token", func(t *testing.T) {
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+		loginRemembered(t, ts)
+
+		// 先在这个浏览器上"退出其他设备"，当前会话因此换了新令牌
+		_, _, body := ts.get(t, "/account/sessions")
+		form := url.Values{}
+		form.Add("csrf_token", extractCSRFToken(t, body))
+		code, _, _ := ts.postForm(t, "/account/sessions/revoke-others", form)
+		assert.Equal(t, code, http.StatusSeeOther)
+
+		// 然后从另一台设备撤销这个新令牌对应的会话，"记住我"cookie 不能再把浏览器登录回来
+		err := app.revokeUserSession(context.Background(), ts.cookie(t, "session"))
+		assert.NilError(t, err)
+		code, header, _ := ts.get(t, "/account/view")
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "/user/login")
+	})
+
+	t.Run("Logout forgets the token", func(t *testing.T) {
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+		value := loginRemembered(t, ts)
+		_, _, body := ts.get(t, "/account/view")
+
+		form := url.Values{}
+		form.Add("csrf_token", extractCSRFToken(t, body))
+		code, _, _ := ts.postForm(t, "/user/logout", form)
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, ts.cookie(t, rememberCookie), "")
+
+		series, _, _ := strings.Cut(value, ":")
+		_, err := tokens.Get(context.Background(), series)
+		assert.Equal(t, err, models.ErrNoRecord)
+	})
+}
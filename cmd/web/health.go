@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// pinger 是 *sql.DB 中就绪检查用到的方法，测试中可以替换
+type pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// healthCheck 是就绪检查中的一项。check 必须在 ctx 结束时尽快返回。
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// checkResult 是一项检查的结果，latency 以毫秒为单位。Status 为 ok、timeout 或 unavailable；
+// /readyz 不需要认证，具体的错误（可能包含 DSN 中的主机、驱动和 TLS 信息）只写入日志，不返回给客户端。
+type checkResult struct {
+	Status  string  `json:"status"`
+	Latency float64 `json:"latency_ms"`
+	err     error
+}
+
+// healthReport 是 /readyz 返回的 JSON
+type healthReport struct {
+	Status    string                 `json:"status"`
+	CheckedAt time.Time              `json:"checked_at"`
+	Checks    map[string]checkResult `json:"checks"`
+}
+
+// healthChecker 运行就绪检查并把结果缓存 ttl 这么久。探针再频繁，数据库每 ttl 最多也只被 ping 一次；
+// 缓存过期时同时到达的请求会等待同一次检查，而不是各自发起一次。
+type healthChecker struct {
+	logger  *slog.Logger
+	checks  []healthCheck
+	timeout time.Duration
+	ttl     time.Duration
+	// 当前时间，测试中可以替换
+	now func() time.Time
+
+	mu      sync.Mutex
+	report  *healthReport
+	expires time.Time
+}
+
+func newHealthChecker(logger *slog.Logger, timeout, ttl time.Duration, checks ...healthCheck) *healthChecker {
+	return &healthChecker{logger: logger, checks: checks, timeout: timeout, ttl: ttl, now: time.Now}
+}
+
+// Report 返回缓存的检查结果，缓存过期时重新检查。各项检查并发进行，每项最多等待 timeout。
+func (hc *healthChecker) Report(ctx context.Context) *healthReport {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.report != nil && hc.now().Before(hc.expires) {
+		return hc.report
+	}
+
+	// 检查结果会共享给其他请求，不能因为发起这次检查的客户端断开连接而中止
+	ctx = context.WithoutCancel(ctx)
+	report := &healthReport{Status: "ok", CheckedAt: hc.now().UTC(), Checks: make(map[string]checkResult, len(hc.checks))}
+	results := make([]checkResult, len(hc.checks))
+	var wg sync.WaitGroup
+	for i, c := range hc.checks {
+		wg.Add(1)
+		go func(i int, c healthCheck) {
+			defer wg.Done()
+			results[i] = hc.run(ctx, c)
+		}(i, c)
+	}
+	wg.Wait()
+	for i, c := range hc.checks {
+		report.Checks[c.name] = results[i]
+		// 只在真正检查时记录失败，返回缓存结果时不重复记录
+		if results[i].Status != "ok" {
+			report.Status = "fail"
+			hc.logger.WarnContext(ctx, "readiness check failed", "check", c.name, "status", results[i].Status, "error", results[i].err)
+		}
+	}
+
+	hc.report = report
+	hc.expires = hc.now().Add(hc.ttl)
+	return report
+}
+
+// run 执行一项检查。有的检查（例如会话存储）不接受上下文，所以在单独的 goroutine 中运行，
+// 超时后不再等待它返回。
+func (hc *healthChecker) run(ctx context.Context, c healthCheck) checkResult {
+	ctx, cancel := context.WithTimeout(ctx, hc.timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	result := checkResult{Status: "ok", Latency: float64(time.Since(start).Microseconds()) / 1000}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		result.Status = "timeout"
+		result.err = err
+	case err != nil:
+		result.Status = "unavailable"
+		result.err = err
+	}
+	return result
+}
+
+// readinessChecks 返回 /readyz 检查的依赖：数据库连接、会话存储、模板缓存，以及启用了日志文件时日志目录是否可写。
+func (app *application) readinessChecks() []healthCheck {
+	checks := []healthCheck{
+		{name: "database", check: func(ctx context.Context) error {
+			return app.db.PingContext(ctx)
+		}},
+		{name: "session_store", check: func(ctx context.Context) error {
+			// 查找一个不存在的令牌，只要存储能正常响应即可，找不到不算错误
+			_, _, err := app.sessionManager.Store.Find("readyz-probe")
+			return err
+		}},
+		{name: "templates", check: func(ctx context.Context) error {
+			if len(app.templateCache) == 0 {
+				return errors.New("template cache is empty")
+			}
+			return nil
+		}},
+	}
+	if app.cfg.log.file != "" {
+		dir := filepath.Dir(app.cfg.log.file)
+		checks = append(checks, healthCheck{name: "log_dir", check: func(ctx context.Context) error {
+			return checkWritable(dir)
+		}})
+	}
+	return checks
+}
+
+// checkWritable 在 dir 中创建并删除一个临时文件，确认磁盘可写（目录存在、有权限、没有写满或被挂载为只读）。
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_, err = f.Write([]byte("ok"))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(name); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// healthz 是存活检查：只要进程还能处理请求就返回 200，不检查任何依赖。
+// 依赖出问题时重启进程也无济于事，那是 /readyz 的职责。
+func (app *application) healthz(w http.ResponseWriter, r *http.Request) {
+	app.writeJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz 是就绪检查：所有依赖都正常时返回 200，否则返回 503 和每一项检查的结果。
+// 收到关闭信号后直接返回 503，和 /ping 一样让负载均衡器摘除实例。
+func (app *application) readyz(w http.ResponseWriter, r *http.Request) {
+	if app.shuttingDown.Load() {
+		app.writeJSON(w, r, http.StatusServiceUnavailable, map[string]string{"status": "shutting_down"})
+		return
+	}
+	report := app.readiness.Report(r.Context())
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	app.writeJSON(w, r, status, report)
+}
+
+// writeJSON 把 v 编码为 JSON 写入响应。探针的结果不应被缓存。
+func (app *application) writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		app.serverError(w, r, fmt.Errorf("encoding health report: %w", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(b)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/hlf2016/snippetbox/internal/assert"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthz(t *testing.T) {
+	app := newTestApplication(t)
+	// 存活检查不关心依赖：数据库不可用时也返回 200
+	app.db = &testDB{err: errors.New("connection refused")}
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	code, header, body := ts.get(t, "/healthz")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, header.Get("Content-Type"), "application/json")
+	assert.Equal(t, body, `{"status":"ok"}`)
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name       string
+		dbErr      error
+		logFile    string
+		wantCode   int
+		wantStatus map[string]string
+	}{
+		{
+			name:       "Healthy",
+			wantCode:   http.StatusOK,
+			wantStatus: map[string]string{"database": "ok", "session_store": "ok", "templates": "ok"},
+		},
+		{
+			name:       "Database down",
+			dbErr:      errors.New("connection refused"),
+			wantCode:   http.StatusServiceUnavailable,
+			wantStatus: map[string]string{"database": "unavailable", "session_store": "ok", "templates": "ok"},
+		},
+		{
+			name:       "Log directory writable",
+			logFile:    filepath.Join(t.TempDir(), "info.log"),
+			wantCode:   http.StatusOK,
+			wantStatus: map[string]string{"database": "ok", "log_dir": "ok"},
+		},
+		{
+			name:       "Log directory missing",
+			logFile:    filepath.Join(t.TempDir(), "missing", "info.log"),
+			wantCode:   http.StatusServiceUnavailable,
+			wantStatus: map[string]string{"database": "ok", "log_dir": "unavailable"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.db = &testDB{err: tt.dbErr}
+			app.cfg.log.file = tt.logFile
+			app.readiness = newHealthChecker(app.logger, time.Second, 0, app.readinessChecks()...)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			code, _, body := ts.get(t, "/readyz")
+			assert.Equal(t, code, tt.wantCode)
+
+			var report healthReport
+			err := json.Unmarshal([]byte(body), &report)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.wantStatus {
+				assert.Equal(t, report.Checks[name].Status, want)
+			}
+			// 错误详情只写入日志，不出现在响应中
+			if strings.Contains(body, "connection refused") || strings.Contains(body, "no such file") {
+				t.Errorf("response leaks error details: %q", body)
+			}
+		})
+	}
+}
+
+func TestReadyzShuttingDown(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	app.shuttingDown.Store(true)
+	code, _, body := ts.get(t, "/readyz")
+	assert.Equal(t, code, http.StatusServiceUnavailable)
+	assert.Equal(t, body, `{"status":"shutting_down"}`)
+}
+
+func TestHealthCheckerCache(t *testing.T) {
+	var calls int
+	hc := newHealthChecker(slog.New(slog.NewTextHandler(io.Discard, nil)), time.Second, 5*time.Second, healthCheck{
+		name: "counter",
+		check: func(ctx context.Context) error {
+			calls++
+			return nil
+		},
+	})
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	hc.now = func() time.Time { return now }
+
+	hc.Report(context.Background())
+	hc.Report(context.Background())
+	assert.Equal(t, calls, 1)
+
+	// 缓存过期后重新检查
+	now = now.Add(5 * time.Second)
+	report := hc.Report(context.Background())
+	assert.Equal(t, calls, 2)
+	assert.Equal(t, report.CheckedAt, now)
+}
+
+func TestHealthCheckerTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	hc := newHealthChecker(slog.New(slog.NewTextHandler(io.Discard, nil)), 10*time.Millisecond, 0, healthCheck{
+		name: "stuck",
+		// 模拟不理会上下文的检查，例如卡住的会话存储
+		check: func(ctx context.Context) error {
+			<-release
+			return nil
+		},
+	})
+
+	report := hc.Report(context.Background())
+	assert.Equal(t, report.Status, "fail")
+	assert.Equal(t, report.Checks["stuck"].Status, "timeout")
+}
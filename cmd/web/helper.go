@@ -2,19 +2,45 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/go-playground/form/v4"
+	"github.com/hlf2016/snippetbox/internal/models"
 	"github.com/justinas/nosurf"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"net/http"
+	"path/filepath"
+	"runtime"
 	"runtime/debug"
+	"strings"
 	"time"
 )
 
-// serverError 辅助程序会将错误信息和堆栈跟踪写入 errorLog，然后向用户发送通用的 500 内部服务器错误响应。
-func (app *application) serverError(w http.ResponseWriter, err error) {
-	trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
-	app.errorLogger.Output(2, trace)
+// serverError 辅助程序会将错误信息和堆栈跟踪连同请求 ID 写入日志，然后向用户发送通用的 500 内部服务器错误响应。
+func (app *application) serverError(w http.ResponseWriter, r *http.Request, err error) {
+	// 把错误记录到当前 span 上，在追踪界面中能直接看到出错的是哪一层
+	span := trace.SpanFromContext(r.Context())
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+
+	stack := debug.Stack()
+	trace := fmt.Sprintf("%s\n%s", err.Error(), stack)
+	// 记录调用 serverError 的位置（相当于原来 Output(2, ...) 加 Lshortfile 的效果），否则日志中只能看到 helper.go
+	_, file, line, _ := runtime.Caller(1)
+	app.logger.ErrorContext(r.Context(), err.Error(),
+		"source", fmt.Sprintf("%s:%d", filepath.Base(file), line),
+		"method", r.Method,
+		"uri", r.URL.RequestURI(),
+		"trace", string(stack),
+	)
+
+	// 数据库查询超时通常是暂时的（数据库繁忙或连接池耗尽），返回 503 和友好的提示页面，而不是通用的 500
+	if errors.Is(err, context.DeadlineExceeded) {
+		app.serviceUnavailable(w, r)
+		return
+	}
 
 	if app.cfg.debug {
 		http.Error(w, trace, http.StatusInternalServerError)
@@ -24,6 +50,25 @@ func (app *application) serverError(w http.ResponseWriter, err error) {
 	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
 
+// serviceUnavailable 发送 503 响应和提示用户稍后重试的页面，Retry-After 标头告诉客户端多久之后再试。
+// serverError 可能在会话载入之前被调用，所以这里不使用 newTemplateData（它会读取会话中的闪现消息）。
+func (app *application) serviceUnavailable(w http.ResponseWriter, r *http.Request) {
+	data := &templateData{
+		CurrentYear:     time.Now().Year(),
+		IsAuthenticated: app.isAuthenticated(r),
+		IsAdmin:         app.hasRole(r, models.RoleAdmin),
+		CurrentUser:     app.currentUser(r),
+		Location:        app.location(r),
+		Locale:          app.locale(r),
+		Locales:         app.localeOptions(),
+		CurrentPath:     r.URL.RequestURI(),
+		OIDCEnabled:     app.oidc != nil,
+		CSRFToken:       nosurf.Token(r),
+	}
+	w.Header().Set("Retry-After", "5")
+	app.render(w, r, http.StatusServiceUnavailable, "unavailable.tmpl", data)
+}
+
 // clientError 辅助程序会向用户发送特定的状态代码和相应的描述。
 // 在本书的后面部分，当用户发送的请求出现问题时，我们将使用它来发送类似 400 "Bad Request（错误请求）"的响应。
 func (app *application) clientError(w http.ResponseWriter, status int) {
@@ -35,19 +80,23 @@ func (app *application) notFound(w http.ResponseWriter) {
 	app.clientError(w, http.StatusNotFound)
 }
 
-func (app *application) render(w http.ResponseWriter, status int, page string, data *templateData) {
+func (app *application) render(w http.ResponseWriter, r *http.Request, status int, page string, data *templateData) {
 	ts, ok := app.templateCache[page]
 	if !ok {
 		err := fmt.Errorf("the template %s doesn't exist", page)
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 
 	buf := new(bytes.Buffer)
 	// 将模板写入缓冲区，而不是直接写入 http.ResponseWriter。如果出现错误，则调用我们的 serverError() 辅助程序，然后返回。
+	_, span := app.tracer.Start(r.Context(), "render "+page)
+	start := time.Now()
 	err := ts.ExecuteTemplate(buf, "base", data)
+	app.metrics.renderDuration.WithLabelValues(page).Observe(time.Since(start).Seconds())
+	span.End()
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 	// 如果模板在写入缓冲区时没有出现任何错误，我们就可以继续将 HTTP 状态代码写入 http.ResponseWriter 中。
@@ -55,12 +104,12 @@ func (app *application) render(w http.ResponseWriter, status int, page string, d
 	// 将缓冲区的内容写入 http.ResponseWriter。注意：这又是一次我们将 http.ResponseWriter 传递给接收 io.Writer 的函数的情况。
 	_, err = buf.WriteTo(w)
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 	}
 	// 直接渲染
 	//err := ts.ExecuteTemplate(w, "base", data)
 	//if err != nil {
-	//	app.serverError(w, err)
+	//	app.serverError(w, r, err)
 	//}
 }
 
@@ -69,6 +118,13 @@ func (app *application) newTemplateData(r *http.Request) *templateData {
 		CurrentYear:     time.Now().Year(),
 		Flash:           app.sessionManager.PopString(r.Context(), "flash"),
 		IsAuthenticated: app.isAuthenticated(r),
+		IsAdmin:         app.hasRole(r, models.RoleAdmin),
+		CurrentUser:     app.currentUser(r),
+		Location:        app.location(r),
+		Locale:          app.locale(r),
+		Locales:         app.localeOptions(),
+		CurrentPath:     r.URL.RequestURI(),
+		OIDCEnabled:     app.oidc != nil,
 		// 所有页面数据上都加入 CSRFToken 便于每个页面上使用
 		CSRFToken: nosurf.Token(r),
 	}
@@ -101,3 +157,80 @@ func (app *application) isAuthenticated(r *http.Request) bool {
 	}
 	return isAuthenticated
 }
+
+// currentUser 返回 authenticate 中间件载入的当前用户，未登录时返回 nil。
+func (app *application) currentUser(r *http.Request) *models.User {
+	user, ok := r.Context().Value(authenticatedUserContextKey).(*models.User)
+	if !ok {
+		return nil
+	}
+	return user
+}
+
+func (app *application) hasRole(r *http.Request, role models.Role) bool {
+	user := app.currentUser(r)
+	return user != nil && user.Role.AtLeast(role)
+}
+
+// canModifySnippet 判断当前用户能否修改或删除片段：创建者本人可以，版主和管理员可以处理任何人的片段。
+func (app *application) canModifySnippet(r *http.Request, snippet *models.Snippet) bool {
+	user := app.currentUser(r)
+	if user == nil {
+		return false
+	}
+	if snippet.UserID != 0 && snippet.UserID == user.ID {
+		return true
+	}
+	return user.Role.AtLeast(models.RoleModerator)
+}
+
+// absoluteURL 把站内路径转换为基于 -base-url 的完整地址，用于邮件这类离开浏览器的链接。
+func (app *application) absoluteURL(path string) string {
+	return strings.TrimSuffix(app.cfg.baseURL, "/") + path
+}
+
+// completeLogin 把通过全部验证步骤的用户写入会话，然后跳转到登录前想访问的页面（默认为创建片段页面）。
+// email 是登录限流使用的账号，登录完成后才清除它的失败记录；不经过限流的登录方式（OIDC）传空字符串。
+// remember 为 true 时签发"记住我"令牌，只有密码登录的表单上有这个选项。
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, userID int, email string, remember bool) {
+	// 对当前会话使用 RenewToken() 方法更改会话 ID。当用户的身份验证状态或权限级别发生变化（如登录和注销操作）时，生成一个新的会话 ID 不失为一种好的做法。
+	err := app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	//	将当前用户的 ID 添加到会话中，这样他们就 "登录 "了。
+	app.sessionManager.Put(r.Context(), app.authId, userID)
+	app.metrics.logins.Inc()
+
+	// 记录设备信息，用户可以在 /account/sessions 页面查看并撤销这个会话
+	err = app.recordUserSession(r, userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if remember {
+		err = app.issueRememberToken(w, r, userID)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	if email != "" {
+		err = app.loginSucceeded(email)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	redirectUrlPath := "/snippet/create"
+	targetUrlPath := app.sessionManager.PopString(r.Context(), "targetUrlPath")
+	if targetUrlPath != "" {
+		redirectUrlPath = targetUrlPath
+	}
+	http.Redirect(w, r, redirectUrlPath, http.StatusSeeOther)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hlf2016/snippetbox/internal/i18n"
+	"github.com/hlf2016/snippetbox/internal/validator"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// 找不到合适的语言时使用英文，它的消息目录也是最完整的
+const defaultLocale = "en"
+
+// 页脚切换语言时把选择的语言写入这个 cookie，未登录的用户也能记住选择
+const localeCookie = "locale"
+
+// locale 返回本次请求使用的界面语言：已登录用户保存的偏好优先，其次是 locale cookie，最后根据 Accept-Language 请求头匹配。
+// 三者都没有可用的语言时返回 defaultLocale。
+func (app *application) locale(r *http.Request) string {
+	if user := app.currentUser(r); user != nil && user.Locale != "" {
+		if locale := app.translations.Match(user.Locale); locale != "" {
+			return locale
+		}
+	}
+	if c, err := r.Cookie(localeCookie); err == nil {
+		if locale := app.translations.Match(c.Value); locale != "" {
+			return locale
+		}
+	}
+	if locale := app.translations.Match(i18n.ParseAcceptLanguage(r.Header.Get("Accept-Language"))...); locale != "" {
+		return locale
+	}
+	return app.translations.Fallback()
+}
+
+// T 按本次请求的语言翻译 key。
+func (app *application) T(r *http.Request, key string, args ...any) string {
+	return app.translations.T(app.locale(r), key, args...)
+}
+
+// flash 把 key 翻译成本次请求的语言后存入会话，在下一个页面上显示。
+// 翻译在存入时完成而不是显示时，因为显示时用户可能已经退出登录（例如注销后的提示），语言偏好随之丢失。
+func (app *application) flash(r *http.Request, key string, args ...any) {
+	app.sessionManager.Put(r.Context(), "flash", app.T(r, key, args...))
+}
+
+// flashPlural 和 flash 一样，但根据 n 选择单数或复数形式的消息，n 作为第一个格式化参数。
+func (app *application) flashPlural(r *http.Request, key string, n int, args ...any) {
+	app.sessionManager.Put(r.Context(), "flash", app.translations.Plural(app.locale(r), key, n, args...))
+}
+
+// humanDuration 把等待时间翻译成本次请求的语言，例如 "15 minutes"、"15 分钟"。
+func (app *application) humanDuration(r *http.Request, d time.Duration) string {
+	return humanDuration(app.translations, app.locale(r), d)
+}
+
+// translate 是模板中的 T 函数。key 可以是消息键字符串，也可以是 validator 记录的错误消息，这样模板中字段错误的写法是：
+// {{with .Form.FieldErrors.title}}<label class='error'>{{T $.Locale .}}</label>{{end}}
+func translate(b *i18n.Bundle, locale string, key any, args ...any) (string, error) {
+	switch k := key.(type) {
+	case string:
+		return b.T(locale, k, args...), nil
+	case validator.Message:
+		return b.T(locale, k.Key, k.Args...), nil
+	case *validator.Message:
+		if k == nil {
+			return "", nil
+		}
+		return b.T(locale, k.Key, k.Args...), nil
+	default:
+		return "", fmt.Errorf("T: unsupported key type %T", key)
+	}
+}
+
+type localeForm struct {
+	Locale string `form:"locale"`
+	// 切换后返回的页面，只接受站内路径
+	Next string `form:"next"`
+}
+
+// setLocalePost 处理页脚的语言切换表单：把选择写入 cookie，已登录的用户同时保存到偏好设置中，然后返回原来的页面。
+func (app *application) setLocalePost(w http.ResponseWriter, r *http.Request) {
+	var form localeForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	locale := app.translations.Match(form.Locale)
+	if locale == "" {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     localeCookie,
+		Value:    locale,
+		Path:     "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	if user := app.currentUser(r); user != nil {
+		prefs := user.Preferences
+		prefs.Locale = locale
+		err = app.users.SetPreferences(r.Context(), user.ID, prefs)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	http.Redirect(w, r, safeRedirectPath(form.Next), http.StatusSeeOther)
+}
+
+// safeRedirectPath 只接受以单个 "/" 开头的站内路径，防止切换语言的表单被用来跳转到其他网站（开放重定向）。
+func safeRedirectPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	u, err := url.Parse(next)
+	if err != nil || u.Host != "" {
+		return "/"
+	}
+	return next
+}
+
+// localeOption 是模板中语言选择框的一个选项：语言标签以及用该语言书写的名称
+type localeOption struct {
+	Tag  string
+	Name string
+}
+
+func (app *application) localeOptions() []localeOption {
+	var options []localeOption
+	for _, tag := range app.translations.Locales() {
+		options = append(options, localeOption{Tag: tag, Name: app.translations.T(tag, "locale.name")})
+	}
+	return options
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/hlf2016/snippetbox/internal/logfile"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// requestIDHeader 是传递请求 ID 的标头。上游的负载均衡器或网关已经生成时沿用它的值，方便把两边的日志对应起来。
+const requestIDHeader = "X-Request-ID"
+
+// requestIDContextKey 对应的值是当前请求的 ID，由 requestID 中间件写入
+const requestIDContextKey = contextKey("requestID")
+
+// 只接受长度合理、由常见字符组成的请求 ID，其余的一律重新生成，避免客户端往日志里塞任意内容
+var requestIDRX = regexp.MustCompile(`^[A-Za-z0-9._:\-]{1,128}$`)
+
+// newLogger 创建写入 w 的结构化日志记录器。format 为 "json" 或 "text"，level 为 slog 能解析的级别名称，例如 "debug"、"info"。
+// 返回的记录器会把上下文中的请求 ID 自动加到每一行日志上，因此处理请求时应该使用 InfoContext、ErrorContext 等方法。
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q (want json or text)", format)
+	}
+	return slog.New(&contextHandler{h}), nil
+}
+
+// reopenLogOnHangup 在收到 SIGHUP 时重新打开日志文件。logrotate 等工具把日志文件改名后发送 SIGHUP，
+// 程序随即开始写入新的文件，而不是继续写已经改名的旧文件。
+func reopenLogOnHangup(w *logfile.Writer, logger *slog.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		err := w.Reopen()
+		if err != nil {
+			logger.Error("reopening log file", "error", err)
+			continue
+		}
+		logger.Info("reopened log file")
+	}
+}
+
+// contextHandler 在交给下一个 Handler 之前，把上下文中的请求 ID 和追踪 ID 作为 request_id、trace_id 属性加到日志记录上。
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestIDFromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{h.Handler.WithGroup(name)}
+}
+
+// requestIDFromContext 返回 requestID 中间件保存的请求 ID，不在请求中时返回空字符串。
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+func newRequestID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// responseRecorder 包装 http.ResponseWriter，记录写出的状态码和字节数，供访问日志使用。
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (rw *responseRecorder) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.status = status
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseRecorder) Write(b []byte) (int, error) {
+	// 没有显式调用 WriteHeader 时，第一次 Write 会隐式地写出 200
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += n
+	return n, err
+}
+
+// Unwrap 让 http.ResponseController 能够找到底层的 ResponseWriter，以使用 Flush、SetWriteDeadline 等功能。
+func (rw *responseRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
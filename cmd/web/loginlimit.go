@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/hlf2016/snippetbox/internal/i18n"
+	"github.com/hlf2016/snippetbox/internal/limiter"
+	"log/slog"
+	"math"
+	"strings"
+	"time"
+)
+
+// 按账号限制：连续失败 5 次后开始退避，失败 10 次锁定 15 分钟。
+var accountLoginPolicy = limiter.Policy{
+	FreeAttempts:     5,
+	BaseDelay:        time.Second,
+	MaxDelay:         5 * time.Minute,
+	LockoutThreshold: 10,
+	LockoutDuration:  15 * time.Minute,
+	ResetAfter:       time.Hour,
+}
+
+// 按 IP 限制：同一出口 IP 后面可能有很多同事，所以阈值比按账号宽松得多，主要用来挡住撞库和借密码哈希消耗 CPU、内存的攻击。
+var ipLoginPolicy = limiter.Policy{
+	FreeAttempts:     20,
+	BaseDelay:        time.Second,
+	MaxDelay:         5 * time.Minute,
+	LockoutThreshold: 100,
+	LockoutDuration:  time.Hour,
+	ResetAfter:       time.Hour,
+}
+
+// newLoginLimiters 创建按账号和按 IP 计数的两个限流器。store 为 nil 时使用进程内存储。
+func newLoginLimiters(store limiter.Store, logger *slog.Logger) (accounts, ips *limiter.Limiter) {
+	if store == nil {
+		store = limiter.NewMemoryStore()
+	}
+	accounts = limiter.New(accountLoginPolicy, store)
+	accounts.OnLockout = func(key string, until time.Time) {
+		logger.Warn("login locked", "account", strings.TrimPrefix(key, "account:"), "until", until.UTC())
+	}
+	ips = limiter.New(ipLoginPolicy, store)
+	ips.OnLockout = func(key string, until time.Time) {
+		logger.Warn("login locked", "ip", strings.TrimPrefix(key, "ip:"), "until", until.UTC())
+	}
+	return accounts, ips
+}
+
+// 两个限流器共用一个存储，因此键需要加上前缀加以区分。邮箱统一转成小写，避免通过改变大小写绕过限制。
+func accountLimiterKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipLimiterKey(ip string) string {
+	return "ip:" + ip
+}
+
+// loginWait 返回账号和 IP 两个维度中较长的等待时间。
+func (app *application) loginWait(email, ip string) (time.Duration, error) {
+	accountWait, err := app.accountLimiter.Wait(accountLimiterKey(email))
+	if err != nil {
+		return 0, err
+	}
+	ipWait, err := app.ipLimiter.Wait(ipLimiterKey(ip))
+	if err != nil {
+		return 0, err
+	}
+	if ipWait > accountWait {
+		return ipWait, nil
+	}
+	return accountWait, nil
+}
+
+func (app *application) loginFailed(email, ip string) error {
+	_, err := app.accountLimiter.Fail(accountLimiterKey(email))
+	if err != nil {
+		return err
+	}
+	_, err = app.ipLimiter.Fail(ipLimiterKey(ip))
+	return err
+}
+
+// loginSucceeded 只清除账号维度的记录。IP 维度的记录保留，否则攻击者可以穿插登录自己的账号来重置计数。
+func (app *application) loginSucceeded(email string) error {
+	return app.accountLimiter.Reset(accountLimiterKey(email))
+}
+
+// humanDuration 把等待时间向上取整成适合展示给用户的文字，例如 "30 seconds"、"15 minutes"，语言由 locale 决定。
+func humanDuration(b *i18n.Bundle, locale string, d time.Duration) string {
+	if d < time.Minute {
+		return b.Plural(locale, "duration.seconds", int(math.Ceil(d.Seconds())))
+	}
+	return b.Plural(locale, "duration.minutes", int(math.Ceil(d.Minutes())))
+}
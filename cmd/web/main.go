@@ -1,80 +1,224 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"database/sql"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/alexedwards/scs/mysqlstore"
 	"github.com/alexedwards/scs/v2"
 	"github.com/go-playground/form/v4"
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/hlf2016/snippetbox/internal/auth"
+	"github.com/hlf2016/snippetbox/internal/i18n"
+	"github.com/hlf2016/snippetbox/internal/limiter"
+	"github.com/hlf2016/snippetbox/internal/logfile"
+	"github.com/hlf2016/snippetbox/internal/mailer"
 	"github.com/hlf2016/snippetbox/internal/models"
+	"github.com/hlf2016/snippetbox/internal/oidc"
+	"github.com/hlf2016/snippetbox/internal/password"
+	"github.com/hlf2016/snippetbox/internal/validator"
+	"github.com/hlf2016/snippetbox/ui"
+	"go.opentelemetry.io/otel/trace"
 	"html/template"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
+	// 把 IANA 时区数据库编译进程序，部署环境中没有 /usr/share/zoneinfo 时也能加载用户选择的时区
+	_ "time/tzdata"
 )
 
 type application struct {
-	infoLogger     *log.Logger
-	errorLogger    *log.Logger
-	fileInfoLogger *log.Logger
+	// 结构化日志，处理请求时使用 InfoContext、ErrorContext 等方法记录，日志会带上请求 ID
+	logger *slog.Logger
+	// 导出给 Prometheus 的指标
+	metrics *metrics
+	// 创建请求、中间件、处理程序和模板渲染的 span；未启用追踪时什么也不做
+	tracer         trace.Tracer
 	cfg            config
 	snippets       models.SnippetModelInterface
 	users          models.UserModelInterface
-	templateCache  map[string]*template.Template
+	twoFactor      models.TwoFactorModelInterface
+	userSessions   models.UserSessionModelInterface
+	emailChanges   models.EmailChangeModelInterface
+	identities     models.IdentityModelInterface
+	rememberTokens models.RememberTokenModelInterface
+	// 登录时验证邮箱和密码，由 -auth-backends 决定使用数据库、LDAP 目录或两者
+	authenticator auth.Authenticator
+	// 注册和修改密码时新密码需要满足的规则
+	passwordPolicy *validator.PasswordPolicy
+	// 外部 OpenID Connect 提供方，未配置时为 nil
+	oidc          *oidc.Provider
+	mailer        mailer.Mailer
+	templateCache map[string]*template.Template
+	// 界面文字的翻译，消息目录内嵌在 ui/i18n 中
+	translations   *i18n.Bundle
 	formDecoder    *form.Decoder
 	sessionManager *scs.SessionManager
+	// 登录失败次数限制，分别按账号和按客户端 IP 计数
+	accountLimiter *limiter.Limiter
+	ipLimiter      *limiter.Limiter
 	// 存储在 session 中的用于判断用户是否已经登录的key
 	authId string
+	// 由 background 启动的后台任务，关闭服务器时等待它们结束
+	wg sync.WaitGroup
+	// 收到关闭信号后为 true，/ping 随即返回 503
+	shuttingDown atomic.Bool
+	// 数据库连接池，就绪检查用它确认数据库可以连接
+	db pinger
+	// /readyz 的依赖检查，结果会缓存一小段时间
+	readiness *healthChecker
 }
 
-// 聚合 config 设置 然后使用 flag.StringVar 读取环境变量赋值
-type config struct {
-	addr      string
-	staticDir string
-	dsn       string
-	debug     bool
-}
+// errInvalidConfig 表示配置有误，main 按 flag 包的约定以状态码 2 退出。
+var errInvalidConfig = errors.New("invalid configuration")
 
 func main() {
-	var cfg config
-	flag.StringVar(&cfg.addr, "addr", ":4000", "HTTP network address")
-	flag.StringVar(&cfg.staticDir, "static-dir", "./ui/static", "Path to static assets")
-
-	// DSN 中的 parseTime=true 部分是一个特定于驱动程序的参数，它指示我们的驱动程序将 SQL TIME 和 DATE 字段转换为 Go time.Time 对象。
-	flag.StringVar(&cfg.dsn, "dsn", "goweb:25804769@/snippetbox?parseTime=true", "MySQL data source name")
-	// 是否启用 debug 模式 直接在页面上输出错误信息
-	flag.BoolVar(&cfg.debug, "debug", false, "whether in debug mode ")
-	// 重要的是，我们使用 flag.Parse() 函数来解析命令行标志。它会读入命令行标志值并将其赋值给 addr 变量。
-	// 您需要在使用 addr 变量之前调用该函数，否则它将始终包含默认值":4000"。如果在解析过程中遇到任何错误，应用程序将被终止。
-	flag.Parse()
-
-	// 使用 log.New() 创建一个日志记录器，用于写入信息消息。它需要三个参数：写入日志的目的地（os.Stdout）、
-	// 信息的字符串前缀（INFO，后跟一个制表符），以及指示包含哪些附加信息（本地日期和时间）的标志。请注意，这些标志是用位运算符 | 连接起来的。
-	infoLogger := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
-	//:如果想在日志输出中包含完整的文件路径，而不仅仅是文件名，可以在创建自定义日志记录器时使用 log.Llongfile 标志，而不是 log.Lshortfile。
-	// 还可以通过添加 log.LUTC 标志，强制日志记录器使用 UTC 日期（而不是本地日期）。
-	errorLogger := log.New(os.Stdout, "Error\t", log.Ldate|log.Ltime|log.Lshortfile)
-	// 启用文件日志
-	f, err := os.OpenFile("./log/info.log", os.O_RDWR|os.O_CREATE, 0666)
+	err := run()
+	if errors.Is(err, errInvalidConfig) {
+		os.Exit(2)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// run 完成初始化并运行服务器，直到收到关闭信号。os.Exit 不会执行 defer，所以程序的主体放在这里，
+// 无论从哪里返回，数据库连接池、日志文件和缓冲中的 span 都会由 defer 关闭，main 只负责根据返回的错误选择退出码。
+// 返回的错误已经打印到标准错误，或在日志创建之后记录到日志中。
+func run() (err error) {
+	cfg, fs, err := loadConfig(os.Args[0], os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		// 命令行标志的错误已经由 FlagSet 连同用法一起打印过，配置文件和环境变量的错误在这里打印
+		if !errors.Is(err, errInvalidFlags) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return fmt.Errorf("%w: %w", errInvalidConfig, err)
+	}
+	if cfg.printConfig {
+		err = writeConfig(os.Stdout, fs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return err
+	}
+	err = cfg.validate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		return fmt.Errorf("%w: %w", errInvalidConfig, err)
+	}
+
+	// 启用文件日志，日志同时写入标准输出和文件。-log-file 为空时只写标准输出
+	var logFile *logfile.Writer
+	out := io.Writer(os.Stdout)
+	if cfg.log.file != "" {
+		logFile, err = logfile.Open(cfg.log.file, logfile.Policy{
+			MaxSize:    int64(cfg.log.maxSize) << 20,
+			Daily:      cfg.log.daily,
+			MaxAge:     cfg.log.maxAge,
+			MaxBackups: cfg.log.maxBackups,
+			Compress:   cfg.log.compress,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return err
+		}
+		// Close 会先 Sync，确保最后几行日志写入磁盘
+		defer logFile.Close()
+		out = io.MultiWriter(os.Stdout, logFile)
+	}
+	logger, err := newLogger(out, cfg.log.format, cfg.log.level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	// 从这里开始的错误都记录到日志中。这个 defer 在关闭日志文件之前执行，最后一条错误也会写入文件
+	defer func() {
+		if err != nil {
+			logger.Error(err.Error())
+		}
+	}()
+	if logFile != nil {
+		go reopenLogOnHangup(logFile, logger)
+	}
+
+	tracerProvider, shutdownTracing, err := setupTracing(cfg)
+	if err != nil {
+		return err
+	}
+	// 退出前把缓冲中的 span 发送出去，收集器无响应时最多等 5 秒
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := shutdownTracing(ctx)
+		if err != nil {
+			logger.Error("flushing traces", "error", err)
+		}
+	}()
+
+	hasher := &password.Hasher{
+		Algorithm: cfg.password.algorithm,
+		Argon2: password.Argon2Params{
+			Memory:     uint32(cfg.password.argon2Memory),
+			Iterations: uint32(cfg.password.argon2Time),
+			Threads:    uint8(cfg.password.argon2Threads),
+			SaltLength: password.DefaultArgon2Params.SaltLength,
+			KeyLength:  password.DefaultArgon2Params.KeyLength,
+		},
+		BcryptCost: cfg.password.bcryptCost,
+	}
+	err = hasher.Validate()
 	if err != nil {
-		errorLogger.Fatal(err)
+		return err
+	}
+
+	passwordPolicy := &validator.PasswordPolicy{
+		MinLength:      cfg.password.minLength,
+		RejectCommon:   true,
+		RejectPersonal: true,
+	}
+	if cfg.password.breachFile != "" {
+		passwordPolicy.Breached, err = validator.LoadBreachedPasswords(cfg.password.breachFile)
+		if err != nil {
+			return err
+		}
 	}
-	defer f.Close()
-	fileInfoLogger := log.New(f, "INFO\t", log.Ldate|log.Ltime)
 
 	db, err := openDB(cfg.dsn)
 	if err != nil {
-		errorLogger.Fatal(err.Error())
+		return err
 	}
 	defer db.Close()
+	users := &models.UserModel{DB: db, Hasher: hasher, Timeout: cfg.queryTimeout}
+
+	// 第一个管理员通过命令行创建：./web -promote-admin=alice@example.com
+	if cfg.promoteAdmin != "" {
+		err = promoteAdmin(context.Background(), users, cfg.promoteAdmin)
+		if err != nil {
+			return err
+		}
+		logger.Info("promoted user to admin", "email", cfg.promoteAdmin)
+		return nil
+	}
+
+	translations, err := i18n.Load(ui.Files, "i18n", defaultLocale)
+	if err != nil {
+		return err
+	}
 
 	// 生成 页面缓存 注入 application 中 方便各处使用
-	templateCache, err := newTemplateCache()
+	templateCache, err := newTemplateCache(translations)
 	if err != nil {
-		errorLogger.Fatal(err)
+		return err
 	}
 
 	// 初始化decoder实例
@@ -86,53 +230,143 @@ func main() {
 	// 但需要注意的是，使用 SameSite=Strict 会阻止用户浏览器在所有跨站使用中发送会话 cookie，包括使用 GET 和 HEAD 等 HTTP 方法的安全请求。
 	// 虽然这听起来更安全（确实如此！），但缺点是当用户从其他网站点击链接到您的应用程序时，不会发送会话 cookie。反过来，这意味着￼￼您的应用程序最初会将用户视为 "未登录"，即使他们有一个包含其 "authenticatedUserID "值的活动会话。
 	// sessionManager.Cookie.SameSite = http.SameSiteStrictMode
-	sessionManager.Store = mysqlstore.New(db)
-	sessionManager.Lifetime = 12 * time.Hour
+	// 包装一层，记录会话存储每种操作的耗时和错误
+	appMetrics := newMetrics(db)
+	sessionManager.Store = &measuredStore{Store: mysqlstore.New(db), metrics: appMetrics}
+	sessionManager.Lifetime = cfg.session.lifetime
 	// 确保在会话 cookie 上设置 Secure 属性。设置该属性意味着用户的网络浏览器只有在使用 HTTPS 连接时才会发送 cookie（而不会通过不安全的 HTTP 连接发送）。
 	sessionManager.Cookie.Secure = true
+	accountLimiter, ipLimiter := newLoginLimiters(limiter.NewMemoryStore(), logger)
+
+	var m mailer.Mailer = &mailer.LogMailer{Logger: logger}
+	if cfg.smtp.host != "" {
+		m = &mailer.SMTPMailer{
+			Host:     cfg.smtp.host,
+			Port:     cfg.smtp.port,
+			Username: cfg.smtp.username,
+			Password: cfg.smtp.password,
+			Sender:   cfg.smtp.sender,
+		}
+	}
+
+	// 提供方的发现文档在第一次登录时才下载，提供方暂时不可用不会影响启动
+	var oidcProvider *oidc.Provider
+	if cfg.oidc.issuer != "" {
+		oidcProvider = oidc.NewProvider(oidc.Config{
+			Issuer:       cfg.oidc.issuer,
+			ClientID:     cfg.oidc.clientID,
+			ClientSecret: cfg.oidc.clientSecret,
+		})
+	}
+
+	authenticator, err := newAuthenticator(cfg, users, &models.IdentityModel{DB: db, Timeout: cfg.queryTimeout})
+	if err != nil {
+		return err
+	}
+
 	app := &application{
-		infoLogger:     infoLogger,
-		errorLogger:    errorLogger,
-		fileInfoLogger: fileInfoLogger,
+		logger:         logger,
+		metrics:        appMetrics,
+		tracer:         tracerProvider.Tracer(tracerName),
 		cfg:            cfg,
-		snippets:       &models.SnippetModel{DB: db},
-		users:          &models.UserModel{DB: db},
+		snippets:       &models.SnippetModel{DB: db, Timeout: cfg.queryTimeout},
+		users:          users,
+		twoFactor:      &models.TwoFactorModel{DB: db, Timeout: cfg.queryTimeout},
+		userSessions:   &models.UserSessionModel{DB: db, Timeout: cfg.queryTimeout},
+		emailChanges:   &models.EmailChangeModel{DB: db, Timeout: cfg.queryTimeout},
+		identities:     &models.IdentityModel{DB: db, Timeout: cfg.queryTimeout},
+		rememberTokens: &models.RememberTokenModel{DB: db, Timeout: cfg.queryTimeout},
+		authenticator:  authenticator,
+		passwordPolicy: passwordPolicy,
+		mailer:         m,
+		oidc:           oidcProvider,
 		templateCache:  templateCache,
+		translations:   translations,
 		formDecoder:    formDecoder,
 		sessionManager: sessionManager,
+		accountLimiter: accountLimiter,
+		ipLimiter:      ipLimiter,
 		authId:         "authenticatedUserID",
+		db:             db,
 	}
+	app.readiness = newHealthChecker(logger, cfg.health.timeout, cfg.health.cacheTTL, app.readinessChecks()...)
 
-	infoLogger.Printf("Starting server on %s", cfg.addr)
-	fileInfoLogger.Printf("Starting server on %s", cfg.addr)
+	logger.Info("starting server", "addr", cfg.addr, "behind_proxy", cfg.behindProxy)
 
-	// 初始化一个 tls.Config 结构，用于保存我们希望服务器使用的非默认 TLS 设置。在本例中，我们唯一要更改的是曲线优选值，以便只使用具有汇编实现的椭圆曲线。
-	// 基本上，使用 tls.Config 设置受支持密码套件的自定义列表只会影响 TLS 1.0-1.2 连接 TLS 1.3 则与之无关 被普遍认为是安全的
-	tlsConfig := &tls.Config{
-		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+	// 在代理后面运行时由代理终结 TLS，本程序只提供纯 HTTP，不需要证书
+	var tlsConfig *tls.Config
+	if !cfg.behindProxy {
+		// 证书由 certReloader 提供，替换证书文件或发送 SIGHUP 后不需要重启就能生效
+		certs, err := newCertReloader(cfg.tls.certFile, cfg.tls.keyFile, cfg.tls.expiryWarning, logger)
+		if err != nil {
+			return err
+		}
+		go certs.watch(cfg.tls.reloadInterval)
+		// validate 已经检查过这两项，这里不会出错
+		minVersion, _ := parseTLSVersion(cfg.tls.minVersion)
+		cipherSuites, _ := parseCipherSuites(cfg.tls.cipherSuites)
+
+		// 初始化一个 tls.Config 结构，用于保存我们希望服务器使用的非默认 TLS 设置。曲线优选值只使用具有汇编实现的椭圆曲线。
+		// 基本上，使用 tls.Config 设置受支持密码套件的自定义列表只会影响 TLS 1.0-1.2 连接 TLS 1.3 则与之无关 被普遍认为是安全的
+		tlsConfig = &tls.Config{
+			MinVersion:       minVersion,
+			CipherSuites:     cipherSuites,
+			CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+			GetCertificate:   certs.GetCertificate,
+		}
 	}
 
 	// 自定义 http Server 错误日志输出器
 	srv := &http.Server{
 		Addr: cfg.addr,
-		// 设置 错误日志输出为 自定义格式
-		ErrorLog:  errorLogger,
+		// http.Server 只接受 *log.Logger，用 slog.NewLogLogger 把它的错误转到结构化日志中
+		ErrorLog:  slog.NewLogLogger(logger.Handler(), slog.LevelError),
 		Handler:   app.routes(),
 		TLSConfig: tlsConfig,
-		// 限制 连接闲置 1 分钟后 自动断开
-		IdleTimeout: time.Minute,
+		// 限制 连接闲置 1 分钟（-idle-timeout）后 自动断开
+		IdleTimeout: cfg.server.idleTimeout,
 		// 如果在请求被接受 5 秒后仍在读取请求头或正文，Go 就会关闭底层连接。由于这是对连接的 "硬 "关闭，用户不会收到任何 HTTP(S) 响应。
 		// 降低慢客户端攻击的风险
 		// 如果设置了 ReadTimeout 但没有设置 IdleTimeout，那么 IdleTimeout 将默认使用与 ReadTimeout 相同的设置。
 		// 例如，如果将 ReadTimeout 设置为 3 秒，那么就会产生一个副作用，即所有保持连接也会在 3 秒未活动后关闭。一般来说，我的建议是避免任何歧义，始终为服务器设置明确的 IdleTimeout 值。
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		ReadTimeout:  cfg.server.readTimeout,
+		WriteTimeout: cfg.server.writeTimeout,
 	}
 
 	// err = srv.ListenAndServe() // 改用 https
-	// 使用 ListenAndServeTLS() 方法启动 HTTPS 服务器。我们将 TLS 证书的路径和相应的私钥作为两个参数传递进去。
-	err = srv.ListenAndServeTLS("./tls/cert.pem", "./tls/key.pem")
-	errorLogger.Fatal(err)
+	var aux []*http.Server
+	// 纯 HTTP 端口：用户输入 http:// 时重定向到 HTTPS，而不是连接失败
+	if cfg.httpAddr != "" {
+		aux = append(aux, &http.Server{
+			Addr:         cfg.httpAddr,
+			Handler:      app.redirectRoutes(),
+			ErrorLog:     slog.NewLogLogger(logger.Handler(), slog.LevelError),
+			IdleTimeout:  cfg.server.idleTimeout,
+			ReadTimeout:  cfg.server.readTimeout,
+			WriteTimeout: cfg.server.writeTimeout,
+		})
+		logger.Info("redirecting plain HTTP to HTTPS", "addr", cfg.httpAddr)
+	}
+	// 管理端口只提供 /metrics，一般只监听本机或内网地址，由 Prometheus 直接抓取
+	if cfg.metrics.addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", app.metrics.handler(cfg.metrics.token))
+		aux = append(aux, &http.Server{
+			Addr:         cfg.metrics.addr,
+			Handler:      mux,
+			ErrorLog:     slog.NewLogLogger(logger.Handler(), slog.LevelError),
+			IdleTimeout:  time.Minute,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		})
+		logger.Info("serving metrics", "addr", cfg.metrics.addr)
+	}
+	err = app.serve(srv, aux...)
+	if err != nil {
+		return err
+	}
+	logger.Info("server stopped")
+	return nil
 }
 
 func openDB(dsn string) (*sql.DB, error) {
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"github.com/alexedwards/scs/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// routeContextKey 对应的值是 *routeInfo，由 measureRequest 中间件放入，匹配到的路由处理程序填写其中的路由模式
+const routeContextKey = contextKey("route")
+
+// metrics 保存程序导出给 Prometheus 的所有指标。它们注册在自己的 Registry 上而不是全局的默认 Registry，
+// 这样测试中可以创建多个互不影响的 application。
+type metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	renderDuration  *prometheus.HistogramVec
+	sessionStore    *prometheus.HistogramVec
+	sessionErrors   *prometheus.CounterVec
+	snippetsCreated prometheus.Counter
+	logins          prometheus.Counter
+	loginFailures   *prometheus.CounterVec
+}
+
+// newMetrics 创建并注册所有指标。db 不为 nil 时同时导出数据库连接池的统计（sql.DB.Stats()）。
+func newMetrics(db *sql.DB) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "snippetbox",
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route pattern, method and status code.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "snippetbox",
+			Name:      "http_request_duration_seconds",
+			Help:      "Time spent handling HTTP requests.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		renderDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "snippetbox",
+			Name:      "template_render_duration_seconds",
+			Help:      "Time spent executing page templates.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25},
+		}, []string{"page"}),
+		sessionStore: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "snippetbox",
+			Name:      "session_store_duration_seconds",
+			Help:      "Time spent in session store operations.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"op"}),
+		sessionErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "snippetbox",
+			Name:      "session_store_errors_total",
+			Help:      "Session store operations that returned an error.",
+		}, []string{"op"}),
+		snippetsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "snippetbox",
+			Name:      "snippets_created_total",
+			Help:      "Snippets created.",
+		}),
+		logins: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "snippetbox",
+			Name:      "logins_total",
+			Help:      "Successful logins.",
+		}),
+		loginFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "snippetbox",
+			Name:      "login_failures_total",
+			Help:      "Failed login attempts by reason.",
+		}, []string{"reason"}),
+	}
+	m.registry.MustRegister(
+		m.requests, m.requestDuration, m.renderDuration, m.sessionStore, m.sessionErrors,
+		m.snippetsCreated, m.logins, m.loginFailures,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	if db != nil {
+		m.registry.MustRegister(collectors.NewDBStatsCollector(db, "snippetbox"))
+	}
+	return m
+}
+
+// handler 返回输出所有指标的 /metrics 处理程序。token 不为空时要求请求带有 "Authorization: Bearer <token>" 标头。
+func (m *metrics) handler(token string) http.Handler {
+	h := promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	if token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// routeInfo 记录请求匹配到的路由模式
+type routeInfo struct {
+	pattern string
+}
+
+// withRoute 在处理请求前把路由模式（例如 /snippet/view/:id）告诉外层的 measureRequest 和请求的服务端 span。
+// 指标中的 route 标签使用路由模式而不是实际路径，否则每个片段 ID 都会产生一个新的时间序列。
+func withRoute(pattern string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info, ok := r.Context().Value(routeContextKey).(*routeInfo); ok {
+			info.pattern = pattern
+		}
+		nameServerSpan(r, pattern)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// measureRequest 按路由模式、请求方法和状态码统计请求数和耗时。没有匹配到任何路由的请求（404、405）
+// 统一记为 "unmatched"。
+func (app *application) measureRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &routeInfo{pattern: "unmatched"}
+		rw := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		ctx := context.WithValue(r.Context(), routeContextKey, info)
+		next.ServeHTTP(rw, r.WithContext(ctx))
+
+		method := metricMethod(r.Method)
+		app.metrics.requests.WithLabelValues(info.pattern, method, strconv.Itoa(rw.status)).Inc()
+		app.metrics.requestDuration.WithLabelValues(info.pattern, method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// metricMethod 把请求方法映射为 method 标签的值。客户端可以发送任意字符串作为方法，没有匹配到路由的请求也会被统计，
+// 如果直接使用 r.Method，任何人都可以制造出无限多的时间序列，所以标准方法之外的一律记为 "other"。
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "other"
+	}
+}
+
+// measuredStore 包装会话存储，记录每种操作的耗时和错误次数。
+type measuredStore struct {
+	scs.Store
+	metrics *metrics
+}
+
+func (s *measuredStore) observe(op string, start time.Time, err error) {
+	s.metrics.sessionStore.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		s.metrics.sessionErrors.WithLabelValues(op).Inc()
+	}
+}
+
+func (s *measuredStore) Find(token string) ([]byte, bool, error) {
+	start := time.Now()
+	b, found, err := s.Store.Find(token)
+	s.observe("find", start, err)
+	return b, found, err
+}
+
+func (s *measuredStore) Commit(token string, b []byte, expiry time.Time) error {
+	start := time.Now()
+	err := s.Store.Commit(token, b, expiry)
+	s.observe("commit", start, err)
+	return err
+}
+
+func (s *measuredStore) Delete(token string) error {
+	start := time.Now()
+	err := s.Store.Delete(token)
+	s.observe("delete", start, err)
+	return err
+}
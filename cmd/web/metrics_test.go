@@ -0,0 +1,85 @@
+package main
+
+import (
+	"github.com/hlf2016/snippetbox/internal/assert"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	app := newTestApplication(t)
+	app.cfg.metrics.token = "s3cret"
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// 产生一些请求：匹配路由的、带不同 ID 的、不存在的路径、非标准的请求方法，以及一次密码错误的登录
+	ts.get(t, "/snippet/view/1")
+	ts.get(t, "/snippet/view/2")
+	ts.get(t, "/no/such/page")
+	ts.do(t, "X-RANDOM-7F3A", "/no/such/page", nil)
+	_, _, body := ts.get(t, "/user/login")
+	ts.postForm(t, "/user/login", url.Values{
+		"email":      {"alice@example.com"},
+		"password":   {"wrong password"},
+		"csrf_token": {extractCSRFToken(t, body)},
+	})
+
+	scrape := func(t *testing.T, token string) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rs, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+		b, err := io.ReadAll(rs.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rs.StatusCode, string(b)
+	}
+
+	t.Run("Missing token", func(t *testing.T) {
+		code, _ := scrape(t, "")
+		assert.Equal(t, code, http.StatusUnauthorized)
+	})
+
+	t.Run("Wrong token", func(t *testing.T) {
+		code, _ := scrape(t, "guess")
+		assert.Equal(t, code, http.StatusUnauthorized)
+	})
+
+	t.Run("Valid token", func(t *testing.T) {
+		code, body := scrape(t, "s3cret")
+		assert.Equal(t, code, http.StatusOK)
+		// 不同的片段 ID 记在同一个路由模式下（模拟模型中没有 ID 为 2 的片段）
+		assert.StringContains(t, body, `snippetbox_http_requests_total{method="GET",route="/snippet/view/:id",status="200"} 1`)
+		assert.StringContains(t, body, `snippetbox_http_requests_total{method="GET",route="/snippet/view/:id",status="404"} 1`)
+		assert.StringContains(t, body, `snippetbox_http_requests_total{method="GET",route="unmatched",status="404"} 1`)
+		// 非标准的方法不会成为新的标签值
+		assert.StringContains(t, body, `snippetbox_http_requests_total{method="other",route="unmatched",status="404"} 1`)
+		if strings.Contains(body, "X-RANDOM-7F3A") {
+			t.Error("arbitrary request method exported as a label value")
+		}
+		assert.StringContains(t, body, `snippetbox_template_render_duration_seconds_count{page="view.tmpl"} 1`)
+		assert.StringContains(t, body, `snippetbox_login_failures_total{reason="invalid_credentials"} 1`)
+	})
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	// 既没有管理端口也没有令牌时，主端口上不提供 /metrics
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	code, _, _ := ts.get(t, "/metrics")
+	assert.Equal(t, code, http.StatusNotFound)
+}
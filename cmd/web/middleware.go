@@ -2,14 +2,25 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/hlf2016/snippetbox/internal/models"
 	"github.com/justinas/nosurf"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"net/http"
 	"strings"
+	"time"
 )
 
-func secureHeaders(next http.Handler) http.Handler {
+// secureHeaders 为每个响应加上安全相关的标头。配置了 -hsts-max-age 时，HTTPS 响应还会带上 Strict-Transport-Security，
+// 浏览器在这段时间内会直接用 HTTPS 访问本站。纯 HTTP 响应中的 HSTS 标头会被浏览器忽略，所以不发送。
+func (app *application) secureHeaders(next http.Handler) http.Handler {
+	hsts := hstsHeader(app.cfg.hsts.maxAge, app.cfg.hsts.includeSubdomains)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hsts != "" && app.isSecure(r) {
+			w.Header().Set("Strict-Transport-Security", hsts)
+		}
 		w.Header().Set("Content-Security-Policy",
 			"default-src 'self'; style-src 'self' fonts.googleapis.com; font-src fonts.gstatic.com")
 		w.Header().Set("Referrer-Policy", "origin-when-cross-origin")
@@ -30,10 +41,45 @@ func neuter(next http.Handler) http.Handler {
 	})
 }
 
+// requestID 为每个请求确定一个 ID：沿用请求中合法的 X-Request-ID，否则生成一个新的。
+// ID 保存在请求上下文中并写入响应标头，之后用 app.logger 的 *Context 方法记录的日志都会带上它。
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDRX.MatchString(id) {
+			var err error
+			id, err = newRequestID()
+			if err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+		}
+		w.Header().Set(requestIDHeader, id)
+		// 服务端 span 上也记下请求 ID，从日志可以找到对应的追踪，反过来也一样
+		if span, ok := r.Context().Value(serverSpanContextKey).(trace.Span); ok {
+			span.SetAttributes(attribute.String("request_id", id))
+		}
+		ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// logRequest 在请求处理完之后记录一行访问日志，包括响应的状态码、字节数和耗时。
 func (app *application) logRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		app.infoLogger.Printf("%s - %s %s %s", r.RemoteAddr, r.Proto, r.Method, r.URL.RequestURI())
-		next.ServeHTTP(w, r)
+		start := time.Now()
+		rw := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+		app.logger.InfoContext(r.Context(), "request",
+			"remote_addr", r.RemoteAddr,
+			"client_ip", app.clientIP(r),
+			"proto", r.Proto,
+			"method", r.Method,
+			"uri", r.URL.RequestURI(),
+			"status", rw.status,
+			"bytes", rw.bytes,
+			"duration", time.Since(start),
+		)
 	})
 }
 
@@ -48,7 +94,7 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 				w.Header().Set("Connection", "close")
 				// 内置的recover()函数返回的值的类型为any，其底层类型可以是字符串、错误或其他类型——无论传递给panic()的参数是什么。在我们的例子中，它是字符串“oops! something went wrong”。
 				// 在上面的代码中，我们通过使用 fmt.Errorf() 函数创建一个包含 any 值的默认文本表示形式的新错误对象，将其标准化为错误，然后将此错误传递给 app.server Error() 帮助程序方法。
-				app.serverError(w, fmt.Errorf("%s", err))
+				app.serverError(w, r, fmt.Errorf("%s", err))
 			}
 		}()
 		next.ServeHTTP(w, r)
@@ -64,12 +110,32 @@ func (app *application) requireAuthentication(next http.Handler) http.Handler {
 			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 			return
 		}
+		// 管理员要求修改密码的用户，在修改之前只能访问修改密码页面和退出登录。
+		// 没有密码的账号无法完成修改（修改密码需要输入当前密码），不受这个限制。
+		if user := app.currentUser(r); user.PasswordResetRequired && !user.Passwordless && r.URL.Path != "/account/password/update" && r.URL.Path != "/user/logout" {
+			app.flash(r, "flash.password_reset_required")
+			http.Redirect(w, r, "/account/password/update", http.StatusSeeOther)
+			return
+		}
 		// 否则，请设置 "Cache-Control: no-store"（缓存控制：不存储）标头，这样需要验证的页面就不会存储在用户浏览器缓存（或其他中间缓存）中。
 		w.Header().Add("Cache-Control", "no-store")
 		next.ServeHTTP(w, r)
 	})
 }
 
+// requireRole 只允许角色不低于 role 的用户访问，需要放在 requireAuthentication 之后使用。
+func (app *application) requireRole(role models.Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !app.hasRole(r, role) {
+				app.clientError(w, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		id := app.sessionManager.GetInt(r.Context(), app.authId)
@@ -77,16 +143,32 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			next.ServeHTTP(w, r)
 			return
 		}
-		exists, err := app.users.Exists(id)
+		// 读取完整的用户记录而不只是检查是否存在，这样后续的 requireRole 和模板都能拿到用户的角色
+		user, err := app.users.Get(r.Context(), id)
 		if err != nil {
-			app.serverError(w, err)
+			if errors.Is(err, models.ErrNoRecord) {
+				next.ServeHTTP(w, r)
+			} else {
+				app.serverError(w, r, err)
+			}
 			return
 		}
 
-		if exists {
-			ctx := context.WithValue(r.Context(), isAuthenticatedContextKey, true)
-			r = r.WithContext(ctx)
+		// 被禁用的账号即使会话仍然有效也按未登录处理，并清除会话中的用户 ID
+		if user.Disabled {
+			app.sessionManager.Remove(r.Context(), app.authId)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		err = app.touchUserSession(r)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
 		}
+		ctx := context.WithValue(r.Context(), isAuthenticatedContextKey, true)
+		ctx = context.WithValue(ctx, authenticatedUserContextKey, user)
+		r = r.WithContext(ctx)
 
 		next.ServeHTTP(w, r)
 	})
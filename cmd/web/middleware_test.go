@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"github.com/hlf2016/snippetbox/internal/assert"
 	"io"
 	"net/http"
@@ -23,7 +25,7 @@ func TestSecureHeaders(t *testing.T) {
 
 	// 将模拟的HTTP处理程序传递给我们的secureHeaders中间件。
 	// 因为secureHeaders返回一个HTTP.Handler，所以我们可以调用它的ServeHTTP()方法，传入HTTP.ResponseRecorder和虚拟的Http.Request来执行它。
-	secureHeaders(next).ServeHTTP(rr, r)
+	newTestApplication(t).secureHeaders(next).ServeHTTP(rr, r)
 
 	rs := rr.Result()
 
@@ -57,3 +59,110 @@ func TestSecureHeaders(t *testing.T) {
 	assert.Equal(t, string(body), "OK")
 
 }
+
+func TestRequestID(t *testing.T) {
+	app := newTestApplication(t)
+
+	tests := []struct {
+		name     string
+		header   string
+		wantSame bool
+	}{
+		{
+			name:     "Generated",
+			header:   "",
+			wantSame: false,
+		},
+		{
+			name:     "Propagated",
+			header:   "lb-7f3a.42",
+			wantSame: true,
+		},
+		{
+			name:     "Invalid replaced",
+			header:   "bad id\nwith newline",
+			wantSame: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Request-ID", tt.header)
+			}
+			var seen string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = requestIDFromContext(r.Context())
+			})
+			rr := httptest.NewRecorder()
+			app.requestID(next).ServeHTTP(rr, r)
+
+			id := rr.Result().Header.Get("X-Request-ID")
+			assert.Equal(t, seen, id)
+			assert.Equal(t, id == tt.header, tt.wantSame)
+			assert.Equal(t, requestIDRX.MatchString(id), true)
+		})
+	}
+}
+
+func TestLogRequest(t *testing.T) {
+	app := newTestApplication(t)
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "json", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.logger = logger
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	})
+	r := httptest.NewRequest(http.MethodGet, "/pot?brew=1", nil)
+	r.Header.Set("X-Request-ID", "abc123")
+	app.requestID(app.logRequest(next)).ServeHTTP(httptest.NewRecorder(), r)
+
+	var line struct {
+		Msg       string `json:"msg"`
+		RequestID string `json:"request_id"`
+		URI       string `json:"uri"`
+		Status    int    `json:"status"`
+		Bytes     int    `json:"bytes"`
+	}
+	err = json.Unmarshal(buf.Bytes(), &line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, line.Msg, "request")
+	assert.Equal(t, line.RequestID, "abc123")
+	assert.Equal(t, line.URI, "/pot?brew=1")
+	assert.Equal(t, line.Status, http.StatusTeapot)
+	assert.Equal(t, line.Bytes, len("short and stout"))
+}
+
+func TestServerErrorLogsRequestID(t *testing.T) {
+	app := newTestApplication(t)
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "text", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.logger = logger
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("oops")
+	})
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Request-ID", "panic-1")
+	rr := httptest.NewRecorder()
+	app.requestID(app.logRequest(app.recoverPanic(next))).ServeHTTP(rr, r)
+
+	assert.Equal(t, rr.Code, http.StatusInternalServerError)
+	out := buf.String()
+	assert.StringContains(t, out, "level=ERROR msg=oops")
+	assert.StringContains(t, out, "source=middleware.go:")
+	assert.StringContains(t, out, "request_id=panic-1")
+	// 访问日志同样记录了 500
+	assert.StringContains(t, out, "status=500")
+}
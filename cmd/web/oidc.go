@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"github.com/hlf2016/snippetbox/internal/auth"
+	"github.com/hlf2016/snippetbox/internal/models"
+	"github.com/hlf2016/snippetbox/internal/oidc"
+	"net/http"
+	"time"
+)
+
+// 发起单点登录时生成的一次性值保存在会话中，回调时取出并删除
+const (
+	oidcStateKey        = "oidcState"
+	oidcNonceKey        = "oidcNonce"
+	oidcCodeVerifierKey = "oidcCodeVerifier"
+	// 不为 0 时这次跳转不是登录，而是已登录的这个用户在提供方重新验证身份
+	oidcReauthUserKey = "oidcReauthUserID"
+)
+
+// reauthenticatedAtKey 记录用户最近一次在提供方重新验证身份的时间（Unix 时间戳），
+// 没有本站密码的用户在 reauthMaxAge 内可以凭它确认删除账号这类敏感操作。
+const (
+	reauthenticatedAtKey = "reauthenticatedAt"
+	reauthMaxAge         = 5 * time.Minute
+)
+
+// errUnverifiedEmail 表示提供方没有确认过这个邮箱，不能用它来关联或创建账号
+var errUnverifiedEmail = errors.New("oidc: email address is not verified")
+
+// oidcRedirectURL 返回提供方登录完成后回到本站的地址，它必须与在提供方登记的地址完全一致。
+func (app *application) oidcRedirectURL() string {
+	if app.cfg.oidc.redirectURL != "" {
+		return app.cfg.oidc.redirectURL
+	}
+	return app.absoluteURL("/auth/oidc/callback")
+}
+
+// oidcLogin 发起单点登录。
+func (app *application) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.notFound(w)
+		return
+	}
+	app.sessionManager.Remove(r.Context(), oidcReauthUserKey)
+	app.redirectToOIDC(w, r, false)
+}
+
+// redirectToOIDC 生成 state、nonce 和 PKCE 验证值并保存到会话中，然后把用户重定向到提供方的登录页面。
+// reauth 为 true 时要求提供方重新验证身份，即使用户在提供方仍处于登录状态。
+func (app *application) redirectToOIDC(w http.ResponseWriter, r *http.Request, reauth bool) {
+	var values [3]string
+	for i := range values {
+		v, err := oidc.RandomString()
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		values[i] = v
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	authCodeURL := app.oidc.AuthCodeURL
+	if reauth {
+		authCodeURL = app.oidc.ReauthCodeURL
+	}
+	authURL, err := authCodeURL(r.Context(), app.oidcRedirectURL(), state, nonce, oidc.CodeChallenge(verifier))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), oidcStateKey, state)
+	app.sessionManager.Put(r.Context(), oidcNonceKey, nonce)
+	app.sessionManager.Put(r.Context(), oidcCodeVerifierKey, verifier)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// oidcCallback 处理提供方的回调：检查 state，用授权码换取并验证 ID 令牌，找到或创建对应的用户后登录。
+func (app *application) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.notFound(w)
+		return
+	}
+
+	// 不论成功与否，这些值都只能使用一次
+	state := app.sessionManager.PopString(r.Context(), oidcStateKey)
+	nonce := app.sessionManager.PopString(r.Context(), oidcNonceKey)
+	verifier := app.sessionManager.PopString(r.Context(), oidcCodeVerifierKey)
+	reauthUserID := app.sessionManager.PopInt(r.Context(), oidcReauthUserKey)
+
+	// state 不匹配说明这个回调不是由本会话发起的登录产生的，可能是 CSRF 攻击
+	query := r.URL.Query()
+	if state == "" || subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	// 用户在提供方取消了登录，或者提供方拒绝了请求
+	if query.Get("error") != "" || query.Get("code") == "" {
+		app.renderLoginError(w, r, http.StatusUnauthorized, "oidc.error.failed")
+		return
+	}
+
+	claims, err := app.oidc.Exchange(r.Context(), app.oidcRedirectURL(), query.Get("code"), verifier, nonce)
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), "oidc login failed", "error", err)
+		app.renderLoginError(w, r, http.StatusUnauthorized, "oidc.error.failed")
+		return
+	}
+
+	if reauthUserID != 0 {
+		app.oidcReauthenticated(w, r, claims, reauthUserID)
+		return
+	}
+
+	userID, created, err := app.oidcUser(r.Context(), claims)
+	if err != nil {
+		switch {
+		case errors.Is(err, errUnverifiedEmail):
+			app.renderLoginError(w, r, http.StatusForbidden, "oidc.error.email_unverified")
+		case errors.Is(err, models.ErrDuplicateEmail):
+			// 两个请求同时为同一个邮箱创建账号
+			app.renderLoginError(w, r, http.StatusConflict, "oidc.error.failed")
+		default:
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	if !created {
+		user, err := app.users.Get(r.Context(), userID)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		if user.Disabled {
+			app.renderLoginError(w, r, http.StatusForbidden, "login.error.disabled")
+			return
+		}
+
+		// 与密码登录一样，开启了两步验证的账号还需要输入验证码
+		enabled, err := app.twoFactorEnabled(r.Context(), userID)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		if enabled {
+			err = app.startTwoFactorLogin(r, userID, user.Email, false)
+			if err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, "/user/login/totp", http.StatusSeeOther)
+			return
+		}
+	}
+
+	app.completeLogin(w, r, userID, "", false)
+}
+
+// oidcUser 返回外部身份对应的用户 ID。身份第一次登录时，按提供方确认过的邮箱关联到已有的用户，
+// 没有这个邮箱的用户时创建一个新用户，created 为 true。
+func (app *application) oidcUser(ctx context.Context, claims *oidc.Claims) (userID int, created bool, err error) {
+	userID, err = app.identities.Get(ctx, claims.Issuer, claims.Subject)
+	if err == nil {
+		return userID, false, nil
+	}
+	if !errors.Is(err, models.ErrNoRecord) {
+		return 0, false, err
+	}
+
+	// 只有提供方确认过的邮箱才可信，否则任何人都可以在提供方填写别人的邮箱来接管对方在本站的账号
+	if claims.Email == "" || !claims.EmailVerified {
+		return 0, false, errUnverifiedEmail
+	}
+
+	p := &auth.Provisioner{Users: app.users, Identities: app.identities}
+	userID, created, err = p.Resolve(ctx, claims.Issuer, claims.Subject, claims.Email, claims.Name)
+	if err != nil {
+		return 0, false, err
+	}
+	if created {
+		app.logger.InfoContext(ctx, "created user via single sign-on", "user_id", userID, "email", claims.Email)
+	}
+	return userID, created, nil
+}
+
+// renderLoginError 重新显示登录页面，并在表单上方显示 key 对应的错误。
+func (app *application) renderLoginError(w http.ResponseWriter, r *http.Request, status int, key string) {
+	var form userLoginForm
+	form.AddNonFieldError(key)
+	data := app.newTemplateData(r)
+	data.Form = form
+	app.render(w, r, status, "login.tmpl", data)
+}
+
+// oidcReauthenticated 处理重新验证身份的回调。身份必须已经关联到发起验证的、当前登录的用户，
+// 并且提供方确实在刚才重新验证过（auth_time），这里不会创建或关联账号。
+func (app *application) oidcReauthenticated(w http.ResponseWriter, r *http.Request, claims *oidc.Claims, reauthUserID int) {
+	userID, err := app.identities.Get(r.Context(), claims.Issuer, claims.Subject)
+	if err != nil && !errors.Is(err, models.ErrNoRecord) {
+		app.serverError(w, r, err)
+		return
+	}
+	currentUserID := app.sessionManager.GetInt(r.Context(), app.authId)
+	fresh := !claims.AuthTime.IsZero() && time.Since(claims.AuthTime) < reauthMaxAge
+	if err != nil || userID != reauthUserID || userID != currentUserID || !fresh {
+		app.logger.WarnContext(r.Context(), "oidc reauthentication rejected", "user_id", currentUserID, "fresh", fresh)
+		app.flash(r, "flash.reauth_failed")
+		http.Redirect(w, r, "/account/delete", http.StatusSeeOther)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), reauthenticatedAtKey, time.Now().Unix())
+	app.flash(r, "flash.reauth_confirmed")
+	http.Redirect(w, r, "/account/delete", http.StatusSeeOther)
+}
+
+// recentlyReauthenticated 判断当前用户是否在 reauthMaxAge 内通过提供方重新验证过身份。
+func (app *application) recentlyReauthenticated(r *http.Request) bool {
+	at := app.sessionManager.GetInt64(r.Context(), reauthenticatedAtKey)
+	return at != 0 && time.Since(time.Unix(at, 0)) < reauthMaxAge
+}
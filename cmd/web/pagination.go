@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Pagination 描述列表页当前所在的页码，模板根据它生成上一页和下一页链接。
+type Pagination struct {
+	Page    int
+	PerPage int
+	Total   int
+}
+
+// 页码的上限。任何列表都远远到不了这么多页，限制它是为了让 Offset() 不会因为 ?page= 中的巨大数字溢出成负数，
+// 负的 OFFSET 会被 MySQL 拒绝，用户看到的将是 500 错误而不是一个空页面。
+const maxPage = 100000
+
+// newPagination 从查询参数 ?page= 中读取页码，缺省或无效时为第一页，超过 maxPage 时为 maxPage。
+func newPagination(r *http.Request, perPage int) Pagination {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	if page > maxPage {
+		page = maxPage
+	}
+	return Pagination{Page: page, PerPage: perPage}
+}
+
+func (p Pagination) Offset() int {
+	return (p.Page - 1) * p.PerPage
+}
+
+func (p Pagination) HasPrev() bool {
+	return p.Page > 1
+}
+
+func (p Pagination) HasNext() bool {
+	return p.Page*p.PerPage < p.Total
+}
+
+func (p Pagination) PrevPage() int {
+	return p.Page - 1
+}
+
+func (p Pagination) NextPage() int {
+	return p.Page + 1
+}
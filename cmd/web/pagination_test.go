@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/hlf2016/snippetbox/internal/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewPagination(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantPage   int
+		wantOffset int
+	}{
+		{
+			name:       "Missing",
+			query:      "",
+			wantPage:   1,
+			wantOffset: 0,
+		},
+		{
+			name:       "Valid",
+			query:      "?page=3",
+			wantPage:   3,
+			wantOffset: 40,
+		},
+		{
+			name:       "Not a number",
+			query:      "?page=abc",
+			wantPage:   1,
+			wantOffset: 0,
+		},
+		{
+			name:       "Negative",
+			query:      "?page=-2",
+			wantPage:   1,
+			wantOffset: 0,
+		},
+		{
+			// (page-1)*perPage 溢出后会得到负的 OFFSET
+			name:       "Huge",
+			query:      "?page=9223372036854775807",
+			wantPage:   maxPage,
+			wantOffset: (maxPage - 1) * 20,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/admin"+tt.query, nil)
+			p := newPagination(r, 20)
+			assert.Equal(t, p.Page, tt.wantPage)
+			assert.Equal(t, p.Offset(), tt.wantOffset)
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hlf2016/snippetbox/internal/models"
+	"github.com/hlf2016/snippetbox/internal/validator"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 删除账号时对用户片段的两种处理方式
+const (
+	snippetsDelete    = "delete"
+	snippetsAnonymise = "anonymise"
+)
+
+type accountDeleteForm struct {
+	Password            string `form:"password"`
+	Snippets            string `form:"snippets"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) accountDelete(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+	data.Form = accountDeleteForm{Snippets: snippetsDelete}
+	data.Reauthenticated = app.recentlyReauthenticated(r)
+	app.render(w, r, http.StatusOK, "account_delete.tmpl", data)
+}
+
+// accountDeleteReauthPost 让没有本站密码的用户（通过单点登录创建的账号）改为在提供方重新验证身份来确认删除，
+// 验证完成后回到删除页面，reauthMaxAge 内提交删除不再需要密码。
+func (app *application) accountDeleteReauthPost(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.notFound(w)
+		return
+	}
+	app.sessionManager.Put(r.Context(), oidcReauthUserKey, app.sessionManager.GetInt(r.Context(), app.authId))
+	app.redirectToOIDC(w, r, true)
+}
+
+func (app *application) accountDeletePost(w http.ResponseWriter, r *http.Request) {
+	var form accountDeleteForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	// 刚在提供方重新验证过身份时不需要再输入密码
+	reauthenticated := app.recentlyReauthenticated(r)
+	if !reauthenticated {
+		form.CheckField(validator.NotBlank(form.Password), "password", "validation.blank")
+	}
+	form.CheckField(validator.PermittedValue(form.Snippets, snippetsDelete, snippetsAnonymise), "snippets", "validation.snippets_choice")
+
+	user := app.currentUser(r)
+	if form.Valid() && !reauthenticated {
+		// 再次确认密码，防止有人在别人忘记锁屏的电脑上删除账号。拿到会话的人可以在这里反复猜密码，
+		// 所以和登录共用按账号和按 IP 的限流。
+		ip := app.clientIP(r)
+		wait, err := app.loginWait(user.Email, ip)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		if wait > 0 {
+			form.AddFieldError("password", "login.error.throttled", app.humanDuration(r, wait))
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			data := app.newTemplateData(r)
+			data.Form = form
+			app.render(w, r, http.StatusTooManyRequests, "account_delete.tmpl", data)
+			return
+		}
+
+		// 通过目录登录的用户没有本站的密码，所以交给 authenticator 验证。Verify 只检查密码，
+		// 不会像登录那样开通用户、同步目录中的角色或升级密码哈希。
+		err = app.authenticator.Verify(r.Context(), user.ID, user.Email, form.Password)
+		switch {
+		case errors.Is(err, models.ErrInvalidCredential):
+			err = app.loginFailed(user.Email, ip)
+			if err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+			form.AddFieldError("password", "account_delete.error.password")
+		case err != nil:
+			app.serverError(w, r, err)
+			return
+		default:
+			err = app.loginSucceeded(user.Email)
+			if err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+		}
+	}
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		data.Reauthenticated = reauthenticated
+		app.render(w, r, http.StatusUnprocessableEntity, "account_delete.tmpl", data)
+		return
+	}
+
+	// 先取出所有会话，账号删除后 user_sessions 中的记录也会被删掉
+	sessions, err := app.userSessions.ForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	err = app.users.Delete(r.Context(), user.ID, form.Snippets == snippetsAnonymise)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	// 让其他设备上的会话立即失效，当前会话则像退出登录一样换一个新令牌
+	current := app.sessionManager.Token(r.Context())
+	for _, s := range sessions {
+		if s.Token == current {
+			continue
+		}
+		err = app.sessionManager.Store.Delete(s.Token)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+	err = app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.sessionManager.Remove(r.Context(), app.authId)
+	app.sessionManager.Remove(r.Context(), reauthenticatedAtKey)
+	app.logger.InfoContext(r.Context(), "user deleted their account", "user_id", user.ID, "snippets", form.Snippets)
+	app.flash(r, "flash.account_deleted")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// 导出文件中的数据结构。单独定义而不是直接序列化 models 中的类型，这样导出格式不会因为模型增加字段而意外改变，
+// 也不会把密码哈希这类字段带出去。
+type exportProfile struct {
+	ID               int       `json:"id"`
+	Name             string    `json:"name"`
+	Username         string    `json:"username"`
+	Email            string    `json:"email"`
+	Bio              string    `json:"bio"`
+	Role             string    `json:"role"`
+	Created          time.Time `json:"created"`
+	TwoFactorEnabled bool      `json:"two_factor_enabled"`
+	// 偏好设置，为空表示跟随浏览器
+	Timezone string `json:"timezone"`
+	Locale   string `json:"locale"`
+}
+
+type exportSnippet struct {
+	ID      int       `json:"id"`
+	Title   string    `json:"title"`
+	Content string    `json:"content"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	// 片段原文在压缩包中的路径
+	File string `json:"file"`
+}
+
+type exportSession struct {
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last_seen"`
+	Expires   time.Time `json:"expires"`
+}
+
+// accountExport 把用户的个人资料、会话和所有片段打包成 ZIP 文件供下载：
+//
+//	profile.json
+//	sessions.json
+//	snippets.json
+//	snippets/<id>.txt
+func (app *application) accountExport(w http.ResponseWriter, r *http.Request) {
+	user := app.currentUser(r)
+	twoFactor, err := app.twoFactorEnabled(r.Context(), user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	snippets, err := app.snippets.ForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	sessions, err := app.userSessions.ForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	profile := exportProfile{
+		ID:               user.ID,
+		Name:             user.Name,
+		Username:         user.Username,
+		Email:            user.Email,
+		Bio:              user.Bio,
+		Role:             string(user.Role),
+		Created:          user.Created,
+		TwoFactorEnabled: twoFactor,
+		Timezone:         user.Timezone,
+		Locale:           user.Locale,
+	}
+	exportedSessions := make([]exportSession, 0, len(sessions))
+	for _, s := range sessions {
+		exportedSessions = append(exportedSessions, exportSession{
+			UserAgent: s.UserAgent,
+			IP:        s.IP,
+			Created:   s.Created,
+			LastSeen:  s.LastSeen,
+			Expires:   s.Expires,
+		})
+	}
+	exportedSnippets := make([]exportSnippet, 0, len(snippets))
+	for _, s := range snippets {
+		exportedSnippets = append(exportedSnippets, exportSnippet{
+			ID:      s.ID,
+			Title:   s.Title,
+			Content: s.Content,
+			Created: s.Created,
+			Expires: s.Expires,
+			File:    "snippets/" + strconv.Itoa(s.ID) + ".txt",
+		})
+	}
+
+	// 和 render 一样先写入缓冲区，出错时还可以返回 500 而不是一个损坏的压缩包
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	files := []struct {
+		name string
+		data any
+	}{
+		{"profile.json", profile},
+		{"sessions.json", exportedSessions},
+		{"snippets.json", exportedSnippets},
+	}
+	for _, f := range files {
+		err = writeZipJSON(zw, f.name, f.data)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+	for _, s := range exportedSnippets {
+		fw, err := zw.Create(s.File)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		_, err = fw.Write([]byte(s.Content))
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="snippetbox-data-%d.zip"`, user.ID))
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	buf.WriteTo(w)
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v any) error {
+	fw, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(fw)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
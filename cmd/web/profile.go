@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/hlf2016/snippetbox/internal/mailer"
+	"github.com/hlf2016/snippetbox/internal/models"
+	"github.com/hlf2016/snippetbox/internal/validator"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	profileSnippetsPerPage = 10
+	maxBioChars            = 500
+	// 修改邮箱的确认链接的有效期
+	emailChangeTTL = 24 * time.Hour
+)
+
+// userProfile 是公开的个人主页，任何人都可以访问。页面上只展示姓名、注册时间、简介和未过期的片段，不展示邮箱。
+func (app *application) userProfile(w http.ResponseWriter, r *http.Request) {
+	// 个人主页地址既可以使用用户 ID 也可以使用用户名。用户名不允许是纯数字，所以两者不会混淆。
+	params := httprouter.ParamsFromContext(r.Context())
+	var user *models.User
+	var err error
+	if id, convErr := strconv.Atoi(params.ByName("id")); convErr == nil {
+		user, err = app.users.Get(r.Context(), id)
+	} else {
+		user, err = app.users.GetByUsername(r.Context(), params.ByName("id"))
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+	// 被禁用的账号不再对外展示
+	if user.Disabled {
+		app.notFound(w)
+		return
+	}
+
+	pagination := newPagination(r, profileSnippetsPerPage)
+	snippets, total, err := app.snippets.LatestForUser(r.Context(), user.ID, pagination.PerPage, pagination.Offset())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	pagination.Total = total
+
+	data := app.newTemplateData(r)
+	data.Profile = user
+	data.Snippets = snippets
+	data.Pagination = pagination
+	app.render(w, r, http.StatusOK, "profile.tmpl", data)
+}
+
+type accountBioForm struct {
+	Bio                 string `form:"bio"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) accountBioPost(w http.ResponseWriter, r *http.Request) {
+	var form accountBioForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.Bio = strings.TrimSpace(form.Bio)
+	form.CheckField(validator.MaxChars(form.Bio, maxBioChars), "bio", "validation.max_chars", maxBioChars)
+	if !form.Valid() {
+		app.renderAccount(w, r, http.StatusUnprocessableEntity, form)
+		return
+	}
+
+	err = app.users.SetBio(r.Context(), app.currentUser(r).ID, form.Bio)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.flash(r, "flash.bio_updated")
+	http.Redirect(w, r, "/account/view", http.StatusSeeOther)
+}
+
+// checkUsername 检查用户名的格式，注册和修改资料时共用。
+func checkUsername(v *validator.Validator, username string) {
+	v.CheckField(validator.NotBlank(username), "username", "validation.blank")
+	v.CheckField(validator.MinChars(username, 3), "username", "validation.min_chars", 3)
+	v.CheckField(validator.MaxChars(username, 30), "username", "validation.max_chars", 30)
+	v.CheckField(validator.Matches(username, validator.UsernameRX), "username", "validation.username")
+}
+
+type accountEditForm struct {
+	Name                string `form:"name"`
+	Username            string `form:"username"`
+	Email               string `form:"email"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) accountEdit(w http.ResponseWriter, r *http.Request) {
+	user := app.currentUser(r)
+	data := app.newTemplateData(r)
+	data.Form = accountEditForm{Name: user.Name, Username: user.Username, Email: user.Email}
+	app.render(w, r, http.StatusOK, "account_edit.tmpl", data)
+}
+
+// accountEditPost 修改姓名、用户名和邮箱。姓名和用户名立即生效；新邮箱需要点击发到该地址的确认链接后才会生效，
+// 同时会给原邮箱发一封通知，账号被盗用时原主人可以及时发现。
+func (app *application) accountEditPost(w http.ResponseWriter, r *http.Request) {
+	var form accountEditForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.Name = strings.TrimSpace(form.Name)
+	form.Username = strings.ToLower(strings.TrimSpace(form.Username))
+	form.Email = strings.TrimSpace(form.Email)
+	form.CheckField(validator.NotBlank(form.Name), "name", "validation.blank")
+	form.CheckField(validator.MaxChars(form.Name, 255), "name", "validation.max_chars", 255)
+	checkUsername(&form.Validator, form.Username)
+	form.CheckField(validator.NotBlank(form.Email), "email", "validation.blank")
+	form.CheckField(validator.Matches(form.Email, validator.EmailRX), "email", "validation.email")
+
+	user := app.currentUser(r)
+	emailChanged := !strings.EqualFold(form.Email, user.Email)
+	if form.Valid() && emailChanged {
+		// 这里的检查只是为了尽早给出提示，确认时数据库的唯一约束才是最终的保障
+		_, err = app.users.GetByEmail(r.Context(), form.Email)
+		if err == nil {
+			form.AddFieldError("email", "error.email_taken")
+		} else if !errors.Is(err, models.ErrNoRecord) {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+	if form.Valid() {
+		err = app.users.UpdateProfile(r.Context(), user.ID, form.Name, form.Username)
+		if err != nil {
+			if errors.Is(err, models.ErrDuplicateUsername) {
+				form.AddFieldError("username", "error.username_taken")
+			} else {
+				app.serverError(w, r, err)
+				return
+			}
+		}
+	}
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "account_edit.tmpl", data)
+		return
+	}
+
+	if !emailChanged {
+		app.flash(r, "flash.profile_updated")
+		http.Redirect(w, r, "/account/view", http.StatusSeeOther)
+		return
+	}
+
+	err = app.requestEmailChange(r, user, form.Email)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.flash(r, "flash.email_change_sent", form.Email)
+	http.Redirect(w, r, "/account/view", http.StatusSeeOther)
+}
+
+// requestEmailChange 记录修改请求，把确认链接发到新邮箱，并通知原邮箱。
+func (app *application) requestEmailChange(r *http.Request, user *models.User, email string) error {
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+	err = app.emailChanges.Insert(r.Context(), user.ID, email, token, time.Now().Add(emailChangeTTL))
+	if err != nil {
+		return err
+	}
+
+	link := app.absoluteURL("/account/email/verify?token=" + url.QueryEscape(token))
+	err = app.mailer.Send(mailer.Message{
+		To:      email,
+		Subject: "Confirm your new Snippetbox email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your new email address by opening the link below within 24 hours:\n\n%s\n\n"+
+			"If you didn't ask to change your email address, you can ignore this message.\n", user.Name, link),
+	})
+	if err != nil {
+		return err
+	}
+	// 通知邮件发送失败不影响修改流程，放到后台发送，不让用户等待 SMTP 服务器
+	app.background(func() {
+		err := app.mailer.Send(mailer.Message{
+			To:      user.Email,
+			Subject: "Your Snippetbox email address is being changed",
+			Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to change the email address of your Snippetbox account to %s. "+
+				"The change takes effect once the new address is confirmed.\n\n"+
+				"If this wasn't you, change your password and sign out your other sessions straight away.\n", user.Name, email),
+		})
+		if err != nil {
+			app.logger.ErrorContext(r.Context(), "sending email change notice", "user_id", user.ID, "error", err)
+		}
+	})
+	return nil
+}
+
+// accountEmailVerify 处理确认链接。令牌本身就是凭证，所以不要求当前处于登录状态，用户可以在其他设备上打开邮件中的链接。
+func (app *application) accountEmailVerify(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		app.notFound(w)
+		return
+	}
+	_, email, err := app.emailChanges.Confirm(r.Context(), token)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecord):
+			app.flash(r, "flash.email_link_invalid")
+		case errors.Is(err, models.ErrDuplicateEmail):
+			app.flash(r, "flash.email_taken")
+		default:
+			app.serverError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	app.flash(r, "flash.email_changed", email)
+	http.Redirect(w, r, "/account/view", http.StatusSeeOther)
+}
+
+// newToken 生成一个 URL 安全的随机令牌，包含 256 位的随机数据。
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"github.com/justinas/alice"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TLS 终结代理用这些标头告诉后端原始请求的协议和客户端地址，只在 -behind-proxy 模式下才被信任
+const (
+	forwardedProtoHeader = "X-Forwarded-Proto"
+	forwardedForHeader   = "X-Forwarded-For"
+	realIPHeader         = "X-Real-IP"
+)
+
+// healthPaths 中的路径在纯 HTTP 上也直接处理而不是重定向，负载均衡器和编排系统的探针通常不走 HTTPS
+var healthPaths = map[string]bool{
+	"/ping":    true,
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// redirectRoutes 返回 -http-addr 纯 HTTP 端口的处理程序：健康检查照常响应，其余请求一律重定向到 HTTPS。
+func (app *application) redirectRoutes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", app.ping)
+	mux.HandleFunc("/healthz", app.healthz)
+	mux.HandleFunc("/readyz", app.readyz)
+	mux.HandleFunc("/", app.redirectToHTTPS)
+	return alice.New(app.requestID, app.logRequest, app.recoverPanic).Then(mux)
+}
+
+// redirectToHTTPS 把请求重定向到同一路径和查询参数的 HTTPS 地址。GET 和 HEAD 用 301，
+// 其他方法用 308，浏览器重新提交时保持原来的方法和请求体。
+func (app *application) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusPermanentRedirect
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		status = http.StatusMovedPermanently
+	}
+	http.Redirect(w, r, app.httpsURL(r), status)
+}
+
+// httpsURL 返回请求对应的 HTTPS 地址。主机名和端口取自 -base-url 而不是请求的 Host 标头：
+// 后者由客户端控制，伪造的 Host 会让可以被缓存的 301 把用户带到别的站点。
+// -base-url 即使是 http 也改为 https，否则纯 HTTP 端口会重定向到自己。
+func (app *application) httpsURL(r *http.Request) string {
+	host := "localhost"
+	// 启动时已经检查过 -base-url，这里不会出错
+	if u, err := url.Parse(app.cfg.baseURL); err == nil {
+		host = u.Host
+	}
+	return "https://" + host + r.URL.RequestURI()
+}
+
+// isSecure 判断客户端是否通过 HTTPS 访问。只有在 -behind-proxy 模式下才相信 X-Forwarded-Proto，
+// 否则任何客户端都可以伪造这个标头。
+func (app *application) isSecure(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return app.cfg.behindProxy && strings.EqualFold(r.Header.Get(forwardedProtoHeader), "https")
+}
+
+// forwardedProto 在 -behind-proxy 模式下把代理转发来的纯 HTTP 请求（X-Forwarded-Proto: http）重定向到 HTTPS。
+// 没有这个标头的请求（例如直接访问后端的健康检查）照常处理。
+func (app *application) forwardedProto(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.cfg.behindProxy && !healthPaths[r.URL.Path] && strings.EqualFold(r.Header.Get(forwardedProtoHeader), "http") {
+			app.redirectToHTTPS(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hstsHeader 返回 Strict-Transport-Security 标头的值，-hsts-max-age 为 0 时返回空字符串。
+func hstsHeader(maxAge time.Duration, includeSubdomains bool) string {
+	if maxAge <= 0 {
+		return ""
+	}
+	value := fmt.Sprintf("max-age=%d", int64(maxAge/time.Second))
+	if includeSubdomains {
+		value += "; includeSubDomains"
+	}
+	return value
+}
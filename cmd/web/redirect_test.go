@@ -0,0 +1,346 @@
+package main
+
+import (
+	"github.com/hlf2016/snippetbox/internal/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newPlainTestServer 和 newTestServer 一样，但使用纯 HTTP
+func newPlainTestServer(t *testing.T, h http.Handler) *testServer {
+	ts := httptest.NewServer(h)
+	ts.Client().CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &testServer{ts}
+}
+
+// do 发送带有指定标头的请求，返回状态码和响应标头
+func (ts *testServer) do(t *testing.T, method, urlPath string, header map[string]string) (int, http.Header) {
+	req, err := http.NewRequest(method, ts.URL+urlPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rs, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Body.Close()
+	return rs.StatusCode, rs.Header
+}
+
+func TestRedirectRoutes(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newPlainTestServer(t, app.redirectRoutes())
+	defer ts.Close()
+
+	tests := []struct {
+		name         string
+		method       string
+		urlPath      string
+		host         string
+		wantCode     int
+		wantLocation string
+	}{
+		{
+			name:         "Path and query preserved",
+			method:       http.MethodGet,
+			urlPath:      "/snippet/view/1?page=2&q=a%20b",
+			host:         "snippetbox.example.com",
+			wantCode:     http.StatusMovedPermanently,
+			wantLocation: "https://snippetbox.example.com/snippet/view/1?page=2&q=a%20b",
+		},
+		{
+			name:         "Spoofed host ignored",
+			method:       http.MethodGet,
+			urlPath:      "/",
+			host:         "evil.example.net:8080",
+			wantCode:     http.StatusMovedPermanently,
+			wantLocation: "https://snippetbox.example.com/",
+		},
+		{
+			name:         "POST keeps its method",
+			method:       http.MethodPost,
+			urlPath:      "/user/login",
+			host:         "snippetbox.example.com",
+			wantCode:     http.StatusPermanentRedirect,
+			wantLocation: "https://snippetbox.example.com/user/login",
+		},
+		{
+			name:     "Liveness served",
+			method:   http.MethodGet,
+			urlPath:  "/healthz",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "Readiness served",
+			method:   http.MethodGet,
+			urlPath:  "/readyz",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "Ping served",
+			method:   http.MethodGet,
+			urlPath:  "/ping",
+			wantCode: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, ts.URL+tt.urlPath, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+			rs, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rs.Body.Close()
+			assert.Equal(t, rs.StatusCode, tt.wantCode)
+			assert.Equal(t, rs.Header.Get("Location"), tt.wantLocation)
+		})
+	}
+}
+
+func TestHTTPSURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		baseURL string
+		host    string
+		want    string
+	}{
+		{
+			name:    "Host from base URL",
+			baseURL: "https://snippetbox.example.com",
+			host:    "evil.example.net",
+			want:    "https://snippetbox.example.com/a?b=c",
+		},
+		{
+			name:    "Base URL port kept",
+			baseURL: "https://localhost:4000",
+			host:    "localhost:80",
+			want:    "https://localhost:4000/a?b=c",
+		},
+		{
+			name:    "IPv6",
+			baseURL: "https://[::1]:4000/",
+			host:    "[::1]:80",
+			want:    "https://[::1]:4000/a?b=c",
+		},
+		{
+			name:    "HTTP base URL",
+			baseURL: "http://snippetbox.example.com",
+			host:    "snippetbox.example.com",
+			want:    "https://snippetbox.example.com/a?b=c",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.cfg.baseURL = tt.baseURL
+			r := httptest.NewRequest(http.MethodGet, "/a?b=c", nil)
+			r.Host = tt.host
+			assert.Equal(t, app.httpsURL(r), tt.want)
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name        string
+		behindProxy bool
+		header      map[string]string
+		want        string
+	}{
+		{
+			name: "Direct connection",
+			want: "192.0.2.1",
+		},
+		{
+			name:   "Forwarded headers ignored without proxy mode",
+			header: map[string]string{forwardedForHeader: "203.0.113.7", realIPHeader: "203.0.113.8"},
+			want:   "192.0.2.1",
+		},
+		{
+			name:        "Forwarded for",
+			behindProxy: true,
+			header:      map[string]string{forwardedForHeader: "203.0.113.7"},
+			want:        "203.0.113.7",
+		},
+		{
+			name:        "Spoofed entries before the proxy's own",
+			behindProxy: true,
+			header:      map[string]string{forwardedForHeader: "198.51.100.1, 203.0.113.7"},
+			want:        "203.0.113.7",
+		},
+		{
+			name:        "Real IP",
+			behindProxy: true,
+			header:      map[string]string{realIPHeader: "2001:db8::1"},
+			want:        "2001:db8::1",
+		},
+		{
+			name:        "Invalid header",
+			behindProxy: true,
+			header:      map[string]string{forwardedForHeader: "unknown"},
+			want:        "192.0.2.1",
+		},
+		{
+			name:        "No headers",
+			behindProxy: true,
+			want:        "192.0.2.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.cfg.behindProxy = tt.behindProxy
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			assert.Equal(t, app.clientIP(r), tt.want)
+		})
+	}
+}
+
+func TestBehindProxy(t *testing.T) {
+	app := newTestApplication(t)
+	app.cfg.behindProxy = true
+	app.cfg.hsts.maxAge = 365 * 24 * time.Hour
+	ts := newPlainTestServer(t, app.routes())
+	defer ts.Close()
+
+	tests := []struct {
+		name         string
+		urlPath      string
+		proto        string
+		wantCode     int
+		wantLocation string
+		wantHSTS     string
+	}{
+		{
+			name:     "Forwarded over HTTPS",
+			urlPath:  "/",
+			proto:    "https",
+			wantCode: http.StatusOK,
+			wantHSTS: "max-age=31536000",
+		},
+		{
+			name:         "Forwarded over HTTP",
+			urlPath:      "/snippet/view/1?x=1",
+			proto:        "http",
+			wantCode:     http.StatusMovedPermanently,
+			wantLocation: "https://snippetbox.example.com/snippet/view/1?x=1",
+		},
+		{
+			name:     "Health check over HTTP",
+			urlPath:  "/healthz",
+			proto:    "http",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "Direct request without the header",
+			urlPath:  "/",
+			wantCode: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, ts.URL+tt.urlPath, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = "snippetbox.example.com"
+			if tt.proto != "" {
+				req.Header.Set(forwardedProtoHeader, tt.proto)
+			}
+			rs, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rs.Body.Close()
+			assert.Equal(t, rs.StatusCode, tt.wantCode)
+			assert.Equal(t, rs.Header.Get("Location"), tt.wantLocation)
+			assert.Equal(t, rs.Header.Get("Strict-Transport-Security"), tt.wantHSTS)
+		})
+	}
+}
+
+func TestHSTS(t *testing.T) {
+	tests := []struct {
+		name              string
+		maxAge            time.Duration
+		includeSubdomains bool
+		plainHTTP         bool
+		proto             string
+		want              string
+	}{
+		{
+			name:   "Disabled",
+			maxAge: 0,
+			want:   "",
+		},
+		{
+			name:   "Enabled",
+			maxAge: 2 * time.Hour,
+			want:   "max-age=7200",
+		},
+		{
+			name:              "Include subdomains",
+			maxAge:            2 * time.Hour,
+			includeSubdomains: true,
+			want:              "max-age=7200; includeSubDomains",
+		},
+		{
+			name:      "Not sent over plain HTTP",
+			maxAge:    2 * time.Hour,
+			plainHTTP: true,
+			want:      "",
+		},
+		{
+			// 不在代理模式下时任何客户端都可以伪造这个标头
+			name:      "Forwarded proto not trusted without proxy mode",
+			maxAge:    2 * time.Hour,
+			plainHTTP: true,
+			proto:     "https",
+			want:      "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.cfg.hsts.maxAge = tt.maxAge
+			app.cfg.hsts.includeSubdomains = tt.includeSubdomains
+
+			var ts *testServer
+			if tt.plainHTTP {
+				ts = newPlainTestServer(t, app.routes())
+			} else {
+				ts = newTestServer(t, app.routes())
+			}
+			defer ts.Close()
+
+			header := map[string]string{}
+			if tt.proto != "" {
+				header[forwardedProtoHeader] = tt.proto
+			}
+			_, h := ts.do(t, http.MethodGet, "/", header)
+			assert.Equal(t, h.Get("Strict-Transport-Security"), tt.want)
+		})
+	}
+}
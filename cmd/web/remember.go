@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"github.com/hlf2016/snippetbox/internal/models"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// 保存 "系列:令牌" 的 cookie
+	rememberCookie = "remember_me"
+	// 会话中记录当前会话是由哪个系列的令牌建立（或签发）的，退出登录时删除这个系列
+	rememberSeriesKey = "rememberSeries"
+	// 同一个浏览器同时发出的几个请求可能都带着刚被更换掉的令牌，这段时间内出现上一个令牌不视为盗用
+	rememberGracePeriod = 30 * time.Second
+)
+
+// issueRememberToken 为刚登录的会话签发一个新系列的令牌。必须在 RenewToken() 之后调用。
+func (app *application) issueRememberToken(w http.ResponseWriter, r *http.Request, userID int) error {
+	series, err := newToken()
+	if err != nil {
+		return err
+	}
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+	expires := time.Now().Add(app.cfg.remember.lifetime)
+	err = app.rememberTokens.Insert(r.Context(), userID, series, token, app.sessionManager.Token(r.Context()), expires)
+	if err != nil {
+		return err
+	}
+	app.sessionManager.Put(r.Context(), rememberSeriesKey, series)
+	setRememberCookie(w, series+":"+token, expires)
+	return nil
+}
+
+// rememberMe 中间件在会话中没有登录用户、但浏览器带着"记住我"cookie 时，用令牌重新登录并更换令牌。
+// 它必须放在 LoadAndSave 之后、authenticate 之前。
+func (app *application) rememberMe(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(rememberCookie)
+		if err != nil || app.sessionManager.Exists(r.Context(), app.authId) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		err = app.loginWithRememberToken(w, r, cookie.Value)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (app *application) loginWithRememberToken(w http.ResponseWriter, r *http.Request, value string) error {
+	series, token, ok := strings.Cut(value, ":")
+	if !ok {
+		clearRememberCookie(w)
+		return nil
+	}
+	t, err := app.rememberTokens.Get(r.Context(), series)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			clearRememberCookie(w)
+			return nil
+		}
+		return err
+	}
+
+	now := time.Now()
+	rotate := true
+	switch {
+	case now.After(t.Expires) || now.Sub(t.LastUsed) > app.cfg.remember.idleTimeout:
+		clearRememberCookie(w)
+		return app.rememberTokens.Delete(r.Context(), series)
+	case t.Matches(token):
+	case t.MatchesPrevious(token) && now.Sub(t.Rotated) < rememberGracePeriod:
+		// 另一个并发请求刚刚更换了令牌，它的响应会带回新的 cookie，这里只登录不再更换
+		rotate = false
+	default:
+		// 系列正确但令牌不对：这个 cookie 被复制过，并且另一方已经用它登录过。无法分辨哪一方是合法用户，
+		// 所以撤销该用户所有的令牌和会话，让双方都重新输入密码。
+		app.logger.WarnContext(r.Context(), "remember-me token reuse, revoking all sessions", "user_id", t.UserID)
+		clearRememberCookie(w)
+		err = app.revokeAllUserSessions(r.Context(), t.UserID)
+		if err != nil {
+			return err
+		}
+		app.flash(r, "flash.remember_theft")
+		return nil
+	}
+
+	user, err := app.users.Get(r.Context(), t.UserID)
+	if err != nil && !errors.Is(err, models.ErrNoRecord) {
+		return err
+	}
+	if user == nil || user.Disabled {
+		clearRememberCookie(w)
+		return app.rememberTokens.Delete(r.Context(), series)
+	}
+
+	// 与密码登录一样换一个新的会话令牌
+	err = app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		return err
+	}
+	if rotate {
+		newValue, err := newToken()
+		if err != nil {
+			return err
+		}
+		rotated, err := app.rememberTokens.Rotate(r.Context(), series, token, newValue, app.sessionManager.Token(r.Context()))
+		if err != nil {
+			return err
+		}
+		// 没有更换成功说明并发的请求抢先一步，同样只登录不设置 cookie
+		if rotated {
+			setRememberCookie(w, series+":"+newValue, t.Expires)
+		}
+	}
+	app.sessionManager.Put(r.Context(), app.authId, user.ID)
+	app.sessionManager.Put(r.Context(), rememberSeriesKey, series)
+	return app.recordUserSession(r, user.ID)
+}
+
+// forgetRememberToken 在退出登录时删除当前会话的令牌系列和浏览器中的 cookie。
+func (app *application) forgetRememberToken(w http.ResponseWriter, r *http.Request) error {
+	clearRememberCookie(w)
+	series := app.sessionManager.PopString(r.Context(), rememberSeriesKey)
+	if series == "" {
+		return nil
+	}
+	return app.rememberTokens.Delete(r.Context(), series)
+}
+
+func setRememberCookie(w http.ResponseWriter, value string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     rememberCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearRememberCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     rememberCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
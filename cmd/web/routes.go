@@ -1,6 +1,7 @@
 package main
 
 import (
+	"github.com/hlf2016/snippetbox/internal/models"
 	"github.com/hlf2016/snippetbox/ui"
 	"github.com/julienschmidt/httprouter"
 	"github.com/justinas/alice"
@@ -9,6 +10,11 @@ import (
 
 func (app *application) routes() http.Handler {
 	router := httprouter.New()
+	// 所有路由都通过 handle 注册：它把路由模式记录下来，作为请求指标的 route 标签和追踪中 span 的名称，
+	// 并为处理程序创建单独的 span
+	handle := func(method, pattern string, chain alice.Chain, handler http.HandlerFunc) {
+		router.Handler(method, pattern, withRoute(pattern, chain.Then(app.traceHandler(method, pattern, handler))))
+	}
 
 	// 创建一个封装 notFound() 辅助函数的处理函数，然后将其指定为 404 Not Found 响应的自定义处理函数。
 	// 您还可以通过设置 router.MethodNotAllowed 来为 405 Method Not Allowed 响应设置自定义处理程序。
@@ -25,34 +31,94 @@ func (app *application) routes() http.Handler {
 	// 将 ui.Files 嵌入式文件系统转换为 http.FS 类型，使其满足 http.FileSystem 接口的要求。然后，我们将其传递给 http.FileServer() 函数，创建文件服务器处理程序。
 	fileServer := http.FileServer(http.FS(ui.Files))
 	// log.Print(cfg)
-	router.Handler(http.MethodGet, "/static/*filepath", fileServer)
+	handle(http.MethodGet, "/static/*filepath", alice.New(), fileServer.ServeHTTP)
 	// 我们的静态文件包含在ui.Files嵌入式文件系统的“Static”文件夹中。因此，例如，我们的CSS样式表位于“Static/css/main.css”。这意味着我们现在不再需要从请求URL中去掉前缀--任何以静态开头的请求都可以直接传递到文件服务器，并且将提供相应的静态文件(只要它存在)。
 
-	router.HandlerFunc(http.MethodGet, "/ping", ping)
+	handle(http.MethodGet, "/ping", alice.New(), app.ping)
+	// 存活检查和就绪检查，供 Kubernetes 等编排系统的探针使用
+	handle(http.MethodGet, "/healthz", alice.New(), app.healthz)
+	handle(http.MethodGet, "/readyz", alice.New(), app.readyz)
+	// 没有单独的管理端口时，/metrics 和普通页面使用同一个端口，必须配置令牌
+	if app.cfg.metrics.addr == "" && app.cfg.metrics.token != "" {
+		handle(http.MethodGet, "/metrics", alice.New(), app.metrics.handler(app.cfg.metrics.token).ServeHTTP)
+	}
 	// 该中间件会在每次 HTTP 请求和响应时自动加载和保存会话数据。
 	// 使用 "dynamic "中间件链的无保护应用路由。
 	// 在所有 "dynamic"路由上使用 nosurf 中间件
-	dynamic := alice.New(app.sessionManager.LoadAndSave, noSurf, app.authenticate)
+	// rememberMe 在会话过期后用"记住我"令牌自动登录，必须在 authenticate 之前
+	// 每个中间件都用 traced 包装，在追踪中显示为单独的 span
+	dynamic := alice.New(
+		app.traced("LoadAndSave", app.sessionManager.LoadAndSave),
+		app.traced("noSurf", noSurf),
+		app.traced("rememberMe", app.rememberMe),
+		app.traced("authenticate", app.authenticate),
+	)
 
-	router.Handler(http.MethodGet, "/about", dynamic.ThenFunc(app.about))
-	router.Handler(http.MethodGet, "/", dynamic.ThenFunc(app.home))
-	router.Handler(http.MethodGet, "/snippet/view/:id", dynamic.ThenFunc(app.snippetView))
-	router.Handler(http.MethodGet, "/user/signup", dynamic.ThenFunc(app.userSignup))
-	router.Handler(http.MethodPost, "/user/signup", dynamic.ThenFunc(app.userSignupPost))
-	router.Handler(http.MethodGet, "/user/login", dynamic.ThenFunc(app.userLogin))
-	router.Handler(http.MethodPost, "/user/login", dynamic.ThenFunc(app.userLoginPost))
+	handle(http.MethodGet, "/about", dynamic, app.about)
+	handle(http.MethodGet, "/", dynamic, app.home)
+	handle(http.MethodGet, "/snippet/view/:id", dynamic, app.snippetView)
+	handle(http.MethodGet, "/u/:id", dynamic, app.userProfile)
+	handle(http.MethodGet, "/user/signup", dynamic, app.userSignup)
+	handle(http.MethodPost, "/user/signup", dynamic, app.userSignupPost)
+	handle(http.MethodGet, "/user/login", dynamic, app.userLogin)
+	handle(http.MethodPost, "/user/login", dynamic, app.userLoginPost)
+	handle(http.MethodGet, "/user/login/totp", dynamic, app.userLoginTOTP)
+	handle(http.MethodPost, "/user/login/totp", dynamic, app.userLoginTOTPPost)
+	handle(http.MethodGet, "/account/email/verify", dynamic, app.accountEmailVerify)
+	// 通过外部 OpenID Connect 提供方单点登录，未配置提供方时返回 404
+	handle(http.MethodGet, "/auth/oidc/login", dynamic, app.oidcLogin)
+	handle(http.MethodGet, "/auth/oidc/callback", dynamic, app.oidcCallback)
+	// 页脚的语言切换表单，未登录的用户也可以使用
+	handle(http.MethodPost, "/locale", dynamic, app.setLocalePost)
 
 	// 受保护（仅通过身份验证）的应用路由，使用新的 "protected"中间件链，其中包括 requireAuthentication 中间件。
-	protected := dynamic.Append(app.requireAuthentication)
-	router.Handler(http.MethodGet, "/snippet/create", protected.ThenFunc(app.snippetCreate))
-	router.Handler(http.MethodPost, "/snippet/create", protected.ThenFunc(app.snippetCreatePost))
-	router.Handler(http.MethodPost, "/user/logout", protected.ThenFunc(app.userLogoutPost))
-	router.Handler(http.MethodGet, "/account/view", protected.ThenFunc(app.accountView))
-	router.Handler(http.MethodGet, "/account/password/update", protected.ThenFunc(app.accountPasswordUpdate))
-	router.Handler(http.MethodPost, "/account/password/update", protected.ThenFunc(app.accountPasswordUpdatePost))
+	protected := dynamic.Append(app.traced("requireAuthentication", app.requireAuthentication))
+	handle(http.MethodGet, "/snippet/create", protected, app.snippetCreate)
+	handle(http.MethodPost, "/snippet/create", protected, app.snippetCreatePost)
+	handle(http.MethodPost, "/snippet/delete/:id", protected, app.snippetDeletePost)
+	handle(http.MethodPost, "/user/logout", protected, app.userLogoutPost)
+	handle(http.MethodGet, "/account/view", protected, app.accountView)
+	handle(http.MethodGet, "/account/password/update", protected, app.accountPasswordUpdate)
+	handle(http.MethodPost, "/account/password/update", protected, app.accountPasswordUpdatePost)
+	handle(http.MethodGet, "/account/totp/setup", protected, app.accountTOTPSetup)
+	handle(http.MethodPost, "/account/totp/setup", protected, app.accountTOTPSetupPost)
+	handle(http.MethodGet, "/account/totp/qr.png", protected, app.accountTOTPQRCode)
+	handle(http.MethodPost, "/account/totp/disable", protected, app.accountTOTPDisablePost)
+	handle(http.MethodGet, "/account/sessions", protected, app.accountSessions)
+	handle(http.MethodPost, "/account/sessions/revoke", protected, app.accountSessionRevokePost)
+	handle(http.MethodPost, "/account/sessions/revoke-others", protected, app.accountSessionRevokeOthersPost)
+	handle(http.MethodPost, "/account/bio", protected, app.accountBioPost)
+	handle(http.MethodGet, "/account/preferences", protected, app.accountPreferences)
+	handle(http.MethodPost, "/account/preferences", protected, app.accountPreferencesPost)
+	handle(http.MethodGet, "/account/edit", protected, app.accountEdit)
+	handle(http.MethodPost, "/account/edit", protected, app.accountEditPost)
+	handle(http.MethodGet, "/account/export", protected, app.accountExport)
+	handle(http.MethodGet, "/account/delete", protected, app.accountDelete)
+	handle(http.MethodPost, "/account/delete", protected, app.accountDeletePost)
+	handle(http.MethodPost, "/account/delete/reauth", protected, app.accountDeleteReauthPost)
+
+	// 仅管理员可以访问的路由
+	admin := protected.Append(app.traced("requireRole", app.requireRole(models.RoleAdmin)))
+	handle(http.MethodGet, "/admin", admin, app.adminView)
+	handle(http.MethodPost, "/admin/users/role", admin, app.adminUserRolePost)
+	handle(http.MethodPost, "/admin/users/disable/:id", admin, app.adminUserDisablePost)
+	handle(http.MethodPost, "/admin/users/enable/:id", admin, app.adminUserEnablePost)
+	handle(http.MethodPost, "/admin/users/force-reset/:id", admin, app.adminUserForceResetPost)
+	handle(http.MethodGet, "/admin/snippets", admin, app.adminSnippets)
+	handle(http.MethodPost, "/admin/snippets/delete", admin, app.adminSnippetDeletePost)
 
 	// 创建一个中间件链，其中包含我们的 "标准 "中间件，该中间件将用于应用程序收到的每个请求。
-	standard := alice.New(app.recoverPanic, app.logRequest, secureHeaders)
+	// traceRequest 放在最前面，为整个请求创建服务端 span；requestID 紧随其后，后面所有中间件的日志都能带上请求 ID；
+	// recoverPanic 放在 measureRequest 和 logRequest 里面，panic 导致的 500 也会记入指标和访问日志。
+	standard := alice.New(
+		app.traceRequest,
+		app.traced("requestID", app.requestID),
+		app.traced("measureRequest", app.measureRequest),
+		app.traced("logRequest", app.logRequest),
+		app.traced("recoverPanic", app.recoverPanic),
+		app.traced("forwardedProto", app.forwardedProto),
+		app.traced("secureHeaders", app.secureHeaders),
+	)
 	// 将 servemux 作为 "next "参数传递给 secureHeaders 中间件。
 	// 因为 secureHeaders 只是一个函数，而函数返回的是 http.Handler，所以我们不需要做其他任何事情。
 	return standard.Then(router)
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// serve 用 srv.TLSConfig 中的证书启动 HTTPS 服务器（TLSConfig 为 nil 时启动纯 HTTP 服务器），并在收到 SIGINT 或 SIGTERM 后优雅地关闭：
+//  1. 先让 /ping 返回 503，等待 shutdownDelay，让负载均衡器有时间把本实例摘掉；
+//  2. 调用 srv.Shutdown 停止接受新连接，等待正在处理的请求完成，最多等待 shutdownTimeout；
+//  3. 关闭 aux 中的服务器，然后在剩余的时间内等待 app.background 启动的后台任务结束。
+//
+// 其中一步失败（例如请求没能在 shutdownTimeout 内完成）不会跳过后面的步骤，所有的错误用 errors.Join 合并后返回。
+//
+// aux 是随主服务器一起启动和关闭的纯 HTTP 服务器，例如 /metrics 的管理端口和重定向到 HTTPS 的端口。
+//
+// 正常关闭时返回 nil。
+func (app *application) serve(srv *http.Server, aux ...*http.Server) error {
+	shutdownErr := make(chan error)
+	// 任何一个服务器无法启动（例如端口被占用）时，serve 都直接返回错误
+	listenErr := make(chan error, len(aux)+1)
+
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		s := <-quit
+
+		app.logger.Info("caught signal, shutting down", "signal", s.String())
+		app.shuttingDown.Store(true)
+		time.Sleep(app.cfg.shutdown.delay)
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.cfg.shutdown.timeout)
+		defer cancel()
+		// 某一步出错（通常是超时）时仍然继续后面的步骤，所有服务器都要关闭、后台任务都要等待，错误最后一起返回
+		var errs []error
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("shutting down %s: %w", srv.Addr, err))
+		}
+		// 辅助服务器最后关闭，排空请求期间仍然可以抓取指标
+		for _, s := range aux {
+			err = s.Shutdown(ctx)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("shutting down %s: %w", s.Addr, err))
+			}
+		}
+
+		app.logger.Info("waiting for background tasks to finish")
+		done := make(chan struct{})
+		go func() {
+			app.wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			errs = append(errs, fmt.Errorf("background tasks did not finish: %w", ctx.Err()))
+		}
+		shutdownErr <- errors.Join(errs...)
+	}()
+
+	// 使用 ListenAndServeTLS() 方法启动 HTTPS 服务器。证书由 srv.TLSConfig.GetCertificate 提供，所以证书和私钥的路径参数留空。
+	// 调用 Shutdown() 后它会立即返回 http.ErrServerClosed，这不是错误，真正的结果要等关闭过程结束
+	for _, s := range aux {
+		go func(s *http.Server) {
+			listenErr <- s.ListenAndServe()
+		}(s)
+	}
+	go func() {
+		// 没有 TLSConfig 时（-behind-proxy）由前面的代理终结 TLS，这里只提供纯 HTTP
+		if srv.TLSConfig == nil {
+			listenErr <- srv.ListenAndServe()
+			return
+		}
+		listenErr <- srv.ListenAndServeTLS("", "")
+	}()
+	err := <-listenErr
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return <-shutdownErr
+}
+
+// background 在新的 goroutine 中执行 fn，服务器关闭时会等待它结束。fn 中的 panic 会被记录下来而不是让整个程序崩溃。
+func (app *application) background(fn func()) {
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.Error("panic in background task", "error", fmt.Sprint(err))
+			}
+		}()
+		fn()
+	}()
+}
+
+// ping 供负载均衡器检查实例是否可以接收请求。收到关闭信号后返回 503，负载均衡器随即停止转发新请求。
+func (app *application) ping(w http.ResponseWriter, r *http.Request) {
+	if app.shuttingDown.Load() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("OK"))
+}
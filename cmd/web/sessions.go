@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/hlf2016/snippetbox/internal/models"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 最后活跃时间的更新间隔。每个请求都写一次数据库没有必要，一分钟的精度对会话列表来说已经足够。
+const userSessionTouchInterval = time.Minute
+
+// clientIP 返回发起请求的客户端 IP 地址（去掉端口号）。在 -behind-proxy 模式下 RemoteAddr 是代理的地址，
+// 这时和 isSecure 一样相信代理设置的标头：优先取 X-Forwarded-For 的最后一项，也就是代理自己追加的、
+// 与它直接相连的客户端地址（前面的各项由客户端发来，可以伪造），其次取 X-Real-IP。标头缺失或不是合法的 IP 时退回 RemoteAddr。
+func (app *application) clientIP(r *http.Request) string {
+	if app.cfg.behindProxy {
+		if xff := r.Header.Values(forwardedForHeader); len(xff) > 0 {
+			hops := strings.Split(xff[len(xff)-1], ",")
+			if ip := net.ParseIP(strings.TrimSpace(hops[len(hops)-1])); ip != nil {
+				return ip.String()
+			}
+		}
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get(realIPHeader))); ip != nil {
+			return ip.String()
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// recordUserSession 必须在 RenewToken() 之后调用，这样记录下来的才是新的会话令牌。
+func (app *application) recordUserSession(r *http.Request, userID int) error {
+	token := app.sessionManager.Token(r.Context())
+	expires := app.sessionManager.Deadline(r.Context())
+	app.sessionManager.Put(r.Context(), "sessionLastSeen", time.Now().Unix())
+	// user_agent 列长度为 512，超长的 User-Agent 直接截断
+	userAgent := r.UserAgent()
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+	return app.userSessions.Insert(r.Context(), userID, token, userAgent, app.clientIP(r), expires)
+}
+
+// touchUserSession 由 authenticate 中间件在每个已登录请求上调用，按 userSessionTouchInterval 的间隔刷新最后活跃时间。
+func (app *application) touchUserSession(r *http.Request) error {
+	lastSeen := app.sessionManager.GetInt64(r.Context(), "sessionLastSeen")
+	if time.Since(time.Unix(lastSeen, 0)) < userSessionTouchInterval {
+		return nil
+	}
+	app.sessionManager.Put(r.Context(), "sessionLastSeen", time.Now().Unix())
+	return app.userSessions.Touch(r.Context(), app.sessionManager.Token(r.Context()))
+}
+
+// revokeUserSession 从会话存储中删除会话数据，持有该令牌的浏览器下次请求时就会变成未登录状态。
+// 用来建立这个会话的"记住我"令牌也一并删除，否则浏览器马上又会自动登录。
+func (app *application) revokeUserSession(ctx context.Context, token string) error {
+	err := app.sessionManager.Store.Delete(token)
+	if err != nil {
+		return err
+	}
+	err = app.rememberTokens.DeleteBySession(ctx, token)
+	if err != nil {
+		return err
+	}
+	return app.userSessions.Delete(ctx, token)
+}
+
+// revokeAllUserSessions 撤销用户所有的会话和"记住我"令牌。
+func (app *application) revokeAllUserSessions(ctx context.Context, userID int) error {
+	sessions, err := app.userSessions.ForUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		err = app.revokeUserSession(ctx, s.Token)
+		if err != nil {
+			return err
+		}
+	}
+	return app.rememberTokens.DeleteForUser(ctx, userID, "")
+}
+
+func (app *application) accountSessions(w http.ResponseWriter, r *http.Request) {
+	userID := app.sessionManager.GetInt(r.Context(), app.authId)
+	sessions, err := app.userSessions.ForUser(r.Context(), userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.UserSessions = sessions
+	currentToken := app.sessionManager.Token(r.Context())
+	for _, s := range sessions {
+		if s.Token == currentToken {
+			data.CurrentSessionID = s.ID
+		}
+	}
+	app.render(w, r, http.StatusOK, "sessions.tmpl", data)
+}
+
+func (app *application) accountSessionRevokePost(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.Atoi(r.PostForm.Get("id"))
+	if err != nil || id < 1 {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// 查询时同时限定了 user_id，用户只能撤销属于自己的会话
+	userID := app.sessionManager.GetInt(r.Context(), app.authId)
+	session, err := app.userSessions.Get(r.Context(), userID, id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+	// 撤销当前会话等同于退出登录，交给 userLogoutPost 处理
+	if session.Token == app.sessionManager.Token(r.Context()) {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err = app.revokeUserSession(r.Context(), session.Token)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.flash(r, "flash.session_revoked")
+	http.Redirect(w, r, "/account/sessions", http.StatusSeeOther)
+}
+
+func (app *application) accountSessionRevokeOthersPost(w http.ResponseWriter, r *http.Request) {
+	userID := app.sessionManager.GetInt(r.Context(), app.authId)
+	sessions, err := app.userSessions.ForUser(r.Context(), userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	currentToken := app.sessionManager.Token(r.Context())
+	for _, s := range sessions {
+		if s.Token == currentToken {
+			continue
+		}
+		err = app.revokeUserSession(r.Context(), s.Token)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	// 会话已经过期、但仍可以用来自动登录的"记住我"令牌也要删除，只保留当前会话的
+	err = app.rememberTokens.DeleteForUser(r.Context(), userID, app.sessionManager.GetString(r.Context(), rememberSeriesKey))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// 同时更换当前会话的令牌，防止旧令牌已经泄露
+	err = app.userSessions.Delete(r.Context(), currentToken)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	err = app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	// 当前会话如果是由"记住我"令牌建立的，令牌要跟着关联到新的会话令牌，否则之后从其他设备撤销这个会话时删不掉它
+	if series := app.sessionManager.GetString(r.Context(), rememberSeriesKey); series != "" {
+		err = app.rememberTokens.UpdateSession(r.Context(), series, app.sessionManager.Token(r.Context()))
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+	err = app.recordUserSession(r, userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.flash(r, "flash.sessions_revoked_others")
+	http.Redirect(w, r, "/account/sessions", http.StatusSeeOther)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+	"github.com/hlf2016/snippetbox/internal/i18n"
 	"github.com/hlf2016/snippetbox/internal/models"
 	"github.com/hlf2016/snippetbox/ui"
 	"html/template"
@@ -17,25 +19,124 @@ type templateData struct {
 	Form            any
 	Flash           string
 	IsAuthenticated bool
-	CSRFToken       string
-	CurrentUser     *models.User
+	// 当前用户是否为管理员，nav.tmpl 根据它决定是否显示管理入口
+	IsAdmin     bool
+	CSRFToken   string
+	CurrentUser *models.User
+	// 两步验证相关：启用页面展示的手动输入密钥、启用成功后只展示一次的恢复码，以及账户页面上的开启状态
+	TOTPSecret       string
+	RecoveryCodes    []string
+	TwoFactorEnabled bool
+	// 活动会话页面：当前用户的所有会话，以及发出本次请求的会话 ID（用于标记 "当前设备"）
+	UserSessions     []*models.UserSession
+	CurrentSessionID int
+	// 当前用户是否可以删除正在查看的片段
+	CanModifySnippet bool
+	// 管理页面中可供选择的角色
+	Roles []models.Role
+	// 管理页面的统计数据、用户列表、搜索关键字和分页信息
+	AdminStats adminStats
+	Users      []*models.User
+	Query      string
+	Pagination Pagination
+	// 公开个人主页上展示的用户
+	Profile *models.User
+	// 查看者所在的时区，模板中的时间都按它显示。未登录的用户为 UTC
+	Location *time.Location
+	// 偏好设置页面中可供选择的时区，以及从浏览器检测到的时区
+	Timezones        []string
+	DetectedTimezone string
+	// 界面语言，模板中通过 {{T $.Locale "key"}} 翻译文字；Locales 是页脚和偏好设置中可供选择的语言
+	Locale  string
+	Locales []localeOption
+	// 当前页面的路径，切换语言后返回这里
+	CurrentPath string
+	// 是否配置了单点登录，登录页面据此显示入口
+	OIDCEnabled bool
+	// 删除账号页面：用户刚在单点登录提供方重新验证过身份，不需要再输入密码
+	Reauthenticated bool
 }
 
 func humanDate(t time.Time) string {
+	return localDate(time.UTC, t)
+}
+
+// localDate 按 loc 时区格式化时间，例如 "17 Mar 2022 at 18:15"。
+func localDate(loc *time.Location, t time.Time) string {
 	// 若传参值为零时刻 即 January 1, year 1, 00:00:00 UTC 返回空字符串
 	if t.IsZero() {
 		return ""
 	}
-	// 无论传参值是何种时区 先转成 UTC 时区 再进行转换 确保只输出 UTC 时区时间
-	return t.UTC().Format("02 Jan 2006 at 15:04")
+	// 无论传参值是何种时区 先转成目标时区 再进行转换
+	return t.In(loc).Format("02 Jan 2006 at 15:04")
+}
+
+// relativeTime 按 locale 语言返回 t 相对于 now 的描述，例如 "3 hours ago"、"in 6 days"。相差 30 天及以上时返回空字符串，由调用方显示完整日期。
+func relativeTime(b *i18n.Bundle, locale string, t, now time.Time) string {
+	d := now.Sub(t)
+	future := d < 0
+	if future {
+		d = -d
+	}
+
+	var n int
+	var unit string
+	switch {
+	case d < time.Minute:
+		return b.T(locale, "time.just_now")
+	case d < time.Hour:
+		n, unit = int(d/time.Minute), "minutes"
+	case d < 24*time.Hour:
+		n, unit = int(d/time.Hour), "hours"
+	case d < 30*24*time.Hour:
+		n, unit = int(d/(24*time.Hour)), "days"
+	default:
+		return ""
+	}
+	// 消息键形如 "time.in_days" 和 "time.days_ago"，单复数由 Plural 根据 n 选择
+	if future {
+		return b.Plural(locale, "time.in_"+unit, n)
+	}
+	return b.Plural(locale, "time."+unit+"_ago", n)
 }
 
-// 初始化 template.FuncMap 对象并将其存储在全局变量中。它本质上是一个字符串键值映射，在自定义模板函数名称和函数本身之间起查找作用。
-var functions = template.FuncMap{
-	"humanDate": humanDate,
+// timeTag 生成一个 <time> 元素：datetime 属性是 ISO 8601 格式的 UTC 时间，文字是 locale 语言的相对时间，
+// 鼠标悬停时通过 title 显示查看者时区中的完整时间。在模板中这样使用：{{.Created | timeTag $.Location $.Locale}}
+func timeTag(b *i18n.Bundle, loc *time.Location, locale string, t time.Time) template.HTML {
+	if t.IsZero() {
+		return ""
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	// 日期格式也随语言变化，例如中文使用 "2022年03月17日 11:15"
+	local := t.In(loc)
+	full := local.Format(b.T(locale, "time.datetime_layout")) + " " + local.Format("MST")
+	text := relativeTime(b, locale, t, time.Now())
+	if text == "" {
+		text = local.Format(b.T(locale, "time.date_layout"))
+	}
+	return template.HTML(fmt.Sprintf(`<time datetime="%s" title="%s">%s</time>`,
+		t.UTC().Format(time.RFC3339), template.HTMLEscapeString(full), template.HTMLEscapeString(text)))
+}
+
+// templateFunctions 返回模板中可以使用的自定义函数。template.FuncMap 本质上是一个字符串键值映射，在自定义模板函数名称和函数本身之间起查找作用。
+// 翻译相关的函数需要用到消息目录，所以这里用闭包把 b 带进去，而不是像以前那样使用全局变量。
+func templateFunctions(b *i18n.Bundle) template.FuncMap {
+	return template.FuncMap{
+		"humanDate": humanDate,
+		"localDate": localDate,
+		"timeTag": func(loc *time.Location, locale string, t time.Time) template.HTML {
+			return timeTag(b, loc, locale, t)
+		},
+		// {{T $.Locale "nav.home"}}，带参数时 {{T $.Locale "profile.empty" .Profile.Name}}
+		"T": func(locale string, key any, args ...any) (string, error) {
+			return translate(b, locale, key, args...)
+		},
+	}
 }
 
-func newTemplateCache() (map[string]*template.Template, error) {
+func newTemplateCache(translations *i18n.Bundle) (map[string]*template.Template, error) {
 	cache := map[string]*template.Template{}
 	//	使用 filepath.Glob() 函数获取与"./ui/html/pages/*.tmpl "模式匹配的所有文件路径的片段。
 	//	这将基本上为我们提供应用程序 "页面 "模板的所有文件路径片段，例如[ui/html/pages/home.tmpl ui/html/pages/view.tmpl]
@@ -60,7 +161,7 @@ func newTemplateCache() (map[string]*template.Template, error) {
 		// 将基本模板文件解析为模板集
 		// 在调用 ParseFiles() 方法之前，template.FuncMap 必须与模板集一起注册。
 		// 这意味着我们必须使用 template.New() 创建一个空模板集，使用 Funcs() 方法注册 template.FuncMap，然后按正常方法解析文件。
-		//ts, err := template.New(name).Funcs(functions).ParseFiles("./ui/html/base.tmpl")
+		//ts, err := template.New(name).Funcs(templateFunctions(translations)).ParseFiles("./ui/html/base.tmpl")
 		//if err != nil {
 		//	return nil, err
 		//}
@@ -76,7 +177,7 @@ func newTemplateCache() (map[string]*template.Template, error) {
 		//}
 
 		// 改用 embedded filesystems
-		ts, err := template.New(name).Funcs(functions).ParseFS(ui.Files, patterns...)
+		ts, err := template.New(name).Funcs(templateFunctions(translations)).ParseFS(ui.Files, patterns...)
 		if err != nil {
 			return nil, err
 		}
@@ -2,10 +2,22 @@ package main
 
 import (
 	"github.com/hlf2016/snippetbox/internal/assert"
+	"github.com/hlf2016/snippetbox/internal/i18n"
+	"github.com/hlf2016/snippetbox/ui"
+	"strings"
 	"testing"
 	"time"
 )
 
+// loadTranslations 加载内嵌在 ui.Files 中的真实消息目录，测试的是用户实际看到的文字
+func loadTranslations(t *testing.T) *i18n.Bundle {
+	b, err := i18n.Load(ui.Files, "i18n", defaultLocale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
 func TestHumanDate(t *testing.T) {
 	tests := []struct {
 		name string
@@ -38,3 +50,114 @@ func TestHumanDate(t *testing.T) {
 		})
 	}
 }
+
+func TestLocalDate(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	assert.NilError(t, err)
+
+	tm := time.Date(2022, 3, 17, 10, 15, 0, 0, time.UTC)
+	assert.Equal(t, localDate(time.UTC, tm), "17 Mar 2022 at 10:15")
+	assert.Equal(t, localDate(shanghai, tm), "17 Mar 2022 at 18:15")
+	assert.Equal(t, localDate(shanghai, time.Time{}), "")
+}
+
+func TestRelativeTime(t *testing.T) {
+	now := time.Date(2022, 3, 17, 10, 15, 0, 0, time.UTC)
+	b := loadTranslations(t)
+	tests := []struct {
+		name   string
+		locale string
+		tm     time.Time
+		want   string
+	}{
+		{
+			name: "Just now",
+			tm:   now.Add(-30 * time.Second),
+			want: "just now",
+		},
+		{
+			name: "One minute",
+			tm:   now.Add(-time.Minute),
+			want: "1 minute ago",
+		},
+		{
+			name: "Hours",
+			tm:   now.Add(-3*time.Hour - 20*time.Minute),
+			want: "3 hours ago",
+		},
+		{
+			name: "Days in the future",
+			tm:   now.Add(6 * 24 * time.Hour),
+			want: "in 6 days",
+		},
+		{
+			name: "Too long ago",
+			tm:   now.AddDate(0, -2, 0),
+			want: "",
+		},
+		{
+			name:   "Chinese",
+			locale: "zh-CN",
+			tm:     now.Add(-3*time.Hour - 20*time.Minute),
+			want:   "3 小时前",
+		},
+		{
+			name:   "Chinese singular",
+			locale: "zh-CN",
+			tm:     now.Add(-time.Minute),
+			want:   "1 分钟前",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			locale := tt.locale
+			if locale == "" {
+				locale = defaultLocale
+			}
+			assert.Equal(t, relativeTime(b, locale, tt.tm, now), tt.want)
+		})
+	}
+}
+
+func TestTimeTag(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	assert.NilError(t, err)
+
+	tm := time.Date(2022, 3, 17, 10, 15, 0, 0, time.UTC)
+	b := loadTranslations(t)
+	got := string(timeTag(b, berlin, "en", tm))
+	assert.Equal(t, got, `<time datetime="2022-03-17T10:15:00Z" title="17 Mar 2022 at 11:15 CET">17 Mar 2022</time>`)
+
+	got = string(timeTag(b, berlin, "zh-CN", tm))
+	assert.Equal(t, got, `<time datetime="2022-03-17T10:15:00Z" title="2022年03月17日 11:15 CET">2022年03月17日</time>`)
+
+	assert.Equal(t, string(timeTag(b, berlin, "en", time.Time{})), "")
+}
+
+// TestCatalogsComplete 检查每个语言的消息目录都翻译了英文目录中的所有消息，单复数形式只要求有 ".other"。
+func TestCatalogsComplete(t *testing.T) {
+	b := loadTranslations(t)
+
+	required := map[string]bool{}
+	for _, key := range b.Keys(defaultLocale) {
+		required[strings.TrimSuffix(key, ".one")] = true
+	}
+	for _, locale := range b.Locales() {
+		t.Run(locale, func(t *testing.T) {
+			have := map[string]bool{}
+			for _, key := range b.Keys(locale) {
+				have[key] = true
+			}
+			for key := range required {
+				// 英文的 "x.one" 对应其他语言的 "x.other"
+				if !have[key] && !have[key+".other"] {
+					t.Errorf("missing translation for %q", key)
+				}
+			}
+			if b.T(locale, "locale.name") == "locale.name" {
+				t.Errorf("missing locale.name")
+			}
+		})
+	}
+}
@@ -2,17 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"github.com/alexedwards/scs/v2"
 	"github.com/go-playground/form/v4"
+	"github.com/hlf2016/snippetbox/internal/auth"
+	"github.com/hlf2016/snippetbox/internal/i18n"
+	"github.com/hlf2016/snippetbox/internal/mailer"
 	"github.com/hlf2016/snippetbox/internal/models/mocks"
+	"github.com/hlf2016/snippetbox/internal/validator"
+	"github.com/hlf2016/snippetbox/ui"
+	"go.opentelemetry.io/otel/trace"
 	"html"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
 	"net/url"
 	"regexp"
+	"sync"
 	"testing"
 	"time"
 )
@@ -35,7 +43,11 @@ func extractCSRFToken(t *testing.T, body string) string {
 }
 
 func newTestApplication(t *testing.T) *application {
-	templateCache, err := newTemplateCache()
+	translations, err := i18n.Load(ui.Files, "i18n", defaultLocale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	templateCache, err := newTemplateCache(translations)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -45,15 +57,67 @@ func newTestApplication(t *testing.T) *application {
 	sessionManager.Lifetime = 12 * time.Hour
 	sessionManager.Cookie.Secure = true
 
-	return &application{
-		errorLogger:    log.New(io.Discard, "", 0),
-		infoLogger:     log.New(io.Discard, "", 0),
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	accountLimiter, ipLimiter := newLoginLimiters(nil, logger)
+
+	var cfg config
+	cfg.baseURL = "https://snippetbox.example.com"
+	cfg.remember.lifetime = 30 * 24 * time.Hour
+	cfg.remember.idleTimeout = 7 * 24 * time.Hour
+
+	app := &application{
+		logger:         logger,
+		metrics:        newMetrics(nil),
+		tracer:         trace.NewNoopTracerProvider().Tracer(tracerName),
+		cfg:            cfg,
 		snippets:       &mocks.SnippetModel{},
 		users:          &mocks.UserModel{},
+		twoFactor:      &mocks.TwoFactorModel{},
+		userSessions:   &mocks.UserSessionModel{},
+		emailChanges:   &mocks.EmailChangeModel{},
+		identities:     &mocks.IdentityModel{},
+		rememberTokens: &mocks.RememberTokenModel{},
+		authenticator:  &auth.Database{Users: &mocks.UserModel{}},
+		passwordPolicy: validator.DefaultPasswordPolicy,
+		mailer:         &testMailer{},
 		templateCache:  templateCache,
+		translations:   translations,
 		formDecoder:    formDecoder,
 		sessionManager: sessionManager,
+		accountLimiter: accountLimiter,
+		ipLimiter:      ipLimiter,
+		db:             &testDB{},
 	}
+	app.readiness = newHealthChecker(logger, time.Second, 0, app.readinessChecks()...)
+	return app
+}
+
+// testDB 代替就绪检查中的数据库连接池，err 不为 nil 时 ping 失败。
+type testDB struct {
+	err error
+}
+
+func (db *testDB) PingContext(ctx context.Context) error {
+	return db.err
+}
+
+// testMailer 记录所有"发送"的邮件，供测试检查。
+type testMailer struct {
+	mu   sync.Mutex
+	sent []mailer.Message
+}
+
+func (m *testMailer) Send(msg mailer.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func (m *testMailer) messages() []mailer.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]mailer.Message(nil), m.sent...)
 }
 
 // 定义嵌入 httptest.Server 实例的自定义 testServer 类型。
@@ -109,3 +173,51 @@ func (ts *testServer) postForm(t *testing.T, urlPath string, form url.Values) (i
 	bytes.TrimSpace(body)
 	return rs.StatusCode, rs.Header, string(body)
 }
+
+// login 使用给定的邮箱和密码登录测试服务器，并返回后续 POST 请求可以使用的 CSRF 令牌。
+func (ts *testServer) login(t *testing.T, email, password string) string {
+	_, _, body := ts.get(t, "/user/login")
+	csrfToken := extractCSRFToken(t, body)
+
+	form := url.Values{}
+	form.Add("email", email)
+	form.Add("password", password)
+	form.Add("csrf_token", csrfToken)
+	code, _, _ := ts.postForm(t, "/user/login", form)
+	if code != http.StatusSeeOther {
+		t.Fatalf("login as %s failed with status %d", email, code)
+	}
+	return csrfToken
+}
+
+// cookie 返回客户端当前保存的名为 name 的 cookie 的值，不存在时返回空字符串。
+func (ts *testServer) cookie(t *testing.T, name string) string {
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range ts.Client().Jar.Cookies(u) {
+		if c.Name == name {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// setCookie 在客户端中保存一个 cookie，模拟从别处复制来的 cookie。
+func (ts *testServer) setCookie(t *testing.T, name, value string) {
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Client().Jar.SetCookies(u, []*http.Cookie{{Name: name, Value: value, Path: "/"}})
+}
+
+// expireSession 删除客户端的会话 cookie，模拟会话过期。
+func (ts *testServer) expireSession(t *testing.T) {
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Client().Jar.SetCookies(u, []*http.Cookie{{Name: "session", Path: "/", MaxAge: -1}})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"github.com/hlf2016/snippetbox/internal/models"
+	"github.com/hlf2016/snippetbox/internal/validator"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// 浏览器通过 main.js 把检测到的时区写入这个 cookie
+const timezoneCookie = "tz"
+
+// commonTimezones 是偏好设置页面中列出的时区。Go 没有提供列出所有时区的 API，这里只列出常用的，
+// 用户已经保存的时区即使不在列表中也会显示为当前选项。
+var commonTimezones = []string{
+	"UTC",
+	"America/Los_Angeles",
+	"America/Denver",
+	"America/Chicago",
+	"America/New_York",
+	"America/Sao_Paulo",
+	"Europe/London",
+	"Europe/Dublin",
+	"Europe/Lisbon",
+	"Europe/Paris",
+	"Europe/Berlin",
+	"Europe/Madrid",
+	"Europe/Amsterdam",
+	"Europe/Stockholm",
+	"Europe/Warsaw",
+	"Europe/Athens",
+	"Europe/Moscow",
+	"Africa/Johannesburg",
+	"Asia/Dubai",
+	"Asia/Kolkata",
+	"Asia/Singapore",
+	"Asia/Shanghai",
+	"Asia/Hong_Kong",
+	"Asia/Taipei",
+	"Asia/Tokyo",
+	"Asia/Seoul",
+	"Australia/Sydney",
+	"Pacific/Auckland",
+}
+
+// loadTimezone 解析 IANA 时区名称。空字符串和 "Local" 都视为无效，服务器所在的时区对用户没有意义。
+func loadTimezone(name string) (*time.Location, bool) {
+	if name == "" || name == "Local" {
+		return nil, false
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, false
+	}
+	return loc, true
+}
+
+// detectedTimezone 返回浏览器报告的时区，cookie 不存在或无效时返回空字符串。
+func detectedTimezone(r *http.Request) string {
+	c, err := r.Cookie(timezoneCookie)
+	if err != nil {
+		return ""
+	}
+	// main.js 用 encodeURIComponent 写入，"/" 被编码成了 %2F
+	name, err := url.QueryUnescape(c.Value)
+	if err != nil {
+		return ""
+	}
+	if _, ok := loadTimezone(name); !ok {
+		return ""
+	}
+	return name
+}
+
+// location 返回查看者的时区：已登录用户优先使用保存的偏好，其次是浏览器检测到的时区；未登录用户一律使用 UTC。
+func (app *application) location(r *http.Request) *time.Location {
+	user := app.currentUser(r)
+	if user == nil {
+		return time.UTC
+	}
+	if loc, ok := loadTimezone(user.Timezone); ok {
+		return loc
+	}
+	if loc, ok := loadTimezone(detectedTimezone(r)); ok {
+		return loc
+	}
+	return time.UTC
+}
+
+type accountPreferencesForm struct {
+	Timezone            string `form:"timezone"`
+	Locale              string `form:"locale"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) accountPreferences(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+	user := app.currentUser(r)
+	data.Form = accountPreferencesForm{Timezone: user.Timezone, Locale: user.Locale}
+	app.renderPreferences(w, r, http.StatusOK, data)
+}
+
+func (app *application) renderPreferences(w http.ResponseWriter, r *http.Request, status int, data *templateData) {
+	data.Timezones = commonTimezones
+	data.DetectedTimezone = detectedTimezone(r)
+	app.render(w, r, status, "preferences.tmpl", data)
+}
+
+func (app *application) accountPreferencesPost(w http.ResponseWriter, r *http.Request) {
+	var form accountPreferencesForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	// 空字符串表示跟随浏览器
+	if form.Timezone != "" {
+		_, ok := loadTimezone(form.Timezone)
+		form.CheckField(ok, "timezone", "validation.timezone")
+	}
+	// 空字符串表示根据浏览器决定，否则必须与某个消息目录完全一致
+	if form.Locale != "" {
+		form.CheckField(app.translations.Match(form.Locale) == form.Locale, "locale", "validation.locale")
+	}
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.renderPreferences(w, r, http.StatusUnprocessableEntity, data)
+		return
+	}
+
+	err = app.users.SetPreferences(r.Context(), app.currentUser(r).ID, models.Preferences{Timezone: form.Timezone, Locale: form.Locale})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.flash(r, "flash.preferences_saved")
+	http.Redirect(w, r, "/account/view", http.StatusSeeOther)
+}
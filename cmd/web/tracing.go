@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/justinas/alice"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"os"
+)
+
+// tracerName 是本程序创建的 span 所属的 instrumentation scope
+const tracerName = "github.com/hlf2016/snippetbox/cmd/web"
+
+// serverSpanContextKey 对应的值是 traceRequest 为请求创建的服务端 span
+const serverSpanContextKey = contextKey("serverSpan")
+
+// setupTracing 按配置创建 TracerProvider，并把它和 W3C Trace Context 传播器设置为全局默认值，
+// 模型层通过 otel.Tracer() 使用它们。exporter 为空或 "none" 时不导出 span，返回的 provider 什么也不做。
+// 程序退出前必须调用 shutdown，把缓冲中的 span 发送出去。
+func setupTracing(cfg config) (tp trace.TracerProvider, shutdown func(context.Context) error, err error) {
+	// 即使不导出 span，也要把上游传来的 traceparent 继续往下传
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var file *os.File
+	switch cfg.tracing.exporter {
+	case "", "none":
+		return trace.NewNoopTracerProvider(), func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "file":
+		file, err = os.OpenFile(cfg.tracing.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	case "otlp":
+		// 未设置 -otlp-endpoint 时使用 OTEL_EXPORTER_OTLP_ENDPOINT 等标准环境变量，默认为 localhost:4318
+		var opts []otlptracehttp.Option
+		if cfg.tracing.otlpEndpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.tracing.otlpEndpoint))
+		}
+		if cfg.tracing.otlpInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		return nil, nil, fmt.Errorf("unknown trace exporter %q (want none, stdout, file or otlp)", cfg.tracing.exporter)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("snippetbox")))
+	if err != nil {
+		return nil, nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		// 上游已经决定采样与否时沿用它的决定，否则按比例采样
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.tracing.sampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	shutdown = func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			file.Close()
+		}
+		return err
+	}
+	return provider, shutdown, nil
+}
+
+// traceRequest 为每个请求创建一个服务端 span。请求带有 traceparent 标头时，新的 span 成为上游 span 的子 span。
+// span 的名称先用请求方法，匹配到路由后由 withRoute 改成 "GET /snippet/view/:id" 这样的形式。
+func (app *application) traceRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := app.tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethod(r.Method),
+				semconv.URLPath(r.URL.Path),
+				semconv.ServerAddress(r.Host),
+				semconv.ClientAddress(r.RemoteAddr),
+				semconv.UserAgentOriginal(r.UserAgent()),
+			),
+		)
+		defer span.End()
+		ctx = context.WithValue(ctx, serverSpanContextKey, span)
+
+		rw := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPStatusCode(rw.status))
+		if rw.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rw.status))
+		}
+	})
+}
+
+// traced 把中间件包装在一个名为 "middleware <name>" 的 span 中。span 包含了该中间件之后的整个处理链，
+// 在追踪界面上可以看出每一层中间件自身花了多少时间。
+func (app *application) traced(name string, mw alice.Constructor) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		h := mw(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, span := app.tracer.Start(r.Context(), "middleware "+name)
+			defer span.End()
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// nameServerSpan 把匹配到的路由模式记录到 traceRequest 创建的服务端 span 上。
+// 经过中间件之后上下文中的当前 span 已经不是服务端 span 了，所以要从 serverSpanContextKey 中取。
+func nameServerSpan(r *http.Request, pattern string) {
+	span, ok := r.Context().Value(serverSpanContextKey).(trace.Span)
+	if !ok {
+		return
+	}
+	span.SetName(r.Method + " " + pattern)
+	span.SetAttributes(semconv.HTTPRoute(pattern))
+}
+
+// traceHandler 为处理程序本身创建一个 span，与中间件的 span 区分开。
+func (app *application) traceHandler(method, pattern string, next http.HandlerFunc) http.Handler {
+	name := "handler " + method + " " + pattern
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := app.tracer.Start(r.Context(), name)
+		defer span.End()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/hlf2016/snippetbox/internal/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net/http"
+	"testing"
+)
+
+func TestTraceRequest(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	app := newTestApplication(t)
+	app.tracer = provider.Tracer(tracerName)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	const (
+		traceID      = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentSpanID = "00f067aa0ba902b7"
+	)
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/snippet/view/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentSpanID+"-01")
+	rs, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Body.Close()
+	assert.Equal(t, rs.StatusCode, http.StatusOK)
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = s
+	}
+
+	// 服务端 span 以路由模式命名，并且是上游 span 的子 span
+	server, ok := spans["GET /snippet/view/:id"]
+	if !ok {
+		t.Fatal("server span not recorded")
+	}
+	assert.Equal(t, server.SpanContext().TraceID().String(), traceID)
+	assert.Equal(t, server.Parent().SpanID().String(), parentSpanID)
+
+	// 中间件、处理程序和模板渲染各有自己的 span，都属于同一个追踪
+	for _, name := range []string{
+		"middleware requestID",
+		"middleware LoadAndSave",
+		"middleware authenticate",
+		"handler GET /snippet/view/:id",
+		"render view.tmpl",
+	} {
+		t.Run(name, func(t *testing.T) {
+			s, ok := spans[name]
+			if !ok {
+				t.Fatalf("span %q not recorded", name)
+			}
+			assert.Equal(t, s.SpanContext().TraceID().String(), traceID)
+		})
+	}
+
+	// 渲染 span 是处理程序 span 的子 span
+	assert.Equal(t, spans["render view.tmpl"].Parent().SpanID(), spans["handler GET /snippet/view/:id"].SpanContext().SpanID())
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"github.com/hlf2016/snippetbox/internal/models"
+	"github.com/hlf2016/snippetbox/internal/validator"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// totpIssuer 会显示在用户的身份验证器应用中，用来区分不同网站的账号
+	totpIssuer = "Snippetbox"
+	// 两步登录中 "待验证" 状态的有效期，超时后需要重新输入密码
+	twoFactorPendingTTL = 5 * time.Minute
+	// 两步登录时允许连续输错验证码的次数
+	twoFactorMaxAttempts = 5
+	recoveryCodeCount    = 10
+)
+
+// totpCodeForm 用于两步登录、启用和关闭两步验证时提交的验证码（也可以是恢复码）。
+type totpCodeForm struct {
+	Code                string `form:"code"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) twoFactorEnabled(ctx context.Context, userID int) (bool, error) {
+	_, err := app.twoFactor.Get(ctx, userID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// startTwoFactorLogin 在密码校验通过后调用。会话中只保存 "待验证" 的用户 ID 和过期时间，不会写入 authenticatedUserID。
+// email 是登录限流使用的账号，输错验证码同样计入这个账号和客户端 IP 的失败次数。
+// remember 是登录表单上"记住我"的选择，和待验证状态保存在一起，放弃验证时随之清除，不会留给之后别的登录方式。
+func (app *application) startTwoFactorLogin(r *http.Request, userID int, email string, remember bool) error {
+	err := app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		return err
+	}
+	app.sessionManager.Put(r.Context(), "pendingTwoFactorUserID", userID)
+	app.sessionManager.Put(r.Context(), "pendingTwoFactorEmail", email)
+	app.sessionManager.Put(r.Context(), "pendingTwoFactorRemember", remember)
+	// 以 Unix 时间戳保存，避免为 gob 编码注册 time.Time 类型
+	app.sessionManager.Put(r.Context(), "pendingTwoFactorExpires", time.Now().Add(twoFactorPendingTTL).Unix())
+	app.sessionManager.Remove(r.Context(), "pendingTwoFactorAttempts")
+	return nil
+}
+
+// pendingTwoFactorUserID 返回等待输入验证码的用户 ID。不存在或已过期时返回 0。
+func (app *application) pendingTwoFactorUserID(r *http.Request) int {
+	userID := app.sessionManager.GetInt(r.Context(), "pendingTwoFactorUserID")
+	if userID == 0 {
+		return 0
+	}
+	if time.Now().Unix() > app.sessionManager.GetInt64(r.Context(), "pendingTwoFactorExpires") {
+		app.clearTwoFactorLogin(r)
+		return 0
+	}
+	return userID
+}
+
+func (app *application) clearTwoFactorLogin(r *http.Request) {
+	app.sessionManager.Remove(r.Context(), "pendingTwoFactorUserID")
+	app.sessionManager.Remove(r.Context(), "pendingTwoFactorEmail")
+	app.sessionManager.Remove(r.Context(), "pendingTwoFactorRemember")
+	app.sessionManager.Remove(r.Context(), "pendingTwoFactorExpires")
+	app.sessionManager.Remove(r.Context(), "pendingTwoFactorAttempts")
+}
+
+// verifySecondFactor 先把 code 当作 TOTP 验证码校验，不通过时再尝试作为一次性恢复码使用。
+func (app *application) verifySecondFactor(ctx context.Context, userID int, code string) (bool, error) {
+	tf, err := app.twoFactor.Get(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	code = strings.TrimSpace(code)
+	if totp.Validate(strings.ReplaceAll(code, " ", ""), tf.Secret) {
+		return true, nil
+	}
+	return app.twoFactor.UseRecoveryCode(ctx, userID, code)
+}
+
+func (app *application) userLoginTOTP(w http.ResponseWriter, r *http.Request) {
+	if app.pendingTwoFactorUserID(r) == 0 {
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+	data := app.newTemplateData(r)
+	data.Form = totpCodeForm{}
+	app.render(w, r, http.StatusOK, "login_totp.tmpl", data)
+}
+
+func (app *application) userLoginTOTPPost(w http.ResponseWriter, r *http.Request) {
+	userID := app.pendingTwoFactorUserID(r)
+	if userID == 0 {
+		app.flash(r, "flash.totp_login_expired")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	var form totpCodeForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.CheckField(validator.NotBlank(form.Code), "code", "validation.blank")
+
+	// 验证码和恢复码的错误同样计入按账号和按 IP 的限流。每个会话的尝试次数上限只能让攻击者重新输入密码，
+	// 知道密码的人仍然可以一直换新会话猜验证码，只有账号维度的限流才能挡住。
+	email := app.sessionManager.GetString(r.Context(), "pendingTwoFactorEmail")
+	ip := app.clientIP(r)
+	wait, err := app.loginWait(email, ip)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if wait > 0 {
+		app.metrics.loginFailures.WithLabelValues("throttled").Inc()
+		form.AddNonFieldError("login.error.throttled", app.humanDuration(r, wait))
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, r, http.StatusTooManyRequests, "login_totp.tmpl", data)
+		return
+	}
+
+	if form.Valid() {
+		ok, err := app.verifySecondFactor(r.Context(), userID, form.Code)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		if !ok {
+			app.metrics.loginFailures.WithLabelValues("totp").Inc()
+			err = app.loginFailed(email, ip)
+			if err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+			// 连续输错太多次时丢弃 "待验证" 状态，强制用户从输入密码重新开始
+			attempts := app.sessionManager.GetInt(r.Context(), "pendingTwoFactorAttempts") + 1
+			if attempts >= twoFactorMaxAttempts {
+				app.clearTwoFactorLogin(r)
+				app.flash(r, "flash.totp_too_many_attempts")
+				http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+				return
+			}
+			app.sessionManager.Put(r.Context(), "pendingTwoFactorAttempts", attempts)
+			form.AddNonFieldError("totp.error.invalid")
+		}
+	}
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "login_totp.tmpl", data)
+		return
+	}
+
+	remember := app.sessionManager.GetBool(r.Context(), "pendingTwoFactorRemember")
+	app.clearTwoFactorLogin(r)
+	app.completeLogin(w, r, userID, email, remember)
+}
+
+// totpSetupKey 从会话中取出尚未确认的 TOTP 密钥。用户确认第一个验证码之前，密钥只保存在会话里，不会写入数据库。
+func (app *application) totpSetupKey(r *http.Request) (*otp.Key, error) {
+	keyURL := app.sessionManager.GetString(r.Context(), "totpSetupURL")
+	if keyURL == "" {
+		return nil, nil
+	}
+	return otp.NewKeyFromURL(keyURL)
+}
+
+func (app *application) accountTOTPSetup(w http.ResponseWriter, r *http.Request) {
+	userID := app.sessionManager.GetInt(r.Context(), app.authId)
+	enabled, err := app.twoFactorEnabled(r.Context(), userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if enabled {
+		app.flash(r, "flash.totp_already_enabled")
+		http.Redirect(w, r, "/account/view", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.users.Get(r.Context(), userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: user.Email,
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.sessionManager.Put(r.Context(), "totpSetupURL", key.URL())
+
+	data := app.newTemplateData(r)
+	data.Form = totpCodeForm{}
+	data.TOTPSecret = key.Secret()
+	app.render(w, r, http.StatusOK, "totp_setup.tmpl", data)
+}
+
+// accountTOTPQRCode 在服务端把会话中的密钥渲染成二维码 PNG。内容安全策略只允许加载同源图片，因此不能使用 data: URL。
+func (app *application) accountTOTPQRCode(w http.ResponseWriter, r *http.Request) {
+	key, err := app.totpSetupKey(r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if key == nil {
+		app.notFound(w)
+		return
+	}
+	img, err := key.Image(200, 200)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	buf := new(bytes.Buffer)
+	err = png.Encode(buf, img)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	buf.WriteTo(w)
+}
+
+func (app *application) accountTOTPSetupPost(w http.ResponseWriter, r *http.Request) {
+	key, err := app.totpSetupKey(r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if key == nil {
+		http.Redirect(w, r, "/account/totp/setup", http.StatusSeeOther)
+		return
+	}
+
+	var form totpCodeForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.CheckField(validator.NotBlank(form.Code), "code", "validation.blank")
+	if form.Valid() {
+		form.CheckField(totp.Validate(strings.ReplaceAll(form.Code, " ", ""), key.Secret()), "code", "totp.error.invalid")
+	}
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		data.TOTPSecret = key.Secret()
+		app.render(w, r, http.StatusUnprocessableEntity, "totp_setup.tmpl", data)
+		return
+	}
+
+	codes, err := generateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	userID := app.sessionManager.GetInt(r.Context(), app.authId)
+	err = app.twoFactor.Enable(r.Context(), userID, key.Secret(), codes)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.sessionManager.Remove(r.Context(), "totpSetupURL")
+
+	// 恢复码只在这里展示一次，因此直接渲染页面而不是重定向
+	data := app.newTemplateData(r)
+	data.RecoveryCodes = codes
+	app.render(w, r, http.StatusOK, "totp_recovery.tmpl", data)
+}
+
+func (app *application) accountTOTPDisablePost(w http.ResponseWriter, r *http.Request) {
+	var form totpCodeForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	userID := app.sessionManager.GetInt(r.Context(), app.authId)
+	ok := false
+	if validator.NotBlank(form.Code) {
+		ok, err = app.verifySecondFactor(r.Context(), userID, form.Code)
+		if err != nil && !errors.Is(err, models.ErrNoRecord) {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+	if !ok {
+		app.flash(r, "flash.totp_disable_invalid")
+		http.Redirect(w, r, "/account/view", http.StatusSeeOther)
+		return
+	}
+
+	err = app.twoFactor.Disable(r.Context(), userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.flash(r, "flash.totp_disabled")
+	http.Redirect(w, r, "/account/view", http.StatusSeeOther)
+}
+
+// generateRecoveryCodes 生成 n 枚形如 "ABCDE-FGH23" 的恢复码。字母表去掉了容易混淆的 0/O 和 1/I，
+// 并且长度正好是 32，能整除 256，所以按字节取模不会产生偏差。
+func generateRecoveryCodes(n int) ([]string, error) {
+	const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	codes := make([]string, 0, n)
+	b := make([]byte, 10)
+	for i := 0; i < n; i++ {
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		for j := range b {
+			b[j] = alphabet[int(b[j])%len(alphabet)]
+		}
+		codes = append(codes, string(b[:5])+"-"+string(b[5:]))
+	}
+	return codes, nil
+}
@@ -0,0 +1,95 @@
+// Package auth 定义了登录时验证邮箱和密码的 Authenticator 接口及其实现：
+// 使用数据库中密码哈希的 Database，以及通过 LDAP/Active Directory 绑定验证的 LDAP。
+// 多个实现可以用 Chain 组合，依次尝试。
+package auth
+
+import (
+	"context"
+	"errors"
+	"github.com/hlf2016/snippetbox/internal/models"
+	"strings"
+)
+
+// Authenticator 验证用户提交的邮箱（或目录中的登录名）和密码，成功时返回本站的用户 ID。
+// 凭据错误时返回 models.ErrInvalidCredential，账号被禁用时返回 models.ErrAccountDisabled。
+type Authenticator interface {
+	Authenticate(ctx context.Context, email, password string) (int, error)
+	// Verify 确认 password 是已登录用户 userID（邮箱为 email）的密码，用于删除账号这类敏感操作前的再次确认。
+	// 与 Authenticate 不同，它没有任何副作用：不开通用户、不同步角色，也不升级密码哈希。
+	// 密码不对或这个用户不归该方式管理时返回 models.ErrInvalidCredential。
+	Verify(ctx context.Context, userID int, email, password string) error
+}
+
+// Database 使用 users 表中保存的密码哈希验证。
+type Database struct {
+	Users models.UserModelInterface
+}
+
+func (d *Database) Authenticate(ctx context.Context, email, password string) (int, error) {
+	return d.Users.Authenticate(ctx, email, password)
+}
+
+func (d *Database) Verify(ctx context.Context, userID int, email, password string) error {
+	return d.Users.VerifyPassword(ctx, userID, password)
+}
+
+// Chain 依次尝试每个 Authenticator，返回第一个成功的结果。只有 models.ErrInvalidCredential 会继续尝试下一个，
+// 其他错误（包括账号被禁用）立即返回。例如 Chain{ldap, database} 让目录中的用户和只存在于本站的管理员都能登录。
+type Chain []Authenticator
+
+func (c Chain) Authenticate(ctx context.Context, email, password string) (int, error) {
+	for _, a := range c {
+		id, err := a.Authenticate(ctx, email, password)
+		if errors.Is(err, models.ErrInvalidCredential) {
+			continue
+		}
+		return id, err
+	}
+	return 0, models.ErrInvalidCredential
+}
+
+func (c Chain) Verify(ctx context.Context, userID int, email, password string) error {
+	for _, a := range c {
+		err := a.Verify(ctx, userID, email, password)
+		if errors.Is(err, models.ErrInvalidCredential) {
+			continue
+		}
+		return err
+	}
+	return models.ErrInvalidCredential
+}
+
+// Provisioner 把外部身份（OpenID Connect 提供方或 LDAP 目录中的用户）对应到本站的用户。
+type Provisioner struct {
+	Users      models.UserModelInterface
+	Identities models.IdentityModelInterface
+}
+
+// Resolve 返回外部身份对应的用户 ID。身份第一次登录时按 email 关联到已有的用户，没有这个邮箱的用户时
+// 创建一个新用户（created 为 true）。调用方必须确认 email 确实属于这个身份。
+func (p *Provisioner) Resolve(ctx context.Context, issuer, subject, email, name string) (userID int, created bool, err error) {
+	userID, err = p.Identities.Get(ctx, issuer, subject)
+	if err == nil {
+		return userID, false, nil
+	}
+	if !errors.Is(err, models.ErrNoRecord) {
+		return 0, false, err
+	}
+
+	user, err := p.Users.GetByEmail(ctx, email)
+	if err == nil {
+		return user.ID, false, p.Identities.Link(ctx, user.ID, issuer, subject)
+	}
+	if !errors.Is(err, models.ErrNoRecord) {
+		return 0, false, err
+	}
+
+	if name == "" {
+		name, _, _ = strings.Cut(email, "@")
+	}
+	userID, err = p.Identities.CreateUser(ctx, name, email, issuer, subject)
+	if err != nil {
+		return 0, false, err
+	}
+	return userID, true, nil
+}
@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/hlf2016/snippetbox/internal/models"
+	"strings"
+)
+
+// 默认按邮箱或 Active Directory 的 userPrincipalName 查找用户，%[1]s 会被替换成转义后的登录名
+const defaultLDAPUserFilter = "(&(objectClass=person)(|(mail=%[1]s)(userPrincipalName=%[1]s)))"
+
+type LDAPConfig struct {
+	// URL 形如 ldaps://ad.example.com:636 或 ldap://ldap.example.com:389
+	URL string
+	// StartTLS 在 ldap:// 连接上升级到 TLS，避免密码以明文传输
+	StartTLS bool
+	// 用来查找用户的服务账号。为空时匿名搜索
+	BindDN       string
+	BindPassword string
+	// 在 BaseDN 下搜索用户
+	BaseDN string
+	// UserFilter 为空时使用 defaultLDAPUserFilter
+	UserFilter string
+	// 读取邮箱、显示名称和所属组的属性，为空时分别使用 mail、displayName 和 memberOf
+	EmailAttribute string
+	NameAttribute  string
+	GroupAttribute string
+	// GroupRoles 把组的 DN 映射到本站的角色。不为空时目录是角色的唯一来源：用户每次登录都会被设置为所属组中
+	// 最高的角色，不属于任何映射组的用户设置为普通用户。为空时不修改角色，仍在本站的管理后台中管理。
+	GroupRoles map[string]models.Role
+	// RequiredGroup 不为空时，只有这个组的成员可以登录
+	RequiredGroup string
+}
+
+// Conn 是我们用到的 LDAP 连接方法，*ldap.Conn 实现了这个接口，测试中可以替换成进程内的假目录。
+type Conn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close()
+}
+
+// LDAP 先用服务账号在目录中搜索用户，再用找到的 DN 和用户提交的密码绑定来验证密码。
+// 验证通过的用户按 Provisioner 关联或创建本站的用户（即时开通），目录中的 DN 作为身份的 subject。
+type LDAP struct {
+	Config      LDAPConfig
+	Provisioner *Provisioner
+	// Dial 为 nil 时使用 ldap.DialURL
+	Dial func(cfg LDAPConfig) (Conn, error)
+}
+
+func (l *LDAP) Authenticate(ctx context.Context, login, password string) (int, error) {
+	entry, err := l.bind(login, password)
+	if err != nil {
+		return 0, err
+	}
+
+	emailAttr := valueOr(l.Config.EmailAttribute, "mail")
+	nameAttr := valueOr(l.Config.NameAttribute, "displayName")
+	groups := entry.GetAttributeValues(valueOr(l.Config.GroupAttribute, "memberOf"))
+	email := entry.GetAttributeValue(emailAttr)
+	if email == "" {
+		return 0, fmt.Errorf("auth: ldap entry %s has no %s attribute", entry.DN, emailAttr)
+	}
+
+	id, created, err := l.Provisioner.Resolve(ctx, l.Config.URL, entry.DN, email, entry.GetAttributeValue(nameAttr))
+	if err != nil {
+		return 0, err
+	}
+
+	currentRole := models.RoleUser
+	if !created {
+		user, err := l.Provisioner.Users.Get(ctx, id)
+		if err != nil {
+			return 0, err
+		}
+		if user.Disabled {
+			return 0, models.ErrAccountDisabled
+		}
+		currentRole = user.Role
+	}
+	if len(l.Config.GroupRoles) > 0 {
+		role := l.roleFor(groups)
+		if role != currentRole {
+			err = l.Provisioner.Users.SetRole(ctx, id, role)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return id, nil
+}
+
+// Verify 只在目录中绑定验证密码，然后确认这个目录条目已经关联到 userID，不会开通用户或同步角色。
+func (l *LDAP) Verify(ctx context.Context, userID int, email, password string) error {
+	entry, err := l.bind(email, password)
+	if err != nil {
+		return err
+	}
+	id, err := l.Provisioner.Identities.Get(ctx, l.Config.URL, entry.DN)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			return models.ErrInvalidCredential
+		}
+		return err
+	}
+	if id != userID {
+		return models.ErrInvalidCredential
+	}
+	return nil
+}
+
+// bind 先用服务账号按 login 搜索用户，再用找到的 DN 和 password 绑定，返回验证通过的目录条目。
+// 密码不对、找不到或找到多个用户、不在 RequiredGroup 中时返回 models.ErrInvalidCredential。
+func (l *LDAP) bind(login, password string) (*ldap.Entry, error) {
+	// 很多目录把空密码的绑定当作"未认证绑定"并返回成功，必须在这里拒绝
+	if login == "" || password == "" {
+		return nil, models.ErrInvalidCredential
+	}
+
+	dial := l.Dial
+	if dial == nil {
+		dial = dialLDAP
+	}
+	conn, err := dial(l.Config)
+	if err != nil {
+		return nil, fmt.Errorf("auth: ldap dial: %w", err)
+	}
+	defer conn.Close()
+
+	if l.Config.BindDN != "" {
+		err = conn.Bind(l.Config.BindDN, l.Config.BindPassword)
+		if err != nil {
+			return nil, fmt.Errorf("auth: ldap service bind: %w", err)
+		}
+	}
+
+	emailAttr := valueOr(l.Config.EmailAttribute, "mail")
+	nameAttr := valueOr(l.Config.NameAttribute, "displayName")
+	groupAttr := valueOr(l.Config.GroupAttribute, "memberOf")
+	filter := fmt.Sprintf(valueOr(l.Config.UserFilter, defaultLDAPUserFilter), ldap.EscapeFilter(login))
+	// 最多取两条结果：找到不止一个用户时说明过滤条件有歧义，拒绝登录
+	req := ldap.NewSearchRequest(l.Config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
+		filter, []string{emailAttr, nameAttr, groupAttr}, nil)
+	result, err := conn.Search(req)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return nil, models.ErrInvalidCredential
+		}
+		return nil, fmt.Errorf("auth: ldap search: %w", err)
+	}
+	if len(result.Entries) != 1 {
+		return nil, models.ErrInvalidCredential
+	}
+	entry := result.Entries[0]
+
+	err = conn.Bind(entry.DN, password)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, models.ErrInvalidCredential
+		}
+		return nil, fmt.Errorf("auth: ldap bind: %w", err)
+	}
+
+	if l.Config.RequiredGroup != "" && !containsDN(entry.GetAttributeValues(groupAttr), l.Config.RequiredGroup) {
+		return nil, models.ErrInvalidCredential
+	}
+	return entry, nil
+}
+
+// roleFor 返回 groups 中映射到的最高角色，没有映射到任何角色时返回普通用户。
+func (l *LDAP) roleFor(groups []string) models.Role {
+	role := models.RoleUser
+	for dn, r := range l.Config.GroupRoles {
+		if containsDN(groups, dn) && r.AtLeast(role) {
+			role = r
+		}
+	}
+	return role
+}
+
+func dialLDAP(cfg LDAPConfig) (Conn, error) {
+	conn, err := ldap.DialURL(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.StartTLS {
+		host := strings.TrimPrefix(cfg.URL, "ldap://")
+		host, _, _ = strings.Cut(host, ":")
+		err = conn.StartTLS(&tls.Config{ServerName: host, MinVersion: tls.VersionTLS12})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// containsDN 判断 dns 中是否包含 dn。DN 的属性名和值通常不区分大小写，这里也忽略 "," 两侧的空格。
+func containsDN(dns []string, dn string) bool {
+	want := normalizeDN(dn)
+	for _, d := range dns {
+		if normalizeDN(d) == want {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeDN(dn string) string {
+	parts := strings.Split(dn, ",")
+	for i, p := range parts {
+		parts[i] = strings.ToLower(strings.TrimSpace(p))
+	}
+	return strings.Join(parts, ",")
+}
+
+func valueOr(v, fallback string) string {
+	if v == "" {
+		return fallback
+	}
+	return v
+}
+
+// ParseGroupRoles 解析命令行中的组角色映射，格式为以 ";" 分隔的 "角色:组DN"，例如
+// "admin:cn=snippetbox-admins,ou=groups,dc=example,dc=com;moderator:cn=snippetbox-mods,ou=groups,dc=example,dc=com"。
+// 组的 DN 中本身就有 "," 和 "="，所以用 ";" 和 ":" 作为分隔符。
+func ParseGroupRoles(s string) (map[string]models.Role, error) {
+	roles := make(map[string]models.Role)
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		role, dn, ok := strings.Cut(item, ":")
+		if !ok || strings.TrimSpace(dn) == "" {
+			return nil, fmt.Errorf("auth: invalid group role mapping %q", item)
+		}
+		r := models.Role(strings.TrimSpace(role))
+		if !r.Valid() {
+			return nil, errors.Join(models.ErrInvalidRole, fmt.Errorf("auth: unknown role %q", role))
+		}
+		roles[strings.TrimSpace(dn)] = r
+	}
+	return roles, nil
+}
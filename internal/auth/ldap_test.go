@@ -0,0 +1,300 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/hlf2016/snippetbox/internal/assert"
+	"github.com/hlf2016/snippetbox/internal/models"
+	"github.com/hlf2016/snippetbox/internal/models/mocks"
+	"strings"
+	"testing"
+)
+
+const (
+	serviceDN   = "cn=snippetbox,ou=services,dc=example,dc=com"
+	adminsGroup = "cn=admins,ou=groups,dc=example,dc=com"
+	modsGroup   = "cn=mods,ou=groups,dc=example,dc=com"
+	staffGroup  = "cn=staff,ou=groups,dc=example,dc=com"
+)
+
+// fakeDirectory 是一个进程内的 LDAP 目录，按 DN 保存条目和密码。
+// Search 只识别过滤条件中的 (mail=...)，和真实的目录一样把未转义的 * 当作通配符。
+type fakeDirectory struct {
+	entries   []*ldap.Entry
+	passwords map[string]string
+	binds     []string
+	closed    bool
+}
+
+func newFakeDirectory() *fakeDirectory {
+	d := &fakeDirectory{passwords: map[string]string{serviceDN: "service-secret"}}
+	d.add("uid=carol,ou=people,dc=example,dc=com", "carol@example.com", "Carol", "directory-pw", staffGroup)
+	d.add("uid=bob,ou=people,dc=example,dc=com", "bob@example.com", "Bob", "directory-pw", staffGroup, "CN=Admins, OU=Groups, DC=example, DC=com")
+	d.add("uid=dave,ou=people,dc=example,dc=com", "dave@example.com", "Dave", "directory-pw", staffGroup)
+	d.add("uid=frank,ou=people,dc=example,dc=com", "frank@example.com", "", "directory-pw", staffGroup, modsGroup)
+	d.add("uid=grace,ou=people,dc=example,dc=com", "grace@example.com", "Grace", "directory-pw")
+	return d
+}
+
+func (d *fakeDirectory) add(dn, mail, name, password string, groups ...string) {
+	d.entries = append(d.entries, ldap.NewEntry(dn, map[string][]string{
+		"mail":        {mail},
+		"displayName": {name},
+		"memberOf":    groups,
+	}))
+	d.passwords[dn] = password
+}
+
+func (d *fakeDirectory) Bind(username, password string) error {
+	d.binds = append(d.binds, username)
+	if want, ok := d.passwords[username]; !ok || want != password || password == "" {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	return nil
+}
+
+func (d *fakeDirectory) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	result := &ldap.SearchResult{}
+	for _, e := range d.entries {
+		if strings.Contains(req.Filter, "(mail=*)") || strings.Contains(req.Filter, "(mail="+ldap.EscapeFilter(e.GetAttributeValue("mail"))+")") {
+			result.Entries = append(result.Entries, e)
+		}
+	}
+	if req.SizeLimit > 0 && len(result.Entries) > req.SizeLimit {
+		return nil, ldap.NewError(ldap.LDAPResultSizeLimitExceeded, errors.New("size limit exceeded"))
+	}
+	return result, nil
+}
+
+func (d *fakeDirectory) Close() {
+	d.closed = true
+}
+
+// recordingUsers 在模拟用户模型的基础上记录 SetRole 的调用
+type recordingUsers struct {
+	mocks.UserModel
+	roles map[int]models.Role
+}
+
+func (u *recordingUsers) SetRole(ctx context.Context, id int, role models.Role) error {
+	u.roles[id] = role
+	return nil
+}
+
+func newTestLDAP(dir *fakeDirectory, cfg LDAPConfig) (*LDAP, *recordingUsers) {
+	users := &recordingUsers{roles: make(map[int]models.Role)}
+	cfg.URL = "ldap://ldap.example.com"
+	cfg.BindDN = serviceDN
+	cfg.BindPassword = "service-secret"
+	cfg.BaseDN = "dc=example,dc=com"
+	return &LDAP{
+		Config:      cfg,
+		Provisioner: &Provisioner{Users: users, Identities: &mocks.IdentityModel{}},
+		Dial:        func(LDAPConfig) (Conn, error) { return dir, nil },
+	}, users
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	groupRoles := map[string]models.Role{adminsGroup: models.RoleAdmin, modsGroup: models.RoleModerator}
+
+	tests := []struct {
+		name      string
+		cfg       LDAPConfig
+		login     string
+		password  string
+		wantID    int
+		wantErr   error
+		wantRoles map[int]models.Role
+	}{
+		{
+			name:      "Existing user linked by email",
+			login:     "carol@example.com",
+			password:  "directory-pw",
+			wantID:    4,
+			wantRoles: map[int]models.Role{},
+		},
+		{
+			name:     "Wrong password",
+			login:    "carol@example.com",
+			password: "password",
+			wantErr:  models.ErrInvalidCredential,
+		},
+		{
+			name:     "Empty password",
+			login:    "carol@example.com",
+			password: "",
+			wantErr:  models.ErrInvalidCredential,
+		},
+		{
+			name:     "Unknown user",
+			login:    "nobody@example.com",
+			password: "directory-pw",
+			wantErr:  models.ErrInvalidCredential,
+		},
+		{
+			name:     "Filter injection",
+			login:    "*",
+			password: "directory-pw",
+			wantErr:  models.ErrInvalidCredential,
+		},
+		{
+			name:     "Disabled user",
+			login:    "dave@example.com",
+			password: "directory-pw",
+			wantErr:  models.ErrAccountDisabled,
+		},
+		{
+			name:      "New user provisioned with mapped role",
+			cfg:       LDAPConfig{GroupRoles: groupRoles},
+			login:     "frank@example.com",
+			password:  "directory-pw",
+			wantID:    mocks.NewIdentityUserID,
+			wantRoles: map[int]models.Role{mocks.NewIdentityUserID: models.RoleModerator},
+		},
+		{
+			name:      "Group DN matched case-insensitively",
+			cfg:       LDAPConfig{GroupRoles: groupRoles},
+			login:     "bob@example.com",
+			password:  "directory-pw",
+			wantID:    2,
+			wantRoles: map[int]models.Role{2: models.RoleAdmin},
+		},
+		{
+			name:      "Role unchanged",
+			cfg:       LDAPConfig{GroupRoles: groupRoles},
+			login:     "carol@example.com",
+			password:  "directory-pw",
+			wantID:    4,
+			wantRoles: map[int]models.Role{},
+		},
+		{
+			name:     "Not in required group",
+			cfg:      LDAPConfig{RequiredGroup: staffGroup},
+			login:    "grace@example.com",
+			password: "directory-pw",
+			wantErr:  models.ErrInvalidCredential,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := newFakeDirectory()
+			l, users := newTestLDAP(dir, tt.cfg)
+
+			id, err := l.Authenticate(context.Background(), tt.login, tt.password)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v; want %v", err, tt.wantErr)
+				}
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, id, tt.wantID)
+			assert.Equal(t, len(users.roles), len(tt.wantRoles))
+			for uid, role := range tt.wantRoles {
+				assert.Equal(t, users.roles[uid], role)
+			}
+			assert.Equal(t, dir.binds[0], serviceDN)
+			assert.Equal(t, dir.closed, true)
+		})
+	}
+}
+
+func TestLDAPAmbiguousFilter(t *testing.T) {
+	dir := newFakeDirectory()
+	l, _ := newTestLDAP(dir, LDAPConfig{UserFilter: "(|(mail=%[1]s)(mail=*))"})
+
+	_, err := l.Authenticate(context.Background(), "carol@example.com", "directory-pw")
+	if !errors.Is(err, models.ErrInvalidCredential) {
+		t.Fatalf("got error %v; want ErrInvalidCredential", err)
+	}
+}
+
+func TestLDAPVerify(t *testing.T) {
+	dir := newFakeDirectory()
+	// 已经关联到 bob（用户 2）的目录条目
+	dir.add(mocks.LinkedSubject, "linked@example.com", "Linked", "directory-pw", staffGroup)
+	groupRoles := map[string]models.Role{adminsGroup: models.RoleAdmin}
+
+	tests := []struct {
+		name     string
+		userID   int
+		email    string
+		password string
+		wantErr  error
+	}{
+		{"Linked entry", 2, "linked@example.com", "directory-pw", nil},
+		{"Wrong password", 2, "linked@example.com", "wrong", models.ErrInvalidCredential},
+		{"Entry linked to another user", 4, "linked@example.com", "directory-pw", models.ErrInvalidCredential},
+		// Authenticate 会按邮箱关联并开通这个条目，Verify 不会
+		{"Entry not linked yet", 4, "carol@example.com", "directory-pw", models.ErrInvalidCredential},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, users := newTestLDAP(dir, LDAPConfig{GroupRoles: groupRoles})
+			err := l.Verify(context.Background(), tt.userID, tt.email, tt.password)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v; want %v", err, tt.wantErr)
+				}
+			} else {
+				assert.NilError(t, err)
+			}
+			// 只验证密码，不同步角色
+			assert.Equal(t, len(users.roles), 0)
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	dir := newFakeDirectory()
+	l, _ := newTestLDAP(dir, LDAPConfig{})
+	chain := Chain{l, &Database{Users: &mocks.UserModel{}}}
+
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		wantID   int
+		wantErr  error
+	}{
+		{"Directory user", "carol@example.com", "directory-pw", 4, nil},
+		{"Local-only user", "admin@example.com", "password", 3, nil},
+		{"Local password for directory user", "carol@example.com", "password", 4, nil},
+		{"Disabled stops the chain", "dave@example.com", "directory-pw", 0, models.ErrAccountDisabled},
+		{"No match", "nobody@example.com", "password", 0, models.ErrInvalidCredential},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := chain.Authenticate(context.Background(), tt.email, tt.password)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v; want %v", err, tt.wantErr)
+				}
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, id, tt.wantID)
+		})
+	}
+}
+
+func TestParseGroupRoles(t *testing.T) {
+	roles, err := ParseGroupRoles("admin:" + adminsGroup + "; moderator:" + modsGroup + ";")
+	assert.NilError(t, err)
+	assert.Equal(t, len(roles), 2)
+	assert.Equal(t, roles[adminsGroup], models.RoleAdmin)
+	assert.Equal(t, roles[modsGroup], models.RoleModerator)
+
+	_, err = ParseGroupRoles("root:" + adminsGroup)
+	if !errors.Is(err, models.ErrInvalidRole) {
+		t.Fatalf("got error %v; want ErrInvalidRole", err)
+	}
+	_, err = ParseGroupRoles(adminsGroup)
+	if err == nil {
+		t.Fatal("expected an error for a mapping without a role")
+	}
+}
@@ -0,0 +1,177 @@
+// Package i18n 提供界面文字的翻译。每种语言的消息目录是一个 JSON 文件，文件名就是语言标签，例如 en.json、zh-CN.json，
+// 内容是从消息键到文字的扁平映射。文字可以包含 fmt 格式化占位符，例如 "%d minutes ago"。
+//
+// 需要区分单复数的消息使用 ".one" 和 ".other" 两个后缀，例如 "time.minutes_ago.one" 和 "time.minutes_ago.other"，
+// 通过 Plural 方法查找。中文没有单复数的区别，只需要提供 ".other"。
+package i18n
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Bundle 保存所有语言的消息目录。加载之后只读，可以安全地并发使用。
+type Bundle struct {
+	fallback string
+	catalogs map[string]map[string]string
+	locales  []string
+}
+
+// Load 读取 fsys 中 dir 目录下所有的 *.json 消息目录。fallback 是找不到翻译时使用的语言，它的目录必须存在。
+func Load(fsys fs.FS, dir, fallback string) (*Bundle, error) {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Bundle{fallback: fallback, catalogs: make(map[string]map[string]string)}
+	for _, file := range files {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		var catalog map[string]string
+		err = json.Unmarshal(data, &catalog)
+		if err != nil {
+			return nil, fmt.Errorf("i18n: %s: %w", file, err)
+		}
+		locale := strings.TrimSuffix(path.Base(file), ".json")
+		b.catalogs[locale] = catalog
+		b.locales = append(b.locales, locale)
+	}
+	if _, ok := b.catalogs[fallback]; !ok {
+		return nil, fmt.Errorf("i18n: no catalog for fallback locale %q in %s", fallback, dir)
+	}
+	sort.Strings(b.locales)
+	return b, nil
+}
+
+// Locales 返回所有可用的语言标签，按字母顺序排列。
+func (b *Bundle) Locales() []string {
+	return b.locales
+}
+
+// Keys 返回 locale 目录中的所有消息键，按字母顺序排列，测试中用来检查各语言的目录是否完整。
+func (b *Bundle) Keys(locale string) []string {
+	keys := make([]string, 0, len(b.catalogs[locale]))
+	for k := range b.catalogs[locale] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// T 返回 key 在 locale 中的翻译，并用 args 格式化。locale 中没有这条消息时使用默认语言，仍然没有时返回 key 本身，
+// 这样漏翻的文字在页面上一眼就能看出来。
+func (b *Bundle) T(locale, key string, args ...any) string {
+	msg, ok := b.lookup(locale, key)
+	if !ok {
+		return key
+	}
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// Plural 根据 n 选择单数或复数形式的消息。n 会作为第一个格式化参数，后面跟着 args。
+func (b *Bundle) Plural(locale, key string, n int, args ...any) string {
+	candidates := []string{key + ".other", key}
+	if n == 1 {
+		candidates = append([]string{key + ".one"}, candidates...)
+	}
+	// 先在请求的语言中查找所有形式，再回退到默认语言，避免中文的单数消息回退成英文
+	for _, l := range []string{locale, b.fallback} {
+		for _, k := range candidates {
+			if msg, ok := b.catalogs[l][k]; ok {
+				return fmt.Sprintf(msg, append([]any{n}, args...)...)
+			}
+		}
+	}
+	return key
+}
+
+func (b *Bundle) lookup(locale, key string) (string, bool) {
+	if msg, ok := b.catalogs[locale][key]; ok {
+		return msg, true
+	}
+	msg, ok := b.catalogs[b.fallback][key]
+	return msg, ok
+}
+
+// Match 按顺序检查候选的语言标签，返回第一个可用的语言。先尝试完全匹配（不区分大小写），
+// 再尝试只匹配主语言，例如 "zh-TW" 和 "zh-Hans" 都会匹配到 "zh-CN"，"en-GB" 会匹配到 "en"。都不匹配时返回空字符串。
+func (b *Bundle) Match(tags ...string) string {
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		for _, l := range b.locales {
+			if strings.EqualFold(l, tag) {
+				return l
+			}
+		}
+		base := baseLanguage(tag)
+		for _, l := range b.locales {
+			if strings.EqualFold(baseLanguage(l), base) {
+				return l
+			}
+		}
+	}
+	return ""
+}
+
+// Fallback 返回默认语言。
+func (b *Bundle) Fallback() string {
+	return b.fallback
+}
+
+func baseLanguage(tag string) string {
+	base, _, _ := strings.Cut(strings.ReplaceAll(tag, "_", "-"), "-")
+	return base
+}
+
+// ParseAcceptLanguage 解析 Accept-Language 请求头，按权重从高到低返回语言标签。
+// 权重为 0 的语言和通配符 "*" 会被忽略，格式错误的部分直接跳过。
+func ParseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var langs []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.TrimSpace(tag)
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q <= 0 {
+			continue
+		}
+		langs = append(langs, weighted{tag, q})
+	}
+	// 稳定排序，权重相同时保持原来的顺序
+	sort.SliceStable(langs, func(i, j int) bool {
+		return langs[i].q > langs[j].q
+	})
+
+	tags := make([]string, len(langs))
+	for i, l := range langs {
+		tags[i] = l.tag
+	}
+	return tags
+}
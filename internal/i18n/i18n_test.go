@@ -0,0 +1,90 @@
+package i18n
+
+import (
+	"github.com/hlf2016/snippetbox/internal/assert"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func newTestBundle(t *testing.T) *Bundle {
+	fsys := fstest.MapFS{
+		"i18n/en.json": {Data: []byte(`{
+			"greeting": "Hello, %s!",
+			"only.en": "English only",
+			"apples.one": "%d apple",
+			"apples.other": "%d apples"
+		}`)},
+		"i18n/zh-CN.json": {Data: []byte(`{
+			"greeting": "你好，%s！",
+			"apples.other": "%d 个苹果"
+		}`)},
+	}
+	b, err := Load(fsys, "i18n", "en")
+	assert.NilError(t, err)
+	return b
+}
+
+func TestBundleT(t *testing.T) {
+	b := newTestBundle(t)
+
+	assert.Equal(t, b.T("en", "greeting", "Alice"), "Hello, Alice!")
+	assert.Equal(t, b.T("zh-CN", "greeting", "Alice"), "你好，Alice！")
+	// 缺少翻译时回退到默认语言，再回退到键本身
+	assert.Equal(t, b.T("zh-CN", "only.en"), "English only")
+	assert.Equal(t, b.T("zh-CN", "missing.key"), "missing.key")
+	assert.Equal(t, b.T("fr", "greeting", "Alice"), "Hello, Alice!")
+}
+
+func TestBundlePlural(t *testing.T) {
+	b := newTestBundle(t)
+
+	assert.Equal(t, b.Plural("en", "apples", 1), "1 apple")
+	assert.Equal(t, b.Plural("en", "apples", 3), "3 apples")
+	// 中文只有 .other，单数时也不能回退成英文
+	assert.Equal(t, b.Plural("zh-CN", "apples", 1), "1 个苹果")
+}
+
+func TestBundleMatch(t *testing.T) {
+	b := newTestBundle(t)
+
+	tests := []struct {
+		name string
+		tags []string
+		want string
+	}{
+		{name: "Exact", tags: []string{"zh-CN"}, want: "zh-CN"},
+		{name: "Case insensitive", tags: []string{"ZH-cn"}, want: "zh-CN"},
+		{name: "Base language", tags: []string{"zh-Hans"}, want: "zh-CN"},
+		{name: "Region variant", tags: []string{"en-GB"}, want: "en"},
+		{name: "First supported wins", tags: []string{"fr", "de", "zh", "en"}, want: "zh-CN"},
+		{name: "Unsupported", tags: []string{"fr", ""}, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, b.Match(tt.tags...), tt.want)
+		})
+	}
+}
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   []string
+	}{
+		{name: "Empty", header: "", want: []string{}},
+		{name: "Single", header: "zh-CN", want: []string{"zh-CN"}},
+		{name: "Weighted", header: "en;q=0.5, zh-CN, zh;q=0.8", want: []string{"zh-CN", "zh", "en"}},
+		{name: "Ignores zero and wildcard", header: "fr;q=0, *, de;q=0.1", want: []string{"de"}},
+		{name: "Skips malformed weight", header: "fr;q=abc, en", want: []string{"en"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ParseAcceptLanguage(tt.header)
+			assert.Equal(t, strings.Join(got, ","), strings.Join(tt.want, ","))
+		})
+	}
+}
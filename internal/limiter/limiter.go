@@ -0,0 +1,139 @@
+package limiter
+
+import (
+	"time"
+)
+
+// Clock 抽象了当前时间的来源，测试中可以替换成可控的假时钟。
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock 使用系统时间。
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Entry 记录某个键（例如账号或 IP 地址）的失败情况。
+type Entry struct {
+	Failures    int
+	LastFailure time.Time
+	// 在此时间之前不允许再次尝试
+	BlockedUntil time.Time
+}
+
+// Store 是失败记录的存储接口。默认使用进程内的 MemoryStore，需要时可以替换成其他实现。
+//
+// 同一个键可能被多个并发的登录请求同时更新，所以修改记录的方法必须是原子的：先读出记录、在内存中修改、
+// 再整个写回的实现会让并发的失败互相覆盖，攻击者同时发出大量请求就能绕过退避和锁定。
+// 基于数据库的实现可以用 UPDATE ... SET failures = failures + 1，基于 Redis 的实现可以用 INCR。
+type Store interface {
+	// Get 返回 key 对应的记录。记录不存在或在 now 时刻已经过期时，found 为 false。
+	Get(key string, now time.Time) (e Entry, found bool, err error)
+	// Incr 原子地把失败次数加一、把 LastFailure 设为 now，并返回更新后的记录。记录不存在、已经过期，
+	// 或距离上一次失败超过 resetAfter 时从零开始计数。记录至少保留到 now 之后的 resetAfter。
+	Incr(key string, now time.Time, resetAfter time.Duration) (Entry, error)
+	// Block 把 BlockedUntil 推迟到 until，已经更晚时保持不变。记录至少保留到 until。
+	Block(key string, until time.Time) error
+	Delete(key string) error
+}
+
+// Policy 描述退避和锁定的规则。
+type Policy struct {
+	// 允许连续失败的次数，超过后开始指数退避
+	FreeAttempts int
+	// 第一次退避的时长，此后每失败一次翻倍，但不超过 MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// 累计失败次数达到 LockoutThreshold 时锁定 LockoutDuration，并触发 OnLockout 通知
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	// 距离最后一次失败超过 ResetAfter 后，失败次数清零
+	ResetAfter time.Duration
+}
+
+type Limiter struct {
+	Policy
+	Store Store
+	Clock Clock
+	// OnLockout 在某个键被锁定时调用，可以用来记录日志或通知用户
+	OnLockout func(key string, until time.Time)
+}
+
+func New(policy Policy, store Store) *Limiter {
+	return &Limiter{
+		Policy: policy,
+		Store:  store,
+		Clock:  SystemClock{},
+	}
+}
+
+// Wait 返回 key 还需要等待多久才能再次尝试，返回 0 表示现在就可以尝试。
+func (l *Limiter) Wait(key string) (time.Duration, error) {
+	now := l.Clock.Now()
+	e, found, err := l.Store.Get(key, now)
+	if err != nil || !found {
+		return 0, err
+	}
+	if now.Before(e.BlockedUntil) {
+		return e.BlockedUntil.Sub(now), nil
+	}
+	return 0, nil
+}
+
+// Fail 记录一次失败，返回此后需要等待的时长。
+//
+// 计数由 Store.Incr 原子地完成，并发的失败各自得到不同的次数，等待时长按各自的次数计算，
+// Block 只会推迟不会提前，所以最终的等待时长取决于其中次数最多的那一次。
+func (l *Limiter) Fail(key string) (time.Duration, error) {
+	now := l.Clock.Now()
+	e, err := l.Store.Incr(key, now, l.ResetAfter)
+	if err != nil {
+		return 0, err
+	}
+
+	locked := l.LockoutThreshold > 0 && e.Failures >= l.LockoutThreshold
+	var delay time.Duration
+	switch {
+	case locked:
+		delay = l.LockoutDuration
+	case e.Failures > l.FreeAttempts:
+		delay = l.backoff(e.Failures - l.FreeAttempts)
+	}
+	if delay > 0 {
+		err = l.Store.Block(key, now.Add(delay))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// 每次从未锁定进入锁定状态时通知，包括锁定过期后再次失败、重新被锁定的情况。
+	// e 中的 BlockedUntil 是本次失败之前的值：上一次失败已经达到阈值并且锁定尚未结束时，说明仍在同一次锁定中。
+	wasLocked := l.LockoutThreshold > 0 && e.Failures-1 >= l.LockoutThreshold && now.Before(e.BlockedUntil)
+	if locked && !wasLocked && l.OnLockout != nil {
+		l.OnLockout(key, now.Add(delay))
+	}
+	return delay, nil
+}
+
+// Reset 清除 key 的失败记录，通常在成功登录后调用。
+func (l *Limiter) Reset(key string) error {
+	return l.Store.Delete(key)
+}
+
+// backoff 返回第 n 次（从 1 开始）退避的时长：BaseDelay, 2*BaseDelay, 4*BaseDelay ...
+func (l *Limiter) backoff(n int) time.Duration {
+	delay := l.BaseDelay
+	for i := 1; i < n; i++ {
+		delay *= 2
+		if l.MaxDelay > 0 && delay >= l.MaxDelay {
+			return l.MaxDelay
+		}
+	}
+	if l.MaxDelay > 0 && delay > l.MaxDelay {
+		return l.MaxDelay
+	}
+	return delay
+}
@@ -0,0 +1,159 @@
+package limiter
+
+import (
+	"github.com/hlf2016/snippetbox/internal/assert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock 是一个只有在调用 Advance() 时才会前进的时钟。
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestLimiter() (*Limiter, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2023, 9, 1, 10, 0, 0, 0, time.UTC)}
+	l := New(Policy{
+		FreeAttempts:     3,
+		BaseDelay:        time.Second,
+		MaxDelay:         10 * time.Second,
+		LockoutThreshold: 8,
+		LockoutDuration:  15 * time.Minute,
+		ResetAfter:       time.Hour,
+	}, NewMemoryStore())
+	l.Clock = clock
+	return l, clock
+}
+
+func TestLimiterBackoff(t *testing.T) {
+	l, _ := newTestLimiter()
+
+	// 前三次失败不需要等待，之后等待时间按 1s、2s、4s、8s 翻倍，并被 MaxDelay 限制在 10s
+	want := []time.Duration{0, 0, 0, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}
+	for i, w := range want {
+		delay, err := l.Fail("alice@example.com")
+		assert.NilError(t, err)
+		assert.Equal(t, delay, w)
+
+		wait, err := l.Wait("alice@example.com")
+		assert.NilError(t, err)
+		if wait != w {
+			t.Errorf("failure %d: got wait %v; want %v", i+1, wait, w)
+		}
+	}
+}
+
+func TestLimiterLockout(t *testing.T) {
+	l, clock := newTestLimiter()
+
+	var lockedKey string
+	var lockedUntil time.Time
+	calls := 0
+	l.OnLockout = func(key string, until time.Time) {
+		lockedKey = key
+		lockedUntil = until
+		calls++
+	}
+
+	for i := 0; i < 8; i++ {
+		_, err := l.Fail("alice@example.com")
+		assert.NilError(t, err)
+	}
+
+	assert.Equal(t, calls, 1)
+	assert.Equal(t, lockedKey, "alice@example.com")
+	assert.Equal(t, lockedUntil, clock.Now().Add(15*time.Minute))
+
+	wait, err := l.Wait("alice@example.com")
+	assert.NilError(t, err)
+	assert.Equal(t, wait, 15*time.Minute)
+
+	// 其他账号不受影响
+	wait, err = l.Wait("bob@example.com")
+	assert.NilError(t, err)
+	assert.Equal(t, wait, time.Duration(0))
+
+	clock.Advance(15 * time.Minute)
+	wait, err = l.Wait("alice@example.com")
+	assert.NilError(t, err)
+	assert.Equal(t, wait, time.Duration(0))
+
+	// 锁定结束后失败次数没有清零，再失败一次会重新锁定，并且再次通知
+	_, err = l.Fail("alice@example.com")
+	assert.NilError(t, err)
+	assert.Equal(t, calls, 2)
+	assert.Equal(t, lockedUntil, clock.Now().Add(15*time.Minute))
+}
+
+func TestLimiterConcurrentFail(t *testing.T) {
+	l, clock := newTestLimiter()
+	var calls atomic.Int32
+	l.OnLockout = func(key string, until time.Time) {
+		calls.Add(1)
+	}
+
+	// 大量并发的失败不能互相覆盖计数，否则攻击者同时发出请求就能绕过锁定
+	const n = 100
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := l.Fail("alice@example.com")
+			assert.NilError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	e, found, err := l.Store.Get("alice@example.com", clock.Now())
+	assert.NilError(t, err)
+	assert.Equal(t, found, true)
+	assert.Equal(t, e.Failures, n)
+	if calls.Load() < 1 {
+		t.Error("expected the lockout to be reported")
+	}
+
+	wait, err := l.Wait("alice@example.com")
+	assert.NilError(t, err)
+	assert.Equal(t, wait, 15*time.Minute)
+}
+
+func TestLimiterReset(t *testing.T) {
+	t.Run("After success", func(t *testing.T) {
+		l, _ := newTestLimiter()
+		for i := 0; i < 5; i++ {
+			l.Fail("alice@example.com")
+		}
+		assert.NilError(t, l.Reset("alice@example.com"))
+
+		delay, err := l.Fail("alice@example.com")
+		assert.NilError(t, err)
+		assert.Equal(t, delay, time.Duration(0))
+	})
+
+	t.Run("After quiet period", func(t *testing.T) {
+		l, clock := newTestLimiter()
+		for i := 0; i < 5; i++ {
+			l.Fail("alice@example.com")
+		}
+		clock.Advance(2 * time.Hour)
+
+		wait, err := l.Wait("alice@example.com")
+		assert.NilError(t, err)
+		assert.Equal(t, wait, time.Duration(0))
+
+		delay, err := l.Fail("alice@example.com")
+		assert.NilError(t, err)
+		assert.Equal(t, delay, time.Duration(0))
+	})
+}
@@ -0,0 +1,85 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+// 清理过期记录的最小间隔
+const sweepInterval = time.Minute
+
+type memoryItem struct {
+	entry   Entry
+	expires time.Time
+}
+
+// MemoryStore 是进程内的 Store 实现，可以安全地并发使用。
+// 过期记录在 Get 时顺带清理，所以不需要额外的后台 goroutine。
+type MemoryStore struct {
+	mu        sync.Mutex
+	items     map[string]memoryItem
+	lastSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{items: make(map[string]memoryItem)}
+}
+
+func (s *MemoryStore) Get(key string, now time.Time) (Entry, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		for k, item := range s.items {
+			if !now.Before(item.expires) {
+				delete(s.items, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	item, ok := s.items[key]
+	if !ok || !now.Before(item.expires) {
+		return Entry{}, false, nil
+	}
+	return item.entry, true, nil
+}
+
+func (s *MemoryStore) Incr(key string, now time.Time, resetAfter time.Duration) (Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.items[key]
+	if !ok || !now.Before(item.expires) || now.Sub(item.entry.LastFailure) > resetAfter {
+		item = memoryItem{}
+	}
+	item.entry.Failures++
+	item.entry.LastFailure = now
+	if expires := now.Add(resetAfter); expires.After(item.expires) {
+		item.expires = expires
+	}
+	s.items[key] = item
+	return item.entry, nil
+}
+
+func (s *MemoryStore) Block(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item := s.items[key]
+	if until.After(item.entry.BlockedUntil) {
+		item.entry.BlockedUntil = until
+	}
+	if until.After(item.expires) {
+		item.expires = until
+	}
+	s.items[key] = item
+	return nil
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, key)
+	return nil
+}
@@ -0,0 +1,375 @@
+// Package logfile 实现一个按大小或按天轮转的日志文件写入器。
+package logfile
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 备份文件名中的时间格式，例如 info-20240501T100000.000.log
+const backupTimeFormat = "20060102T150405.000"
+
+// Policy 描述轮转和保留的规则。各项为零值时表示不启用对应的规则。
+type Policy struct {
+	// 当前文件超过这个字节数时轮转
+	MaxSize int64
+	// 为 true 时，每天第一次写入前轮转前一天的文件
+	Daily bool
+	// 删除比这更早的备份
+	MaxAge time.Duration
+	// 最多保留的备份个数
+	MaxBackups int
+	// 为 true 时用 gzip 压缩轮转出来的备份
+	Compress bool
+}
+
+// Writer 是可以并发使用的 io.Writer。轮转时把当前文件改名为带时间戳的备份，然后重新创建原来的文件。
+// 压缩和清理旧备份在后台进行，Close 会等待它们结束。
+type Writer struct {
+	path   string
+	policy Policy
+	// 当前时间，测试中可以替换
+	now func() time.Time
+	// 轮转和重新打开失败时的错误写到这里，默认为标准错误，测试中可以替换
+	errorLog io.Writer
+
+	mu sync.Mutex
+	// file 为 nil 而 closed 为 false 表示上一次轮转或重新打开失败，下一次写入时重试
+	file   *os.File
+	closed bool
+	size   int64
+	// 当前文件开始写入的日期，用于按天轮转
+	day string
+	// 最近一次轮转或打开失败的错误，用来避免每写一行都向标准错误重复报告同一个问题
+	failure error
+
+	// 压缩和清理同一时间只运行一个
+	millMu sync.Mutex
+	wg     sync.WaitGroup
+}
+
+// Open 以追加方式打开 path 对应的日志文件，目录不存在时自动创建。
+func Open(path string, policy Policy) (*Writer, error) {
+	if policy.MaxSize < 0 || policy.MaxAge < 0 || policy.MaxBackups < 0 {
+		return nil, errors.New("logfile: policy values must not be negative")
+	}
+	w := &Writer{path: path, policy: policy, now: time.Now, errorLog: os.Stderr}
+	err := w.open()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// open 打开（或创建）日志文件。必须持有 mu 或在 Writer 还未共享时调用。
+func (w *Writer) open() error {
+	err := os.MkdirAll(filepath.Dir(w.path), 0755)
+	if err != nil {
+		return err
+	}
+	// 必须使用 O_APPEND：否则重启后会从文件开头覆盖上一次的日志，多个进程写同一个文件时也会互相覆盖
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = info.Size()
+	// 已有内容的文件按最后修改的日期计算，这样隔天重启后第一次写入也会先轮转
+	w.day = w.now().Format(time.DateOnly)
+	if w.size > 0 {
+		w.day = info.ModTime().Format(time.DateOnly)
+	}
+	return nil
+}
+
+// Write 写入 p，写入之前如果满足轮转条件则先轮转。
+//
+// 轮转失败（例如没有目录的写权限、磁盘已满）不能让日志从此停止：改名失败时继续写入原来的文件，
+// 下一次写入时再尝试轮转；重新打开失败时这一次写入返回错误，下一次写入时重试打开。
+// 写日志的调用方通常会忽略错误，所以失败的原因同时报告到标准错误。
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	if w.file == nil {
+		err := w.open()
+		w.report(err)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if w.shouldRotate(int64(len(p))) {
+		err := w.rotate()
+		w.report(err)
+		if w.file == nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// report 把轮转或打开的错误写到 errorLog。同样的失败只在第一次发生时报告，恢复之后再报告一次。
+func (w *Writer) report(err error) {
+	switch {
+	case err == nil && w.failure != nil:
+		fmt.Fprintf(w.errorLog, "logfile: %s: recovered from: %v\n", w.path, w.failure)
+	case err != nil && w.failure == nil:
+		fmt.Fprintf(w.errorLog, "logfile: %s: %v\n", w.path, err)
+	}
+	w.failure = err
+}
+
+func (w *Writer) shouldRotate(n int64) bool {
+	if w.size == 0 {
+		return false
+	}
+	if w.policy.MaxSize > 0 && w.size+n > w.policy.MaxSize {
+		return true
+	}
+	return w.policy.Daily && w.now().Format(time.DateOnly) != w.day
+}
+
+// Rotate 立即轮转当前文件。
+func (w *Writer) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	if w.file == nil {
+		return w.open()
+	}
+	return w.rotate()
+}
+
+// rotate 把当前文件改名为备份并重新打开原来的路径。改名失败时重新打开的是原来的文件，日志继续追加在后面；
+// 重新打开也失败时 w.file 为 nil，由下一次 Write 重试。
+func (w *Writer) rotate() error {
+	// 关闭出错时文件描述符同样已经释放，继续改名和重新打开
+	closeErr := w.file.Close()
+	w.file = nil
+	renameErr := os.Rename(w.path, w.backupName(w.now()))
+	if errors.Is(renameErr, os.ErrNotExist) {
+		renameErr = nil
+	}
+	if renameErr != nil {
+		renameErr = fmt.Errorf("rotate: %w", renameErr)
+	}
+	err := w.open()
+	if err != nil {
+		return errors.Join(closeErr, renameErr, fmt.Errorf("reopen: %w", err))
+	}
+	if renameErr == nil {
+		w.mill()
+	}
+	return errors.Join(closeErr, renameErr)
+}
+
+// Reopen 关闭并重新打开日志文件，但不改名。配合 logrotate 等外部工具使用：
+// 它们把文件改名之后发送 SIGHUP，程序收到信号后调用 Reopen 开始写入新文件。
+// 重新打开失败时由下一次 Write 重试。
+func (w *Writer) Reopen() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	var closeErr error
+	if w.file != nil {
+		closeErr = w.file.Close()
+		w.file = nil
+	}
+	err := w.open()
+	if err != nil {
+		return errors.Join(closeErr, err)
+	}
+	return closeErr
+}
+
+// Sync 把当前文件的内容刷到磁盘。
+func (w *Writer) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Sync()
+}
+
+// Close 关闭当前文件，并等待后台的压缩和清理结束。
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	var err error
+	w.closed = true
+	if w.file != nil {
+		err = w.file.Sync()
+		if closeErr := w.file.Close(); err == nil {
+			err = closeErr
+		}
+		w.file = nil
+	}
+	w.mu.Unlock()
+	w.wg.Wait()
+	return err
+}
+
+// backupName 返回在 t 时刻轮转出来的备份文件名：info.log 变为 info-20240501T100000.000.log。
+func (w *Writer) backupName(t time.Time) string {
+	dir, prefix, ext := w.nameParts()
+	return filepath.Join(dir, prefix+t.Format(backupTimeFormat)+ext)
+}
+
+func (w *Writer) nameParts() (dir, prefix, ext string) {
+	dir = filepath.Dir(w.path)
+	base := filepath.Base(w.path)
+	ext = filepath.Ext(base)
+	return dir, strings.TrimSuffix(base, ext) + "-", ext
+}
+
+// mill 在后台压缩新的备份，并按保留规则删除旧备份。
+func (w *Writer) mill() {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.millMu.Lock()
+		defer w.millMu.Unlock()
+		// 后台任务没有调用方可以接收错误，写到标准错误，不能写入日志本身以免递归
+		err := w.millRun()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "logfile: %v\n", err)
+		}
+	}()
+}
+
+type backup struct {
+	path string
+	time time.Time
+}
+
+func (w *Writer) millRun() error {
+	backups, err := w.backups()
+	if err != nil {
+		return err
+	}
+
+	var remove []backup
+	if w.policy.MaxBackups > 0 && len(backups) > w.policy.MaxBackups {
+		remove = append(remove, backups[w.policy.MaxBackups:]...)
+		backups = backups[:w.policy.MaxBackups]
+	}
+	if w.policy.MaxAge > 0 {
+		cutoff := w.now().Add(-w.policy.MaxAge)
+		kept := backups[:0]
+		for _, b := range backups {
+			if b.time.Before(cutoff) {
+				remove = append(remove, b)
+			} else {
+				kept = append(kept, b)
+			}
+		}
+		backups = kept
+	}
+
+	var errs []error
+	for _, b := range remove {
+		err := os.Remove(b.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	if w.policy.Compress {
+		for _, b := range backups {
+			if !strings.HasSuffix(b.path, ".gz") {
+				errs = append(errs, compress(b.path))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// backups 返回目录中属于这个日志文件的备份，最新的在前。
+func (w *Writer) backups() ([]backup, error) {
+	dir, prefix, ext := w.nameParts()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []backup
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimPrefix(name, prefix)
+		stamp = strings.TrimSuffix(stamp, ".gz")
+		if !strings.HasSuffix(stamp, ext) {
+			continue
+		}
+		t, err := time.ParseInLocation(backupTimeFormat, strings.TrimSuffix(stamp, ext), time.Local)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{path: filepath.Join(dir, name), time: t})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].time.After(backups[j].time)
+	})
+	return backups, nil
+}
+
+// compress 把 path 压缩为 path.gz，成功后删除原文件。
+func compress(path string) (err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			dst.Close()
+			os.Remove(path + ".gz")
+		}
+	}()
+
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if err != nil {
+		return err
+	}
+	err = gz.Close()
+	if err != nil {
+		return err
+	}
+	err = dst.Close()
+	if err != nil {
+		return err
+	}
+	src.Close()
+	return os.Remove(path)
+}
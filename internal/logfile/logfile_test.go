@@ -0,0 +1,264 @@
+package logfile
+
+import (
+	"compress/gzip"
+	"github.com/hlf2016/snippetbox/internal/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock 返回可以手动拨动的时间
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func openTest(t *testing.T, policy Policy) (*Writer, *fakeClock, string) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "info.log")
+	w, err := Open(path, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{t: time.Date(2024, 5, 1, 10, 0, 0, 0, time.Local)}
+	w.now = clock.now
+	w.day = clock.t.Format(time.DateOnly)
+	t.Cleanup(func() { w.Close() })
+	return w, clock, dir
+}
+
+func write(t *testing.T, w *Writer, s string) {
+	_, err := io.WriteString(w, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func listDir(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log", "info.log")
+	for _, line := range []string{"first\n", "second\n"} {
+		w, err := Open(path, Policy{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(t, w, line)
+		w.Close()
+	}
+	// 重新打开后追加，而不是覆盖上一次的内容
+	assert.Equal(t, readFile(t, path), "first\nsecond\n")
+}
+
+func TestRotateBySize(t *testing.T) {
+	w, _, dir := openTest(t, Policy{MaxSize: 10})
+
+	write(t, w, "12345678\n")
+	write(t, w, "abcdefgh\n")
+	w.Close()
+
+	assert.Equal(t, readFile(t, filepath.Join(dir, "info.log")), "abcdefgh\n")
+	assert.Equal(t, readFile(t, filepath.Join(dir, "info-20240501T100000.000.log")), "12345678\n")
+}
+
+func TestRotateDaily(t *testing.T) {
+	w, clock, dir := openTest(t, Policy{Daily: true})
+
+	write(t, w, "monday\n")
+	clock.t = clock.t.Add(time.Hour)
+	write(t, w, "still monday\n")
+	assert.Equal(t, len(listDir(t, dir)), 1)
+
+	clock.t = clock.t.Add(24 * time.Hour)
+	write(t, w, "tuesday\n")
+	w.Close()
+
+	assert.Equal(t, readFile(t, filepath.Join(dir, "info.log")), "tuesday\n")
+	assert.Equal(t, readFile(t, filepath.Join(dir, "info-20240502T110000.000.log")), "monday\nstill monday\n")
+}
+
+func TestRetention(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		want   []string
+	}{
+		{
+			name:   "Max backups",
+			policy: Policy{MaxBackups: 2},
+			want:   []string{"info-20240501T130000.000.log", "info-20240501T140000.000.log", "info.log"},
+		},
+		{
+			name:   "Max age",
+			policy: Policy{MaxAge: 90 * time.Minute},
+			want:   []string{"info-20240501T130000.000.log", "info-20240501T140000.000.log", "info.log"},
+		},
+		{
+			name:   "Compress",
+			policy: Policy{MaxBackups: 1, Compress: true},
+			want:   []string{"info-20240501T140000.000.log.gz", "info.log"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, clock, dir := openTest(t, tt.policy)
+			for i := 0; i < 4; i++ {
+				clock.t = clock.t.Add(time.Hour)
+				write(t, w, "line\n")
+				err := w.Rotate()
+				if err != nil {
+					t.Fatal(err)
+				}
+				// 等待本次的压缩和清理结束，下一次轮转的结果才确定
+				w.wg.Wait()
+			}
+			w.Close()
+			assert.Equal(t, strings.Join(listDir(t, dir), " "), strings.Join(tt.want, " "))
+		})
+	}
+}
+
+func TestCompress(t *testing.T) {
+	w, _, dir := openTest(t, Policy{Compress: true})
+	write(t, w, "compressed\n")
+	err := w.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	f, err := os.Open(filepath.Join(dir, "info-20240501T100000.000.log.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(b), "compressed\n")
+}
+
+func TestReopen(t *testing.T) {
+	w, _, dir := openTest(t, Policy{})
+	path := filepath.Join(dir, "info.log")
+
+	write(t, w, "before\n")
+	// 模拟 logrotate：先把文件改名，再通知程序重新打开
+	err := os.Rename(path, path+".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Reopen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, w, "after\n")
+	w.Close()
+
+	assert.Equal(t, readFile(t, path+".1"), "before\n")
+	assert.Equal(t, readFile(t, path), "after\n")
+}
+
+func TestRotateFailure(t *testing.T) {
+	// root 不受目录权限的限制，改名不会失败
+	if os.Geteuid() == 0 {
+		t.Skip("logfile: directory permissions are not enforced for root")
+	}
+	w, clock, dir := openTest(t, Policy{MaxSize: 10})
+	path := filepath.Join(dir, "info.log")
+	var errorLog strings.Builder
+	w.errorLog = &errorLog
+
+	write(t, w, "first\n")
+	// 目录只读时无法改名，日志继续追加到原来的文件
+	err := os.Chmod(dir, 0555)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(dir, 0755) })
+	write(t, w, "second\n")
+	write(t, w, "third\n")
+	assert.Equal(t, readFile(t, path), "first\nsecond\nthird\n")
+	// 同一个错误只报告一次
+	assert.Equal(t, strings.Count(errorLog.String(), "rotate:"), 1)
+
+	// 权限恢复后下一次写入时完成轮转
+	err = os.Chmod(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, w, "fourth\n")
+	assert.StringContains(t, errorLog.String(), "recovered from")
+	assert.Equal(t, readFile(t, path), "fourth\n")
+	assert.Equal(t, readFile(t, w.backupName(clock.t)), "first\nsecond\nthird\n")
+}
+
+func TestReopenFailure(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("logfile: directory permissions are not enforced for root")
+	}
+	w, _, dir := openTest(t, Policy{})
+	path := filepath.Join(dir, "info.log")
+	var errorLog strings.Builder
+	w.errorLog = &errorLog
+
+	write(t, w, "before\n")
+	err := os.Rename(path, path+".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 文件已经被移走而目录只读，无法创建新文件
+	err = os.Chmod(dir, 0555)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(dir, 0755) })
+	err = w.Reopen()
+	if err == nil {
+		t.Fatal("expected reopening to fail")
+	}
+	_, err = io.WriteString(w, "lost\n")
+	if err == nil {
+		t.Fatal("expected the write to fail")
+	}
+	assert.StringContains(t, errorLog.String(), "permission denied")
+
+	// 权限恢复后下一次写入时重新打开，而不是从此返回 os.ErrClosed
+	err = os.Chmod(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, w, "after\n")
+	assert.Equal(t, readFile(t, path), "after\n")
+}
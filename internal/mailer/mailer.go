@@ -0,0 +1,75 @@
+package mailer
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message 是一封纯文本邮件。
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer 是发送邮件的接口。程序中的其他部分只依赖这个接口，测试时可以换成记录邮件的实现。
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// LogMailer 不真正发送邮件，只把邮件内容写入日志。没有配置 SMTP 服务器时（例如本地开发）使用它。
+type LogMailer struct {
+	Logger *slog.Logger
+}
+
+func (m *LogMailer) Send(msg Message) error {
+	m.Logger.Info("mail", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+	return nil
+}
+
+// SMTPMailer 通过 SMTP 服务器发送邮件。服务器支持 STARTTLS 时 smtp.SendMail 会自动启用。
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	// 发件人，例如 "Snippetbox <no-reply@snippetbox.example.com>"
+	Sender string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	return smtp.SendMail(addr, auth, envelopeAddress(m.Sender), []string{msg.To}, m.format(msg))
+}
+
+func (m *SMTPMailer) format(msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", m.Sender)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// envelopeAddress 从 "Name <addr>" 形式的发件人中取出 SMTP 信封需要的纯地址。
+func envelopeAddress(sender string) string {
+	start := strings.LastIndex(sender, "<")
+	end := strings.LastIndex(sender, ">")
+	if start >= 0 && end > start {
+		return sender[start+1 : end]
+	}
+	return sender
+}
@@ -0,0 +1,49 @@
+package mailer
+
+import (
+	"github.com/hlf2016/snippetbox/internal/assert"
+	"strings"
+	"testing"
+)
+
+func TestEnvelopeAddress(t *testing.T) {
+	tests := []struct {
+		name   string
+		sender string
+		want   string
+	}{
+		{
+			name:   "Bare address",
+			sender: "no-reply@example.com",
+			want:   "no-reply@example.com",
+		},
+		{
+			name:   "Display name",
+			sender: "Snippetbox <no-reply@example.com>",
+			want:   "no-reply@example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, envelopeAddress(tt.sender), tt.want)
+		})
+	}
+}
+
+func TestSMTPMailerFormat(t *testing.T) {
+	m := &SMTPMailer{Sender: "Snippetbox <no-reply@example.com>"}
+	msg := string(m.format(Message{
+		To:      "alice@example.com",
+		Subject: "Hello",
+		Body:    "line one\nline two",
+	}))
+
+	assert.StringContains(t, msg, "From: Snippetbox <no-reply@example.com>\r\n")
+	assert.StringContains(t, msg, "To: alice@example.com\r\n")
+	assert.StringContains(t, msg, "Subject: Hello\r\n")
+	// 头部和正文之间用空行分隔，正文中的换行统一转换成 CRLF
+	if !strings.HasSuffix(msg, "\r\n\r\nline one\r\nline two") {
+		t.Errorf("unexpected message body: %q", msg)
+	}
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+type EmailChangeModelInterface interface {
+	Insert(ctx context.Context, userID int, email, token string, expires time.Time) error
+	Confirm(ctx context.Context, token string) (userID int, email string, err error)
+}
+
+// EmailChangeModel 保存等待确认的邮箱修改请求。新邮箱只有在用户点击发到该邮箱的确认链接后才会生效，
+// 数据库中只保存确认令牌的 SHA-256 哈希。
+type EmailChangeModel struct {
+	DB *sql.DB
+	// Timeout 限制每次方法调用中查询的总耗时，为 0 时只受调用方上下文的限制
+	Timeout time.Duration
+}
+
+// Insert 记录一个新的修改请求。每个用户同时只保留最新的一个请求，之前发出的确认链接随之失效。
+func (m *EmailChangeModel) Insert(ctx context.Context, userID int, email, token string, expires time.Time) error {
+	ctx, done := startQuery(ctx, "EmailChangeModel.Insert", m.Timeout)
+	defer done()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM email_changes WHERE user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	stmt := `INSERT INTO email_changes (token_hash, user_id, email, created, expires) VALUES (?, ?, ?, UTC_TIMESTAMP(), ?)`
+	_, err = tx.ExecContext(ctx, stmt, hashToken(token), userID, email, expires.UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Confirm 使用确认令牌把用户的邮箱改为新地址，返回用户 ID 和新邮箱。令牌不存在或已过期时返回 ErrNoRecord，
+// 新邮箱在此期间被其他用户注册时返回 ErrDuplicateEmail。
+func (m *EmailChangeModel) Confirm(ctx context.Context, token string) (int, string, error) {
+	ctx, done := startQuery(ctx, "EmailChangeModel.Confirm", m.Timeout)
+	defer done()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var email string
+	stmt := `SELECT user_id, email FROM email_changes WHERE token_hash = ? AND expires > UTC_TIMESTAMP()`
+	err = tx.QueryRowContext(ctx, stmt, hashToken(token)).Scan(&userID, &email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, "", ErrNoRecord
+		}
+		return 0, "", err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET email = ? WHERE id = ?`, email, userID)
+	if err != nil {
+		return 0, "", duplicateError(err)
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM email_changes WHERE user_id = ?`, userID)
+	if err != nil {
+		return 0, "", err
+	}
+	return userID, email, tx.Commit()
+}
+
+// hashToken 返回随机令牌的 SHA-256 哈希。令牌本身有足够的熵，不需要 bcrypt 这样的慢哈希。
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -6,6 +6,12 @@ var (
 	ErrNoRecord = errors.New("models: no matching record found")
 	// ErrDuplicateEmail 添加新的 ErrDuplicateEmail 错误。如果用户尝试使用已被使用的电子邮件地址注册
 	ErrDuplicateEmail = errors.New("models: duplicate email")
+	// ErrDuplicateUsername 用户名已被其他用户使用
+	ErrDuplicateUsername = errors.New("models: duplicate username")
 	// ErrInvalidCredential 添加新的 ErrInvalidCredentials 错误。如果用户尝试使用错误的电子邮件地址或密码登录
 	ErrInvalidCredential = errors.New("models: invalid credentials")
+	// ErrInvalidRole 设置角色时传入了未知的角色
+	ErrInvalidRole = errors.New("models: invalid role")
+	// ErrAccountDisabled 账号已被管理员禁用
+	ErrAccountDisabled = errors.New("models: account disabled")
 )
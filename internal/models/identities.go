@@ -0,0 +1,76 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type IdentityModelInterface interface {
+	Get(ctx context.Context, issuer, subject string) (int, error)
+	Link(ctx context.Context, userID int, issuer, subject string) error
+	CreateUser(ctx context.Context, name, email, issuer, subject string) (int, error)
+}
+
+// IdentityModel 记录用户在外部 OpenID Connect 提供方的身份。一个身份由签发者和 subject 唯一确定，
+// 之后通过同一个身份登录时不再依赖邮箱，用户在提供方修改邮箱也不会影响登录。
+type IdentityModel struct {
+	DB *sql.DB
+	// Timeout 限制每次方法调用中查询的总耗时，为 0 时只受调用方上下文的限制
+	Timeout time.Duration
+}
+
+// Get 返回身份对应的用户 ID，没有关联的用户时返回 ErrNoRecord。
+func (m *IdentityModel) Get(ctx context.Context, issuer, subject string) (int, error) {
+	ctx, done := startQuery(ctx, "IdentityModel.Get", m.Timeout)
+	defer done()
+	var userID int
+	stmt := `SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?`
+	err := m.DB.QueryRowContext(ctx, stmt, issuer, subject).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoRecord
+		}
+		return 0, err
+	}
+	return userID, nil
+}
+
+// Link 把身份关联到已有的用户。
+func (m *IdentityModel) Link(ctx context.Context, userID int, issuer, subject string) error {
+	ctx, done := startQuery(ctx, "IdentityModel.Link", m.Timeout)
+	defer done()
+	stmt := `INSERT INTO user_identities (user_id, issuer, subject, created) VALUES (?, ?, ?, UTC_TIMESTAMP())`
+	_, err := m.DB.ExecContext(ctx, stmt, userID, issuer, subject)
+	return err
+}
+
+// CreateUser 为第一次登录的外部身份创建用户并关联身份，返回新用户的 ID。新用户没有可用的密码
+// （hashed_password 为 "!"，password.Hasher 永远不会认为它匹配），只能通过提供方登录。
+// 邮箱已被其他用户使用时返回 ErrDuplicateEmail。
+func (m *IdentityModel) CreateUser(ctx context.Context, name, email, issuer, subject string) (int, error) {
+	ctx, done := startQuery(ctx, "IdentityModel.CreateUser", m.Timeout)
+	defer done()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt := `INSERT INTO users (name, email, hashed_password, created) VALUES (?, ?, '!', UTC_TIMESTAMP())`
+	result, err := tx.ExecContext(ctx, stmt, name, email)
+	if err != nil {
+		return 0, duplicateError(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	stmt = `INSERT INTO user_identities (user_id, issuer, subject, created) VALUES (?, ?, ?, UTC_TIMESTAMP())`
+	_, err = tx.ExecContext(ctx, stmt, id, issuer, subject)
+	if err != nil {
+		return 0, err
+	}
+	return int(id), tx.Commit()
+}
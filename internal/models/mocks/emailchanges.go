@@ -0,0 +1,23 @@
+package mocks
+
+import (
+	"context"
+	"github.com/hlf2016/snippetbox/internal/models"
+	"time"
+)
+
+// EmailChangeToken 是可以确认的模拟令牌，确认后用户 1 的邮箱改为 alice.new@example.com
+const EmailChangeToken = "valid-email-change-token"
+
+type EmailChangeModel struct{}
+
+func (m *EmailChangeModel) Insert(ctx context.Context, userID int, email, token string, expires time.Time) error {
+	return nil
+}
+
+func (m *EmailChangeModel) Confirm(ctx context.Context, token string) (int, string, error) {
+	if token == EmailChangeToken {
+		return 1, "alice.new@example.com", nil
+	}
+	return 0, "", models.ErrNoRecord
+}
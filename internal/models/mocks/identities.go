@@ -0,0 +1,32 @@
+package mocks
+
+import (
+	"context"
+	"github.com/hlf2016/snippetbox/internal/models"
+)
+
+// LinkedSubject 是已经关联到用户 2（bob）的外部身份，任何签发者都适用
+const LinkedSubject = "linked-subject"
+
+// NewIdentityUserID 是 CreateUser 为新的外部身份创建的用户 ID
+const NewIdentityUserID = 7
+
+type IdentityModel struct{}
+
+func (m *IdentityModel) Get(ctx context.Context, issuer, subject string) (int, error) {
+	if subject == LinkedSubject {
+		return 2, nil
+	}
+	return 0, models.ErrNoRecord
+}
+
+func (m *IdentityModel) Link(ctx context.Context, userID int, issuer, subject string) error {
+	return nil
+}
+
+func (m *IdentityModel) CreateUser(ctx context.Context, name, email, issuer, subject string) (int, error) {
+	if email == "dupe@example.com" {
+		return 0, models.ErrDuplicateEmail
+	}
+	return NewIdentityUserID, nil
+}
@@ -0,0 +1,117 @@
+package mocks
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/hlf2016/snippetbox/internal/models"
+	"sync"
+	"time"
+)
+
+// RememberTokenModel 把令牌保存在内存中。与其他模拟模型不同，它需要真的记住令牌，
+// 测试才能覆盖令牌的更换和重放检测。
+type RememberTokenModel struct {
+	mu     sync.Mutex
+	tokens map[string]*models.RememberToken
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (m *RememberTokenModel) Insert(ctx context.Context, userID int, series, token, sessionToken string, expires time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tokens == nil {
+		m.tokens = make(map[string]*models.RememberToken)
+	}
+	now := time.Now()
+	m.tokens[series] = &models.RememberToken{
+		ID:           len(m.tokens) + 1,
+		UserID:       userID,
+		Series:       series,
+		TokenHash:    hashToken(token),
+		SessionToken: sessionToken,
+		Created:      now,
+		LastUsed:     now,
+		Rotated:      now,
+		Expires:      expires,
+	}
+	return nil
+}
+
+func (m *RememberTokenModel) Get(ctx context.Context, series string) (*models.RememberToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[series]
+	if !ok {
+		return nil, models.ErrNoRecord
+	}
+	copied := *t
+	return &copied, nil
+}
+
+func (m *RememberTokenModel) Rotate(ctx context.Context, series, oldToken, newToken, sessionToken string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[series]
+	if !ok || t.TokenHash != hashToken(oldToken) {
+		return false, nil
+	}
+	t.PreviousHash = t.TokenHash
+	t.TokenHash = hashToken(newToken)
+	t.SessionToken = sessionToken
+	t.LastUsed = time.Now()
+	t.Rotated = time.Now()
+	return true, nil
+}
+
+func (m *RememberTokenModel) UpdateSession(ctx context.Context, series, sessionToken string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tokens[series]; ok {
+		t.SessionToken = sessionToken
+	}
+	return nil
+}
+
+func (m *RememberTokenModel) Delete(ctx context.Context, series string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tokens, series)
+	return nil
+}
+
+func (m *RememberTokenModel) DeleteBySession(ctx context.Context, sessionToken string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for series, t := range m.tokens {
+		if t.SessionToken == sessionToken {
+			delete(m.tokens, series)
+		}
+	}
+	return nil
+}
+
+func (m *RememberTokenModel) DeleteForUser(ctx context.Context, userID int, exceptSeries string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for series, t := range m.tokens {
+		if t.UserID == userID && series != exceptSeries {
+			delete(m.tokens, series)
+		}
+	}
+	return nil
+}
+
+// Backdate 把令牌的最后使用和更换时间提前 d，用来测试闲置超时和并发请求的宽限期
+func (m *RememberTokenModel) Backdate(series string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tokens[series]; ok {
+		t.LastUsed = t.LastUsed.Add(-d)
+		t.Rotated = t.Rotated.Add(-d)
+	}
+}
@@ -1,12 +1,14 @@
 package mocks
 
 import (
+	"context"
 	"github.com/hlf2016/snippetbox/internal/models"
 	"time"
 )
 
 var mockSnippet = &models.Snippet{
 	ID:      1,
+	UserID:  1,
 	Title:   "An old silent pond",
 	Content: "An old silent pond...",
 	Created: time.Now(),
@@ -15,17 +17,73 @@ var mockSnippet = &models.Snippet{
 
 type SnippetModel struct{}
 
-func (m *SnippetModel) Insert(title string, content string, expires int) (int, error) {
+func (m *SnippetModel) Insert(ctx context.Context, userID int, title string, content string, expires int) (int, error) {
 	return 2, nil
 }
-func (m *SnippetModel) Get(id int) (*models.Snippet, error) {
+func (m *SnippetModel) Get(ctx context.Context, id int) (*models.Snippet, error) {
 	switch id {
 	case 1:
 		return mockSnippet, nil
+	// 模拟查询超时
+	case 99:
+		return nil, context.DeadlineExceeded
 	default:
 		return nil, models.ErrNoRecord
 	}
 }
-func (m *SnippetModel) Latest() ([]*models.Snippet, error) {
+func (m *SnippetModel) Latest(ctx context.Context) ([]*models.Snippet, error) {
 	return []*models.Snippet{mockSnippet}, nil
 }
+
+func (m *SnippetModel) ForUser(ctx context.Context, userID int) ([]*models.Snippet, error) {
+	if userID == mockSnippet.UserID {
+		return []*models.Snippet{mockSnippet}, nil
+	}
+	return nil, nil
+}
+
+func (m *SnippetModel) LatestForUser(ctx context.Context, userID, limit, offset int) ([]*models.Snippet, int, error) {
+	if userID != mockSnippet.UserID {
+		return nil, 0, nil
+	}
+	if offset > 0 {
+		return nil, 1, nil
+	}
+	return []*models.Snippet{mockSnippet}, 1, nil
+}
+
+func (m *SnippetModel) Delete(ctx context.Context, id int) error {
+	switch id {
+	case 1:
+		return nil
+	default:
+		return models.ErrNoRecord
+	}
+}
+
+func (m *SnippetModel) List(ctx context.Context, limit, offset int) ([]*models.Snippet, int, error) {
+	if offset > 0 {
+		return nil, 1, nil
+	}
+	return []*models.Snippet{mockSnippet}, 1, nil
+}
+
+func (m *SnippetModel) DeleteMany(ctx context.Context, ids []int) (int, error) {
+	n := 0
+	for _, id := range ids {
+		if id == 1 {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *SnippetModel) CreatedPerDay(ctx context.Context, days int) ([]models.DailyCount, error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	counts := make([]models.DailyCount, days)
+	for i := range counts {
+		counts[i] = models.DailyCount{Day: today.AddDate(0, 0, i-days+1)}
+	}
+	counts[days-1].Count = 1
+	return counts, nil
+}
@@ -0,0 +1,34 @@
+package mocks
+
+import (
+	"context"
+	"github.com/hlf2016/snippetbox/internal/models"
+	"time"
+)
+
+// TOTPSecret 是模拟用户 2 (bob@example.com) 的 TOTP 密钥，测试中可以用它生成有效的验证码。
+const TOTPSecret = "JBSWY3DPEHPK3PXP"
+
+// RecoveryCode 是模拟用户 2 唯一可用的恢复码。
+const RecoveryCode = "ABCDE-12345"
+
+type TwoFactorModel struct{}
+
+func (m *TwoFactorModel) Get(ctx context.Context, userID int) (*models.TwoFactor, error) {
+	if userID == 2 {
+		return &models.TwoFactor{UserID: 2, Secret: TOTPSecret, Created: time.Now()}, nil
+	}
+	return nil, models.ErrNoRecord
+}
+
+func (m *TwoFactorModel) Enable(ctx context.Context, userID int, secret string, recoveryCodes []string) error {
+	return nil
+}
+
+func (m *TwoFactorModel) Disable(ctx context.Context, userID int) error {
+	return nil
+}
+
+func (m *TwoFactorModel) UseRecoveryCode(ctx context.Context, userID int, code string) (bool, error) {
+	return userID == 2 && code == RecoveryCode, nil
+}
@@ -1,49 +1,150 @@
 package mocks
 
 import (
+	"context"
 	"github.com/hlf2016/snippetbox/internal/models"
+	"strings"
 	"time"
 )
 
+// 模拟用户：1 为普通用户 alice，2 为开启了两步验证的 bob（见 TwoFactorModel），3 为管理员，4 为普通用户 carol，
+// 5 为已被禁用的 dave，6 为被要求修改密码的 erin。他们的密码都是 "password"。
+// 7 为通过单点登录创建、没有密码的 heidi（IdentityModel.CreateUser 返回的 ID），她同样被要求修改密码。
+var mockUsers = map[int]*models.User{
+	1: {
+		ID:       1,
+		Name:     "test",
+		Username: "alice",
+		Email:    "example@email.com",
+		Created:  time.Now(),
+		Role:     models.RoleUser,
+		Bio:      "Writes haiku on the train.",
+	},
+	2: {
+		ID:       2,
+		Name:     "bob",
+		Username: "bob",
+		Email:    "bob@example.com",
+		Created:  time.Now(),
+		Role:     models.RoleUser,
+	},
+	3: {
+		ID:      3,
+		Name:    "admin",
+		Email:   "admin@example.com",
+		Created: time.Now(),
+		Role:    models.RoleAdmin,
+	},
+	4: {
+		ID:          4,
+		Name:        "carol",
+		Email:       "carol@example.com",
+		Created:     time.Now(),
+		Role:        models.RoleUser,
+		Preferences: models.Preferences{Timezone: "Asia/Shanghai"},
+	},
+	5: {
+		ID:       5,
+		Name:     "dave",
+		Email:    "dave@example.com",
+		Created:  time.Now(),
+		Role:     models.RoleUser,
+		Disabled: true,
+	},
+	6: {
+		ID:                    6,
+		Name:                  "erin",
+		Email:                 "erin@example.com",
+		Created:               time.Now(),
+		Role:                  models.RoleUser,
+		PasswordResetRequired: true,
+	},
+	7: {
+		ID:                    7,
+		Name:                  "heidi",
+		Email:                 "heidi@example.com",
+		Created:               time.Now(),
+		Role:                  models.RoleUser,
+		PasswordResetRequired: true,
+		Passwordless:          true,
+	},
+}
+
 type UserModel struct{}
 
-func (m *UserModel) Insert(name, email, password string) error {
-	switch email {
-	case "dupe@example.com":
+func (m *UserModel) Insert(ctx context.Context, name, username, email, password string) error {
+	switch {
+	case email == "dupe@example.com":
 		return models.ErrDuplicateEmail
+	case username == "dupe":
+		return models.ErrDuplicateUsername
 	default:
 		return nil
 	}
 }
-func (m *UserModel) Authenticate(email, password string) (int, error) {
-	if email == "alice@example.com" && password == "password" {
+func (m *UserModel) Authenticate(ctx context.Context, email, password string) (int, error) {
+	if password != "password" {
+		return 0, models.ErrInvalidCredential
+	}
+	switch email {
+	case "alice@example.com":
 		return 1, nil
+	case "bob@example.com":
+		return 2, nil
+	case "admin@example.com":
+		return 3, nil
+	case "carol@example.com":
+		return 4, nil
+	case "dave@example.com":
+		return 0, models.ErrAccountDisabled
+	case "erin@example.com":
+		return 6, nil
 	}
 	return 0, models.ErrInvalidCredential
 }
-func (m *UserModel) Exists(id int) (bool, error) {
-	switch id {
-	case 1:
-		return true, nil
-	default:
-		return false, nil
+func (m *UserModel) Exists(ctx context.Context, id int) (bool, error) {
+	_, ok := mockUsers[id]
+	return ok, nil
+}
+
+func (m *UserModel) Get(ctx context.Context, id int) (*models.User, error) {
+	if u, ok := mockUsers[id]; ok {
+		return u, nil
 	}
+	return nil, models.ErrNoRecord
 }
 
-func (m *UserModel) Get(id int) (*models.User, error) {
-	if id == 1 {
-		u := &models.User{
-			ID:      1,
-			Name:    "test",
-			Email:   "example@email.com",
-			Created: time.Now(),
+func (m *UserModel) GetByEmail(ctx context.Context, email string) (*models.User, error) {
+	for _, u := range mockUsers {
+		if u.Email == email {
+			return u, nil
+		}
+	}
+	return nil, models.ErrNoRecord
+}
+
+func (m *UserModel) GetByUsername(ctx context.Context, username string) (*models.User, error) {
+	for _, u := range mockUsers {
+		if u.Username != "" && u.Username == username {
+			return u, nil
 		}
-		return u, nil
 	}
 	return nil, models.ErrNoRecord
 }
 
-func (m *UserModel) PasswordUpdate(id int, currentPassword, newPassword string) error {
+func (m *UserModel) UpdateProfile(ctx context.Context, id int, name, username string) error {
+	if _, ok := mockUsers[id]; !ok {
+		return models.ErrNoRecord
+	}
+	for _, u := range mockUsers {
+		if u.ID != id && u.Username == username {
+			return models.ErrDuplicateUsername
+		}
+	}
+	return nil
+}
+
+func (m *UserModel) PasswordUpdate(ctx context.Context, id int, currentPassword, newPassword string) error {
 	if id == 1 {
 		if currentPassword == "password" {
 			return models.ErrInvalidCredential
@@ -53,3 +154,74 @@ func (m *UserModel) PasswordUpdate(id int, currentPassword, newPassword string)
 
 	return models.ErrNoRecord
 }
+
+func (m *UserModel) VerifyPassword(ctx context.Context, id int, password string) error {
+	if _, ok := mockUsers[id]; !ok || password != "password" {
+		return models.ErrInvalidCredential
+	}
+	return nil
+}
+
+func (m *UserModel) SetRole(ctx context.Context, id int, role models.Role) error {
+	if !role.Valid() {
+		return models.ErrInvalidRole
+	}
+	if _, ok := mockUsers[id]; !ok {
+		return models.ErrNoRecord
+	}
+	return nil
+}
+
+func (m *UserModel) List(ctx context.Context, query string, limit, offset int) ([]*models.User, int, error) {
+	var users []*models.User
+	for id := len(mockUsers); id >= 1; id-- {
+		u := mockUsers[id]
+		if query == "" || strings.Contains(u.Name, query) || strings.Contains(u.Username, query) || strings.Contains(u.Email, query) {
+			users = append(users, u)
+		}
+	}
+	total := len(users)
+	if offset >= total {
+		return nil, total, nil
+	}
+	return users[offset:min(offset+limit, total)], total, nil
+}
+
+func (m *UserModel) Count(ctx context.Context) (int, error) {
+	return len(mockUsers), nil
+}
+
+func (m *UserModel) SetDisabled(ctx context.Context, id int, disabled bool) error {
+	if _, ok := mockUsers[id]; !ok {
+		return models.ErrNoRecord
+	}
+	return nil
+}
+
+func (m *UserModel) RequirePasswordReset(ctx context.Context, id int) error {
+	if _, ok := mockUsers[id]; !ok {
+		return models.ErrNoRecord
+	}
+	return nil
+}
+
+func (m *UserModel) Delete(ctx context.Context, id int, anonymiseSnippets bool) error {
+	if _, ok := mockUsers[id]; !ok {
+		return models.ErrNoRecord
+	}
+	return nil
+}
+
+func (m *UserModel) SetBio(ctx context.Context, id int, bio string) error {
+	if _, ok := mockUsers[id]; !ok {
+		return models.ErrNoRecord
+	}
+	return nil
+}
+
+func (m *UserModel) SetPreferences(ctx context.Context, id int, prefs models.Preferences) error {
+	if _, ok := mockUsers[id]; !ok {
+		return models.ErrNoRecord
+	}
+	return nil
+}
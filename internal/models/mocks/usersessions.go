@@ -0,0 +1,51 @@
+package mocks
+
+import (
+	"context"
+	"github.com/hlf2016/snippetbox/internal/models"
+	"time"
+)
+
+// mockUserSession 代表用户 1 在另一台设备上的会话
+var mockUserSession = &models.UserSession{
+	ID:        1,
+	UserID:    1,
+	Token:     "other-device-token",
+	UserAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)",
+	IP:        "192.0.2.10",
+	Created:   time.Now(),
+	LastSeen:  time.Now(),
+	Expires:   time.Now().Add(time.Hour),
+}
+
+type UserSessionModel struct{}
+
+func (m *UserSessionModel) Insert(ctx context.Context, userID int, token, userAgent, ip string, expires time.Time) error {
+	return nil
+}
+
+func (m *UserSessionModel) Touch(ctx context.Context, token string) error {
+	return nil
+}
+
+func (m *UserSessionModel) Get(ctx context.Context, userID, id int) (*models.UserSession, error) {
+	if userID == 1 && id == 1 {
+		return mockUserSession, nil
+	}
+	return nil, models.ErrNoRecord
+}
+
+func (m *UserSessionModel) ForUser(ctx context.Context, userID int) ([]*models.UserSession, error) {
+	if userID == 1 {
+		return []*models.UserSession{mockUserSession}, nil
+	}
+	return nil, nil
+}
+
+func (m *UserSessionModel) Delete(ctx context.Context, token string) error {
+	return nil
+}
+
+func (m *UserSessionModel) ActiveUsers(ctx context.Context, since time.Time) (int, error) {
+	return 1, nil
+}
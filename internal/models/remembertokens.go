@@ -0,0 +1,140 @@
+package models
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type RememberTokenModelInterface interface {
+	Insert(ctx context.Context, userID int, series, token, sessionToken string, expires time.Time) error
+	Get(ctx context.Context, series string) (*RememberToken, error)
+	Rotate(ctx context.Context, series, oldToken, newToken, sessionToken string) (bool, error)
+	UpdateSession(ctx context.Context, series, sessionToken string) error
+	Delete(ctx context.Context, series string) error
+	DeleteBySession(ctx context.Context, sessionToken string) error
+	DeleteForUser(ctx context.Context, userID int, exceptSeries string) error
+}
+
+// RememberToken 是"记住我"登录使用的持久令牌。浏览器的 cookie 中保存 "系列:令牌"：系列在整个有效期内不变，
+// 令牌每次用来登录后都会更换。数据库中只保存令牌的 SHA-256 哈希。
+//
+// 如果一个已经被更换掉的令牌再次出现，说明 cookie 被复制过，合法用户和攻击者中有一方拿的是旧令牌，
+// 这时应该撤销该用户所有的令牌和会话。
+type RememberToken struct {
+	ID     int
+	UserID int
+	Series string
+	// 当前令牌和上一个令牌的哈希。保留上一个是为了容忍同一浏览器同时发出的几个请求都带着旧令牌
+	TokenHash    string
+	PreviousHash string
+	// 用这个令牌登录后建立的会话，撤销会话时一并删除令牌
+	SessionToken string
+	Created      time.Time
+	// 最后一次用来登录的时间，用于判断闲置超时
+	LastUsed time.Time
+	// 上一次更换令牌的时间
+	Rotated time.Time
+	Expires time.Time
+}
+
+// Matches 判断 token 是否为当前令牌
+func (t *RememberToken) Matches(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(t.TokenHash)) == 1
+}
+
+// MatchesPrevious 判断 token 是否为刚被更换掉的上一个令牌
+func (t *RememberToken) MatchesPrevious(token string) bool {
+	return t.PreviousHash != "" && subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(t.PreviousHash)) == 1
+}
+
+type RememberTokenModel struct {
+	DB *sql.DB
+	// Timeout 限制每次方法调用中查询的总耗时，为 0 时只受调用方上下文的限制
+	Timeout time.Duration
+}
+
+func (m *RememberTokenModel) Insert(ctx context.Context, userID int, series, token, sessionToken string, expires time.Time) error {
+	ctx, done := startQuery(ctx, "RememberTokenModel.Insert", m.Timeout)
+	defer done()
+	// 顺便清理该用户已过期的令牌
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM remember_tokens WHERE user_id = ? AND expires <= UTC_TIMESTAMP()`, userID)
+	if err != nil {
+		return err
+	}
+	stmt := `INSERT INTO remember_tokens (user_id, series, token_hash, previous_hash, session_token, created, last_used, rotated, expires)
+	VALUES (?, ?, ?, '', ?, UTC_TIMESTAMP(), UTC_TIMESTAMP(), UTC_TIMESTAMP(), ?)`
+	_, err = m.DB.ExecContext(ctx, stmt, userID, series, hashToken(token), sessionToken, expires.UTC())
+	return err
+}
+
+// Get 返回系列对应的令牌，包括已经过期的，由调用方判断过期和闲置超时。不存在时返回 ErrNoRecord。
+func (m *RememberTokenModel) Get(ctx context.Context, series string) (*RememberToken, error) {
+	ctx, done := startQuery(ctx, "RememberTokenModel.Get", m.Timeout)
+	defer done()
+	t := &RememberToken{}
+	stmt := `SELECT id, user_id, series, token_hash, previous_hash, session_token, created, last_used, rotated, expires
+	FROM remember_tokens WHERE series = ?`
+	err := m.DB.QueryRowContext(ctx, stmt, series).Scan(&t.ID, &t.UserID, &t.Series, &t.TokenHash, &t.PreviousHash, &t.SessionToken,
+		&t.Created, &t.LastUsed, &t.Rotated, &t.Expires)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		} else {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Rotate 把系列的令牌从 oldToken 换成 newToken，并记录新的会话。只有当前令牌仍是 oldToken 时才会更换，
+// 返回 false 表示另一个请求已经抢先更换了。
+func (m *RememberTokenModel) Rotate(ctx context.Context, series, oldToken, newToken, sessionToken string) (bool, error) {
+	ctx, done := startQuery(ctx, "RememberTokenModel.Rotate", m.Timeout)
+	defer done()
+	stmt := `UPDATE remember_tokens SET token_hash = ?, previous_hash = token_hash, session_token = ?,
+	last_used = UTC_TIMESTAMP(), rotated = UTC_TIMESTAMP() WHERE series = ? AND token_hash = ?`
+	result, err := m.DB.ExecContext(ctx, stmt, hashToken(newToken), sessionToken, series, hashToken(oldToken))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// UpdateSession 把系列关联到新的会话令牌。会话通过 RenewToken() 换了令牌之后必须调用，
+// 否则之后撤销这个会话时 DeleteBySession 找不到对应的系列，浏览器可以用 cookie 重新登录。
+func (m *RememberTokenModel) UpdateSession(ctx context.Context, series, sessionToken string) error {
+	ctx, done := startQuery(ctx, "RememberTokenModel.UpdateSession", m.Timeout)
+	defer done()
+	_, err := m.DB.ExecContext(ctx, `UPDATE remember_tokens SET session_token = ? WHERE series = ?`, sessionToken, series)
+	return err
+}
+
+func (m *RememberTokenModel) Delete(ctx context.Context, series string) error {
+	ctx, done := startQuery(ctx, "RememberTokenModel.Delete", m.Timeout)
+	defer done()
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM remember_tokens WHERE series = ?`, series)
+	return err
+}
+
+// DeleteBySession 删除用来建立 sessionToken 会话的令牌，撤销会话时调用，否则浏览器马上又会用令牌重新登录。
+func (m *RememberTokenModel) DeleteBySession(ctx context.Context, sessionToken string) error {
+	ctx, done := startQuery(ctx, "RememberTokenModel.DeleteBySession", m.Timeout)
+	defer done()
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM remember_tokens WHERE session_token = ?`, sessionToken)
+	return err
+}
+
+// DeleteForUser 删除用户除 exceptSeries 之外的所有令牌，exceptSeries 为空时全部删除。
+func (m *RememberTokenModel) DeleteForUser(ctx context.Context, userID int, exceptSeries string) error {
+	ctx, done := startQuery(ctx, "RememberTokenModel.DeleteForUser", m.Timeout)
+	defer done()
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM remember_tokens WHERE user_id = ? AND series <> ?`, userID, exceptSeries)
+	return err
+}
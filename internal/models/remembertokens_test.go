@@ -0,0 +1,51 @@
+package models
+
+import (
+	"context"
+	"github.com/hlf2016/snippetbox/internal/assert"
+	"testing"
+	"time"
+)
+
+func TestRememberTokenModelRotate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("models: skipping integration test")
+	}
+	db := newTestDB(t)
+	m := RememberTokenModel{DB: db}
+
+	err := m.Insert(context.Background(), 1, "series-1", "token-1", "session-1", time.Now().Add(time.Hour))
+	assert.NilError(t, err)
+
+	tok, err := m.Get(context.Background(), "series-1")
+	assert.NilError(t, err)
+	assert.Equal(t, tok.Matches("token-1"), true)
+	assert.Equal(t, tok.MatchesPrevious("token-1"), false)
+
+	ok, err := m.Rotate(context.Background(), "series-1", "token-1", "token-2", "session-2")
+	assert.NilError(t, err)
+	assert.Equal(t, ok, true)
+
+	// 旧令牌不能再次更换
+	ok, err = m.Rotate(context.Background(), "series-1", "token-1", "token-3", "session-3")
+	assert.NilError(t, err)
+	assert.Equal(t, ok, false)
+
+	tok, err = m.Get(context.Background(), "series-1")
+	assert.NilError(t, err)
+	assert.Equal(t, tok.Matches("token-2"), true)
+	assert.Equal(t, tok.MatchesPrevious("token-1"), true)
+	assert.Equal(t, tok.SessionToken, "session-2")
+
+	// 会话换了令牌之后，按新令牌撤销会话要能找到这个系列
+	err = m.UpdateSession(context.Background(), "series-1", "session-3")
+	assert.NilError(t, err)
+	err = m.DeleteBySession(context.Background(), "session-2")
+	assert.NilError(t, err)
+	_, err = m.Get(context.Background(), "series-1")
+	assert.NilError(t, err)
+	err = m.DeleteBySession(context.Background(), "session-3")
+	assert.NilError(t, err)
+	_, err = m.Get(context.Background(), "series-1")
+	assert.Equal(t, err, ErrNoRecord)
+}
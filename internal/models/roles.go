@@ -0,0 +1,27 @@
+package models
+
+// Role 表示用户的角色。权限按 user < moderator < admin 的顺序递增，高等级角色拥有低等级角色的全部权限。
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+var roleRank = map[Role]int{
+	RoleUser:      1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+// Valid 判断是否为已知的角色。
+func (r Role) Valid() bool {
+	_, ok := roleRank[r]
+	return ok
+}
+
+// AtLeast 判断 r 的权限是否不低于 min。未知角色没有任何权限。
+func (r Role) AtLeast(min Role) bool {
+	return r.Valid() && roleRank[r] >= roleRank[min]
+}
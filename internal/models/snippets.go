@@ -1,19 +1,35 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"strings"
 	"time"
 )
 
 type SnippetModelInterface interface {
-	Insert(title string, content string, expires int) (int, error)
-	Get(id int) (*Snippet, error)
-	Latest() ([]*Snippet, error)
+	Insert(ctx context.Context, userID int, title string, content string, expires int) (int, error)
+	Get(ctx context.Context, id int) (*Snippet, error)
+	Latest(ctx context.Context) ([]*Snippet, error)
+	ForUser(ctx context.Context, userID int) ([]*Snippet, error)
+	LatestForUser(ctx context.Context, userID, limit, offset int) ([]*Snippet, int, error)
+	Delete(ctx context.Context, id int) error
+	List(ctx context.Context, limit, offset int) ([]*Snippet, int, error)
+	DeleteMany(ctx context.Context, ids []int) (int, error)
+	CreatedPerDay(ctx context.Context, days int) ([]DailyCount, error)
+}
+
+// DailyCount 是某一天（UTC）的计数，用于管理后台的统计图表。
+type DailyCount struct {
+	Day   time.Time
+	Count int
 }
 
 type Snippet struct {
-	ID      int
+	ID int
+	// 创建者的用户 ID。功能上线前创建的片段没有创建者，此时为 0
+	UserID  int
 	Title   string
 	Content string
 	Created time.Time
@@ -22,14 +38,18 @@ type Snippet struct {
 
 type SnippetModel struct {
 	DB *sql.DB
+	// Timeout 限制每次方法调用中查询的总耗时，为 0 时只受调用方上下文的限制
+	Timeout time.Duration
 }
 
-func (m *SnippetModel) Insert(title string, content string, expires int) (int, error) {
-	stmt := `INSERT INTO snippets (title, content, created, expires) 
-	VALUES (?, ?, UTC_TIMESTAMP(), DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? DAY))`
-	result, err := m.DB.Exec(stmt, title, content, expires)
+func (m *SnippetModel) Insert(ctx context.Context, userID int, title string, content string, expires int) (int, error) {
+	ctx, done := startQuery(ctx, "SnippetModel.Insert", m.Timeout)
+	defer done()
+	stmt := `INSERT INTO snippets (user_id, title, content, created, expires) 
+	VALUES (?, ?, ?, UTC_TIMESTAMP(), DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? DAY))`
+	result, err := m.DB.ExecContext(ctx, stmt, userID, title, content, expires)
 	if err != nil {
-		return 0, nil
+		return 0, err
 	}
 	id, err := result.LastInsertId()
 	if err != nil {
@@ -39,12 +59,16 @@ func (m *SnippetModel) Insert(title string, content string, expires int) (int, e
 	return int(id), nil
 }
 
-func (m *SnippetModel) Get(id int) (*Snippet, error) {
+func (m *SnippetModel) Get(ctx context.Context, id int) (*Snippet, error) {
+	ctx, done := startQuery(ctx, "SnippetModel.Get", m.Timeout)
+	defer done()
 	// 初始化指向已清零的新 Snippet 结构的指针。
 	s := &Snippet{}
+	// user_id 列可以为 NULL，需要先扫描到 sql.NullInt64 中
+	var userID sql.NullInt64
 	// 使用 row.Scan() 将 sql.Row 中每个字段的值复制到 Snippet 结构中的相应字段。
 	// 请注意，row.Scan 的参数是指向要将数据复制到的位置的指针，参数数必须与语句返回的列数完全相同。
-	err := m.DB.QueryRow(`SELECT id, title, content, created, expires FROM snippets WHERE expires > UTC_TIMESTAMP() AND id = ?`, id).Scan(&s.ID, &s.Title, &s.Content, &s.Created, &s.Expires)
+	err := m.DB.QueryRowContext(ctx, `SELECT id, user_id, title, content, created, expires FROM snippets WHERE expires > UTC_TIMESTAMP() AND id = ?`, id).Scan(&s.ID, &userID, &s.Title, &s.Content, &s.Created, &s.Expires)
 	if err != nil {
 		// 如果查询没有返回记录，那么 row.Scan() 将返回一个 sql.ErrNoRows 错误。
 		// 我们使用 errors.Is() 函数专门检查该错误，并返回我们自己的 ErrNoRecord 错误（我们稍后将创建该错误）
@@ -54,11 +78,14 @@ func (m *SnippetModel) Get(id int) (*Snippet, error) {
 			return nil, err
 		}
 	}
+	s.UserID = int(userID.Int64)
 	return s, nil
 }
 
-func (m *SnippetModel) Latest() ([]*Snippet, error) {
-	rows, err := m.DB.Query(`SELECT id, title, content, created, expires FROM snippets WHERE expires > UTC_TIMESTAMP() ORDER BY id DESC LIMIT 10`)
+func (m *SnippetModel) Latest(ctx context.Context) ([]*Snippet, error) {
+	ctx, done := startQuery(ctx, "SnippetModel.Latest", m.Timeout)
+	defer done()
+	rows, err := m.DB.QueryContext(ctx, `SELECT id, title, content, created, expires FROM snippets WHERE expires > UTC_TIMESTAMP() ORDER BY id DESC LIMIT 10`)
 	if err != nil {
 		return nil, err
 	}
@@ -82,3 +109,170 @@ func (m *SnippetModel) Latest() ([]*Snippet, error) {
 
 	return snippets, nil
 }
+
+// ForUser 按 ID 升序返回用户创建的所有片段，包括已过期的，用于导出个人数据。
+func (m *SnippetModel) ForUser(ctx context.Context, userID int) ([]*Snippet, error) {
+	ctx, done := startQuery(ctx, "SnippetModel.ForUser", m.Timeout)
+	defer done()
+	rows, err := m.DB.QueryContext(ctx, `SELECT id, title, content, created, expires FROM snippets WHERE user_id = ? ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var snippets []*Snippet
+	for rows.Next() {
+		s := &Snippet{UserID: userID}
+		err := rows.Scan(&s.ID, &s.Title, &s.Content, &s.Created, &s.Expires)
+		if err != nil {
+			return nil, err
+		}
+		snippets = append(snippets, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return snippets, nil
+}
+
+// LatestForUser 按 ID 倒序分页返回用户未过期的片段，用于公开的个人主页。第二个返回值是未过期片段的总数。
+func (m *SnippetModel) LatestForUser(ctx context.Context, userID, limit, offset int) ([]*Snippet, int, error) {
+	ctx, done := startQuery(ctx, "SnippetModel.LatestForUser", m.Timeout)
+	defer done()
+	var total int
+	err := m.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM snippets WHERE user_id = ? AND expires > UTC_TIMESTAMP()`, userID).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	stmt := `SELECT id, title, content, created, expires FROM snippets WHERE user_id = ? AND expires > UTC_TIMESTAMP()
+	ORDER BY id DESC LIMIT ? OFFSET ?`
+	rows, err := m.DB.QueryContext(ctx, stmt, userID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var snippets []*Snippet
+	for rows.Next() {
+		s := &Snippet{UserID: userID}
+		err := rows.Scan(&s.ID, &s.Title, &s.Content, &s.Created, &s.Expires)
+		if err != nil {
+			return nil, 0, err
+		}
+		snippets = append(snippets, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return snippets, total, nil
+}
+
+func (m *SnippetModel) Delete(ctx context.Context, id int) error {
+	ctx, done := startQuery(ctx, "SnippetModel.Delete", m.Timeout)
+	defer done()
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM snippets WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+// List 供管理后台使用，按 ID 倒序分页返回所有片段（包括已过期的）。第二个返回值是片段总数。
+func (m *SnippetModel) List(ctx context.Context, limit, offset int) ([]*Snippet, int, error) {
+	ctx, done := startQuery(ctx, "SnippetModel.List", m.Timeout)
+	defer done()
+	var total int
+	err := m.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM snippets`).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT id, user_id, title, content, created, expires FROM snippets ORDER BY id DESC LIMIT ? OFFSET ?`, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var snippets []*Snippet
+	for rows.Next() {
+		s := &Snippet{}
+		var userID sql.NullInt64
+		err := rows.Scan(&s.ID, &userID, &s.Title, &s.Content, &s.Created, &s.Expires)
+		if err != nil {
+			return nil, 0, err
+		}
+		s.UserID = int(userID.Int64)
+		snippets = append(snippets, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return snippets, total, nil
+}
+
+// DeleteMany 一次删除多个片段，返回实际删除的数量。不存在的 ID 会被忽略。
+func (m *SnippetModel) DeleteMany(ctx context.Context, ids []int) (int, error) {
+	ctx, done := startQuery(ctx, "SnippetModel.DeleteMany", m.Timeout)
+	defer done()
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM snippets WHERE id IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// CreatedPerDay 返回最近 days 天（包括今天，按 UTC 计算）每天新建的片段数量，按日期升序排列。没有新片段的日期计数为 0。
+func (m *SnippetModel) CreatedPerDay(ctx context.Context, days int) ([]DailyCount, error) {
+	ctx, done := startQuery(ctx, "SnippetModel.CreatedPerDay", m.Timeout)
+	defer done()
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	start := today.AddDate(0, 0, -(days - 1))
+
+	stmt := `SELECT DATE(created), COUNT(*) FROM snippets WHERE created >= ? GROUP BY DATE(created)`
+	rows, err := m.DB.QueryContext(ctx, stmt, start)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var day time.Time
+		var n int
+		err := rows.Scan(&day, &n)
+		if err != nil {
+			return nil, err
+		}
+		counts[day.Format(time.DateOnly)] = n
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]DailyCount, days)
+	for i := range result {
+		day := start.AddDate(0, 0, i)
+		result[i] = DailyCount{Day: day, Count: counts[day.Format(time.DateOnly)]}
+	}
+	return result, nil
+}
@@ -1,23 +1,90 @@
 -- Go 工具会忽略任何名为 testdata 的目录，因此在编译应用程序时会忽略这些脚本（它也会忽略任何名称以 _ 或 .字符开头的目录或文件）。
 CREATE TABLE snippets (
     id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    user_id INTEGER NULL,
     title VARCHAR(100) NOT NULL,
     content TEXT NOT NULL,
     created DATETIME NOT NULL,
     expires DATETIME NOT NULL
 );
 CREATE INDEX idx_snippets_created ON snippets(created);
+CREATE INDEX idx_snippets_user_id ON snippets(user_id);
 CREATE TABLE users (
    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
    name VARCHAR(255) NOT NULL,
+   username VARCHAR(30) NULL,
    email VARCHAR(255) NOT NULL,
-   hashed_password CHAR(60) NOT NULL,
-   created DATETIME NOT NULL
+   hashed_password VARCHAR(255) NOT NULL,
+   created DATETIME NOT NULL,
+   role VARCHAR(16) NOT NULL DEFAULT 'user',
+   disabled BOOLEAN NOT NULL DEFAULT FALSE,
+   password_reset_required BOOLEAN NOT NULL DEFAULT FALSE,
+   bio VARCHAR(500) NOT NULL DEFAULT '',
+   timezone VARCHAR(64) NOT NULL DEFAULT '',
+   locale VARCHAR(16) NOT NULL DEFAULT ''
 );
 ALTER TABLE users ADD CONSTRAINT users_uc_email UNIQUE (email);
+ALTER TABLE users ADD CONSTRAINT users_uc_username UNIQUE (username);
 INSERT INTO users (name, email, hashed_password, created) VALUES (
     'Alice Jones',
     'alice@example.com',
     '$2a$12$NuTjWXm3KKntReFwyBVHyuf/to.HEwTy.eS206TNfkGfr6HzGJSWG',
     '2022-01-01 10:00:00'
 );
+CREATE TABLE user_totp (
+    user_id INTEGER NOT NULL PRIMARY KEY,
+    secret VARCHAR(64) NOT NULL,
+    created DATETIME NOT NULL
+);
+CREATE TABLE user_recovery_codes (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    user_id INTEGER NOT NULL,
+    hashed_code CHAR(64) NOT NULL,
+    used DATETIME NULL
+);
+CREATE INDEX idx_user_recovery_codes_user_id ON user_recovery_codes(user_id);
+CREATE TABLE user_sessions (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    user_id INTEGER NOT NULL,
+    token CHAR(43) NOT NULL,
+    user_agent VARCHAR(512) NOT NULL,
+    ip VARCHAR(45) NOT NULL,
+    created DATETIME NOT NULL,
+    last_seen DATETIME NOT NULL,
+    expires DATETIME NOT NULL
+);
+CREATE INDEX idx_user_sessions_user_id ON user_sessions(user_id);
+CREATE INDEX idx_user_sessions_last_seen ON user_sessions(last_seen);
+ALTER TABLE user_sessions ADD CONSTRAINT user_sessions_uc_token UNIQUE (token);
+CREATE TABLE email_changes (
+    token_hash CHAR(64) NOT NULL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    created DATETIME NOT NULL,
+    expires DATETIME NOT NULL
+);
+CREATE INDEX idx_email_changes_user_id ON email_changes(user_id);
+CREATE TABLE user_identities (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    user_id INTEGER NOT NULL,
+    issuer VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    created DATETIME NOT NULL
+);
+CREATE INDEX idx_user_identities_user_id ON user_identities(user_id);
+ALTER TABLE user_identities ADD CONSTRAINT user_identities_uc_issuer_subject UNIQUE (issuer, subject);
+CREATE TABLE remember_tokens (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    user_id INTEGER NOT NULL,
+    series CHAR(43) NOT NULL,
+    token_hash CHAR(64) NOT NULL,
+    previous_hash VARCHAR(64) NOT NULL DEFAULT '',
+    session_token CHAR(43) NOT NULL,
+    created DATETIME NOT NULL,
+    last_used DATETIME NOT NULL,
+    rotated DATETIME NOT NULL,
+    expires DATETIME NOT NULL
+);
+CREATE INDEX idx_remember_tokens_user_id ON remember_tokens(user_id);
+CREATE INDEX idx_remember_tokens_session_token ON remember_tokens(session_token);
+ALTER TABLE remember_tokens ADD CONSTRAINT remember_tokens_uc_series UNIQUE (series);
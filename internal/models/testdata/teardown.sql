@@ -1,3 +1,9 @@
 #  Go 工具会忽略任何名为 testdata 的目录，因此在编译应用程序时会忽略这些脚本（它也会忽略任何名称以 _ 或 .字符开头的目录或文件）。
+DROP TABLE remember_tokens;
+DROP TABLE user_identities;
+DROP TABLE email_changes;
+DROP TABLE user_sessions;
+DROP TABLE user_recovery_codes;
+DROP TABLE user_totp;
 DROP TABLE users;
 DROP TABLE snippets;
\ No newline at end of file
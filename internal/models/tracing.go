@@ -0,0 +1,35 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// tracer 使用全局的 TracerProvider。程序没有配置追踪时它什么也不做，开销可以忽略。
+var tracer = otel.Tracer("github.com/hlf2016/snippetbox/internal/models")
+
+// startQuery 为一次模型方法调用创建 span，并在 timeout 大于 0 时给上下文加上超时。
+// 方法中的所有查询都使用返回的上下文，调用方负责在方法返回时调用 done，它会取消超时并结束 span。
+// 客户端断开连接或超时后，database/sql 会中止正在执行的查询，返回 context.Canceled 或 context.DeadlineExceeded。
+func startQuery(ctx context.Context, name string, timeout time.Duration) (context.Context, func()) {
+	ctx, span := tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemMySQL),
+	)
+	cancel := context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	return ctx, func() {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			span.SetStatus(codes.Error, "query timed out")
+		}
+		cancel()
+		span.End()
+	}
+}
@@ -0,0 +1,123 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+type TwoFactorModelInterface interface {
+	Get(ctx context.Context, userID int) (*TwoFactor, error)
+	Enable(ctx context.Context, userID int, secret string, recoveryCodes []string) error
+	Disable(ctx context.Context, userID int) error
+	UseRecoveryCode(ctx context.Context, userID int, code string) (bool, error)
+}
+
+// TwoFactor 保存用户已确认启用的 TOTP 密钥。user_totp 表中存在记录即表示该用户已开启两步验证。
+type TwoFactor struct {
+	UserID  int
+	Secret  string
+	Created time.Time
+}
+
+type TwoFactorModel struct {
+	DB *sql.DB
+	// Timeout 限制每次方法调用中查询的总耗时，为 0 时只受调用方上下文的限制
+	Timeout time.Duration
+}
+
+func (m *TwoFactorModel) Get(ctx context.Context, userID int) (*TwoFactor, error) {
+	ctx, done := startQuery(ctx, "TwoFactorModel.Get", m.Timeout)
+	defer done()
+	tf := &TwoFactor{}
+	stmt := `SELECT user_id, secret, created FROM user_totp WHERE user_id = ?`
+	err := m.DB.QueryRowContext(ctx, stmt, userID).Scan(&tf.UserID, &tf.Secret, &tf.Created)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		} else {
+			return nil, err
+		}
+	}
+	return tf, nil
+}
+
+// Enable 在同一个事务中写入 TOTP 密钥并替换该用户的全部恢复码。恢复码只保存 SHA-256 摘要，明文仅在启用时展示给用户一次。
+func (m *TwoFactorModel) Enable(ctx context.Context, userID int, secret string, recoveryCodes []string) error {
+	ctx, done := startQuery(ctx, "TwoFactorModel.Enable", m.Timeout)
+	defer done()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// 如果在 Commit() 之前返回，Rollback() 会撤销事务中的所有操作；Commit() 之后再调用 Rollback() 则不会有任何效果。
+	defer tx.Rollback()
+
+	stmt := `REPLACE INTO user_totp (user_id, secret, created) VALUES (?, ?, UTC_TIMESTAMP())`
+	_, err = tx.ExecContext(ctx, stmt, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM user_recovery_codes WHERE user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+
+	stmt = `INSERT INTO user_recovery_codes (user_id, hashed_code) VALUES (?, ?)`
+	for _, code := range recoveryCodes {
+		_, err = tx.ExecContext(ctx, stmt, userID, hashRecoveryCode(code))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (m *TwoFactorModel) Disable(ctx context.Context, userID int) error {
+	ctx, done := startQuery(ctx, "TwoFactorModel.Disable", m.Timeout)
+	defer done()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM user_totp WHERE user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM user_recovery_codes WHERE user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseRecoveryCode 将一枚未使用过的恢复码标记为已使用。只有真正更新到一行记录时才返回 true，因此每枚恢复码只能使用一次。
+func (m *TwoFactorModel) UseRecoveryCode(ctx context.Context, userID int, code string) (bool, error) {
+	ctx, done := startQuery(ctx, "TwoFactorModel.UseRecoveryCode", m.Timeout)
+	defer done()
+	stmt := `UPDATE user_recovery_codes SET used = UTC_TIMESTAMP() WHERE user_id = ? AND hashed_code = ? AND used IS NULL LIMIT 1`
+	result, err := m.DB.ExecContext(ctx, stmt, userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// hashRecoveryCode 在计算摘要前去掉空白和连字符并统一转为大写，这样用户输入 "abcde-12345" 和 "ABCDE12345" 都能匹配。
+func hashRecoveryCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
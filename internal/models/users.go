@@ -1,61 +1,139 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"github.com/go-sql-driver/mysql"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/hlf2016/snippetbox/internal/password"
 	"strings"
 	"time"
 )
 
 type UserModelInterface interface {
-	Insert(name, email, password string) error
-	Authenticate(email, password string) (int, error)
-	Exists(id int) (bool, error)
-	Get(id int) (*User, error)
-	PasswordUpdate(id int, currentPassword, newPassword string) error
+	Insert(ctx context.Context, name, username, email, password string) error
+	Authenticate(ctx context.Context, email, password string) (int, error)
+	Exists(ctx context.Context, id int) (bool, error)
+	Get(ctx context.Context, id int) (*User, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	GetByUsername(ctx context.Context, username string) (*User, error)
+	UpdateProfile(ctx context.Context, id int, name, username string) error
+	PasswordUpdate(ctx context.Context, id int, currentPassword, newPassword string) error
+	VerifyPassword(ctx context.Context, id int, password string) error
+	SetRole(ctx context.Context, id int, role Role) error
+	List(ctx context.Context, query string, limit, offset int) ([]*User, int, error)
+	Count(ctx context.Context) (int, error)
+	SetDisabled(ctx context.Context, id int, disabled bool) error
+	RequirePasswordReset(ctx context.Context, id int) error
+	Delete(ctx context.Context, id int, anonymiseSnippets bool) error
+	SetBio(ctx context.Context, id int, bio string) error
+	SetPreferences(ctx context.Context, id int, prefs Preferences) error
 }
 
 type User struct {
-	ID             int
-	Name           string
+	ID   int
+	Name string
+	// 用户名在全站唯一，用于个人主页地址。功能上线前注册的用户没有用户名，此时为空字符串
+	Username       string
 	Email          string
 	HashedPassword []byte
 	Created        time.Time
+	Role           Role
+	// 被管理员禁用的账号无法登录，已有的会话也会失效
+	Disabled bool
+	// 管理员要求用户在下次访问时修改密码
+	PasswordResetRequired bool
+	// 账号没有本站的密码（通过单点登录创建），无法修改密码
+	Passwordless bool
+	// 显示在公开个人主页上的简介
+	Bio string
+	Preferences
+}
+
+// Preferences 是用户可以在偏好设置页面修改的显示选项。
+type Preferences struct {
+	// IANA 时区名称，例如 "Asia/Shanghai"。为空时使用浏览器检测到的时区
+	Timezone string
+	// 界面语言，例如 "zh-CN"。为空时根据 cookie 和浏览器的 Accept-Language 决定
+	Locale string
+}
+
+// userColumns 是读取 User 时查询的列，顺序必须与 scanUser 一致。
+// 没有密码的账号保存的哈希不以 "$" 开头（见 password.Hasher.Verify）。
+const userColumns = `id, name, username, email, created, role, disabled, password_reset_required,
+	hashed_password NOT LIKE '$%', bio, timezone, locale`
+
+// rowScanner 是 *sql.Row 和 *sql.Rows 共有的 Scan 方法
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row rowScanner) (*User, error) {
+	u := &User{}
+	var username sql.NullString
+	err := row.Scan(&u.ID, &u.Name, &username, &u.Email, &u.Created, &u.Role, &u.Disabled, &u.PasswordResetRequired, &u.Passwordless, &u.Bio, &u.Timezone, &u.Locale)
+	if err != nil {
+		return nil, err
+	}
+	u.Username = username.String
+	return u, nil
 }
 
 type UserModel struct {
 	DB *sql.DB
+	// Hasher 生成和验证密码哈希，为 nil 时使用 password.Default（argon2id）
+	Hasher *password.Hasher
+	// Timeout 限制每次方法调用中查询的总耗时，为 0 时只受调用方上下文的限制
+	Timeout time.Duration
+}
+
+func (m *UserModel) hasher() *password.Hasher {
+	if m.Hasher == nil {
+		return password.Default
+	}
+	return m.Hasher
 }
 
-func (m *UserModel) Insert(name, email, password string) error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+func (m *UserModel) Insert(ctx context.Context, name, username, email, plaintext string) error {
+	ctx, done := startQuery(ctx, "UserModel.Insert", m.Timeout)
+	defer done()
+	hashedPassword, err := m.hasher().Hash(plaintext)
 	if err != nil {
 		return err
 	}
-	stmt := `INSERT INTO users (name, email, hashed_password, created) VALUES (? ,?, ?, UTC_TIMESTAMP())`
-	_, err = m.DB.Exec(stmt, name, email, string(hashedPassword))
+	stmt := `INSERT INTO users (name, username, email, hashed_password, created) VALUES (?, ?, ?, ?, UTC_TIMESTAMP())`
+	_, err = m.DB.ExecContext(ctx, stmt, name, username, email, hashedPassword)
 	if err != nil {
 		// 如果返回错误，我们将使用 errors.As() 函数检查错误是否属于 mysql.MySQLError 类型。
 		// 如果是，该错误将被赋值给 mySQLError 变量。然后，我们可以通过检查错误代码是否等于 1062 以及错误消息字符串的内容，检查错误是否与 users_uc_email 密钥有关。如果是，我们将返回 ErrDuplicateEmail 错误信息
-		var mysqlError *mysql.MySQLError
-		if errors.As(err, &mysqlError) {
-			if mysqlError.Number == 1062 && strings.Contains(mysqlError.Message, "users_uc_email") {
-				return ErrDuplicateEmail
-			}
-		}
-		return err
+		return duplicateError(err)
 	}
 	return nil
 }
 
-func (m *UserModel) Authenticate(email, password string) (int, error) {
+// duplicateError 把违反唯一约束的 MySQL 错误转换成 ErrDuplicateEmail 或 ErrDuplicateUsername，其他错误原样返回。
+func duplicateError(err error) error {
+	var mysqlError *mysql.MySQLError
+	if errors.As(err, &mysqlError) && mysqlError.Number == 1062 {
+		switch {
+		case strings.Contains(mysqlError.Message, "users_uc_email"):
+			return ErrDuplicateEmail
+		case strings.Contains(mysqlError.Message, "users_uc_username"):
+			return ErrDuplicateUsername
+		}
+	}
+	return err
+}
+
+func (m *UserModel) Authenticate(ctx context.Context, email, plaintext string) (int, error) {
+	ctx, done := startQuery(ctx, "UserModel.Authenticate", m.Timeout)
+	defer done()
 	// 读取与给定电子邮件相关的 ID 和哈希密码。如果不存在匹配的电子邮件，我们将返回 ErrInvalidCredentials 错误信息
 	var id int
-	var hashedPassword []byte
-	stmt := `SELECT id, hashed_password FROM users WHERE email= ?`
-	err := m.DB.QueryRow(stmt, email).Scan(&id, &hashedPassword)
+	var hashedPassword string
+	var disabled bool
+	stmt := `SELECT id, hashed_password, disabled FROM users WHERE email= ?`
+	err := m.DB.QueryRowContext(ctx, stmt, email).Scan(&id, &hashedPassword, &disabled)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return 0, ErrInvalidCredential
@@ -64,28 +142,103 @@ func (m *UserModel) Authenticate(email, password string) (int, error) {
 		}
 	}
 	// 检查提供的散列密码和纯文本密码是否匹配。如果不匹配，我们将返回 ErrInvalidCredentials 错误。
-	err = bcrypt.CompareHashAndPassword(hashedPassword, []byte(password))
+	ok, needsRehash, err := m.hasher().Verify(hashedPassword, plaintext)
 	if err != nil {
-		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
-			return 0, ErrInvalidCredential
-		} else {
-			return 0, err
-		}
+		return 0, err
+	}
+	if !ok {
+		return 0, ErrInvalidCredential
+	}
+	// 密码正确之后才检查账号是否被禁用，避免向不知道密码的人透露账号状态
+	if disabled {
+		return 0, ErrAccountDisabled
+	}
+	// 哈希使用的是旧算法（bcrypt）或旧参数时，趁现在知道明文密码重新计算。失败不影响这次登录，下次登录时会再试
+	if needsRehash {
+		_ = m.rehash(ctx, id, hashedPassword, plaintext)
 	}
 	return id, nil
 }
 
-func (m *UserModel) Exists(id int) (bool, error) {
+// rehash 用当前的算法和参数重新计算密码哈希。只在哈希仍是 oldHash 时才替换，
+// 避免覆盖同时发生的密码修改。
+func (m *UserModel) rehash(ctx context.Context, id int, oldHash, plaintext string) error {
+	newHash, err := m.hasher().Hash(plaintext)
+	if err != nil {
+		return err
+	}
+	stmt := `UPDATE users SET hashed_password = ? WHERE id = ? AND hashed_password = ?`
+	_, err = m.DB.ExecContext(ctx, stmt, newHash, id, oldHash)
+	return err
+}
+
+// VerifyPassword 检查 plaintext 是否为用户 id 的密码，不匹配时返回 ErrInvalidCredential。
+// 它用于已登录用户的再次确认，与 Authenticate 不同，不检查禁用状态，也不会升级旧的哈希。
+func (m *UserModel) VerifyPassword(ctx context.Context, id int, plaintext string) error {
+	ctx, done := startQuery(ctx, "UserModel.VerifyPassword", m.Timeout)
+	defer done()
+	var hashedPassword string
+	err := m.DB.QueryRowContext(ctx, `SELECT hashed_password FROM users WHERE id = ?`, id).Scan(&hashedPassword)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidCredential
+		}
+		return err
+	}
+	ok, _, err := m.hasher().Verify(hashedPassword, plaintext)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidCredential
+	}
+	return nil
+}
+
+func (m *UserModel) Exists(ctx context.Context, id int) (bool, error) {
+	ctx, done := startQuery(ctx, "UserModel.Exists", m.Timeout)
+	defer done()
 	var exists bool
 	stmt := `SELECT EXISTS(SELECT true FROM users WHERE id=?)`
-	err := m.DB.QueryRow(stmt, id).Scan(&exists)
+	err := m.DB.QueryRowContext(ctx, stmt, id).Scan(&exists)
 	return exists, err
 }
 
-func (m *UserModel) Get(id int) (*User, error) {
-	var user User
-	stmt := "SELECT id, name, email, created from users WHERE id = ?"
-	err := m.DB.QueryRow(stmt, id).Scan(&user.ID, &user.Name, &user.Email, &user.Created)
+func (m *UserModel) Get(ctx context.Context, id int) (*User, error) {
+	ctx, done := startQuery(ctx, "UserModel.Get", m.Timeout)
+	defer done()
+	stmt := "SELECT " + userColumns + " FROM users WHERE id = ?"
+	user, err := scanUser(m.DB.QueryRowContext(ctx, stmt, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		} else {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+func (m *UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, done := startQuery(ctx, "UserModel.GetByEmail", m.Timeout)
+	defer done()
+	stmt := "SELECT " + userColumns + " FROM users WHERE email = ?"
+	user, err := scanUser(m.DB.QueryRowContext(ctx, stmt, email))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		} else {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+func (m *UserModel) GetByUsername(ctx context.Context, username string) (*User, error) {
+	ctx, done := startQuery(ctx, "UserModel.GetByUsername", m.Timeout)
+	defer done()
+	stmt := "SELECT " + userColumns + " FROM users WHERE username = ?"
+	user, err := scanUser(m.DB.QueryRowContext(ctx, stmt, username))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrNoRecord
@@ -93,29 +246,188 @@ func (m *UserModel) Get(id int) (*User, error) {
 			return nil, err
 		}
 	}
-	return &user, nil
+	return user, nil
 }
 
-func (m *UserModel) PasswordUpdate(id int, currentPassword, newPassword string) error {
-	var currentHashedPassword []byte
+// UpdateProfile 修改姓名和用户名。用户名已被占用时返回 ErrDuplicateUsername。
+func (m *UserModel) UpdateProfile(ctx context.Context, id int, name, username string) error {
+	ctx, done := startQuery(ctx, "UserModel.UpdateProfile", m.Timeout)
+	defer done()
+	err := m.update(ctx, `UPDATE users SET name = ?, username = ? WHERE id = ?`, id, name, username, id)
+	return duplicateError(err)
+}
+
+func (m *UserModel) SetRole(ctx context.Context, id int, role Role) error {
+	ctx, done := startQuery(ctx, "UserModel.SetRole", m.Timeout)
+	defer done()
+	if !role.Valid() {
+		return ErrInvalidRole
+	}
+	return m.update(ctx, `UPDATE users SET role = ? WHERE id = ?`, id, role, id)
+}
+
+func (m *UserModel) PasswordUpdate(ctx context.Context, id int, currentPassword, newPassword string) error {
+	ctx, done := startQuery(ctx, "UserModel.PasswordUpdate", m.Timeout)
+	defer done()
+	var currentHashedPassword string
 	stmt := `SELECT hashed_password FROM users WHERE id = ?`
-	err := m.DB.QueryRow(stmt, id).Scan(&currentHashedPassword)
+	err := m.DB.QueryRowContext(ctx, stmt, id).Scan(&currentHashedPassword)
 	if err != nil {
 		return err
 	}
-	err = bcrypt.CompareHashAndPassword(currentHashedPassword, []byte(currentPassword))
+	ok, _, err := m.hasher().Verify(currentHashedPassword, currentPassword)
 	if err != nil {
-		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
-			return ErrInvalidCredential
-		} else {
+		return err
+	}
+	if !ok {
+		return ErrInvalidCredential
+	}
+	newHashedPassword, err := m.hasher().Hash(newPassword)
+	if err != nil {
+		return err
+	}
+	stmt = `UPDATE users SET hashed_password = ?, password_reset_required = FALSE WHERE id = ? `
+	_, err = m.DB.ExecContext(ctx, stmt, newHashedPassword, id)
+	return err
+}
+
+// List 按注册时间倒序分页返回用户，query 非空时按姓名、用户名或邮箱模糊匹配。第二个返回值是符合条件的用户总数。
+func (m *UserModel) List(ctx context.Context, query string, limit, offset int) ([]*User, int, error) {
+	ctx, done := startQuery(ctx, "UserModel.List", m.Timeout)
+	defer done()
+	where := ""
+	var args []any
+	if query != "" {
+		// 转义 LIKE 中的通配符，让用户输入的 % 和 _ 按字面匹配
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query) + "%"
+		where = " WHERE name LIKE ? OR username LIKE ? OR email LIKE ?"
+		args = append(args, pattern, pattern, pattern)
+	}
+
+	var total int
+	err := m.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM users"+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	stmt := "SELECT " + userColumns + " FROM users" + where + " ORDER BY id DESC LIMIT ? OFFSET ?"
+	rows, err := m.DB.QueryContext(ctx, stmt, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, u)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+func (m *UserModel) Count(ctx context.Context) (int, error) {
+	ctx, done := startQuery(ctx, "UserModel.Count", m.Timeout)
+	defer done()
+	var n int
+	err := m.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM users`).Scan(&n)
+	return n, err
+}
+
+func (m *UserModel) SetDisabled(ctx context.Context, id int, disabled bool) error {
+	ctx, done := startQuery(ctx, "UserModel.SetDisabled", m.Timeout)
+	defer done()
+	return m.update(ctx, `UPDATE users SET disabled = ? WHERE id = ?`, id, disabled, id)
+}
+
+func (m *UserModel) SetBio(ctx context.Context, id int, bio string) error {
+	ctx, done := startQuery(ctx, "UserModel.SetBio", m.Timeout)
+	defer done()
+	return m.update(ctx, `UPDATE users SET bio = ? WHERE id = ?`, id, bio, id)
+}
+
+func (m *UserModel) SetPreferences(ctx context.Context, id int, prefs Preferences) error {
+	ctx, done := startQuery(ctx, "UserModel.SetPreferences", m.Timeout)
+	defer done()
+	return m.update(ctx, `UPDATE users SET timezone = ?, locale = ? WHERE id = ?`, id, prefs.Timezone, prefs.Locale, id)
+}
+
+func (m *UserModel) RequirePasswordReset(ctx context.Context, id int) error {
+	ctx, done := startQuery(ctx, "UserModel.RequirePasswordReset", m.Timeout)
+	defer done()
+	return m.update(ctx, `UPDATE users SET password_reset_required = TRUE WHERE id = ?`, id, id)
+}
+
+// update 执行针对单个用户的 UPDATE 语句，用户不存在时返回 ErrNoRecord。
+func (m *UserModel) update(ctx context.Context, stmt string, id int, args ...any) error {
+	result, err := m.DB.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	// MySQL 默认只统计真正被修改的行，值没有变化时 n 也是 0，所以这里再确认一次用户是否存在
+	if n == 0 {
+		exists, err := m.Exists(ctx, id)
+		if err != nil {
 			return err
 		}
+		if !exists {
+			return ErrNoRecord
+		}
 	}
-	newHashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), 12)
+	return nil
+}
+
+// Delete 在一个事务中删除用户及其两步验证、会话等关联数据。anonymiseSnippets 为 true 时保留用户的片段，
+// 只清除它们的创建者；否则一并删除。scs 会话存储中的数据不在这里处理，调用方需要先用会话令牌删除它们。
+func (m *UserModel) Delete(ctx context.Context, id int, anonymiseSnippets bool) error {
+	ctx, done := startQuery(ctx, "UserModel.Delete", m.Timeout)
+	defer done()
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	stmt = `UPDATE users SET hashed_password = ? WHERE id = ? `
-	_, err = m.DB.Exec(stmt, newHashedPassword, id)
-	return err
+	// 事务提交之后再调用 Rollback 不会有任何作用，所以可以放心地 defer
+	defer tx.Rollback()
+
+	snippetStmt := `DELETE FROM snippets WHERE user_id = ?`
+	if anonymiseSnippets {
+		snippetStmt = `UPDATE snippets SET user_id = NULL WHERE user_id = ?`
+	}
+	stmts := []string{
+		snippetStmt,
+		`DELETE FROM user_recovery_codes WHERE user_id = ?`,
+		`DELETE FROM user_totp WHERE user_id = ?`,
+		`DELETE FROM user_sessions WHERE user_id = ?`,
+		`DELETE FROM user_identities WHERE user_id = ?`,
+		`DELETE FROM remember_tokens WHERE user_id = ?`,
+		`DELETE FROM email_changes WHERE user_id = ?`,
+	}
+	for _, stmt := range stmts {
+		_, err = tx.ExecContext(ctx, stmt, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+	return tx.Commit()
 }
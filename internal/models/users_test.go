@@ -1,8 +1,13 @@
 package models
 
 import (
+	"context"
+	"errors"
 	"github.com/hlf2016/snippetbox/internal/assert"
+	"github.com/hlf2016/snippetbox/internal/password"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestUserModelExists(t *testing.T) {
@@ -36,10 +41,106 @@ func TestUserModelExists(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			// 调用 newTestDB() 辅助函数获取测试数据库的连接池。在 t.Run() 中调用此函数意味着将为每个子测试设置和删除新的数据库表和数据。
 			db := newTestDB(t)
-			m := UserModel{db}
-			exists, err := m.Exists(tt.userID)
+			m := UserModel{DB: db}
+			exists, err := m.Exists(context.Background(), tt.userID)
 			assert.Equal(t, exists, tt.want)
 			assert.NilError(t, err)
 		})
 	}
 }
+
+func TestUserModelDelete(t *testing.T) {
+	if testing.Short() {
+		t.Skip("models: skipping integration test")
+	}
+	tests := []struct {
+		name              string
+		anonymiseSnippets bool
+		wantSnippets      int
+	}{
+		{
+			name:              "Delete snippets",
+			anonymiseSnippets: false,
+			wantSnippets:      0,
+		},
+		{
+			name:              "Anonymise snippets",
+			anonymiseSnippets: true,
+			wantSnippets:      1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			snippets := SnippetModel{DB: db}
+			_, err := snippets.Insert(context.Background(), 1, "Title", "Content", 7)
+			assert.NilError(t, err)
+			emailChanges := EmailChangeModel{DB: db}
+			err = emailChanges.Insert(context.Background(), 1, "alice@example.org", "token", time.Now().Add(time.Hour))
+			assert.NilError(t, err)
+
+			m := UserModel{DB: db}
+			err = m.Delete(context.Background(), 1, tt.anonymiseSnippets)
+			assert.NilError(t, err)
+
+			exists, err := m.Exists(context.Background(), 1)
+			assert.NilError(t, err)
+			assert.Equal(t, exists, false)
+
+			var n int
+			err = db.QueryRow(`SELECT COUNT(*) FROM snippets WHERE user_id IS NULL`).Scan(&n)
+			assert.NilError(t, err)
+			assert.Equal(t, n, tt.wantSnippets)
+
+			// 表之间没有外键，等待确认的新邮箱和令牌哈希需要在同一个事务中删除
+			err = db.QueryRow(`SELECT COUNT(*) FROM email_changes WHERE user_id = 1`).Scan(&n)
+			assert.NilError(t, err)
+			assert.Equal(t, n, 0)
+
+			err = m.Delete(context.Background(), 1, tt.anonymiseSnippets)
+			assert.Equal(t, err, ErrNoRecord)
+		})
+	}
+}
+
+func TestUserModelAuthenticateRehash(t *testing.T) {
+	if testing.Short() {
+		t.Skip("models: skipping integration test")
+	}
+	db := newTestDB(t)
+	// setup.sql 中 alice 的密码是 bcrypt 哈希，登录后应该被替换成 argon2id
+	m := UserModel{DB: db, Hasher: &password.Hasher{
+		Algorithm: password.Argon2id,
+		Argon2:    password.Argon2Params{Memory: 64, Iterations: 1, Threads: 1, SaltLength: 16, KeyLength: 32},
+	}}
+
+	_, err := m.Authenticate(context.Background(), "alice@example.com", "wrong")
+	assert.Equal(t, err, ErrInvalidCredential)
+
+	id, err := m.Authenticate(context.Background(), "alice@example.com", "pa$$word")
+	assert.NilError(t, err)
+	assert.Equal(t, id, 1)
+
+	var hash string
+	err = db.QueryRow(`SELECT hashed_password FROM users WHERE id = 1`).Scan(&hash)
+	assert.NilError(t, err)
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		t.Fatalf("got hash %q; want an argon2id hash", hash)
+	}
+
+	id, err = m.Authenticate(context.Background(), "alice@example.com", "pa$$word")
+	assert.NilError(t, err)
+	assert.Equal(t, id, 1)
+}
+
+func TestUserModelTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("models: skipping integration test")
+	}
+	db := newTestDB(t)
+	// 超时短到任何查询都来不及完成
+	m := UserModel{DB: db, Timeout: time.Nanosecond}
+	_, err := m.Exists(context.Background(), 1)
+	assert.Equal(t, errors.Is(err, context.DeadlineExceeded), true)
+}
@@ -0,0 +1,118 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type UserSessionModelInterface interface {
+	Insert(ctx context.Context, userID int, token, userAgent, ip string, expires time.Time) error
+	Touch(ctx context.Context, token string) error
+	Get(ctx context.Context, userID, id int) (*UserSession, error)
+	ForUser(ctx context.Context, userID int) ([]*UserSession, error)
+	Delete(ctx context.Context, token string) error
+	ActiveUsers(ctx context.Context, since time.Time) (int, error)
+}
+
+// UserSession 记录一个已登录会话的设备信息。会话数据本身仍然由 scs 保存在 mysqlstore 的 sessions 表中，
+// 这里的 Token 与其一一对应，撤销会话时需要用它从会话存储中删除数据。
+type UserSession struct {
+	ID        int
+	UserID    int
+	Token     string
+	UserAgent string
+	IP        string
+	Created   time.Time
+	LastSeen  time.Time
+	Expires   time.Time
+}
+
+type UserSessionModel struct {
+	DB *sql.DB
+	// Timeout 限制每次方法调用中查询的总耗时，为 0 时只受调用方上下文的限制
+	Timeout time.Duration
+}
+
+func (m *UserSessionModel) Insert(ctx context.Context, userID int, token, userAgent, ip string, expires time.Time) error {
+	ctx, done := startQuery(ctx, "UserSessionModel.Insert", m.Timeout)
+	defer done()
+	// 顺便清理该用户已过期的会话记录，避免表无限增长
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM user_sessions WHERE user_id = ? AND expires <= UTC_TIMESTAMP()`, userID)
+	if err != nil {
+		return err
+	}
+	stmt := `INSERT INTO user_sessions (user_id, token, user_agent, ip, created, last_seen, expires)
+	VALUES (?, ?, ?, ?, UTC_TIMESTAMP(), UTC_TIMESTAMP(), ?)`
+	_, err = m.DB.ExecContext(ctx, stmt, userID, token, userAgent, ip, expires.UTC())
+	return err
+}
+
+// Touch 更新会话的最后活跃时间。如果会话在本功能上线之前就已创建（没有对应记录），则什么也不做。
+func (m *UserSessionModel) Touch(ctx context.Context, token string) error {
+	ctx, done := startQuery(ctx, "UserSessionModel.Touch", m.Timeout)
+	defer done()
+	_, err := m.DB.ExecContext(ctx, `UPDATE user_sessions SET last_seen = UTC_TIMESTAMP() WHERE token = ?`, token)
+	return err
+}
+
+func (m *UserSessionModel) Get(ctx context.Context, userID, id int) (*UserSession, error) {
+	ctx, done := startQuery(ctx, "UserSessionModel.Get", m.Timeout)
+	defer done()
+	s := &UserSession{}
+	stmt := `SELECT id, user_id, token, user_agent, ip, created, last_seen, expires FROM user_sessions
+	WHERE id = ? AND user_id = ? AND expires > UTC_TIMESTAMP()`
+	err := m.DB.QueryRowContext(ctx, stmt, id, userID).Scan(&s.ID, &s.UserID, &s.Token, &s.UserAgent, &s.IP, &s.Created, &s.LastSeen, &s.Expires)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		} else {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// ForUser 按最后活跃时间倒序返回用户所有未过期的会话。
+func (m *UserSessionModel) ForUser(ctx context.Context, userID int) ([]*UserSession, error) {
+	ctx, done := startQuery(ctx, "UserSessionModel.ForUser", m.Timeout)
+	defer done()
+	stmt := `SELECT id, user_id, token, user_agent, ip, created, last_seen, expires FROM user_sessions
+	WHERE user_id = ? AND expires > UTC_TIMESTAMP() ORDER BY last_seen DESC`
+	rows, err := m.DB.QueryContext(ctx, stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*UserSession
+	for rows.Next() {
+		s := &UserSession{}
+		err := rows.Scan(&s.ID, &s.UserID, &s.Token, &s.UserAgent, &s.IP, &s.Created, &s.LastSeen, &s.Expires)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (m *UserSessionModel) Delete(ctx context.Context, token string) error {
+	ctx, done := startQuery(ctx, "UserSessionModel.Delete", m.Timeout)
+	defer done()
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM user_sessions WHERE token = ?`, token)
+	return err
+}
+
+// ActiveUsers 返回 since 之后有过活动的不同用户数量。
+func (m *UserSessionModel) ActiveUsers(ctx context.Context, since time.Time) (int, error) {
+	ctx, done := startQuery(ctx, "UserSessionModel.ActiveUsers", m.Timeout)
+	defer done()
+	var n int
+	err := m.DB.QueryRowContext(ctx, `SELECT COUNT(DISTINCT user_id) FROM user_sessions WHERE last_seen >= ?`, since.UTC()).Scan(&n)
+	return n, err
+}
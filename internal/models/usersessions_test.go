@@ -0,0 +1,20 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"github.com/hlf2016/snippetbox/internal/assert"
+	"testing"
+	"time"
+)
+
+func TestUserSessionModelTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("models: skipping integration test")
+	}
+	db := newTestDB(t)
+	// Touch 在每个已登录请求上执行，数据库卡住时同样要在超时后返回
+	m := UserSessionModel{DB: db, Timeout: time.Nanosecond}
+	err := m.Touch(context.Background(), "token")
+	assert.Equal(t, errors.Is(err, context.DeadlineExceeded), true)
+}
@@ -0,0 +1,512 @@
+// Package oidc 实现 OpenID Connect 授权码流程中依赖方（Relying Party）需要的部分：读取提供方的发现文档、
+// 生成授权地址、用授权码换取 ID 令牌，以及使用提供方 JWKS 中的公钥验证 ID 令牌。
+//
+// 这里只实现了我们用到的功能：授权码流程 + PKCE（S256），ID 令牌签名算法只接受 RS256 和 ES256。
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidToken 表示 ID 令牌没有通过验证：格式错误、签名无效、签发者或受众不符、已过期或 nonce 不匹配。
+var ErrInvalidToken = errors.New("oidc: invalid id token")
+
+// 验证 exp 和 iat 时允许的时钟偏差
+const clockSkew = time.Minute
+
+// 遇到未知的 kid 时会重新下载 JWKS 以支持提供方轮换密钥，但两次下载至少间隔这么久，
+// 避免伪造的令牌让我们不停地请求提供方。
+const jwksRefreshInterval = time.Minute
+
+type Config struct {
+	// Issuer 是提供方的签发者地址，发现文档位于 Issuer + "/.well-known/openid-configuration"
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Scopes 为空时使用 openid、email 和 profile
+	Scopes []string
+	// Client 为 nil 时使用一个 10 秒超时的 http.Client
+	Client *http.Client
+}
+
+// Claims 是我们从 ID 令牌中读取的声明。
+type Claims struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Nonce         string
+	Expiry        time.Time
+	IssuedAt      time.Time
+	// AuthTime 是用户在提供方最后一次验证身份的时间，令牌中没有 auth_time 时为零值
+	AuthTime time.Time
+}
+
+// Provider 代表一个 OpenID Connect 提供方。发现文档和 JWKS 在第一次使用时下载并缓存，可以安全地并发使用。
+type Provider struct {
+	cfg    Config
+	client *http.Client
+	// now 返回当前时间，测试中可以替换
+	now func() time.Time
+
+	mu          sync.Mutex
+	metadata    *metadata
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+// metadata 是发现文档中我们用到的字段
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func NewProvider(cfg Config) *Provider {
+	client := cfg.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	return &Provider{cfg: cfg, client: client, now: time.Now}
+}
+
+// discover 下载并缓存发现文档。文档中的 issuer 必须与配置的完全一致，否则攻击者可以用别的提供方签发的令牌冒充。
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	var md metadata
+	err := p.getJSON(ctx, p.cfg.Issuer+"/.well-known/openid-configuration", &md)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(md.Issuer, "/") != p.cfg.Issuer {
+		return nil, fmt.Errorf("oidc: issuer mismatch: configured %q, provider reports %q", p.cfg.Issuer, md.Issuer)
+	}
+	if md.AuthorizationEndpoint == "" || md.TokenEndpoint == "" || md.JWKSURI == "" {
+		return nil, errors.New("oidc: discovery document is missing required endpoints")
+	}
+	p.metadata = &md
+	return p.metadata, nil
+}
+
+// AuthCodeURL 返回把用户重定向到提供方登录页面的地址。state 用来防止 CSRF，nonce 会被写进 ID 令牌用来防止重放，
+// codeChallenge 是 PKCE 校验值，由 CodeChallenge(verifier) 计算。
+func (p *Provider) AuthCodeURL(ctx context.Context, redirectURL, state, nonce, codeChallenge string) (string, error) {
+	return p.authCodeURL(ctx, redirectURL, state, nonce, codeChallenge, nil)
+}
+
+// ReauthCodeURL 和 AuthCodeURL 一样，但要求提供方重新验证用户的身份（prompt=login、max_age=0），
+// 即使用户在提供方仍处于登录状态。提供方会在 ID 令牌的 auth_time 中返回这次验证的时间，调用方应检查它。
+func (p *Provider) ReauthCodeURL(ctx context.Context, redirectURL, state, nonce, codeChallenge string) (string, error) {
+	return p.authCodeURL(ctx, redirectURL, state, nonce, codeChallenge, url.Values{
+		"prompt":  {"login"},
+		"max_age": {"0"},
+	})
+}
+
+func (p *Provider) authCodeURL(ctx context.Context, redirectURL, state, nonce, codeChallenge string, extra url.Values) (string, error) {
+	md, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(md.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("oidc: invalid authorization endpoint: %w", err)
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", redirectURL)
+	q.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", codeChallenge)
+	q.Set("code_challenge_method", "S256")
+	for k, v := range extra {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Exchange 用授权码和 PKCE 验证值换取令牌，验证其中的 ID 令牌后返回它的声明。nonce 必须是发起登录时使用的值。
+func (p *Provider) Exchange(ctx context.Context, redirectURL, code, codeVerifier, nonce string) (*Claims, error) {
+	md, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURL)
+	form.Set("code_verifier", codeVerifier)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, md.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// client_secret_basic：RFC 6749 要求先对客户端 ID 和密钥做表单编码
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: token request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || token.Error != "" {
+		return nil, fmt.Errorf("oidc: token request failed: %d %s %s", resp.StatusCode, token.Error, token.ErrorDescription)
+	}
+	if token.IDToken == "" {
+		return nil, errors.New("oidc: token response has no id_token")
+	}
+	return p.Verify(ctx, token.IDToken, nonce)
+}
+
+// Verify 验证 ID 令牌的签名和声明，成功时返回声明。
+func (p *Provider) Verify(ctx context.Context, rawIDToken, nonce string) (*Claims, error) {
+	md, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err = decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidToken, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature encoding", ErrInvalidToken)
+	}
+
+	key, err := p.publicKey(ctx, md.JWKSURI, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	// 签名算法由我们根据密钥类型决定，而不是相信令牌头部，防止 "alg":"none" 或用公钥做 HMAC 密钥之类的攻击
+	err = verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw struct {
+		Iss           string          `json:"iss"`
+		Sub           string          `json:"sub"`
+		Aud           audience        `json:"aud"`
+		Azp           string          `json:"azp"`
+		Exp           int64           `json:"exp"`
+		Iat           int64           `json:"iat"`
+		AuthTime      int64           `json:"auth_time"`
+		Nonce         string          `json:"nonce"`
+		Email         string          `json:"email"`
+		EmailVerified json.RawMessage `json:"email_verified"`
+		Name          string          `json:"name"`
+	}
+	err = decodeSegment(parts[1], &raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: payload: %v", ErrInvalidToken, err)
+	}
+
+	now := p.now()
+	switch {
+	case strings.TrimSuffix(raw.Iss, "/") != p.cfg.Issuer:
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, raw.Iss)
+	case !raw.Aud.contains(p.cfg.ClientID):
+		return nil, fmt.Errorf("%w: token is not intended for this client", ErrInvalidToken)
+	case len(raw.Aud) > 1 && raw.Azp != p.cfg.ClientID:
+		return nil, fmt.Errorf("%w: unexpected authorized party %q", ErrInvalidToken, raw.Azp)
+	case raw.Sub == "":
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidToken)
+	case raw.Exp == 0 || now.After(time.Unix(raw.Exp, 0).Add(clockSkew)):
+		return nil, fmt.Errorf("%w: token has expired", ErrInvalidToken)
+	case raw.Iat != 0 && time.Unix(raw.Iat, 0).After(now.Add(clockSkew)):
+		return nil, fmt.Errorf("%w: token issued in the future", ErrInvalidToken)
+	case raw.Nonce == "" || raw.Nonce != nonce:
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidToken)
+	}
+
+	return &Claims{
+		Issuer:        raw.Iss,
+		Subject:       raw.Sub,
+		Email:         raw.Email,
+		EmailVerified: parseBool(raw.EmailVerified),
+		Name:          raw.Name,
+		Nonce:         raw.Nonce,
+		Expiry:        time.Unix(raw.Exp, 0),
+		IssuedAt:      time.Unix(raw.Iat, 0),
+		AuthTime:      unixTime(raw.AuthTime),
+	}, nil
+}
+
+// publicKey 返回 kid 对应的公钥。缓存中没有时重新下载 JWKS，但受 jwksRefreshInterval 限制。
+func (p *Provider) publicKey(ctx context.Context, jwksURI, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	if p.keys != nil && p.now().Sub(p.keysFetched) < jwksRefreshInterval {
+		return nil, fmt.Errorf("%w: unknown key id %q", ErrInvalidToken, kid)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := p.getJSON(ctx, jwksURI, &set)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		// 只使用签名密钥，跳过不认识的密钥类型
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	p.keys = keys
+	p.keysFetched = p.now()
+
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key id %q", ErrInvalidToken, kid)
+}
+
+// lookupKey 在缓存中查找密钥。令牌没有 kid 时，只有在 JWKS 中恰好只有一个密钥的情况下才使用它。
+func (p *Provider) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("oidc: fetching %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: fetching %s: unexpected status %d", url, resp.StatusCode)
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(dst)
+	if err != nil {
+		return fmt.Errorf("oidc: decoding %s: %w", url, err)
+	}
+	return nil
+}
+
+// jsonWebKey 是 JWKS 中的一个密钥（RFC 7517），只包含 RSA 和 EC 公钥用到的字段
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("oidc: rsa exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("oidc: unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !key.Curve.IsOnCurve(x, y) {
+			return nil, errors.New("oidc: ec point is not on the curve")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("oidc: unsupported key type %q", k.Kty)
+	}
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return fmt.Errorf("%w: algorithm %q does not match the rsa key", ErrInvalidToken, alg)
+		}
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return fmt.Errorf("%w: bad signature", ErrInvalidToken)
+		}
+	case *ecdsa.PublicKey:
+		// JWS 中的 ECDSA 签名是定长的 r || s，而不是 ASN.1 编码
+		if alg != "ES256" || len(signature) != 64 {
+			return fmt.Errorf("%w: algorithm %q does not match the ec key", ErrInvalidToken, alg)
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return fmt.Errorf("%w: bad signature", ErrInvalidToken)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported key", ErrInvalidToken)
+	}
+	return nil
+}
+
+// audience 是 aud 声明，它可以是单个字符串，也可以是字符串数组
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*a = audience{single}
+		return nil
+	}
+	var many []string
+	err := json.Unmarshal(data, &many)
+	if err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBool 解析 email_verified。规范要求是布尔值，但有的提供方会返回字符串 "true"。
+func parseBool(data json.RawMessage) bool {
+	var b bool
+	if json.Unmarshal(data, &b) == nil {
+		return b
+	}
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		return s == "true"
+	}
+	return false
+}
+
+func decodeSegment(seg string, dst any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("oidc: invalid key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// unixTime 把 Unix 时间戳转换为 time.Time，0 表示缺失，返回零值
+func unixTime(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+// RandomString 返回 32 字节随机数的 base64url 编码（43 个字符），用作 state、nonce 和 PKCE 验证值。
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallenge 按 PKCE 的 S256 方法根据验证值计算校验值。
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,196 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"github.com/hlf2016/snippetbox/internal/assert"
+	"github.com/hlf2016/snippetbox/internal/oidc/oidctest"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestProvider(t *testing.T) (*Provider, *oidctest.Provider) {
+	fake := oidctest.NewProvider(t)
+	p := NewProvider(Config{
+		Issuer:       fake.Issuer(),
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+	})
+	return p, fake
+}
+
+func TestVerify(t *testing.T) {
+	identity := oidctest.Identity{Subject: "subject-1", Email: "alice@example.com", EmailVerified: true, Name: "Alice"}
+
+	tests := []struct {
+		name    string
+		modify  func(claims map[string]any)
+		nonce   string
+		wantErr bool
+	}{
+		{
+			name:   "Valid",
+			modify: func(claims map[string]any) {},
+			nonce:  "n-1",
+		},
+		{
+			name: "Audience array with azp",
+			modify: func(claims map[string]any) {
+				claims["aud"] = []string{oidctest.ClientID, "other"}
+				claims["azp"] = oidctest.ClientID
+			},
+			nonce: "n-1",
+		},
+		{
+			name:   "Email verified as string",
+			modify: func(claims map[string]any) { claims["email_verified"] = "true" },
+			nonce:  "n-1",
+		},
+		{
+			name:    "Wrong nonce",
+			modify:  func(claims map[string]any) {},
+			nonce:   "n-2",
+			wantErr: true,
+		},
+		{
+			name:    "Wrong audience",
+			modify:  func(claims map[string]any) { claims["aud"] = "someone-else" },
+			nonce:   "n-1",
+			wantErr: true,
+		},
+		{
+			name:    "Audience array without azp",
+			modify:  func(claims map[string]any) { claims["aud"] = []string{oidctest.ClientID, "other"} },
+			nonce:   "n-1",
+			wantErr: true,
+		},
+		{
+			name:    "Wrong issuer",
+			modify:  func(claims map[string]any) { claims["iss"] = "https://evil.example.com" },
+			nonce:   "n-1",
+			wantErr: true,
+		},
+		{
+			name:    "Expired",
+			modify:  func(claims map[string]any) { claims["exp"] = time.Now().Add(-time.Hour).Unix() },
+			nonce:   "n-1",
+			wantErr: true,
+		},
+		{
+			name:    "Issued in the future",
+			modify:  func(claims map[string]any) { claims["iat"] = time.Now().Add(time.Hour).Unix() },
+			nonce:   "n-1",
+			wantErr: true,
+		},
+		{
+			name:    "Missing subject",
+			modify:  func(claims map[string]any) { delete(claims, "sub") },
+			nonce:   "n-1",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, fake := newTestProvider(t)
+			claims := fake.Claims(identity, "n-1")
+			tt.modify(claims)
+
+			got, err := p.Verify(context.Background(), fake.Sign(claims), tt.nonce)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidToken) {
+					t.Fatalf("got error %v; want ErrInvalidToken", err)
+				}
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, got.Subject, "subject-1")
+			assert.Equal(t, got.Email, "alice@example.com")
+			assert.Equal(t, got.EmailVerified, true)
+		})
+	}
+}
+
+func TestVerifyRejectsTampering(t *testing.T) {
+	p, fake := newTestProvider(t)
+	token := fake.Sign(fake.Claims(oidctest.Identity{Subject: "subject-1"}, "n-1"))
+	parts := strings.Split(token, ".")
+
+	// 替换声明但保留原来的签名
+	forged := fake.Claims(oidctest.Identity{Subject: "admin"}, "n-1")
+	other := strings.Split(fake.Sign(forged), ".")
+	_, err := p.Verify(context.Background(), parts[0]+"."+other[1]+"."+parts[2], "n-1")
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("got error %v; want ErrInvalidToken", err)
+	}
+
+	// "alg":"none" 的令牌没有签名
+	none := "eyJhbGciOiJub25lIiwia2lkIjoidGVzdC1rZXkifQ." + parts[1] + "."
+	_, err = p.Verify(context.Background(), none, "n-1")
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("got error %v; want ErrInvalidToken", err)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	p, _ := newTestProvider(t)
+	ctx := context.Background()
+	redirectURL := "https://snippetbox.example.com/auth/oidc/callback"
+
+	verifier, err := RandomString()
+	assert.NilError(t, err)
+
+	authURL, err := p.AuthCodeURL(ctx, redirectURL, "state-1", "nonce-1", CodeChallenge(verifier))
+	assert.NilError(t, err)
+
+	// 模拟浏览器访问授权端点，提供方直接重定向回 redirect_uri
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	assert.NilError(t, err)
+	resp.Body.Close()
+	back, err := url.Parse(resp.Header.Get("Location"))
+	assert.NilError(t, err)
+	assert.Equal(t, back.Query().Get("state"), "state-1")
+	code := back.Query().Get("code")
+
+	// 错误的 PKCE 验证值会被令牌端点拒绝，授权码随之作废
+	_, err = p.Exchange(ctx, redirectURL, code, "wrong-verifier", "nonce-1")
+	if err == nil {
+		t.Fatal("expected an error for a wrong code verifier")
+	}
+
+	resp, err = client.Get(authURL)
+	assert.NilError(t, err)
+	resp.Body.Close()
+	back, _ = url.Parse(resp.Header.Get("Location"))
+	claims, err := p.Exchange(ctx, redirectURL, back.Query().Get("code"), verifier, "nonce-1")
+	assert.NilError(t, err)
+	assert.Equal(t, claims.Subject, "subject-1")
+	assert.Equal(t, claims.Email, "alice@example.com")
+	assert.Equal(t, claims.AuthTime.IsZero(), false)
+}
+
+func TestReauthCodeURL(t *testing.T) {
+	p, _ := newTestProvider(t)
+	authURL, err := p.ReauthCodeURL(context.Background(), "https://snippetbox.example.com/auth/oidc/callback", "s", "n", "c")
+	assert.NilError(t, err)
+	u, err := url.Parse(authURL)
+	assert.NilError(t, err)
+	assert.Equal(t, u.Query().Get("prompt"), "login")
+	assert.Equal(t, u.Query().Get("max_age"), "0")
+	assert.Equal(t, u.Query().Get("state"), "s")
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	fake := oidctest.NewProvider(t)
+	p := NewProvider(Config{Issuer: fake.Issuer() + "/tenant", ClientID: oidctest.ClientID})
+	_, err := p.AuthCodeURL(context.Background(), "https://example.com/cb", "s", "n", "c")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
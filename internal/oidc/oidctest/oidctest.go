@@ -0,0 +1,234 @@
+// Package oidctest 提供一个运行在 httptest.Server 上的 OpenID Connect 提供方，供测试使用。
+//
+// 它实现了发现文档、JWKS、授权端点和令牌端点。授权端点不显示登录页面，而是直接以 Identity 的身份
+// 签发授权码并重定向回 redirect_uri；令牌端点会检查客户端密钥、redirect_uri 和 PKCE 验证值。
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	ClientID     = "snippetbox-test"
+	ClientSecret = "test-secret"
+	keyID        = "test-key"
+)
+
+// Identity 是授权端点登录的用户
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+type Provider struct {
+	*httptest.Server
+	Key *rsa.PrivateKey
+
+	mu       sync.Mutex
+	identity Identity
+	codes    map[string]authRequest
+	// 不为空时覆盖签发的 ID 令牌中的 nonce，用来测试重放保护
+	nonceOverride string
+}
+
+// authRequest 是授权端点收到的、等待令牌端点兑换的请求
+type authRequest struct {
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+	identity      Identity
+}
+
+// NewProvider 启动一个提供方，测试结束时自动关闭。
+func NewProvider(t *testing.T) *Provider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Provider{
+		Key:   key,
+		codes: make(map[string]authRequest),
+		identity: Identity{
+			Subject:       "subject-1",
+			Email:         "alice@example.com",
+			EmailVerified: true,
+			Name:          "Alice Jones",
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Server.Close)
+	return p
+}
+
+// Issuer 返回提供方的签发者地址
+func (p *Provider) Issuer() string {
+	return p.URL
+}
+
+// SetIdentity 设置之后登录的用户
+func (p *Provider) SetIdentity(id Identity) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.identity = id
+}
+
+// SetNonceOverride 让之后签发的 ID 令牌使用固定的 nonce，而不是授权请求中的值
+func (p *Provider) SetNonceOverride(nonce string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nonceOverride = nonce
+}
+
+// Sign 用提供方的密钥签名任意声明，返回紧凑格式的 JWT
+func (p *Provider) Sign(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": keyID, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.Key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// Claims 返回为 id 签发的标准声明，测试可以在此基础上修改后用 Sign 签名
+func (p *Provider) Claims(id Identity, nonce string) map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":            p.Issuer(),
+		"sub":            id.Subject,
+		"aud":            ClientID,
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"iat":            now.Unix(),
+		"auth_time":      now.Unix(),
+		"nonce":          nonce,
+		"email":          id.Email,
+		"email_verified": id.EmailVerified,
+		"name":           id.Name,
+	}
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 p.Issuer(),
+		"authorization_endpoint": p.URL + "/authorize",
+		"token_endpoint":         p.URL + "/token",
+		"jwks_uri":               p.URL + "/jwks",
+	})
+}
+
+func (p *Provider) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := p.Key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": keyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != ClientID || q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || q.Get("redirect_uri") == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	code := base64.RawURLEncoding.EncodeToString(randomBytes())
+	p.mu.Lock()
+	p.codes[code] = authRequest{
+		redirectURI:   q.Get("redirect_uri"),
+		nonce:         q.Get("nonce"),
+		codeChallenge: q.Get("code_challenge"),
+		identity:      p.identity,
+	}
+	p.mu.Unlock()
+
+	back := redirectURI.Query()
+	back.Set("code", code)
+	back.Set("state", q.Get("state"))
+	redirectURI.RawQuery = back.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok || clientID != ClientID || secret != ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	// 授权码只能使用一次
+	p.mu.Lock()
+	req, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	nonce := req.nonce
+	if p.nonceOverride != "" {
+		nonce = p.nonceOverride
+	}
+	p.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case r.PostForm.Get("grant_type") != "authorization_code", !ok:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+	case r.PostForm.Get("redirect_uri") != req.redirectURI:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "redirect_uri mismatch"})
+	case base64.RawURLEncoding.EncodeToString(sum[:]) != req.codeChallenge:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+	default:
+		writeJSON(w, http.StatusOK, map[string]any{
+			"access_token": base64.RawURLEncoding.EncodeToString(randomBytes()),
+			"token_type":   "Bearer",
+			"expires_in":   300,
+			"id_token":     p.Sign(p.Claims(req.identity, nonce)),
+		})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomBytes() []byte {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return b
+}
@@ -0,0 +1,182 @@
+// Package password 负责生成和验证密码哈希。
+//
+// 哈希以 PHC 字符串格式保存，算法和参数都编码在字符串中，例如
+//
+//	$argon2id$v=19$m=65536,t=3,p=2$<盐>$<哈希>
+//
+// 因此修改默认算法或参数后，旧的哈希仍然可以验证。早期版本使用的 bcrypt 哈希（$2a$、$2b$、$2y$）
+// 同样可以验证，Verify 会报告这类哈希需要重新计算，调用方在用户下次登录时用新的参数替换。
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+var (
+	// ErrUnsupportedHash 表示哈希字符串的格式或算法无法识别
+	ErrUnsupportedHash = errors.New("password: unsupported hash format")
+	// ErrUnknownAlgorithm 表示 Hasher 配置了未知的算法
+	ErrUnknownAlgorithm = errors.New("password: unknown algorithm")
+)
+
+// Argon2Params 是 argon2id 的参数。Memory 以 KiB 为单位。
+type Argon2Params struct {
+	Memory     uint32
+	Iterations uint32
+	Threads    uint8
+	SaltLength uint32
+	KeyLength  uint32
+}
+
+// DefaultArgon2Params 采用 RFC 9106 中内存受限环境下的推荐值：64 MiB 内存、3 次迭代
+var DefaultArgon2Params = Argon2Params{
+	Memory:     64 * 1024,
+	Iterations: 3,
+	Threads:    2,
+	SaltLength: 16,
+	KeyLength:  32,
+}
+
+// DefaultBcryptCost 与之前写死在 UserModel 中的代价一致
+const DefaultBcryptCost = 12
+
+// Hasher 用 Algorithm 指定的算法生成新的哈希，并能验证任何受支持算法的哈希。
+type Hasher struct {
+	// Algorithm 为 Argon2id 或 Bcrypt，为空时使用 Argon2id
+	Algorithm  string
+	Argon2     Argon2Params
+	BcryptCost int
+}
+
+// Default 是使用默认参数的 argon2id Hasher
+var Default = &Hasher{Algorithm: Argon2id, Argon2: DefaultArgon2Params, BcryptCost: DefaultBcryptCost}
+
+// Validate 检查 Hasher 的配置，在启动时调用可以尽早发现错误的命令行参数。
+func (h *Hasher) Validate() error {
+	switch h.algorithm() {
+	case Argon2id:
+		p := h.Argon2
+		if p.Memory < 8*uint32(p.Threads) || p.Iterations < 1 || p.Threads < 1 || p.SaltLength < 8 || p.KeyLength < 16 {
+			return fmt.Errorf("password: invalid argon2id parameters m=%d,t=%d,p=%d", p.Memory, p.Iterations, p.Threads)
+		}
+	case Bcrypt:
+		if h.BcryptCost < bcrypt.MinCost || h.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("password: invalid bcrypt cost %d", h.BcryptCost)
+		}
+	default:
+		return fmt.Errorf("%w %q", ErrUnknownAlgorithm, h.Algorithm)
+	}
+	return nil
+}
+
+func (h *Hasher) algorithm() string {
+	if h.Algorithm == "" {
+		return Argon2id
+	}
+	return h.Algorithm
+}
+
+// Hash 返回 password 的 PHC 格式哈希。
+func (h *Hasher) Hash(password string) (string, error) {
+	switch h.algorithm() {
+	case Argon2id:
+		p := h.Argon2
+		salt := make([]byte, p.SaltLength)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Threads, p.KeyLength)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Iterations, p.Threads,
+			b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+	case Bcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		return string(hash), err
+	default:
+		return "", fmt.Errorf("%w %q", ErrUnknownAlgorithm, h.Algorithm)
+	}
+}
+
+// Verify 判断 password 是否与 hash 匹配。needsRehash 为 true 表示密码正确，但哈希使用的算法或参数与
+// 当前配置不同，应该用 Hash 重新计算后保存。
+//
+// 不以 "$" 开头的值（例如只能通过单点登录的账号保存的 "!"）表示账号没有可用的密码，永远不匹配。
+func (h *Hasher) Verify(hash, password string) (ok, needsRehash bool, err error) {
+	if !strings.HasPrefix(hash, "$") {
+		return false, false, nil
+	}
+
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		p, salt, key, err := decodeArgon2id(hash)
+		if err != nil {
+			return false, false, err
+		}
+		got := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(got, key) != 1 {
+			return false, false, nil
+		}
+		want := h.Argon2
+		stale := h.algorithm() != Argon2id || p.Memory != want.Memory || p.Iterations != want.Iterations ||
+			p.Threads != want.Threads || uint32(len(salt)) != want.SaltLength || uint32(len(key)) != want.KeyLength
+		return true, stale, nil
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err != nil {
+			if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+				return false, false, nil
+			}
+			return false, false, err
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return false, false, err
+		}
+		return true, h.algorithm() != Bcrypt || cost != h.BcryptCost, nil
+	default:
+		return false, false, ErrUnsupportedHash
+	}
+}
+
+// PHC 字符串格式规定盐和哈希使用不带填充的标准 Base64 编码
+var b64 = base64.RawStdEncoding
+
+func decodeArgon2id(hash string) (p Argon2Params, salt, key []byte, err error) {
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", 盐, 哈希
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, ErrUnsupportedHash
+	}
+	var version int
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return p, nil, nil, ErrUnsupportedHash
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Threads)
+	if err != nil || p.Iterations < 1 || p.Threads < 1 {
+		return p, nil, nil, ErrUnsupportedHash
+	}
+	salt, err = b64.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, ErrUnsupportedHash
+	}
+	key, err = b64.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, ErrUnsupportedHash
+	}
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+	return p, salt, key, nil
+}
@@ -0,0 +1,107 @@
+package password
+
+import (
+	"errors"
+	"github.com/hlf2016/snippetbox/internal/assert"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"testing"
+)
+
+// 测试使用很小的参数，避免每次哈希都消耗 64 MiB 内存
+var testParams = Argon2Params{Memory: 64, Iterations: 1, Threads: 1, SaltLength: 16, KeyLength: 32}
+
+func TestHashAndVerify(t *testing.T) {
+	h := &Hasher{Algorithm: Argon2id, Argon2: testParams, BcryptCost: bcrypt.MinCost}
+
+	hash, err := h.Hash("pa$$word")
+	assert.NilError(t, err)
+	assert.StringContains(t, hash, "$argon2id$v=19$m=64,t=1,p=1$")
+
+	ok, rehash, err := h.Verify(hash, "pa$$word")
+	assert.NilError(t, err)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, rehash, false)
+
+	ok, _, err = h.Verify(hash, "wrong")
+	assert.NilError(t, err)
+	assert.Equal(t, ok, false)
+
+	// 同一个密码每次的盐都不同
+	other, err := h.Hash("pa$$word")
+	assert.NilError(t, err)
+	if other == hash {
+		t.Fatal("expected different hashes for the same password")
+	}
+}
+
+func TestVerifyNeedsRehash(t *testing.T) {
+	current := &Hasher{Algorithm: Argon2id, Argon2: testParams, BcryptCost: bcrypt.MinCost}
+	weaker := &Hasher{Algorithm: Argon2id, Argon2: Argon2Params{Memory: 32, Iterations: 1, Threads: 1, SaltLength: 16, KeyLength: 32}}
+	oldBcrypt, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	assert.NilError(t, err)
+	weakerHash, err := weaker.Hash("password")
+	assert.NilError(t, err)
+
+	tests := []struct {
+		name       string
+		hasher     *Hasher
+		hash       string
+		wantRehash bool
+	}{
+		{"bcrypt to argon2id", current, string(oldBcrypt), true},
+		{"Outdated argon2id parameters", current, weakerHash, true},
+		{"bcrypt with current cost", &Hasher{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost}, string(oldBcrypt), false},
+		{"bcrypt with higher cost", &Hasher{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost + 1}, string(oldBcrypt), true},
+		{"argon2id to bcrypt", &Hasher{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost}, weakerHash, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, rehash, err := tt.hasher.Verify(tt.hash, "password")
+			assert.NilError(t, err)
+			assert.Equal(t, ok, true)
+			assert.Equal(t, rehash, tt.wantRehash)
+		})
+	}
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	h := &Hasher{Argon2: testParams}
+
+	// 没有密码的账号
+	ok, _, err := h.Verify("!", "")
+	assert.NilError(t, err)
+	assert.Equal(t, ok, false)
+
+	for _, hash := range []string{
+		"$scrypt$ln=15,r=8,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHRzYWx0$aGFzaA",
+		"$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHRzYWx0$aGFzaA",
+		"$argon2id$v=19$m=64,t=1,p=1$not base64!$aGFzaA",
+		"$argon2id$v=19$m=64,t=1,p=1",
+	} {
+		_, _, err := h.Verify(hash, "password")
+		if !errors.Is(err, ErrUnsupportedHash) {
+			t.Errorf("Verify(%q) error = %v; want ErrUnsupportedHash", hash, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	assert.NilError(t, Default.Validate())
+	assert.NilError(t, (&Hasher{Algorithm: Bcrypt, BcryptCost: 12}).Validate())
+
+	for _, h := range []*Hasher{
+		{Algorithm: "md5"},
+		{Algorithm: Bcrypt, BcryptCost: 2},
+		{Algorithm: Argon2id, Argon2: Argon2Params{Memory: 64, Iterations: 0, Threads: 1, SaltLength: 16, KeyLength: 32}},
+	} {
+		if h.Validate() == nil {
+			t.Errorf("Validate(%+v) = nil; want an error", h)
+		}
+	}
+	if !strings.Contains((&Hasher{Algorithm: "md5"}).Validate().Error(), "md5") {
+		t.Error("expected the algorithm name in the error")
+	}
+}
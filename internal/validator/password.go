@@ -0,0 +1,152 @@
+package validator
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// commonPasswordsList 是随程序分发的常见密码列表，每行一个，来自公开泄露数据中出现次数最多的密码
+//
+//go:embed common-passwords.txt
+var commonPasswordsList string
+
+var (
+	commonPasswordsOnce sync.Once
+	commonPasswords     map[string]struct{}
+)
+
+// isCommonPassword 判断 password 是否在常见密码列表中，比较时不区分大小写
+func isCommonPassword(password string) bool {
+	commonPasswordsOnce.Do(func() {
+		commonPasswords = make(map[string]struct{})
+		for _, line := range strings.Split(commonPasswordsList, "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				commonPasswords[strings.ToLower(line)] = struct{}{}
+			}
+		}
+	})
+	_, ok := commonPasswords[strings.ToLower(password)]
+	return ok
+}
+
+// PasswordPolicy 是设置密码时需要满足的规则。
+type PasswordPolicy struct {
+	// 最少字符数（按 Unicode 字符计算）
+	MinLength int
+	// 拒绝出现在常见密码列表中的密码
+	RejectCommon bool
+	// 拒绝包含用户姓名、用户名或邮箱的密码
+	RejectPersonal bool
+	// Breached 不为 nil 时拒绝出现在泄露密码数据中的密码
+	Breached *BreachedPasswords
+}
+
+// DefaultPasswordPolicy 不检查泄露密码，因为它需要单独下载的数据文件
+var DefaultPasswordPolicy = &PasswordPolicy{MinLength: 8, RejectCommon: true, RejectPersonal: true}
+
+// CheckPassword 按 policy 检查 password，把第一条不满足的规则记录为 field 的错误。
+// personal 是用户的姓名、用户名、邮箱等，密码中不能包含它们。
+func (v *Validator) CheckPassword(policy *PasswordPolicy, field, password string, personal ...string) {
+	switch {
+	case !MinChars(password, policy.MinLength):
+		v.AddFieldError(field, "validation.min_chars", policy.MinLength)
+	case policy.RejectPersonal && containsPersonal(password, personal):
+		v.AddFieldError(field, "validation.password_personal")
+	case policy.RejectCommon && isCommonPassword(password):
+		v.AddFieldError(field, "validation.password_common")
+	case policy.Breached != nil && policy.Breached.Contains(password):
+		v.AddFieldError(field, "validation.password_breached")
+	}
+}
+
+// minPersonalToken 是参与比较的个人信息片段的最少字符数，太短的片段（例如 "li"、"com"）会误伤正常的密码
+const minPersonalToken = 4
+
+// containsPersonal 判断 password 是否包含 personal 中的任何一项。邮箱只比较 @ 之前的部分，
+// 每一项还会按空格、点、下划线等符号拆开，分别比较，例如 "Alice Jones" 会检查 "alice" 和 "jones"。
+func containsPersonal(password string, personal []string) bool {
+	lower := strings.ToLower(password)
+	for _, value := range personal {
+		value = strings.ToLower(strings.TrimSpace(value))
+		if local, _, ok := strings.Cut(value, "@"); ok {
+			value = local
+		}
+		tokens := strings.FieldsFunc(value, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, token := range append(tokens, value) {
+			if utf8.RuneCountInString(token) >= minPersonalToken && strings.Contains(lower, token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// BreachedPasswords 是泄露密码的 SHA-1 哈希集合，按哈希的前 5 个十六进制字符分组保存。
+//
+// 查询方式与 Have I Been Pwned 的 k-匿名范围接口相同：先取出同一前缀下的所有后缀，再在其中查找。
+// 数据完全在本地，密码和哈希都不会发送到外部服务；以后换成在线接口时只需要替换 Range。
+type BreachedPasswords struct {
+	ranges map[string][]string
+}
+
+// LoadBreachedPasswords 读取泄露密码文件。文件每行一个 40 位十六进制的 SHA-1 哈希，后面可以带上
+// ":出现次数"，也就是 Have I Been Pwned 提供下载的格式。完整的数据有几十 GB，部署时通常只保留
+// 出现次数较多的一部分。
+func LoadBreachedPasswords(path string) (*BreachedPasswords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadBreachedPasswords(f)
+}
+
+// ReadBreachedPasswords 从 r 中读取泄露密码，格式见 LoadBreachedPasswords。
+func ReadBreachedPasswords(r io.Reader) (*BreachedPasswords, error) {
+	b := &BreachedPasswords{ranges: make(map[string][]string)}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		hash, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if hash == "" {
+			continue
+		}
+		hash = strings.ToUpper(hash)
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 2*sha1.Size {
+			return nil, fmt.Errorf("validator: invalid SHA-1 hash on line %d", line)
+		}
+		b.ranges[hash[:5]] = append(b.ranges[hash[:5]], hash[5:])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Range 返回以 prefix（5 个大写十六进制字符）开头的所有哈希的剩余部分。
+func (b *BreachedPasswords) Range(prefix string) []string {
+	return b.ranges[prefix]
+}
+
+// Contains 判断 password 是否出现在泄露密码中。
+func (b *BreachedPasswords) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	for _, suffix := range b.Range(hash[:5]) {
+		if suffix == hash[5:] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package validator
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/hlf2016/snippetbox/internal/assert"
+	"strings"
+	"testing"
+)
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func TestCheckPassword(t *testing.T) {
+	breached, err := ReadBreachedPasswords(strings.NewReader(
+		sha1Hex("correct horse battery") + ":52\n" + strings.ToLower(sha1Hex("Tr0ub4dor&3")) + "\n\n"))
+	assert.NilError(t, err)
+	policy := &PasswordPolicy{MinLength: 10, RejectCommon: true, RejectPersonal: true, Breached: breached}
+	personal := []string{"Alice Jones", "alice_j", "alice.jones@example.com"}
+
+	tests := []struct {
+		name     string
+		policy   *PasswordPolicy
+		password string
+		wantKey  string
+	}{
+		{"Valid", policy, "purple-otter-lamp", ""},
+		{"Too short", policy, "otter-lam", "validation.min_chars"},
+		{"Length counts characters not bytes", policy, "紫色的水獭和一盏台灯啊", ""},
+		{"Contains name", policy, "ilovejones99", "validation.password_personal"},
+		{"Contains email local part case-insensitively", policy, "xxALICE.JONESxx", "validation.password_personal"},
+		{"Short tokens are ignored", &PasswordPolicy{MinLength: 8, RejectPersonal: true}, "dogcat-j-rocks", ""},
+		{"Common password", policy, "qwertyuiop", "validation.password_common"},
+		{"Common password ignores case", policy, "Password123", "validation.password_common"},
+		{"Common check disabled", &PasswordPolicy{MinLength: 8}, "password123", ""},
+		{"Breached password", policy, "correct horse battery", "validation.password_breached"},
+		{"Breached file in lowercase", policy, "Tr0ub4dor&3", "validation.password_breached"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v Validator
+			v.CheckPassword(tt.policy, "password", tt.password, personal...)
+			if tt.wantKey == "" {
+				assert.Equal(t, v.Valid(), true)
+				return
+			}
+			if v.FieldErrors["password"] == nil {
+				t.Fatalf("expected a %s error", tt.wantKey)
+			}
+			assert.Equal(t, v.FieldErrors["password"].Key, tt.wantKey)
+		})
+	}
+}
+
+func TestReadBreachedPasswordsInvalid(t *testing.T) {
+	_, err := ReadBreachedPasswords(strings.NewReader(sha1Hex("a") + "\nnot-a-hash:3\n"))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	assert.StringContains(t, err.Error(), "line 2")
+}
@@ -10,11 +10,23 @@ import (
 // https://html.spec.whatwg.org/multipage/input.html#valid-e-mail-address
 var EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 
+// UsernameRX 只允许小写字母、数字和下划线，并且至少包含一个字母或下划线。
+// 纯数字的用户名会与 /u/:id 中的用户 ID 混淆，所以不允许。
+var UsernameRX = regexp.MustCompile("^[a-z0-9_]*[a-z_][a-z0-9_]*$")
+
+// Message 是一条待翻译的错误信息：Key 是 ui/i18n 消息目录中的键，Args 是格式化参数。
+// 验证器只记录键，由模板按查看者的语言翻译。
+type Message struct {
+	Key  string
+	Args []any
+}
+
 // Validator 定义一个新的验证器类型，其中包含表单字段的验证错误映射。
 type Validator struct {
-	// 在结构体中添加一个新的 NonFieldErrors []string 字段，用于保存与特定表单字段无关的验证错误。
-	NonFieldErrors []string
-	FieldErrors    map[string]string
+	// 在结构体中添加一个新的 NonFieldErrors 字段，用于保存与特定表单字段无关的验证错误。
+	NonFieldErrors []Message
+	// 值使用指针：模板中 {{with .Form.FieldErrors.email}} 对不存在的键会得到 nil，而结构体的零值总被当作 true。
+	FieldErrors map[string]*Message
 }
 
 // Valid 如果 validator 的 FieldErrors 不包含任何项时 返回 true
@@ -22,22 +34,23 @@ func (v *Validator) Valid() bool {
 	return len(v.FieldErrors) == 0 && len(v.NonFieldErrors) == 0
 }
 
-func (v *Validator) AddFieldError(key, message string) {
+// AddFieldError 为字段添加一条错误信息，同一字段只保留第一条。
+func (v *Validator) AddFieldError(field, key string, args ...any) {
 	if v.FieldErrors == nil {
-		v.FieldErrors = make(map[string]string)
+		v.FieldErrors = make(map[string]*Message)
 	}
-	if _, exists := v.FieldErrors[key]; !exists {
-		v.FieldErrors[key] = message
+	if _, exists := v.FieldErrors[field]; !exists {
+		v.FieldErrors[field] = &Message{Key: key, Args: args}
 	}
 }
 
-func (v *Validator) AddNonFieldError(message string) {
-	v.NonFieldErrors = append(v.NonFieldErrors, message)
+func (v *Validator) AddNonFieldError(key string, args ...any) {
+	v.NonFieldErrors = append(v.NonFieldErrors, Message{Key: key, Args: args})
 }
 
-func (v *Validator) CheckField(ok bool, key, message string) {
+func (v *Validator) CheckField(ok bool, field, key string, args ...any) {
 	if !ok {
-		v.AddFieldError(key, message)
+		v.AddFieldError(field, key, args...)
 	}
 }
 
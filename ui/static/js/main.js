@@ -5,4 +5,11 @@ for (var i = 0; i < navLinks.length; i++) {
 		link.classList.add("live");
 		break;
 	}
-}
\ No newline at end of file
+}
+// 把浏览器所在的时区告诉服务器，没有设置时区偏好的用户会按这个时区显示时间
+try {
+	var tz = Intl.DateTimeFormat().resolvedOptions().timeZone;
+	if (tz) {
+		document.cookie = "tz=" + encodeURIComponent(tz) + "; path=/; max-age=31536000; samesite=lax; secure";
+	}
+} catch (e) {}